@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Accumulator struct {
+	Op    string
+	Field string
+}
+
+type GroupSpec struct {
+	GroupBy      []string
+	Accumulators map[string]Accumulator
+	Having       Filter
+}
+
+type group struct {
+	key    string
+	values []interface{}
+	states map[string]*accumulatorState
+}
+
+type accumulatorState struct {
+	count int
+	sum   float64
+	best  interface{}
+	seen  bool
+}
+
+// Aggregate groups the records matching filter by the GroupBy fields and
+// computes each accumulator per group. Every result holds the group values
+// under their field names next to the accumulator outputs, and results are
+// kept only when they satisfy Having.
+func (d *Driver) Aggregate(collection string, filter Filter, spec *GroupSpec) ([]map[string]interface{}, error) {
+	if spec == nil {
+		return nil, fmt.Errorf("Missing group spec")
+	}
+
+	for name, acc := range spec.Accumulators {
+		switch acc.Op {
+		case "$count":
+		case "$sum", "$avg", "$min", "$max":
+			if acc.Field == "" {
+				return nil, fmt.Errorf("Accumulator %v: %v needs a field", name, acc.Op)
+			}
+		default:
+			return nil, fmt.Errorf("Accumulator %v: unknown operator %v", name, acc.Op)
+		}
+	}
+
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	having, err := d.Prepare(spec.Having)
+
+	if err != nil {
+		return nil, err
+	}
+
+	havingConds, err := having.bind(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*group)
+
+	err = q.each(collection, nil, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		if doc == nil {
+			if err := json.Unmarshal(b, &doc); err != nil {
+				return fmt.Errorf("Unable to decode %v/%v: %w", collection, resource, err)
+			}
+		}
+
+		values := make([]interface{}, len(spec.GroupBy))
+
+		for i, field := range spec.GroupBy {
+			values[i], _ = lookupField(doc, field)
+		}
+
+		key := valueKey(values)
+		g, ok := groups[key]
+
+		if !ok {
+			g = &group{key: key, values: values, states: make(map[string]*accumulatorState)}
+			groups[key] = g
+		}
+
+		for name, acc := range spec.Accumulators {
+			st, ok := g.states[name]
+
+			if !ok {
+				st = &accumulatorState{}
+				g.states[name] = st
+			}
+
+			st.add(acc, doc)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(groups))
+
+	for key := range groups {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var results []map[string]interface{}
+
+	for _, key := range keys {
+		g := groups[key]
+		result := make(map[string]interface{})
+
+		for i, field := range spec.GroupBy {
+			setPath(result, strings.Split(field, "."), g.values[i])
+		}
+
+		for name, acc := range spec.Accumulators {
+			result[name] = g.states[name].result(acc)
+		}
+
+		if !matchConditions(result, havingConds) {
+			continue
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (st *accumulatorState) add(acc Accumulator, doc map[string]interface{}) {
+	if acc.Op == "$count" {
+		if acc.Field == "" {
+			st.count++
+		} else if _, ok := lookupField(doc, acc.Field); ok {
+			st.count++
+		}
+		return
+	}
+
+	value, ok := lookupField(doc, acc.Field)
+
+	if !ok {
+		return
+	}
+
+	switch acc.Op {
+	case "$sum", "$avg":
+		if f, ok := toFloat(value); ok {
+			st.sum += f
+			st.count++
+		}
+
+	case "$min", "$max":
+		c := defaultCompare(value, st.best)
+
+		if !st.seen || (acc.Op == "$min" && c < 0) || (acc.Op == "$max" && c > 0) {
+			st.best, st.seen = value, true
+		}
+	}
+}
+
+func (st *accumulatorState) result(acc Accumulator) interface{} {
+	switch acc.Op {
+	case "$count":
+		return st.count
+	case "$sum":
+		return st.sum
+	case "$avg":
+		if st.count == 0 {
+			return nil
+		}
+		return st.sum / float64(st.count)
+	}
+
+	return st.best
+}
+
+func setPath(m map[string]interface{}, path []string, value interface{}) {
+	for _, part := range path[:len(path)-1] {
+		child, ok := m[part].(map[string]interface{})
+
+		if !ok {
+			child = make(map[string]interface{})
+			m[part] = child
+		}
+
+		m = child
+	}
+
+	m[path[len(path)-1]] = value
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	arraysDir               = ".arrays"
+	arrayManifest           = "manifest.json"
+	defaultArraySegmentSize = 1000
+)
+
+// arrayManifestDoc lists the number of items in each segment of a segmented
+// array. A segment may hold more items than its count after an interrupted
+// append; the extra ones are ignored and overwritten by the next append.
+type arrayManifestDoc struct {
+	Segments []int `json:"segments"`
+}
+
+func (m *arrayManifestDoc) length() int {
+	n := 0
+
+	for _, count := range m.Segments {
+		n += count
+	}
+
+	return n
+}
+
+func (d *Driver) arrayPath(collection, resource string) string {
+	return filepath.Join(d.dir, arraysDir, collection, fileName(resource))
+}
+
+// arrayKey names the file of an array at path for its signature: its path
+// below the arrays of the collection, so that neither segments nor whole
+// arrays can be swapped unnoticed.
+func (d *Driver) arrayKey(collection, path string) string {
+	rel, err := filepath.Rel(filepath.Join(d.dir, arraysDir, collection), path)
+
+	if err != nil {
+		return path
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func segmentPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.json", i))
+}
+
+func (d *Driver) arraySegmentSize() int {
+	if d.opts.ArraySegmentSize > 0 {
+		return d.opts.ArraySegmentSize
+	}
+
+	return defaultArraySegmentSize
+}
+
+func checkArray(collection, resource string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	return nil
+}
+
+// ArrayAppend appends items to a segmented array, creating it if needed,
+// and returns its new length. Segmented arrays are stored as a series of
+// segments of Options.ArraySegmentSize items, so an append only rewrites
+// the last segment however long the array grows. They are kept apart from
+// the records of the collection.
+func (d *Driver) ArrayAppend(collection, resource string, items ...interface{}) (_ int, err error) {
+	defer d.observe(time.Now(), &err, "append", collection, resource)
+
+	if err := checkArray(collection, resource); err != nil {
+		return 0, err
+	}
+
+	resource = d.key(resource)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := d.arrayPath(collection, resource)
+	m, err := d.readArrayManifest(collection, dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	size := d.arraySegmentSize()
+
+	for len(items) > 0 {
+		last := len(m.Segments) - 1
+
+		if last < 0 || m.Segments[last] >= size {
+			m.Segments = append(m.Segments, 0)
+			last++
+		}
+
+		var segment []json.RawMessage
+
+		if m.Segments[last] > 0 {
+			if segment, err = d.readSegment(collection, dir, last, m.Segments[last]); err != nil {
+				return 0, err
+			}
+		}
+
+		n := size - len(segment)
+
+		if n > len(items) {
+			n = len(items)
+		}
+
+		for _, item := range items[:n] {
+			b, err := json.Marshal(item)
+
+			if err != nil {
+				return 0, err
+			}
+
+			segment = append(segment, b)
+		}
+
+		items = items[n:]
+
+		if err := d.writeArrayFile(collection, segmentPath(dir, last), segment); err != nil {
+			return 0, err
+		}
+
+		m.Segments[last] = len(segment)
+	}
+
+	if err := d.writeArrayFile(collection, filepath.Join(dir, arrayManifest), m); err != nil {
+		return 0, err
+	}
+
+	return m.length(), nil
+}
+
+// ArrayRange reads the items of a segmented array from start up to, but not
+// including, end, reading only the segments that hold them. An end past the
+// last item, or a negative one, reads to the end of the array.
+func (d *Driver) ArrayRange(collection, resource string, start, end int) (_ []json.RawMessage, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	if err := checkArray(collection, resource); err != nil {
+		return nil, err
+	}
+
+	if start < 0 {
+		return nil, fmt.Errorf("Start must not be negative")
+	}
+
+	resource = d.key(resource)
+	dir := d.arrayPath(collection, resource)
+
+	m, err := d.readArrayManifest(collection, dir)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if length := m.length(); end < 0 || end > length {
+		end = length
+	}
+
+	var items []json.RawMessage
+	offset := 0
+
+	for i, count := range m.Segments {
+		if offset >= end {
+			break
+		}
+
+		if offset+count > start {
+			segment, err := d.readSegment(collection, dir, i, count)
+
+			if err != nil {
+				return nil, err
+			}
+
+			lo, hi := start-offset, end-offset
+
+			if lo < 0 {
+				lo = 0
+			}
+
+			if hi > count {
+				hi = count
+			}
+
+			items = append(items, segment[lo:hi]...)
+		}
+
+		offset += count
+	}
+
+	return items, nil
+}
+
+// ArrayLen returns the number of items in a segmented array.
+func (d *Driver) ArrayLen(collection, resource string) (_ int, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	if err := checkArray(collection, resource); err != nil {
+		return 0, err
+	}
+
+	m, err := d.readArrayManifest(collection, d.arrayPath(collection, d.key(resource)))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+
+	return m.length(), nil
+}
+
+// DeleteArray removes a segmented array.
+func (d *Driver) DeleteArray(collection, resource string) (err error) {
+	defer d.observe(time.Now(), &err, "delete", collection, resource)
+
+	if err := checkArray(collection, resource); err != nil {
+		return err
+	}
+
+	resource = d.key(resource)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := d.arrayPath(collection, resource)
+
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	if err := d.removeAll(dir); err != nil {
+		return err
+	}
+
+	removeEmptyParents(filepath.Join(d.dir, arraysDir), dir)
+
+	return nil
+}
+
+func (d *Driver) readArrayManifest(collection, dir string) (*arrayManifestDoc, error) {
+	m := &arrayManifestDoc{}
+
+	path := filepath.Join(dir, arrayManifest)
+	b, err := d.readRecordFile(collection, d.arrayKey(collection, path), path)
+
+	if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("Invalid array manifest %v: %w", dir, err)
+	}
+
+	return m, nil
+}
+
+// readSegment reads the first count items of segment i.
+func (d *Driver) readSegment(collection, dir string, i, count int) ([]json.RawMessage, error) {
+	b, err := d.readRecordFile(collection, d.arrayKey(collection, segmentPath(dir, i)), segmentPath(dir, i))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var segment []json.RawMessage
+
+	if err := json.Unmarshal(b, &segment); err != nil {
+		return nil, fmt.Errorf("Invalid array segment %v: %w", segmentPath(dir, i), err)
+	}
+
+	if len(segment) < count {
+		return nil, fmt.Errorf("Array segment %v holds %d items, expected %d", segmentPath(dir, i), len(segment), count)
+	}
+
+	return segment[:count], nil
+}
+
+func (d *Driver) writeArrayFile(collection, path string, v interface{}) error {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	stored, err := d.encodeRecord(collection, d.arrayKey(collection, path), b)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeFile(path+".tmp", stored, 0644); err != nil {
+		return err
+	}
+
+	if err := d.syncWrite(d.opts.Durability, path+".tmp"); err != nil {
+		return err
+	}
+
+	if err := d.replaceFile(path+".tmp", path); err != nil {
+		return err
+	}
+
+	return d.syncWrite(d.opts.Durability, filepath.Dir(path))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrForbidden    = errors.New("Forbidden")
+)
+
+// Role is the access a client has to a collection. Each role includes the
+// ones before it; RoleAdmin is kept for operations on a collection as a
+// whole.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleWrite
+	RoleAdmin
+)
+
+// Roles maps collections to the role held on them, with "*" standing for
+// collections not listed.
+type Roles map[string]Role
+
+func (r Roles) role(collection string) Role {
+	if role, ok := r[collection]; ok {
+		return role
+	}
+
+	return r["*"]
+}
+
+// AuthorizeFunc decides whether request r may have access to collection,
+// returning ErrUnauthorized for unknown clients and ErrForbidden for known
+// ones without the access.
+type AuthorizeFunc func(r *http.Request, collection string, access Role) error
+
+// TokenAuth authorizes requests carrying one of tokens, either as a bearer
+// token in the Authorization header or in X-API-Key, with the roles mapped
+// to it.
+func TokenAuth(tokens map[string]Roles) AuthorizeFunc {
+	// Tokens are looked up by hash, so the time taken does not depend on
+	// how much of a token a client guessed.
+	hashed := make(map[[sha256.Size]byte]Roles, len(tokens))
+
+	for token, roles := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = roles
+	}
+
+	return func(r *http.Request, collection string, access Role) error {
+		token := r.Header.Get("X-API-Key")
+
+		if auth := r.Header.Get("Authorization"); token == "" && auth != "" {
+			scheme, t, _ := strings.Cut(auth, " ")
+
+			if strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(t)
+			}
+		}
+
+		if token == "" {
+			return ErrUnauthorized
+		}
+
+		roles, ok := hashed[sha256.Sum256([]byte(token))]
+
+		if !ok {
+			return ErrUnauthorized
+		}
+
+		if roles.role(collection) < access {
+			return ErrForbidden
+		}
+
+		return nil
+	}
+}
+
+// access is the role a request needs.
+func access(r *http.Request) Role {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleRead
+	}
+
+	return RoleWrite
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// AvroSchema encodes documents to and from the Avro binary format, for
+// exchanging records with systems built around Avro. Values map onto
+// documents the way encoding/json would produce them: records and maps
+// are objects, bytes and fixed are base64 strings, and timestamp and date
+// logical types are RFC 3339 and YYYY-MM-DD strings.
+type AvroSchema struct {
+	text string
+	root *avroType
+}
+
+type avroType struct {
+	kind     string
+	logical  string
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	def        interface{}
+	hasDefault bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// ParseAvroSchema parses an Avro schema in its JSON form.
+func ParseAvroSchema(schema string) (*AvroSchema, error) {
+	var v interface{}
+
+	if err := decodeNumbers([]byte(schema), &v); err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema: %w", err)
+	}
+
+	root, err := parseAvro(v, "", make(map[string]*avroType))
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema: %w", err)
+	}
+
+	return &AvroSchema{text: schema, root: root}, nil
+}
+
+func (s *AvroSchema) String() string {
+	return s.text
+}
+
+// Marshal encodes v, which is first converted to JSON values as
+// json.Marshal would, in the Avro binary format.
+func (s *AvroSchema) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return s.root.encode(nil, doc)
+}
+
+// Unmarshal decodes the Avro binary data b into v as json.Unmarshal would
+// decode the equivalent JSON.
+func (s *AvroSchema) Unmarshal(b []byte, v interface{}) error {
+	doc, err := s.decode(b)
+
+	if err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(doc)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(j, v)
+}
+
+func (s *AvroSchema) decode(b []byte) (interface{}, error) {
+	r := &avroReader{b: b}
+	doc, err := s.root.decode(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r.i != len(b) {
+		return nil, fmt.Errorf("Trailing bytes after Avro datum")
+	}
+
+	return doc, nil
+}
+
+// ReadAvro returns the record encoded with schema.
+func (d *Driver) ReadAvro(collection, resource string, schema *AvroSchema) ([]byte, error) {
+	b, err := d.ReadRaw(collection, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil {
+		return nil, err
+	}
+
+	return schema.root.encode(nil, doc)
+}
+
+// WriteAvro stores the Avro binary data b, decoded with schema, as the
+// record.
+func (d *Driver) WriteAvro(collection, resource string, schema *AvroSchema, b []byte) error {
+	doc, err := schema.decode(b)
+
+	if err != nil {
+		return err
+	}
+
+	return d.Write(collection, resource, doc)
+}
+
+func parseAvro(v interface{}, namespace string, names map[string]*avroType) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroType{kind: v}, nil
+		}
+
+		if t, ok := names[avroFullName(v, namespace)]; ok {
+			return t, nil
+		}
+
+		if t, ok := names[v]; ok {
+			return t, nil
+		}
+
+		return nil, fmt.Errorf("Unknown type %q", v)
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+
+		for _, branch := range v {
+			t, err := parseAvro(branch, namespace, names)
+
+			if err != nil {
+				return nil, err
+			}
+
+			union.branches = append(union.branches, t)
+		}
+
+		return union, nil
+
+	case map[string]interface{}:
+		kind, ok := v["type"].(string)
+
+		if !ok {
+			return parseAvro(v["type"], namespace, names)
+		}
+
+		logical, _ := v["logicalType"].(string)
+
+		if ns, ok := v["namespace"].(string); ok {
+			namespace = ns
+		}
+
+		var name string
+
+		if n, ok := v["name"].(string); ok {
+			name = avroFullName(n, namespace)
+
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				namespace = name[:i]
+			}
+		}
+
+		switch kind {
+		case "record", "error":
+			t := &avroType{kind: "record", name: name}
+			names[name] = t
+
+			fields, _ := v["fields"].([]interface{})
+
+			for _, f := range fields {
+				m, _ := f.(map[string]interface{})
+				fieldName, _ := m["name"].(string)
+
+				if fieldName == "" {
+					return nil, fmt.Errorf("Missing name of a field of %v", name)
+				}
+
+				ft, err := parseAvro(m["type"], namespace, names)
+
+				if err != nil {
+					return nil, fmt.Errorf("%v.%v: %w", name, fieldName, err)
+				}
+
+				def, hasDefault := m["default"]
+				t.fields = append(t.fields, avroField{name: fieldName, typ: ft, def: def, hasDefault: hasDefault})
+			}
+
+			return t, nil
+
+		case "enum":
+			t := &avroType{kind: "enum", name: name}
+
+			symbols, _ := v["symbols"].([]interface{})
+
+			for _, s := range symbols {
+				symbol, _ := s.(string)
+				t.symbols = append(t.symbols, symbol)
+			}
+
+			names[name] = t
+			return t, nil
+
+		case "fixed":
+			size, _ := v["size"].(json.Number)
+			n, err := size.Int64()
+
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid size of fixed %v", name)
+			}
+
+			t := &avroType{kind: "fixed", name: name, logical: logical, size: int(n)}
+			names[name] = t
+			return t, nil
+
+		case "array", "map":
+			key := "items"
+
+			if kind == "map" {
+				key = "values"
+			}
+
+			items, err := parseAvro(v[key], namespace, names)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &avroType{kind: kind, items: items}, nil
+		}
+
+		t, err := parseAvro(kind, namespace, names)
+
+		if err != nil || logical == "" || !avroPrimitives[t.kind] {
+			return t, err
+		}
+
+		return &avroType{kind: t.kind, logical: logical}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid type %v", v)
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+
+	return namespace + "." + name
+}
+
+func (t *avroType) encode(b []byte, v interface{}) ([]byte, error) {
+	switch t.kind {
+	case "null":
+		if v != nil {
+			return nil, fmt.Errorf("%v is not null", v)
+		}
+
+		return b, nil
+
+	case "boolean":
+		bit, ok := v.(bool)
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not a boolean", v)
+		}
+
+		if bit {
+			return append(b, 1), nil
+		}
+
+		return append(b, 0), nil
+
+	case "int", "long":
+		n, ok := avroInteger(t, v)
+
+		if !ok || (t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32)) {
+			return nil, fmt.Errorf("%v is not an %v", v, t.kind)
+		}
+
+		return binary.AppendVarint(b, n), nil
+
+	case "float", "double":
+		f, ok := avroNumber(v)
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", v)
+		}
+
+		if t.kind == "float" {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+		}
+
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+
+	case "string":
+		s, ok := v.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", v)
+		}
+
+		b = binary.AppendVarint(b, int64(len(s)))
+		return append(b, s...), nil
+
+	case "bytes", "fixed":
+		s, _ := v.(string)
+		data, err := base64.StdEncoding.DecodeString(s)
+
+		if _, ok := v.(string); !ok || err != nil {
+			return nil, fmt.Errorf("%v is not base64 data", v)
+		}
+
+		if t.kind == "fixed" {
+			if len(data) != t.size {
+				return nil, fmt.Errorf("%v is not %d bytes long", v, t.size)
+			}
+
+			return append(b, data...), nil
+		}
+
+		b = binary.AppendVarint(b, int64(len(data)))
+		return append(b, data...), nil
+
+	case "enum":
+		s, _ := v.(string)
+
+		for i, symbol := range t.symbols {
+			if s == symbol {
+				return binary.AppendVarint(b, int64(i)), nil
+			}
+		}
+
+		return nil, fmt.Errorf("%v is not a symbol of %v", v, t.name)
+
+	case "array":
+		items, ok := v.([]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not an array", v)
+		}
+
+		if len(items) > 0 {
+			b = binary.AppendVarint(b, int64(len(items)))
+		}
+
+		for i, item := range items {
+			var err error
+
+			if b, err = t.items.encode(b, item); err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+
+		return append(b, 0), nil
+
+	case "map":
+		m, ok := v.(map[string]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not an object", v)
+		}
+
+		if len(m) > 0 {
+			b = binary.AppendVarint(b, int64(len(m)))
+		}
+
+		for k, item := range m {
+			b = binary.AppendVarint(b, int64(len(k)))
+			b = append(b, k...)
+
+			var err error
+
+			if b, err = t.items.encode(b, item); err != nil {
+				return nil, fmt.Errorf("%v: %w", k, err)
+			}
+		}
+
+		return append(b, 0), nil
+
+	case "record":
+		m, ok := v.(map[string]interface{})
+
+		if !ok {
+			return nil, fmt.Errorf("%v is not an object", v)
+		}
+
+		for _, f := range t.fields {
+			value, ok := m[f.name]
+
+			if !ok && f.hasDefault {
+				value = f.def
+			}
+
+			var err error
+
+			if b, err = f.typ.encode(b, value); err != nil {
+				if !ok && !f.hasDefault {
+					return nil, fmt.Errorf("Missing field %v", f.name)
+				}
+
+				return nil, fmt.Errorf("%v: %w", f.name, err)
+			}
+		}
+
+		return b, nil
+
+	case "union":
+		for i, branch := range t.branches {
+			if out, err := branch.encode(binary.AppendVarint(b, int64(i)), v); err == nil {
+				return out, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%v matches no type of the union", v)
+	}
+
+	return nil, fmt.Errorf("Unknown type %v", t.kind)
+}
+
+// avroInteger reads an int or long, taking timestamps and dates as
+// strings for the logical types that need them.
+func avroInteger(t *avroType, v interface{}) (int64, bool) {
+	if s, ok := v.(string); ok {
+		switch t.logical {
+		case "timestamp-millis", "timestamp-micros":
+			ts, err := time.Parse(time.RFC3339Nano, s)
+
+			if err != nil {
+				return 0, false
+			}
+
+			if t.logical == "timestamp-millis" {
+				return ts.UnixMilli(), true
+			}
+
+			return ts.UnixMicro(), true
+
+		case "date":
+			day, err := time.Parse("2006-01-02", s)
+
+			if err != nil {
+				return 0, false
+			}
+
+			return day.Unix() / 86400, true
+		}
+
+		return 0, false
+	}
+
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+func avroNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+type avroReader struct {
+	b []byte
+	i int
+}
+
+var errAvroTruncated = fmt.Errorf("Truncated Avro datum")
+
+func (r *avroReader) varint() (int64, error) {
+	n, size := binary.Varint(r.b[r.i:])
+
+	if size <= 0 {
+		return 0, errAvroTruncated
+	}
+
+	r.i += size
+	return n, nil
+}
+
+func (r *avroReader) next(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.b)-r.i) {
+		return nil, errAvroTruncated
+	}
+
+	b := r.b[r.i : r.i+int(n)]
+	r.i += int(n)
+	return b, nil
+}
+
+func (t *avroType) decode(r *avroReader) (interface{}, error) {
+	switch t.kind {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		b, err := r.next(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return b[0] != 0, nil
+
+	case "int", "long":
+		n, err := r.varint()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch t.logical {
+		case "timestamp-millis":
+			return time.UnixMilli(n).UTC().Format(time.RFC3339Nano), nil
+		case "timestamp-micros":
+			return time.UnixMicro(n).UTC().Format(time.RFC3339Nano), nil
+		case "date":
+			return time.Unix(n*86400, 0).UTC().Format("2006-01-02"), nil
+		}
+
+		return n, nil
+
+	case "float":
+		b, err := r.next(4)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+
+	case "double":
+		b, err := r.next(8)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+
+	case "string", "bytes":
+		n, err := r.varint()
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := r.next(n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if t.kind == "bytes" {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+
+		return string(b), nil
+
+	case "fixed":
+		b, err := r.next(int64(t.size))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return base64.StdEncoding.EncodeToString(b), nil
+
+	case "enum":
+		i, err := r.varint()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return nil, fmt.Errorf("Invalid symbol %d of %v", i, t.name)
+		}
+
+		return t.symbols[i], nil
+
+	case "array", "map":
+		var (
+			items  []interface{}
+			values = map[string]interface{}{}
+		)
+
+		for {
+			n, err := r.varint()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if n == 0 {
+				break
+			}
+
+			// A negative count is followed by the size of the block in
+			// bytes, which readers that do not skip can ignore.
+			if n < 0 {
+				n = -n
+
+				if _, err := r.varint(); err != nil {
+					return nil, err
+				}
+			}
+
+			for ; n > 0; n-- {
+				var key string
+
+				if t.kind == "map" {
+					size, err := r.varint()
+
+					if err != nil {
+						return nil, err
+					}
+
+					k, err := r.next(size)
+
+					if err != nil {
+						return nil, err
+					}
+
+					key = string(k)
+				}
+
+				item, err := t.items.decode(r)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if t.kind == "map" {
+					values[key] = item
+				} else {
+					items = append(items, item)
+				}
+			}
+		}
+
+		if t.kind == "map" {
+			return values, nil
+		}
+
+		if items == nil {
+			items = []interface{}{}
+		}
+
+		return items, nil
+
+	case "record":
+		doc := make(map[string]interface{}, len(t.fields))
+
+		for _, f := range t.fields {
+			value, err := f.typ.decode(r)
+
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", f.name, err)
+			}
+
+			doc[f.name] = value
+		}
+
+		return doc, nil
+
+	case "union":
+		i, err := r.varint()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i < 0 || i >= int64(len(t.branches)) {
+			return nil, fmt.Errorf("Invalid union branch %d", i)
+		}
+
+		return t.branches[i].decode(r)
+	}
+
+	return nil, fmt.Errorf("Unknown type %v", t.kind)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type BloomOptions struct {
+	// ExpectedRecords is the number of records the filter is sized for.
+	// Past it, the false positive rate grows.
+	ExpectedRecords int
+
+	// FalsePositiveRate defaults to 1%.
+	FalsePositiveRate float64
+}
+
+// bloomFilter remembers every key written to a collection. Keys are never
+// removed, so a deleted key still passes; the filter only saves the lookup
+// of keys that were never written.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+func newBloomFilter(o BloomOptions) *bloomFilter {
+	n := float64(o.ExpectedRecords)
+
+	if n < 1 {
+		n = 1
+	}
+
+	p := o.FalsePositiveRate
+
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / n * math.Ln2)
+
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{bits: make([]uint64, (uint64(m)+63)/64), hashes: uint64(k)}
+}
+
+// positions derives the bits of key by double hashing.
+func (f *bloomFilter) positions(key string, fn func(word int, mask uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+	size := uint64(len(f.bits)) * 64
+
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % size
+
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.positions(key, func(word int, mask uint64) bool {
+		for {
+			old := atomic.LoadUint64(&f.bits[word])
+
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.bits[word], old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	found := true
+
+	f.positions(key, func(word int, mask uint64) bool {
+		found = atomic.LoadUint64(&f.bits[word])&mask != 0
+		return found
+	})
+
+	return found
+}
+
+// SetBloomFilter keeps a bloom filter of the keys of collection, so that
+// Read and Exists answer most lookups of keys that were never written
+// without touching the disk. The filter is built from the records on disk
+// and lives in memory only. A nil BloomOptions removes it.
+func (d *Driver) SetBloomFilter(collection string, opts *BloomOptions) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if opts == nil {
+		d.configure(collection, func(cfg *collectionConfig) {
+			cfg.bloom = nil
+		})
+		return nil
+	}
+
+	if opts.ExpectedRecords < 0 {
+		return fmt.Errorf("Expected records must not be negative")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	resources, err := d.resources(collection)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	o := *opts
+
+	if o.ExpectedRecords < len(resources) {
+		o.ExpectedRecords = len(resources)
+	}
+
+	f := newBloomFilter(o)
+
+	for _, resource := range resources {
+		f.add(resource)
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.bloom = f
+	})
+
+	return nil
+}
+
+// mayExist reports whether a record may exist, which is false only when the
+// bloom filter of its collection rules it out.
+func (d *Driver) mayExist(collection, resource string) bool {
+	f := d.config(collection).bloom
+
+	return f == nil || f.mayContain(resource)
+}
+
+// bloomAdd adds a key that is about to be written to the bloom filter of its
+// collection. It is added before the record lands so that readers never
+// miss it.
+func (d *Driver) bloomAdd(collection, resource string) {
+	if f := d.config(collection).bloom; f != nil {
+		f.add(resource)
+	}
+}
+
+// Exists reports whether a record exists and has not expired.
+func (d *Driver) Exists(collection, resource string) (_ bool, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return false, err
+	}
+
+	if resource == "" {
+		return false, fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	d.flushCollection(collection)
+
+	if !d.mayExist(collection, resource) {
+		return false, nil
+	}
+
+	if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !d.expired(collection, resource), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QueryBuilder is a chainable front-end to Find:
+//
+//	db.C("Users").Where("Address.City", "=", "Pune").Sort("-Age").Limit(10).All(&users)
+//
+// Errors in the chain are reported by the method that runs the query.
+type QueryBuilder struct {
+	d          *Driver
+	collection string
+	filter     Filter
+	opts       FindOptions
+	err        error
+}
+
+var builderOperators = map[string]string{
+	"=":      "$eq",
+	"==":     "$eq",
+	"!=":     "$ne",
+	">":      "$gt",
+	">=":     "$gte",
+	"<":      "$lt",
+	"<=":     "$lte",
+	"in":     "$in",
+	"nin":    "$nin",
+	"not in": "$nin",
+	"exists": "$exists",
+	"fuzzy":  "$fuzzy",
+}
+
+// C starts a query on collection.
+func (d *Driver) C(collection string) *QueryBuilder {
+	return &QueryBuilder{d: d, collection: collection, filter: Filter{}}
+}
+
+// Where adds a condition on field. op is one of =, !=, >, >=, <, <=, in,
+// nin, exists and fuzzy, or a filter operator such as "$gte".
+func (b *QueryBuilder) Where(field, op string, value interface{}) *QueryBuilder {
+	if !strings.HasPrefix(op, "$") {
+		name, ok := builderOperators[strings.ToLower(op)]
+
+		if !ok {
+			b.fail(fmt.Errorf("Unknown operator %q on %v", op, field))
+			return b
+		}
+
+		op = name
+	}
+
+	ops, _ := b.filter[field].(map[string]interface{})
+
+	if ops == nil {
+		ops = make(map[string]interface{})
+		b.filter[field] = ops
+	}
+
+	if _, ok := ops[op]; ok {
+		b.fail(fmt.Errorf("Conflicting %v conditions on %v", op, field))
+		return b
+	}
+
+	ops[op] = value
+
+	return b
+}
+
+// Sort orders the results by fields, where a leading "-" sorts that field
+// in descending order.
+func (b *QueryBuilder) Sort(fields ...string) *QueryBuilder {
+	b.opts.Sort = append(b.opts.Sort, SortBy(fields...)...)
+	return b
+}
+
+func (b *QueryBuilder) Limit(n int) *QueryBuilder {
+	b.opts.Limit = n
+	return b
+}
+
+func (b *QueryBuilder) Skip(n int) *QueryBuilder {
+	b.opts.Offset = n
+	return b
+}
+
+// Select keeps only fields in the results.
+func (b *QueryBuilder) Select(fields ...string) *QueryBuilder {
+	b.opts.Fields = append(b.opts.Fields, fields...)
+	return b
+}
+
+func (b *QueryBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *QueryBuilder) query() (*Query, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return b.d.Prepare(b.filter)
+}
+
+// Find returns the JSON of the matching records.
+func (b *QueryBuilder) Find() ([]string, error) {
+	return b.find(b.opts)
+}
+
+func (b *QueryBuilder) find(opts FindOptions) ([]string, error) {
+	q, err := b.query()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.FindWithOptions(b.collection, nil, &opts)
+}
+
+// All decodes the matching records into v, which must point to a slice.
+func (b *QueryBuilder) All(v interface{}) error {
+	records, err := b.Find()
+
+	if err != nil {
+		return err
+	}
+
+	return b.d.decode(b.collection, []byte("["+strings.Join(records, ",")+"]"), v)
+}
+
+// One decodes the first matching record into v, and returns
+// ErrRecordNotFound when nothing matches.
+func (b *QueryBuilder) One(v interface{}) error {
+	opts := b.opts
+	opts.Limit = 1
+
+	records, err := b.find(opts)
+
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return ErrRecordNotFound
+	}
+
+	return b.d.decode(b.collection, []byte(records[0]), v)
+}
+
+// Count returns the number of matching records, ignoring Skip and Limit.
+func (b *QueryBuilder) Count() (int, error) {
+	q, err := b.query()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	err = q.each(b.collection, nil, "", func(resource string, _ []byte, _ map[string]interface{}) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// Page returns a page of matching records and the cursor of the next one,
+// as FindPage does. Pages follow resource order, so Sort, Skip and Limit
+// cannot be combined with it.
+func (b *QueryBuilder) Page(cursor string, size int) ([]string, string, error) {
+	if len(b.opts.Sort) > 0 || b.opts.Offset > 0 || b.opts.Limit > 0 {
+		return nil, "", fmt.Errorf("Page cannot be combined with Sort, Skip or Limit")
+	}
+
+	q, err := b.query()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return q.FindPage(b.collection, nil, cursor, size)
+}
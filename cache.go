@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// recordCache keeps the decoded contents of recently used records, evicting
+// the least recently used once it holds Options.CacheSize records.
+//
+// Readers fill the cache without holding the collection lock, so a fill is
+// dropped if the generation of the collection moved while the record was
+// being read.
+type recordCache struct {
+	mutex   sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits, misses int64
+}
+
+type cacheEntry struct {
+	key string
+	b   []byte
+}
+
+func newRecordCache(size int) *recordCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &recordCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(collection, resource string) string {
+	return collection + "/" + resource
+}
+
+func (c *recordCache) get(collection, resource string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[cacheKey(collection, resource)]
+
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(e)
+
+	return e.Value.(*cacheEntry).b, true
+}
+
+// fill caches a record read from disk after a miss, unless current reports
+// that it changed in the meantime.
+func (c *recordCache) fill(collection, resource string, b []byte, current func() bool) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if current() {
+		c.putLocked(cacheKey(collection, resource), b)
+	}
+}
+
+// put caches the new value of a record that was just written.
+func (c *recordCache) put(collection, resource string, b []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.putLocked(cacheKey(collection, resource), b)
+}
+
+func (c *recordCache) putLocked(key string, b []byte) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).b = b
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, b: b})
+
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+	}
+}
+
+// remove drops a record, or every record of collection when resource is
+// empty.
+func (c *recordCache) remove(collection, resource string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resource != "" {
+		if e, ok := c.entries[cacheKey(collection, resource)]; ok {
+			c.order.Remove(e)
+			delete(c.entries, cacheKey(collection, resource))
+		}
+		return
+	}
+
+	prefix := collection + "/"
+
+	for key, e := range c.entries {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			c.order.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Preload reads the records of the given collections, or of every
+// collection when none are given, into the read cache and loads their
+// expiries, so the first requests after startup are served from memory.
+// Without a cache only the expiries and the operating system's page cache
+// are warmed.
+func (d *Driver) Preload(collections ...string) error {
+	explicit := len(collections) > 0
+
+	if !explicit {
+		all, err := d.listCollections()
+
+		if err != nil {
+			return err
+		}
+
+		collections = all
+	}
+
+	for _, collection := range collections {
+		if err := checkCollection(collection); err != nil {
+			return err
+		}
+
+		if _, err := stat(filepath.Join(d.dir, collection)); err != nil {
+			if !explicit && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		d.loadExpiries(collection).mutex.Unlock()
+
+		count := 0
+
+		err := d.eachRecord(collection, "", func(resource string, b []byte) error {
+			count++
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		d.log.Debug("Preloaded %d records of '%s'\n", count, collection)
+	}
+
+	return nil
+}
+
+func (c *recordCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{Capacity: c.size, Entries: c.order.Len(), Hits: c.hits, Misses: c.misses}
+}
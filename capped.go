@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type CapOptions struct {
+	MaxRecords int   `json:"maxRecords,omitempty"`
+	MaxBytes   int64 `json:"maxBytes,omitempty"`
+}
+
+// SetCapped turns collection into a capped collection: once a write takes it
+// past MaxRecords records or MaxBytes bytes, the least recently written
+// records are deleted until it fits again. The record just written is never
+// evicted. A zero CapOptions removes the cap.
+func (d *Driver) SetCapped(collection string, limits CapOptions) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if limits.MaxRecords < 0 || limits.MaxBytes < 0 {
+		return fmt.Errorf("Cap limits must not be negative")
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.capped = limits
+	})
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.evict(collection, "")
+}
+
+func (d *Driver) capOf(collection string) CapOptions {
+	return d.config(collection).capped
+}
+
+// capOrder mirrors the records of a capped collection in the order they
+// were last written, oldest first, with their sizes, so that evicting does
+// not scan the collection. A rewritten or deleted record leaves its old
+// place in the queue behind, which is skipped once it comes up.
+type capOrder struct {
+	queue []capEntry
+	seq   map[string]uint64
+	sizes map[string]int64
+	bytes int64
+	next  uint64
+}
+
+type capEntry struct {
+	resource string
+	seq      uint64
+}
+
+// loadCapOrder returns the write order of collection, reading it from disk
+// if this is the first time it is needed: by the clock in the metadata of
+// the records, and by modification time for records written without one.
+// Callers must hold the collection lock.
+func (d *Driver) loadCapOrder(collection string) (*capOrder, error) {
+	if o, ok := d.capOrders.Load(collection); ok {
+		return o.(*capOrder), nil
+	}
+
+	o := &capOrder{seq: make(map[string]uint64), sizes: make(map[string]int64)}
+	dir := filepath.Join(d.dir, collection)
+
+	files, err := d.readTree(dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	type written struct {
+		resource string
+		clock    *HLC
+		modTime  int64
+		size     int64
+	}
+
+	var records []written
+
+	for _, file := range files {
+		if !isRecordFile(file) {
+			continue
+		}
+
+		resource := d.recordKey(collection, file.Name())
+		m, err := d.readMeta(collection, resource)
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, written{
+			resource: resource,
+			clock:    m.Clock,
+			modTime:  file.ModTime().UnixNano(),
+			size:     d.fileSize(filepath.Join(dir, file.Name()), file),
+		})
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+
+		if a.clock == nil || b.clock == nil {
+			return a.clock == nil && (b.clock != nil || a.modTime < b.modTime)
+		}
+
+		return a.clock.Compare(*b.clock) < 0
+	})
+
+	for _, r := range records {
+		o.touch(r.resource, r.size)
+	}
+
+	d.capOrders.Store(collection, o)
+
+	return o, nil
+}
+
+// touch moves resource to the back of the queue with its new size.
+func (o *capOrder) touch(resource string, size int64) {
+	o.forget(resource)
+
+	o.next++
+	o.seq[resource] = o.next
+	o.sizes[resource] = size
+	o.bytes += size
+	o.queue = append(o.queue, capEntry{resource: resource, seq: o.next})
+
+	// Drop the places left behind once they outnumber the records.
+	if len(o.queue) > 2*len(o.seq)+16 {
+		live := o.queue[:0]
+
+		for _, e := range o.queue {
+			if o.seq[e.resource] == e.seq {
+				live = append(live, e)
+			}
+		}
+
+		o.queue = live
+	}
+}
+
+func (o *capOrder) forget(resource string) {
+	if _, ok := o.seq[resource]; ok {
+		o.bytes -= o.sizes[resource]
+		delete(o.seq, resource)
+		delete(o.sizes, resource)
+	}
+}
+
+func (o *capOrder) within(limits CapOptions) bool {
+	return (limits.MaxRecords == 0 || len(o.seq) <= limits.MaxRecords) && (limits.MaxBytes == 0 || o.bytes <= limits.MaxBytes)
+}
+
+// forgetCapped drops a deleted record from the write order of its
+// collection, or the whole order when resource is empty, to be read from
+// disk again when next needed. Callers must hold the collection lock.
+func (d *Driver) forgetCapped(collection, resource string) {
+	if resource == "" {
+		d.capOrders.Delete(collection)
+		return
+	}
+
+	if o, ok := d.capOrders.Load(collection); ok {
+		o.(*capOrder).forget(resource)
+	}
+}
+
+// resizeCapped updates the size of a record rewritten in place without
+// being written anew. Callers must hold the collection lock.
+func (d *Driver) resizeCapped(collection, resource string, size int64) {
+	o, ok := d.capOrders.Load(collection)
+
+	if !ok {
+		return
+	}
+
+	c := o.(*capOrder)
+
+	if _, ok := c.seq[resource]; ok {
+		c.bytes += size - c.sizes[resource]
+		c.sizes[resource] = size
+	}
+}
+
+// evict deletes the least recently written records of a capped collection,
+// other than keep, the record just written, until it is within its cap.
+// Callers must hold the collection lock.
+func (d *Driver) evict(collection, keep string) error {
+	limits := d.capOf(collection)
+
+	if limits.MaxRecords == 0 && limits.MaxBytes == 0 {
+		d.capOrders.Delete(collection)
+		return nil
+	}
+
+	o, err := d.loadCapOrder(collection)
+
+	if err != nil {
+		return err
+	}
+
+	if keep != "" {
+		if size := d.recordSize(d.recordPath(collection, keep)); size >= 0 {
+			o.touch(keep, size)
+		}
+	}
+
+	for len(o.queue) > 0 && !o.within(limits) {
+		e := o.queue[0]
+
+		if o.seq[e.resource] != e.seq {
+			o.queue = o.queue[1:]
+			continue
+		}
+
+		if e.resource == keep {
+			break
+		}
+
+		err := d.remove(collection, e.resource)
+
+		if err != nil && !errors.Is(err, ErrRecordNotFound) && !errors.Is(err, ErrCollectionNotFound) {
+			return fmt.Errorf("Unable to evict %v/%v: %w", collection, e.resource, err)
+		}
+
+		if err == nil {
+			d.log.Debug("Evicted '%s/%s' from capped collection\n", collection, e.resource)
+		}
+
+		o.forget(e.resource)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCappedEviction(t *testing.T) {
+	type op struct {
+		write  string
+		delete string
+	}
+
+	tests := []struct {
+		name   string
+		limits CapOptions
+		ops    []op
+		reopen bool
+		want   []string
+	}{
+		{
+			name:   "oldest evicted",
+			limits: CapOptions{MaxRecords: 2},
+			ops:    []op{{write: "a"}, {write: "b"}, {write: "c"}},
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "rewrite moves to the back",
+			limits: CapOptions{MaxRecords: 2},
+			ops:    []op{{write: "a"}, {write: "b"}, {write: "a"}, {write: "c"}},
+			want:   []string{"a", "c"},
+		},
+		{
+			name:   "deleted records not counted",
+			limits: CapOptions{MaxRecords: 2},
+			ops:    []op{{write: "a"}, {write: "b"}, {delete: "a"}, {write: "c"}},
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "byte cap",
+			limits: CapOptions{MaxBytes: 40},
+			ops:    []op{{write: "a"}, {write: "b"}, {write: "c"}, {write: "d"}},
+			want:   []string{"c", "d"},
+		},
+		{
+			name:   "order read from metadata",
+			limits: CapOptions{MaxRecords: 2},
+			ops:    []op{{write: "c"}, {write: "a"}, {write: "b"}},
+			reopen: true,
+			want:   []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := New(dir, nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { db.Close() }()
+
+			if err := db.SetCapped("Events", tt.limits); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, o := range tt.ops {
+				if tt.reopen && i == len(tt.ops)-1 {
+					// Every file gets the same modification time, so only
+					// the clock in the metadata tells the order.
+					same := time.Now().Add(-time.Hour)
+
+					for _, id := range []string{"a", "c"} {
+						if err := os.Chtimes(filepath.Join(dir, "Events", id+".json"), same, same); err != nil {
+							t.Fatal(err)
+						}
+					}
+
+					db.Close()
+
+					if db, err = New(dir, nil); err != nil {
+						t.Fatal(err)
+					}
+
+					if err := db.SetCapped("Events", tt.limits); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if o.write != "" {
+					err = db.Write("Events", o.write, map[string]string{"id": o.write})
+				} else {
+					err = db.Delete("Events", o.delete)
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := db.resources("Events")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrConditionFailed = errors.New("Condition failed")
+
+// Condition is evaluated against the current state of a record before a
+// conditional write. current is nil when the record does not exist.
+type Condition interface {
+	holds(current []byte, revision int64) (bool, error)
+}
+
+type equalsCondition struct {
+	value interface{}
+}
+
+type fieldEqualsCondition struct {
+	field string
+	value interface{}
+}
+
+type revisionCondition struct {
+	revision int64
+}
+
+// IfEquals holds when the stored document is JSON-equal to v.
+func IfEquals(v interface{}) Condition {
+	return equalsCondition{value: v}
+}
+
+// IfFieldEquals holds when the stored document has field set to v.
+func IfFieldEquals(field string, v interface{}) Condition {
+	return fieldEqualsCondition{field: field, value: v}
+}
+
+// IfRevision holds when the record is at revision n. Revision 0 means the
+// record must not exist yet.
+func IfRevision(n int64) Condition {
+	return revisionCondition{revision: n}
+}
+
+func (c equalsCondition) holds(current []byte, revision int64) (bool, error) {
+	if current == nil {
+		return false, nil
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return false, err
+	}
+
+	return valueKey(doc) == normalizedKey(c.value), nil
+}
+
+func (c fieldEqualsCondition) holds(current []byte, revision int64) (bool, error) {
+	if current == nil {
+		return false, nil
+	}
+
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return false, err
+	}
+
+	value, ok := lookupField(doc, c.field)
+
+	return ok && valueKey(value) == normalizedKey(c.value), nil
+}
+
+func (c revisionCondition) holds(current []byte, revision int64) (bool, error) {
+	if current == nil {
+		return c.revision == 0, nil
+	}
+
+	return revision == c.revision, nil
+}
+
+// WriteIf writes v only when cond holds for the current record, evaluating
+// the condition and writing under the same collection lock. It returns
+// ErrConditionFailed when the condition does not hold, unless the
+// collection has a resolver set with OnConflict.
+func (d *Driver) WriteIf(collection, resource string, v interface{}, cond Condition) (err error) {
+	defer d.observe(time.Now(), &err, "write", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	if cond == nil {
+		return fmt.Errorf("Missing condition")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, revision, err := d.current(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := cond.holds(current, revision)
+
+	if err != nil {
+		return fmt.Errorf("Unable to evaluate condition on %v/%v: %w", collection, resource, err)
+	}
+
+	if !ok {
+		return d.resolveConflict(collection, resource, current, v)
+	}
+
+	return d.write(collection, resource, v)
+}
+
+// DeleteIf deletes a record only when cond holds for it, returning
+// ErrConditionFailed otherwise.
+func (d *Driver) DeleteIf(collection, resource string, cond Condition) (err error) {
+	defer d.observe(time.Now(), &err, "delete", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	if cond == nil {
+		return fmt.Errorf("Missing condition")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, revision, err := d.current(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := cond.holds(current, revision)
+
+	if err != nil {
+		return fmt.Errorf("Unable to evaluate condition on %v/%v: %w", collection, resource, err)
+	}
+
+	if !ok {
+		return ErrConditionFailed
+	}
+
+	return d.delete(collection, resource)
+}
+
+// Revision returns the revision of a record, which starts at 1 and grows
+// with every write, carrying on from where it was when a record is deleted
+// and written again.
+func (d *Driver) Revision(collection, resource string) (_ int64, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	resource = d.key(resource)
+
+	d.flushCollection(collection)
+
+	if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		if os.IsNotExist(err) {
+			return 0, d.notFound(collection)
+		}
+		return 0, err
+	}
+
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Revision, nil
+}
+
+// current returns the stored document and revision of a record, or a nil
+// document when it does not exist or has expired.
+func (d *Driver) current(collection, resource string) ([]byte, int64, error) {
+	b, err := d.readRecord(collection, resource)
+
+	if os.IsNotExist(err) || (err == nil && d.expired(collection, resource)) {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b, m.Revision, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const changesDir = ".changes"
+
+const defaultSegmentSize = 16 << 20
+
+// ChangeLogOptions keeps every change made through the driver on disk, in
+// order and numbered, so that they can be read back with Changes and
+// delivered by sinks even across restarts.
+type ChangeLogOptions struct {
+	// SegmentSize is the size the log grows to before a new segment file
+	// is started. It defaults to 16 MiB.
+	SegmentSize int64
+
+	// Retention is how long segments are kept once a newer one has been
+	// started. Zero keeps them forever.
+	Retention time.Duration
+}
+
+// changeLog appends changes to segment files under .changes, each named
+// after the sequence number of its first change and holding one JSON entry
+// per line.
+type changeLog struct {
+	mutex sync.Mutex
+	dir   string
+	opts  ChangeLogOptions
+	seq   int64
+	f     *os.File
+	size  int64
+	wake  chan struct{}
+}
+
+type changeEntry struct {
+	Seq        int64           `json:"seq"`
+	Time       time.Time       `json:"time"`
+	Collection string          `json:"collection"`
+	Resource   string          `json:"resource"`
+	Value      json.RawMessage `json:"value,omitempty"`
+
+	// Sealed holds the value instead when the collection stores its
+	// records compressed, encrypted or signed.
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+func changeSegment(seq int64) string {
+	return fmt.Sprintf("%020d.jsonl", seq)
+}
+
+func (d *Driver) openChangeLog(opts ChangeLogOptions) (*changeLog, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+
+	l := &changeLog{dir: filepath.Join(d.dir, changesDir), opts: opts, wake: make(chan struct{})}
+
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := l.segments()
+
+	if err != nil || len(segments) == 0 {
+		return l, err
+	}
+
+	last := segments[len(segments)-1]
+	l.seq = last - 1
+
+	f, err := os.OpenFile(filepath.Join(l.dir, changeSegment(last)), os.O_RDWR, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	// Find the last complete entry, cutting off one left half written by
+	// a crash.
+	r := bufio.NewReader(f)
+	var size int64
+
+	for {
+		line, err := r.ReadBytes('\n')
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var e changeEntry
+
+		if err := json.Unmarshal(line, &e); err != nil {
+			d.log.Warn("Cutting off broken entry of change log segment %d: %v\n", last, err)
+			break
+		}
+
+		l.seq = e.Seq
+		size += int64(len(line))
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// segments lists the first sequence number of each segment, in order.
+func (l *changeLog) segments() ([]int64, error) {
+	files, err := os.ReadDir(l.dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int64
+
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".jsonl")
+
+		if seq, err := strconv.ParseInt(name, 10, 64); err == nil && name != file.Name() {
+			segments = append(segments, seq)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
+
+// append numbers c and adds it to the log.
+func (l *changeLog) append(c *Change, sealed []byte, durability Durability) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e := changeEntry{Seq: l.seq + 1, Time: c.Time, Collection: c.Collection, Resource: c.Resource}
+
+	if bytes.HasPrefix(sealed, envelopeMagic) {
+		e.Sealed = sealed
+	} else {
+		e.Value = c.Value
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if l.f != nil && l.size > 0 && l.size+int64(len(line)) > l.opts.SegmentSize {
+		l.f.Close()
+		l.f = nil
+		l.prune()
+	}
+
+	if l.f == nil {
+		if err := l.open(e.Seq); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.f.Write(line); err != nil {
+		return err
+	}
+
+	if durability == DurabilitySync {
+		if err := l.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	l.seq = e.Seq
+	l.size += int64(len(line))
+	c.Seq = e.Seq
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+
+	return nil
+}
+
+// open opens the segment to append to: the last one when it has room, or
+// else a new one starting at seq.
+func (l *changeLog) open(seq int64) error {
+	segments, err := l.segments()
+
+	if err != nil {
+		return err
+	}
+
+	name := changeSegment(seq)
+
+	if len(segments) > 0 {
+		last := filepath.Join(l.dir, changeSegment(segments[len(segments)-1]))
+
+		if fi, err := os.Stat(last); err == nil && fi.Size() < l.opts.SegmentSize {
+			name = filepath.Base(last)
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(l.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f, l.size = f, fi.Size()
+
+	return nil
+}
+
+// prune removes the segments older than the retention, except the last.
+func (l *changeLog) prune() {
+	if l.opts.Retention <= 0 {
+		return
+	}
+
+	segments, err := l.segments()
+
+	if err != nil || len(segments) < 2 {
+		return
+	}
+
+	for _, seq := range segments[:len(segments)-1] {
+		path := filepath.Join(l.dir, changeSegment(seq))
+
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > l.opts.Retention {
+			os.Remove(path)
+		}
+	}
+}
+
+func (l *changeLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.f != nil {
+		l.f.Sync()
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// logChange adds c to the change log, if there is one.
+func (d *Driver) logChange(c *Change) {
+	if d.changes == nil {
+		return
+	}
+
+	var sealed []byte
+
+	if c.Value != nil {
+		var err error
+
+		if sealed, err = d.sealRecord(c.Collection, c.Resource, c.Value); err != nil {
+			d.log.Warn("Unable to log change of '%s/%s': %v\n", c.Collection, c.Resource, err)
+			return
+		}
+	}
+
+	if err := d.changes.append(c, sealed, d.opts.Durability); err != nil {
+		d.log.Warn("Unable to log change of '%s/%s': %v\n", c.Collection, c.Resource, err)
+	}
+}
+
+var errChangeLogDisabled = fmt.Errorf("Change log is not enabled")
+
+// LastChange returns the sequence number of the latest change logged.
+func (d *Driver) LastChange() (int64, error) {
+	if d.changes == nil {
+		return 0, errChangeLogDisabled
+	}
+
+	d.changes.mutex.Lock()
+	defer d.changes.mutex.Unlock()
+
+	return d.changes.seq, nil
+}
+
+// Changes returns up to limit of the changes logged after the one numbered
+// since, in order. Changes already pruned from the log are skipped, and so
+// are those of subjects forgotten since. A limit of zero or less returns
+// all of them.
+func (d *Driver) Changes(since int64, limit int) ([]Change, error) {
+	changes, _, err := d.readChanges(since, limit)
+	return changes, err
+}
+
+// readChanges is Changes, also returning the sequence number of the last
+// entry read, which is past the last change returned when the ones after
+// it could not be.
+func (d *Driver) readChanges(since int64, limit int) ([]Change, int64, error) {
+	if d.changes == nil {
+		return nil, since, errChangeLogDisabled
+	}
+
+	segments, err := d.changes.segments()
+
+	if err != nil {
+		return nil, since, err
+	}
+
+	start := 0
+
+	for i, seq := range segments {
+		if seq <= since+1 {
+			start = i
+		}
+	}
+
+	var changes []Change
+	last := since
+
+	for _, seq := range segments[start:] {
+		f, err := os.Open(filepath.Join(d.changes.dir, changeSegment(seq)))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return changes, last, err
+		}
+
+		r := bufio.NewReader(f)
+
+		for limit <= 0 || len(changes) < limit {
+			line, err := r.ReadBytes('\n')
+
+			// An entry without its newline is still being written.
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return changes, last, err
+			}
+
+			var e changeEntry
+
+			if err := json.Unmarshal(line, &e); err != nil {
+				f.Close()
+				return changes, last, err
+			}
+
+			if e.Seq <= since {
+				continue
+			}
+
+			last = e.Seq
+			c := Change{Seq: e.Seq, Time: e.Time, Collection: e.Collection, Resource: e.Resource, Value: e.Value}
+
+			if e.Sealed != nil {
+				b, err := d.decodeRecord(e.Collection, e.Resource, e.Sealed)
+
+				if errors.Is(err, ErrForgotten) {
+					continue
+				}
+
+				if err != nil {
+					f.Close()
+					return changes, last, err
+				}
+
+				c.Value = b
+			}
+
+			changes = append(changes, c)
+		}
+
+		f.Close()
+
+		if limit > 0 && len(changes) >= limit {
+			break
+		}
+	}
+
+	return changes, last, nil
+}
+
+// WaitChanges blocks until a change after the one numbered since has been
+// logged, or ctx is done.
+func (d *Driver) WaitChanges(ctx context.Context, since int64) error {
+	if d.changes == nil {
+		return errChangeLogDisabled
+	}
+
+	for {
+		d.changes.mutex.Lock()
+		seq, wake := d.changes.seq, d.changes.wake
+		d.changes.mutex.Unlock()
+
+		if seq > since {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Change is a record written or deleted through the driver.
+type Change struct {
+	// Seq numbers the changes kept in the change log, and is zero when
+	// there is none.
+	Seq int64 `json:"seq,omitempty"`
+
+	Collection string `json:"collection"`
+	Resource   string `json:"resource"`
+
+	// Value is the record as written, nil when it was deleted.
+	Value json.RawMessage `json:"value"`
+
+	Time time.Time `json:"time"`
+}
+
+func (c Change) Deleted() bool {
+	return c.Value == nil
+}
+
+type changeListener struct {
+	fn func(Change)
+}
+
+// OnChange calls fn with every change made through the driver, in the
+// order they are made to each collection, and returns a function that stops
+// it. fn is called with the collection lock held, so it must not block nor
+// change the collection itself; slow listeners should hand changes off.
+func (d *Driver) OnChange(fn func(Change)) (stop func()) {
+	l := &changeListener{fn: fn}
+
+	d.mutex.Lock()
+	old, _ := d.listeners.Load().([]*changeListener)
+	d.listeners.Store(append(old[:len(old):len(old)], l))
+	d.mutex.Unlock()
+
+	return func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+
+		old, _ := d.listeners.Load().([]*changeListener)
+		listeners := make([]*changeListener, 0, len(old))
+
+		for _, o := range old {
+			if o != l {
+				listeners = append(listeners, o)
+			}
+		}
+
+		d.listeners.Store(listeners)
+	}
+}
+
+func (d *Driver) listening() bool {
+	listeners, _ := d.listeners.Load().([]*changeListener)
+	return len(listeners) > 0 || d.changes != nil
+}
+
+// notify tells the listeners that a record was written, or deleted when b
+// is nil. Callers must hold the collection lock.
+func (d *Driver) notify(collection, resource string, b []byte) {
+	if !d.listening() {
+		return
+	}
+
+	c := Change{Collection: collection, Resource: resource, Value: b, Time: time.Now()}
+	d.logChange(&c)
+
+	listeners, _ := d.listeners.Load().([]*changeListener)
+
+	for _, l := range listeners {
+		l.fn(c)
+	}
+}
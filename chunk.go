@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const chunksDir = ".chunks"
+
+// chunkGrace is how old an unreferenced chunk must be before CollectChunks
+// removes it, which leaves writers time to publish the manifest that refers
+// to the chunks they have just written.
+const chunkGrace = 10 * time.Minute
+
+// maxChunks is the most chunks a record is split into, which keeps the
+// manifest well within the envelope header limit.
+const maxChunks = 512
+
+func (d *Driver) chunkPath(sum string) string {
+	return filepath.Join(d.dir, chunksDir, sum[:2], sum)
+}
+
+// chunkRecord splits stored bytes larger than Options.ChunkSize into chunk
+// files and returns the manifest to store in their place. Chunks are named
+// by the hash of their content, so a manifest stays readable wherever it is
+// copied, as into the history or a snapshot, and unchanged chunks are
+// shared between versions.
+func (d *Driver) chunkRecord(stored []byte) ([]byte, error) {
+	size := d.opts.ChunkSize
+
+	if size <= 0 || len(stored) <= size {
+		return stored, nil
+	}
+
+	if len(stored) > size*maxChunks {
+		size = (len(stored) + maxChunks - 1) / maxChunks
+	}
+
+	h := envelopeHeader{Size: int64(len(stored))}
+	var paths []string
+
+	for off := 0; off < len(stored); off += size {
+		end := off + size
+
+		if end > len(stored) {
+			end = len(stored)
+		}
+
+		sum, path, err := d.writeChunk(stored[off:end])
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Chunks = append(h.Chunks, sum)
+		paths = append(paths, path, filepath.Dir(path))
+	}
+
+	if err := d.syncWrite(d.opts.Durability, paths...); err != nil {
+		return nil, err
+	}
+
+	return sealEnvelope(h, nil)
+}
+
+func (d *Driver) writeChunk(b []byte) (string, string, error) {
+	s := sha256.Sum256(b)
+	sum := hex.EncodeToString(s[:])
+	path := d.chunkPath(sum)
+
+	// A chunk that is already stored only needs to look recent, so that
+	// CollectChunks does not take it before the new manifest is written.
+	now := time.Now()
+
+	if err := os.Chtimes(path, now, now); err == nil {
+		return sum, path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", "", err
+	}
+
+	if err := d.writeFile(path+".tmp", b, 0644); err != nil {
+		return "", "", err
+	}
+
+	if err := d.replaceFile(path+".tmp", path); err != nil {
+		return "", "", err
+	}
+
+	return sum, path, nil
+}
+
+// readChunks reassembles the stored bytes a manifest refers to.
+func (d *Driver) readChunks(h *envelopeHeader) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, h.Size))
+
+	for _, sum := range h.Chunks {
+		if len(sum) < 2 {
+			return nil, fmt.Errorf("Invalid chunk %q", sum)
+		}
+
+		if err := d.readFileTo(d.chunkPath(sum), buf); err != nil {
+			return nil, fmt.Errorf("Unable to read chunk %v: %w", sum, err)
+		}
+	}
+
+	if int64(buf.Len()) != h.Size {
+		return nil, fmt.Errorf("Chunked record is %d bytes, expected %d", buf.Len(), h.Size)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CollectChunks removes the chunks that no record, history version, trashed
+// record or snapshot refers to any more. Compact runs it too.
+func (d *Driver) CollectChunks() (int, error) {
+	chunks := filepath.Join(d.dir, chunksDir)
+
+	if _, err := os.Stat(chunks); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	used := make(map[string]bool)
+
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path == chunks {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		h, err := readEnvelopeHeader(path)
+
+		if err != nil {
+			return err
+		}
+
+		if h != nil {
+			for _, sum := range h.Chunks {
+				used[sum] = true
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-chunkGrace)
+	removed := 0
+
+	err = filepath.Walk(chunks, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		name := strings.TrimSuffix(fi.Name(), ".tmp")
+
+		if fi.IsDir() || used[name] || fi.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		removeEmptyParents(chunks, path)
+		removed++
+
+		return nil
+	})
+
+	if removed > 0 {
+		d.log.Info("Removed %d unreferenced chunks\n", removed)
+	}
+
+	return removed, err
+}
+
+// readEnvelopeHeader reads just the envelope header of a file, or nil for
+// files without one.
+func readEnvelopeHeader(path string) (*envelopeHeader, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	defer f.Close()
+
+	prefix := make([]byte, len(envelopeMagic)+2)
+
+	if _, err := io.ReadFull(f, prefix); err != nil || !bytes.HasPrefix(prefix, envelopeMagic) {
+		return nil, nil
+	}
+
+	n := int(prefix[len(envelopeMagic)])<<8 | int(prefix[len(envelopeMagic)+1])
+	b := make([]byte, len(prefix)+n)
+	copy(b, prefix)
+
+	if _, err := io.ReadFull(f, b[len(prefix):]); err != nil {
+		return nil, nil
+	}
+
+	h, _, err := openEnvelope(b)
+
+	if err != nil {
+		return nil, nil
+	}
+
+	return h, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		size      int
+	}{
+		{name: "unchunked", chunkSize: 1000, size: 500},
+		{name: "few chunks", chunkSize: 1000, size: 5000},
+		{name: "many chunks", chunkSize: 100, size: 120000},
+		{name: "more than fit a header", chunkSize: 10, size: 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := New(t.TempDir(), &Options{ChunkSize: tt.chunkSize})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{"text": strings.Repeat("x", tt.size)}
+
+			if err := db.Write("Docs", "a", want); err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]string
+
+			if err := db.Read("Docs", "a", &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got["text"] != want["text"] {
+				t.Errorf("Read returned %d bytes, want %d", len(got["text"]), len(want["text"]))
+			}
+		})
+	}
+}
+
+func TestChunkQuota(t *testing.T) {
+	db, err := New(t.TempDir(), &Options{ChunkSize: 1000, MaxBytes: 5000})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Write("Docs", "small", map[string]string{"text": strings.Repeat("x", 3000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := db.Usage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Bytes < 3000 {
+		t.Errorf("Usage reports %d bytes for a 3000 byte record", u.Bytes)
+	}
+
+	err = db.Write("Docs", "large", map[string]string{"text": strings.Repeat("x", 50000)})
+
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Write of 50000 bytes past MaxBytes 5000 returned %v, want ErrQuotaExceeded", err)
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coldPrefix is the prefix of the keys of cold records in the object store.
+// Records are kept by the hash of their stored bytes, like chunks, so a
+// stub stays valid wherever it is copied and objects are never changed.
+const coldPrefix = "records/"
+
+// coldGrace is how old an unreferenced object must be before CollectCold
+// removes it, which leaves a demotion time to replace the record with its
+// stub once the object is uploaded.
+const coldGrace = 10 * time.Minute
+
+type TieringOptions struct {
+	// Store is the cold storage records are demoted to.
+	Store ObjectStore
+
+	// Interval is how often the tier policies of the collections are
+	// applied. When it is zero they are only applied by Tier.
+	Interval time.Duration
+
+	// Timeout bounds each request to the store. It defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// TierPolicy decides which records of a collection are kept in cold
+// storage. Records stay listed and readable wherever they are; a cold
+// record leaves a stub of a few bytes on local disk, and reading it fetches
+// it from the store.
+type TierPolicy struct {
+	// DemoteAfter demotes the records not written, nor promoted, for this
+	// long. Zero demotes every record, keeping the whole collection cold.
+	DemoteAfter time.Duration `json:"-"`
+
+	// PromoteReads brings a cold record back to local disk once it has
+	// been read this many times, past the caches, between two runs of the
+	// policy. Zero keeps cold records cold until they are written.
+	PromoteReads int `json:"promoteReads,omitempty"`
+}
+
+type tierPolicyJSON struct {
+	DemoteAfter string `json:"demoteAfter,omitempty"`
+	*tierPolicyFields
+}
+
+type tierPolicyFields TierPolicy
+
+// MarshalJSON writes DemoteAfter as a duration string such as "720h".
+func (p TierPolicy) MarshalJSON() ([]byte, error) {
+	out := tierPolicyJSON{tierPolicyFields: (*tierPolicyFields)(&p)}
+
+	if p.DemoteAfter > 0 {
+		out.DemoteAfter = p.DemoteAfter.String()
+	}
+
+	return json.Marshal(out)
+}
+
+func (p *TierPolicy) UnmarshalJSON(b []byte) error {
+	in := tierPolicyJSON{tierPolicyFields: (*tierPolicyFields)(p)}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&in); err != nil {
+		return err
+	}
+
+	if in.DemoteAfter == "" {
+		p.DemoteAfter = 0
+		return nil
+	}
+
+	after, err := time.ParseDuration(in.DemoteAfter)
+
+	if err != nil {
+		return fmt.Errorf("Invalid demoteAfter: %w", err)
+	}
+
+	p.DemoteAfter = after
+
+	return nil
+}
+
+type TieringStatus struct {
+	Running   bool
+	Demoted   int
+	Promoted  int
+	Collected int
+	LastRun   time.Time
+	LastError error
+}
+
+type tiering struct {
+	store   ObjectStore
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	status TieringStatus
+
+	// reads counts the reads of cold records since the last run, and
+	// promoted holds when records were last promoted, by collection.
+	reads    map[string]map[string]int
+	promoted map[string]map[string]time.Time
+}
+
+func newTiering(o TieringOptions) (*tiering, error) {
+	if o.Store == nil {
+		return nil, fmt.Errorf("Missing object store")
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Second
+	}
+
+	return &tiering{
+		store:    o.Store,
+		timeout:  o.Timeout,
+		reads:    make(map[string]map[string]int),
+		promoted: make(map[string]map[string]time.Time),
+	}, nil
+}
+
+func coldKey(sum string) string {
+	return coldPrefix + sum[:2] + "/" + sum
+}
+
+func (d *Driver) checkTiering() error {
+	if d.tiering == nil {
+		return fmt.Errorf("Tiering is not configured")
+	}
+
+	return nil
+}
+
+// readCold fetches the stored bytes of a cold record from the store.
+func (d *Driver) readCold(h *envelopeHeader) ([]byte, error) {
+	if d.tiering == nil {
+		return nil, fmt.Errorf("Record is in cold storage, but tiering is not configured")
+	}
+
+	if len(h.Cold) < 2 {
+		return nil, fmt.Errorf("Invalid cold record %q", h.Cold)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.tiering.timeout)
+	defer cancel()
+
+	b, err := d.tiering.store.Get(ctx, coldKey(h.Cold))
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read cold record %v: %w", h.Cold, err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	if hex.EncodeToString(sum[:]) != h.Cold || int64(len(b)) != h.Size {
+		return nil, fmt.Errorf("Cold record %v does not match its hash", h.Cold)
+	}
+
+	return b, nil
+}
+
+// coldRead counts a read of the record stored as b, if it is cold and its
+// collection's policy promotes records on reads.
+func (d *Driver) coldRead(collection, resource string, b []byte) {
+	if d.tiering == nil || !bytes.HasPrefix(b, envelopeMagic) {
+		return
+	}
+
+	if h, _, err := openEnvelope(b); err != nil || h == nil || h.Cold == "" {
+		return
+	}
+
+	if p, ok := d.Policy(collection); !ok || p.Tier == nil || p.Tier.PromoteReads <= 0 {
+		return
+	}
+
+	t := d.tiering
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.reads[collection] == nil {
+		t.reads[collection] = make(map[string]int)
+	}
+
+	t.reads[collection][resource]++
+}
+
+// Tier applies the tier policies of the collections, demoting and promoting
+// their records, and then collects the objects no record refers to any
+// more. Tiering runs it every TieringOptions.Interval.
+func (d *Driver) Tier() error {
+	return d.tier(context.Background())
+}
+
+func (d *Driver) tier(ctx context.Context) error {
+	if err := d.checkTiering(); err != nil {
+		return err
+	}
+
+	t := d.tiering
+
+	t.mutex.Lock()
+
+	if t.status.Running {
+		t.mutex.Unlock()
+		return fmt.Errorf("Tiering already running")
+	}
+
+	start := time.Now()
+	t.status = TieringStatus{Running: true, LastRun: start}
+	t.mutex.Unlock()
+
+	status, err := d.applyTierPolicies(ctx)
+
+	if err == nil {
+		status.Collected, err = d.collectCold(ctx)
+	}
+
+	if err != nil {
+		d.log.Error("Tiering failed: %v\n", err)
+	}
+
+	status.LastRun, status.LastError = start, err
+
+	t.mutex.Lock()
+	t.status = status
+	t.mutex.Unlock()
+
+	return err
+}
+
+func (d *Driver) applyTierPolicies(ctx context.Context) (TieringStatus, error) {
+	var status TieringStatus
+
+	policies := d.Policies()
+	names := make([]string, 0, len(policies))
+
+	for collection, p := range policies {
+		if p.Tier != nil {
+			names = append(names, collection)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, collection := range names {
+		demoted, promoted, err := d.tierCollection(ctx, collection, *policies[collection].Tier)
+
+		status.Demoted += demoted
+		status.Promoted += promoted
+
+		if err != nil {
+			return status, fmt.Errorf("Unable to tier %v: %w", collection, err)
+		}
+	}
+
+	return status, nil
+}
+
+func (d *Driver) TieringStatus() TieringStatus {
+	if d.tiering == nil {
+		return TieringStatus{}
+	}
+
+	d.tiering.mutex.Lock()
+	defer d.tiering.mutex.Unlock()
+
+	return d.tiering.status
+}
+
+// tierCollection promotes the records of collection read often enough
+// since the last run and demotes those old enough.
+func (d *Driver) tierCollection(ctx context.Context, collection string, p TierPolicy) (int, int, error) {
+	t := d.tiering
+
+	t.mutex.Lock()
+	reads := t.reads[collection]
+	delete(t.reads, collection)
+	promotedAt := t.promoted[collection]
+	t.mutex.Unlock()
+
+	d.flushCollection(collection)
+
+	resources, err := d.resources(collection)
+
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cutoff := time.Now().Add(-p.DemoteAfter)
+	demoted, promoted := 0, 0
+
+	for _, resource := range resources {
+		if err := ctx.Err(); err != nil {
+			return demoted, promoted, err
+		}
+
+		if d.expired(collection, resource) {
+			continue
+		}
+
+		if p.PromoteReads > 0 && reads[resource] >= p.PromoteReads {
+			ok, err := d.promoteRecord(ctx, collection, resource)
+
+			if err != nil {
+				return demoted, promoted, err
+			}
+
+			if ok {
+				promoted++
+			}
+
+			continue
+		}
+
+		if p.DemoteAfter > 0 {
+			fi, err := os.Stat(d.recordPath(collection, resource))
+
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			if err != nil {
+				return demoted, promoted, err
+			}
+
+			t.mutex.Lock()
+			at := promotedAt[resource]
+			t.mutex.Unlock()
+
+			if fi.ModTime().After(cutoff) || at.After(cutoff) {
+				continue
+			}
+		}
+
+		ok, err := d.demoteRecord(ctx, collection, resource)
+
+		if err != nil {
+			return demoted, promoted, err
+		}
+
+		if ok {
+			demoted++
+		}
+	}
+
+	t.mutex.Lock()
+
+	for resource, at := range t.promoted[collection] {
+		if !at.After(cutoff) {
+			delete(t.promoted[collection], resource)
+		}
+	}
+
+	t.mutex.Unlock()
+
+	return demoted, promoted, nil
+}
+
+// Demote moves a record, or every record of a collection when resource is
+// empty, to cold storage, whatever the collection's policy.
+func (d *Driver) Demote(collection, resource string) error {
+	return d.moveTier(collection, resource, d.demoteRecord)
+}
+
+// Promote brings a record, or every record of a collection when resource is
+// empty, back from cold storage to local disk. The collection's policy may
+// demote them again on its next run.
+func (d *Driver) Promote(collection, resource string) error {
+	return d.moveTier(collection, resource, d.promoteRecord)
+}
+
+func (d *Driver) moveTier(collection, resource string, move func(ctx context.Context, collection, resource string) (bool, error)) error {
+	if err := d.checkTiering(); err != nil {
+		return err
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	d.flushCollection(collection)
+
+	resources := []string{d.key(resource)}
+
+	if resource == "" {
+		var err error
+
+		if resources, err = d.resources(collection); err != nil {
+			if os.IsNotExist(err) {
+				return ErrCollectionNotFound
+			}
+			return err
+		}
+	} else if _, err := os.Stat(d.recordPath(collection, resources[0])); os.IsNotExist(err) {
+		return d.notFound(collection)
+	}
+
+	for _, r := range resources {
+		if _, err := move(context.Background(), collection, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// demoteRecord uploads the stored bytes of a record to the store and
+// replaces them with a stub referring to them. It reports whether the
+// record was demoted: it is not when it is already cold, is chunked, or was
+// changed during the upload. The object is then left for CollectCold.
+func (d *Driver) demoteRecord(ctx context.Context, collection, resource string) (bool, error) {
+	path := d.recordPath(collection, resource)
+	stored, err := d.readFile(path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if h, _, err := openEnvelope(stored); err != nil || (h != nil && (h.Cold != "" || len(h.Chunks) > 0)) {
+		return false, err
+	}
+
+	s := sha256.Sum256(stored)
+	sum := hex.EncodeToString(s[:])
+
+	put, cancel := context.WithTimeout(ctx, d.tiering.timeout)
+	err = d.tiering.store.Put(put, coldKey(sum), stored)
+	cancel()
+
+	if err != nil {
+		return false, fmt.Errorf("Unable to demote %v/%v: %w", collection, resource, err)
+	}
+
+	stub, err := sealEnvelope(envelopeHeader{Cold: sum, Size: int64(len(stored))}, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	return d.replaceTier(collection, resource, stored, stub)
+}
+
+// promoteRecord fetches the stored bytes of a cold record back in place of
+// its stub. It reports whether the record was promoted: it is not when it
+// is not cold or was changed during the download.
+func (d *Driver) promoteRecord(ctx context.Context, collection, resource string) (bool, error) {
+	path := d.recordPath(collection, resource)
+	stub, err := d.readFile(path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	h, _, err := openEnvelope(stub)
+
+	if err != nil || h == nil || h.Cold == "" {
+		return false, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	stored, err := d.readCold(h)
+
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := d.replaceTier(collection, resource, stub, stored)
+
+	if ok {
+		t := d.tiering
+
+		t.mutex.Lock()
+
+		if t.promoted[collection] == nil {
+			t.promoted[collection] = make(map[string]time.Time)
+		}
+
+		t.promoted[collection][resource] = time.Now()
+		t.mutex.Unlock()
+	}
+
+	return ok, err
+}
+
+// replaceTier replaces the stored bytes from of a record with to, which hold
+// the same record in another tier, unless the record was changed since from
+// was read. The file keeps its modification time, so that a record's age
+// is the time since it was written. The value of the record is unchanged,
+// so nothing else is told about it.
+func (d *Driver) replaceTier(collection, resource string, from, to []byte) (bool, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.writable(); err != nil {
+		return false, err
+	}
+
+	path := d.recordPath(collection, resource)
+	fi, err := os.Stat(path)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	current, err := d.readFile(path)
+
+	if err != nil || !bytes.Equal(current, from) {
+		return false, err
+	}
+
+	if err := d.reserve(collection, storedSize(from), storedSize(to)); err != nil {
+		return false, err
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := d.writeFile(tmpPath, to, 0644); err != nil {
+		d.unreserve(collection, storedSize(from), storedSize(to))
+		return false, err
+	}
+
+	if err := os.Chtimes(tmpPath, fi.ModTime(), fi.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		d.unreserve(collection, storedSize(from), storedSize(to))
+		return false, err
+	}
+
+	if err := d.syncWrite(d.opts.Durability, tmpPath); err != nil {
+		d.unreserve(collection, storedSize(from), storedSize(to))
+		return false, err
+	}
+
+	if err := d.replaceFile(tmpPath, path); err != nil {
+		d.unreserve(collection, storedSize(from), storedSize(to))
+		return false, err
+	}
+
+	d.resizeCapped(collection, resource, storedSize(to))
+
+	return true, d.syncWrite(d.opts.Durability, filepath.Dir(path))
+}
+
+// CollectCold removes the objects of the store that no record, history
+// version, trashed record or snapshot refers to any more. Tier runs it too.
+func (d *Driver) CollectCold() (int, error) {
+	if err := d.checkTiering(); err != nil {
+		return 0, err
+	}
+
+	return d.collectCold(context.Background())
+}
+
+func (d *Driver) collectCold(ctx context.Context) (int, error) {
+	used := make(map[string]bool)
+	chunks := filepath.Join(d.dir, chunksDir)
+
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path == chunks {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		h, err := readEnvelopeHeader(path)
+
+		if err != nil {
+			return err
+		}
+
+		if h != nil && h.Cold != "" {
+			used[h.Cold] = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	list, cancel := context.WithTimeout(ctx, d.tiering.timeout)
+	objects, err := d.tiering.store.List(list, coldPrefix)
+	cancel()
+
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list cold records: %w", err)
+	}
+
+	cutoff := time.Now().Add(-coldGrace)
+	removed := 0
+
+	for _, o := range objects {
+		sum := o.Key[strings.LastIndex(o.Key, "/")+1:]
+
+		if used[sum] || o.Modified.After(cutoff) {
+			continue
+		}
+
+		del, cancel := context.WithTimeout(ctx, d.tiering.timeout)
+		err := d.tiering.store.Delete(del, o.Key)
+		cancel()
+
+		if err != nil {
+			return removed, fmt.Errorf("Unable to remove cold record %v: %w", sum, err)
+		}
+
+		removed++
+	}
+
+	if removed > 0 {
+		d.log.Info("Removed %d unreferenced cold records\n", removed)
+	}
+
+	return removed, nil
+}
+
+func (d *Driver) tierer(ctx context.Context, t *task) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := d.tier(ctx)
+
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			t.beat(err)
+		}
+	}
+}
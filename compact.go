@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type CompactionOptions struct {
+	// Interval is how often the triggers are evaluated.
+	Interval time.Duration
+
+	// StaleRatio triggers a compaction once stale files make up at least this
+	// fraction of the files in the database.
+	StaleRatio float64
+
+	// MaxSize triggers a compaction once the database holds at least this
+	// many bytes. Live records count too, so once they alone pass it the
+	// scheduled compactions back off: after each that reclaims nothing,
+	// the triggers are evaluated half as often, down to once every
+	// maxCompactionBackoff intervals, until one reclaims something again.
+	MaxSize int64
+
+	// WindowStart and WindowEnd restrict compactions to a time of day, given
+	// as offsets from midnight. The window may wrap past midnight.
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+}
+
+type CompactionStatus struct {
+	Running     bool
+	Collections int
+	Done        int
+	Removed     int
+	Reclaimed   int64
+	LastRun     time.Time
+	LastError   error
+}
+
+// maxCompactionBackoff is the most intervals the compactor skips after a
+// scheduled compaction that reclaimed nothing.
+const maxCompactionBackoff = 64
+
+// nextBackoff returns how many intervals to skip after a scheduled
+// compaction, given how many were skipped before it and whether it
+// reclaimed anything.
+func nextBackoff(backoff int, reclaimed bool) int {
+	switch {
+	case reclaimed:
+		return 0
+	case backoff == 0:
+		return 1
+	case backoff < maxCompactionBackoff:
+		return backoff * 2
+	}
+
+	return maxCompactionBackoff
+}
+
+type usageScan struct {
+	files int
+	stale int
+	size  int64
+}
+
+// Compact removes the files a crash or an interrupted operation can leave
+// behind: temporary files from unfinished writes, metadata of records that
+// no longer exist and expired records the sweeper has not reached yet. With
+// tombstones enabled it also vacuums those past their retention, and with
+// history enabled it prunes versions past theirs.
+func (d *Driver) Compact() error {
+	d.mutex.Lock()
+
+	if d.compaction.Running {
+		d.mutex.Unlock()
+		return fmt.Errorf("Compaction already running")
+	}
+
+	d.compaction = CompactionStatus{Running: true, LastRun: time.Now()}
+	d.mutex.Unlock()
+
+	collections, err := d.listCollections()
+
+	d.mutex.Lock()
+	d.compaction.Collections = len(collections)
+	d.mutex.Unlock()
+
+	for _, collection := range collections {
+		if err != nil {
+			break
+		}
+
+		var removed int
+		var reclaimed int64
+
+		removed, reclaimed, err = d.compactCollection(collection)
+
+		d.mutex.Lock()
+		d.compaction.Done++
+		d.compaction.Removed += removed
+		d.compaction.Reclaimed += reclaimed
+		d.mutex.Unlock()
+	}
+
+	if err == nil && d.opts.History {
+		err = d.PruneHistory()
+	}
+
+	if err == nil && d.opts.Tombstones {
+		var vacuumed int
+
+		vacuumed, err = d.Vacuum()
+
+		d.mutex.Lock()
+		d.compaction.Removed += vacuumed
+		d.mutex.Unlock()
+	}
+
+	if err == nil {
+		var collected int
+
+		collected, err = d.CollectChunks()
+
+		d.mutex.Lock()
+		d.compaction.Removed += collected
+		d.mutex.Unlock()
+	}
+
+	d.mutex.Lock()
+	d.compaction.Running = false
+	d.compaction.LastError = err
+	status := d.compaction
+	d.mutex.Unlock()
+
+	if status.Removed > 0 {
+		d.log.Info("Compaction removed %d stale files, reclaiming %d bytes\n", status.Removed, status.Reclaimed)
+	}
+
+	return err
+}
+
+func (d *Driver) CompactionStatus() CompactionStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.compaction
+}
+
+func (d *Driver) compactCollection(collection string) (int, int64, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var (
+		removed   int
+		reclaimed int64
+	)
+
+	remove := func(path string, fi os.FileInfo) error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		removed++
+		reclaimed += fi.Size()
+
+		return nil
+	}
+
+	dir := filepath.Join(d.dir, collection)
+	files, err := d.readTree(dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		return removed, reclaimed, err
+	}
+
+	cutoff := time.Now().Add(-stageGrace)
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmp") && file.ModTime().Before(cutoff) {
+			if err := remove(filepath.Join(dir, file.Name()), file); err != nil {
+				return removed, reclaimed, err
+			}
+		}
+	}
+
+	metas, err := d.readTree(d.metaPath(collection, ""))
+
+	if err != nil && !os.IsNotExist(err) {
+		return removed, reclaimed, err
+	}
+
+	for _, file := range metas {
+		path := filepath.Join(d.metaPath(collection, ""), file.Name())
+		resource := d.recordKey(collection, file.Name())
+
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			if err := remove(path, file); err != nil {
+				return removed, reclaimed, err
+			}
+			continue
+		}
+
+		record, err := os.Stat(d.recordPath(collection, resource))
+
+		switch {
+		case os.IsNotExist(err):
+			m, err := d.readMeta(collection, resource)
+
+			if err == nil && m.Deleted != nil {
+				continue
+			}
+
+			d.forgetExpiries(collection, resource)
+
+			if err == nil {
+				if err := d.raiseFloor(collection, m.Revision); err != nil {
+					return removed, reclaimed, err
+				}
+			}
+
+			if err := remove(path, file); err != nil {
+				return removed, reclaimed, err
+			}
+
+		case err != nil:
+			return removed, reclaimed, err
+
+		case d.expired(collection, resource):
+			size := d.recordSize(d.recordPath(collection, resource))
+
+			if err := remove(d.recordPath(collection, resource), record); err != nil {
+				return removed, reclaimed, err
+			}
+
+			d.release(collection, size)
+
+			d.changedRecord(collection, resource, nil)
+			d.recordHistory(collection, resource, nil)
+			d.notify(collection, resource, nil)
+			d.removeFromIndexes(collection, resource)
+			d.forgetExpiries(collection, resource)
+			d.forgetCapped(collection, resource)
+
+			if err := d.retireRevision(collection, resource); err != nil {
+				return removed, reclaimed, err
+			}
+
+			if err := remove(path, file); err != nil {
+				return removed, reclaimed, err
+			}
+		}
+	}
+
+	return removed, reclaimed, nil
+}
+
+// listCollections returns the collections present on disk, including those
+// that only have metadata left.
+func (d *Driver) listCollections() ([]string, error) {
+	seen := make(map[string]bool)
+	var collections []string
+
+	for _, dir := range []string{d.dir, filepath.Join(d.dir, metaDir)} {
+		files, err := ioutil.ReadDir(dir)
+
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() && !strings.HasPrefix(file.Name(), ".") && !seen[file.Name()] {
+				seen[file.Name()] = true
+				collections = append(collections, file.Name())
+			}
+		}
+	}
+
+	return collections, nil
+}
+
+func (d *Driver) scanUsage() (usageScan, error) {
+	var u usageScan
+
+	cutoff := time.Now().Add(-stageGrace)
+
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		u.files++
+		u.size += fi.Size()
+
+		if strings.HasSuffix(fi.Name(), ".tmp") && fi.ModTime().Before(cutoff) {
+			u.stale++
+		}
+
+		return nil
+	})
+
+	return u, err
+}
+
+func (o *CompactionOptions) inWindow(now time.Time) bool {
+	if o.WindowStart == o.WindowEnd {
+		return true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	if o.WindowStart < o.WindowEnd {
+		return offset >= o.WindowStart && offset < o.WindowEnd
+	}
+
+	return offset >= o.WindowStart || offset < o.WindowEnd
+}
+
+func (d *Driver) shouldCompact(o *CompactionOptions) (bool, error) {
+	if !o.inWindow(time.Now()) {
+		return false, nil
+	}
+
+	if o.StaleRatio <= 0 && o.MaxSize <= 0 {
+		return true, nil
+	}
+
+	u, err := d.scanUsage()
+
+	if err != nil {
+		return false, err
+	}
+
+	if o.MaxSize > 0 && u.size >= o.MaxSize {
+		return true, nil
+	}
+
+	return o.StaleRatio > 0 && u.files > 0 && float64(u.stale)/float64(u.files) >= o.StaleRatio, nil
+}
+
+func (d *Driver) compactor(ctx context.Context, t *task, o CompactionOptions) error {
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	var skip, backoff int
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if skip > 0 {
+				skip--
+				t.beat(nil)
+				continue
+			}
+
+			ok, err := d.shouldCompact(&o)
+
+			if err == nil && ok {
+				err = d.Compact()
+				backoff = nextBackoff(backoff, err != nil || d.CompactionStatus().Removed > 0)
+				skip = backoff
+			}
+
+			if err != nil {
+				d.log.Error("Scheduled compaction failed: %v\n", err)
+			}
+
+			t.beat(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		backoff   int
+		reclaimed bool
+		want      int
+	}{
+		{name: "first idle run", backoff: 0, reclaimed: false, want: 1},
+		{name: "idle again", backoff: 1, reclaimed: false, want: 2},
+		{name: "idle a while", backoff: 16, reclaimed: false, want: 32},
+		{name: "capped", backoff: maxCompactionBackoff, reclaimed: false, want: maxCompactionBackoff},
+		{name: "reclaimed", backoff: 32, reclaimed: true, want: 0},
+		{name: "reclaimed first", backoff: 0, reclaimed: true, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBackoff(tt.backoff, tt.reclaimed); got != tt.want {
+				t.Errorf("nextBackoff(%d, %v) = %d, want %d", tt.backoff, tt.reclaimed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompactReclaimsNothingFromLiveData(t *testing.T) {
+	db, err := New(t.TempDir(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := db.Write("Users", id, map[string]string{"id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o := CompactionOptions{MaxSize: 1}
+
+	if ok, err := db.shouldCompact(&o); err != nil || !ok {
+		t.Fatalf("shouldCompact = %v, %v, want true", ok, err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := db.CompactionStatus().Removed; removed != 0 {
+		t.Fatalf("Compact removed %d files of live data", removed)
+	}
+
+	if got := nextBackoff(0, db.CompactionStatus().Removed > 0); got == 0 {
+		t.Errorf("compactor does not back off after reclaiming nothing")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compressor interface {
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+var (
+	compressorsMutex sync.RWMutex
+	compressors      = map[string]Compressor{
+		"gzip":   gzipCompressor{},
+		"snappy": snappyCompressor{},
+		"zstd":   &zstdCompressor{},
+	}
+)
+
+// RegisterCompressor makes a compression algorithm available to
+// SetCompression under name.
+func RegisterCompressor(name string, c Compressor) {
+	compressorsMutex.Lock()
+	defer compressorsMutex.Unlock()
+
+	compressors[name] = c
+}
+
+func compressor(name string) (Compressor, error) {
+	compressorsMutex.RLock()
+	defer compressorsMutex.RUnlock()
+
+	c, ok := compressors[name]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression algorithm %v", name)
+	}
+
+	return c, nil
+}
+
+// SetCompression selects the algorithm new records of collection are
+// compressed with, or turns compression off when algorithm is empty.
+// Records are decompressed according to how they were stored, so changing
+// the setting never affects reads of existing records.
+func (d *Driver) SetCompression(collection, algorithm string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if algorithm != "" {
+		if _, err := compressor(algorithm); err != nil {
+			return err
+		}
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.compression = algorithm
+	})
+
+	return nil
+}
+
+func (d *Driver) compression(collection string) string {
+	return d.config(collection).compression
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(b []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, b), nil
+}
+
+func (snappyCompressor) Decompress(b []byte) ([]byte, error) {
+	return s2.Decode(nil, b)
+}
+
+// zstdCompressor shares one encoder and decoder, which are safe for
+// concurrent EncodeAll and DecodeAll calls.
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.encoder, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+
+		z.decoder, z.err = zstd.NewReader(nil)
+	})
+
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(b []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+
+	return z.encoder.EncodeAll(b, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(b []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+
+	return z.decoder.DecodeAll(b, nil)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ComputedFunc func(doc map[string]interface{}) interface{}
+
+type collectionConfig struct {
+	computed    map[string]ComputedFunc
+	compression string
+	capped      CapOptions
+	bloom       *bloomFilter
+	decode      *DecodeOptions
+	defaults    map[string]interface{}
+	validator   func(doc interface{}) error
+	schema      *docSchema
+	ttl         time.Duration
+	indexes     []string
+	resolver    ConflictResolver
+	merge       MergeFunc
+	crdt        CRDTKind
+
+	subjectField string
+
+	migrations         []Migration
+	migrationWriteBack bool
+}
+
+// config returns the settings of collection without locking; they are
+// replaced as a whole, never modified, so readers need no lock. A
+// collection that was never configured has the zero settings.
+func (d *Driver) config(collection string) *collectionConfig {
+	configs, _ := d.collections.Load().(map[string]*collectionConfig)
+
+	if cfg, ok := configs[collection]; ok {
+		return cfg
+	}
+
+	return &collectionConfig{}
+}
+
+// configure changes the settings of collection by applying fn to a copy of
+// them and publishing the result.
+func (d *Driver) configure(collection string, fn func(cfg *collectionConfig)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	old, _ := d.collections.Load().(map[string]*collectionConfig)
+	configs := make(map[string]*collectionConfig, len(old)+1)
+
+	for name, cfg := range old {
+		configs[name] = cfg
+	}
+
+	cfg := *d.config(collection)
+	cfg.computed = make(map[string]ComputedFunc, len(cfg.computed))
+
+	for name, f := range d.config(collection).computed {
+		cfg.computed[name] = f
+	}
+
+	fn(&cfg)
+	configs[collection] = &cfg
+
+	d.collections.Store(configs)
+}
+
+// SetComputedField registers fn to derive the named field from each document
+// of collection. Computed fields are added to query results, can be used in
+// filters and sorts, and can be indexed like stored fields.
+func (d *Driver) SetComputedField(collection, name string, fn ComputedFunc) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if name == "" {
+		return fmt.Errorf("Missing field")
+	}
+
+	if fn == nil {
+		return fmt.Errorf("Missing computed field function")
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.computed[name] = fn
+	})
+
+	d.reindex(collection, name)
+
+	return nil
+}
+
+func (d *Driver) RemoveComputedField(collection, name string) {
+	d.configure(collection, func(cfg *collectionConfig) {
+		delete(cfg.computed, name)
+	})
+
+	d.reindex(collection, name)
+}
+
+type computedField struct {
+	name string
+	path []string
+	fn   ComputedFunc
+}
+
+func (d *Driver) computedFields(collection string) []computedField {
+	cfg := d.config(collection)
+
+	if len(cfg.computed) == 0 {
+		return nil
+	}
+
+	fields := make([]computedField, 0, len(cfg.computed))
+
+	for name, fn := range cfg.computed {
+		fields = append(fields, computedField{name: name, path: strings.Split(name, "."), fn: fn})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+
+	return fields
+}
+
+// withComputed returns the record with the computed fields of collection
+// filled in. Records of collections without computed fields are returned
+// unchanged and without being decoded.
+func (d *Driver) withComputed(collection string, b []byte) ([]byte, map[string]interface{}, error) {
+	fields := d.computedFields(collection)
+
+	if len(fields) == 0 {
+		return b, nil, nil
+	}
+
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	for _, f := range fields {
+		setPath(doc, f.path, f.fn(doc))
+	}
+
+	b, err := marshalRecord(doc)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, doc, nil
+}
+
+// reindex rebuilds an existing index on field after the way it is computed
+// has changed.
+func (d *Driver) reindex(collection, field string) {
+	if d.index(collection, field) == nil {
+		return
+	}
+
+	d.DropIndex(collection, field)
+
+	if err := d.EnsureIndex(collection, field); err != nil {
+		d.log.Warn("Unable to rebuild index on '%s.%s': %v\n", collection, field, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the deployment configuration of a driver and the servers in
+// front of it, read by LoadConfig from a JSON file and the environment.
+type Config struct {
+	Dir           string
+	Durability    Durability
+	GroupCommit   time.Duration
+	CacheSize     int
+	JournalSize   int
+	MaxOpenFiles  int
+	SweepInterval time.Duration
+	Watch         bool
+	KeyIndex      bool
+
+	// HTTPAddr, RESPAddr and MemcacheAddr are the addresses Serve listens
+	// on; servers without one are not started.
+	HTTPAddr     string
+	RESPAddr     string
+	MemcacheAddr string
+}
+
+// configSetting is a setting of Config, named by its key in the file and
+// overridden by its environment variable.
+type configSetting struct {
+	key string
+	env string
+	set func(c *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"dir", "GOJSONDB_DIR", func(c *Config, v string) error {
+		c.Dir = v
+		return nil
+	}},
+	{"durability", "GOJSONDB_DURABILITY", func(c *Config, v string) error {
+		switch strings.ToLower(v) {
+		case "none":
+			c.Durability = DurabilityNone
+		case "sync":
+			c.Durability = DurabilitySync
+		default:
+			return fmt.Errorf("%q is not none or sync", v)
+		}
+		return nil
+	}},
+	{"groupCommit", "GOJSONDB_GROUP_COMMIT", durationSetting(func(c *Config) *time.Duration { return &c.GroupCommit })},
+	{"cacheSize", "GOJSONDB_CACHE_SIZE", countSetting(func(c *Config) *int { return &c.CacheSize })},
+	{"journalSize", "GOJSONDB_JOURNAL_SIZE", countSetting(func(c *Config) *int { return &c.JournalSize })},
+	{"maxOpenFiles", "GOJSONDB_MAX_OPEN_FILES", countSetting(func(c *Config) *int { return &c.MaxOpenFiles })},
+	{"sweepInterval", "GOJSONDB_SWEEP_INTERVAL", durationSetting(func(c *Config) *time.Duration { return &c.SweepInterval })},
+	{"watch", "GOJSONDB_WATCH", boolSetting(func(c *Config) *bool { return &c.Watch })},
+	{"keyIndex", "GOJSONDB_KEY_INDEX", boolSetting(func(c *Config) *bool { return &c.KeyIndex })},
+	{"httpAddr", "GOJSONDB_HTTP_ADDR", addrSetting(func(c *Config) *string { return &c.HTTPAddr })},
+	{"respAddr", "GOJSONDB_RESP_ADDR", addrSetting(func(c *Config) *string { return &c.RESPAddr })},
+	{"memcacheAddr", "GOJSONDB_MEMCACHE_ADDR", addrSetting(func(c *Config) *string { return &c.MemcacheAddr })},
+}
+
+func durationSetting(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+
+		if err != nil || d < 0 {
+			return fmt.Errorf("%q is not a duration such as 500ms or 1m", v)
+		}
+
+		*field(c) = d
+		return nil
+	}
+}
+
+func countSetting(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolSetting(field func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+
+		*field(c) = b
+		return nil
+	}
+}
+
+// addrSetting takes a host:port address, or a bare port to listen on
+// every interface.
+func addrSetting(field func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		if v == "" {
+			*field(c) = ""
+			return nil
+		}
+
+		if _, err := strconv.Atoi(v); err == nil {
+			v = ":" + v
+		}
+
+		_, port, err := net.SplitHostPort(v)
+
+		if err != nil {
+			return fmt.Errorf("%q is not an address such as :8080 or localhost:8080", v)
+		}
+
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("%q has no valid port", v)
+		}
+
+		*field(c) = v
+		return nil
+	}
+}
+
+// LoadConfig reads the configuration file at path, if path is not empty,
+// and then applies the GOJSONDB_ environment variables over it, so a
+// deployment can tune the driver without recompiling. The file is a JSON
+// object of the settings to change, such as
+//
+//	{"dir": "/var/lib/db", "durability": "sync", "cacheSize": 1000, "httpAddr": ":8080"}
+//
+// Errors name the setting, and the file or variable it came from.
+func LoadConfig(path string) (*Config, error) {
+	c := &Config{}
+
+	if path != "" {
+		if err := c.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range configSettings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(c, v); err != nil {
+				return nil, fmt.Errorf("Invalid %v: %w", s.env, err)
+			}
+		}
+	}
+
+	if c.Dir == "" {
+		return nil, fmt.Errorf("Missing database directory: set dir in the configuration file or GOJSONDB_DIR")
+	}
+
+	return c, nil
+}
+
+func (c *Config) load(path string) error {
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+
+	if err := decodeNumbers(b, &values); err != nil {
+		return fmt.Errorf("Invalid configuration file %v: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, ok := findSetting(key)
+
+		if !ok {
+			return fmt.Errorf("Unknown setting %q in %v, expected one of %v", key, path, settingKeys())
+		}
+
+		var v string
+
+		switch value := values[key].(type) {
+		case string:
+			v = value
+		case json.Number:
+			v = value.String()
+		case bool:
+			v = strconv.FormatBool(value)
+		default:
+			return fmt.Errorf("Invalid %v in %v: expected a string, number or boolean", key, path)
+		}
+
+		if err := s.set(c, v); err != nil {
+			return fmt.Errorf("Invalid %v in %v: %w", key, path, err)
+		}
+	}
+
+	return nil
+}
+
+func findSetting(key string) (configSetting, bool) {
+	for _, s := range configSettings {
+		if s.key == key {
+			return s, true
+		}
+	}
+
+	return configSetting{}, false
+}
+
+func settingKeys() string {
+	keys := make([]string, len(configSettings))
+
+	for i, s := range configSettings {
+		keys[i] = s.key
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+// Options returns the driver options the configuration sets.
+func (c *Config) Options() *Options {
+	return &Options{
+		Durability:    c.Durability,
+		GroupCommit:   c.GroupCommit,
+		CacheSize:     c.CacheSize,
+		JournalSize:   c.JournalSize,
+		MaxOpenFiles:  c.MaxOpenFiles,
+		SweepInterval: c.SweepInterval,
+		Watch:         c.Watch,
+		KeyIndex:      c.KeyIndex,
+	}
+}
+
+// NewFromConfig opens the database configured by the file at path and the
+// environment, as read by LoadConfig.
+func NewFromConfig(path string) (*Driver, error) {
+	c, err := LoadConfig(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return New(c.Dir, c.Options())
+}
+
+// Serve starts the servers the configuration has addresses for in front
+// of db, returning when one of them fails.
+func (c *Config) Serve(db *Driver) error {
+	errs := make(chan error, 3)
+	started := 0
+
+	if c.HTTPAddr != "" {
+		started++
+		s := NewServer(db, nil)
+		go func() { errs <- fmt.Errorf("HTTP server: %w", s.ListenAndServe(c.HTTPAddr)) }()
+	}
+
+	if c.RESPAddr != "" {
+		started++
+		s := NewRESPServer(db, nil)
+		go func() { errs <- fmt.Errorf("RESP server: %w", s.ListenAndServe(c.RESPAddr)) }()
+	}
+
+	if c.MemcacheAddr != "" {
+		s, err := NewMemcacheServer(db, nil)
+
+		if err != nil {
+			return err
+		}
+
+		started++
+		go func() { errs <- fmt.Errorf("Memcache server: %w", s.ListenAndServe(c.MemcacheAddr)) }()
+	}
+
+	if started == 0 {
+		return fmt.Errorf("No server addresses configured")
+	}
+
+	return <-errs
+}
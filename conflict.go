@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// ConflictResolver decides what a conditional write stores when its
+// condition does not hold. existing is the stored document, nil when the
+// record does not exist, and incoming the document being written. The
+// resolver returns the document to write instead, nil to keep the existing
+// one, or an error, such as ErrConditionFailed, to fail the write.
+type ConflictResolver func(collection, resource string, existing, incoming json.RawMessage) (interface{}, error)
+
+// OnConflict has fn resolve the failed conditions of WriteIf on the records
+// of collection, rather than failing with ErrConditionFailed. A nil fn
+// removes the resolver.
+func (d *Driver) OnConflict(collection string, fn ConflictResolver) {
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.resolver = fn
+	})
+}
+
+// PreferIncoming resolves conflicts by writing the incoming document.
+func PreferIncoming(collection, resource string, existing, incoming json.RawMessage) (interface{}, error) {
+	return incoming, nil
+}
+
+// PreferExisting resolves conflicts by keeping the stored document, or
+// failing the write when there is none.
+func PreferExisting(collection, resource string, existing, incoming json.RawMessage) (interface{}, error) {
+	if existing == nil {
+		return nil, ErrConditionFailed
+	}
+
+	return nil, nil
+}
+
+// MergeIncoming resolves conflicts by merging the incoming document into
+// the stored one as a JSON merge patch (RFC 7386).
+func MergeIncoming(collection, resource string, existing, incoming json.RawMessage) (interface{}, error) {
+	var target, patch interface{}
+
+	if existing != nil {
+		if err := decodeNumbers(existing, &target); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodeNumbers(incoming, &patch); err != nil {
+		return nil, err
+	}
+
+	return mergePatch(target, patch), nil
+}
+
+// resolveConflict writes the document the resolver of collection picks for
+// a failed conditional write of v. Callers must hold the collection lock.
+func (d *Driver) resolveConflict(collection, resource string, current []byte, v interface{}) error {
+	fn := d.config(collection).resolver
+
+	if fn == nil {
+		return ErrConditionFailed
+	}
+
+	incoming, err := d.marshalDocument(collection, v)
+
+	if err != nil {
+		return err
+	}
+
+	doc, err := fn(collection, resource, current, incoming)
+
+	if err != nil {
+		return err
+	}
+
+	if doc == nil {
+		return nil
+	}
+
+	return d.write(collection, resource, doc)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CORSOptions lets browsers on other origins use a Server.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed, or "*" for any. With
+	// AllowCredentials, "*" is ignored and origins must be listed, as
+	// letting any site make credentialed requests would let it act as
+	// the user.
+	AllowedOrigins []string
+
+	// AllowedMethods defaults to the methods the server serves, and
+	// AllowedHeaders to those it reads.
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// ExposedHeaders defaults to ETag.
+	ExposedHeaders []string
+
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache the answer to a preflight.
+	MaxAge time.Duration
+}
+
+func (c *CORSOptions) allows(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if (o == "*" && !c.AllowCredentials) || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignoresWildcard reports whether AllowedOrigins holds "*", which is
+// ignored with AllowCredentials.
+func (c *CORSOptions) ignoresWildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" && c.AllowCredentials {
+			return true
+		}
+	}
+
+	return false
+}
+
+func orDefault(values []string, defaults ...string) string {
+	if len(values) == 0 {
+		values = defaults
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// wrap wraps next with the CORS policy c. Preflight requests are answered
+// without reaching next, as browsers send them without credentials.
+func (c *CORSOptions) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		if !c.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+
+		if c.AllowCredentials || !c.allows("*") {
+			h.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			h.Set("Access-Control-Expose-Headers", orDefault(c.ExposedHeaders, "ETag"))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", orDefault(c.AllowedMethods, "GET", "PUT", "DELETE"))
+		h.Set("Access-Control-Allow-Headers", orDefault(c.AllowedHeaders, "Authorization", "Content-Type", "If-Match", "If-None-Match", "X-API-Key"))
+
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", fmt.Sprint(int(c.MaxAge.Seconds())))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
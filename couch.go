@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRevs is the number of CouchDB revisions remembered for each record.
+const maxRevs = 100
+
+// revID makes the CouchDB revision of generation gen of a record. The same
+// arguments always make the same revision.
+func revID(collection, resource string, gen int, salt string) string {
+	sum := sha256.Sum256([]byte(collection + "\x00" + resource + "\x00" + strconv.Itoa(gen) + "\x00" + salt))
+	return fmt.Sprintf("%d-%s", gen, hex.EncodeToString(sum[:16]))
+}
+
+func revGen(rev string) int {
+	gen, _, _ := strings.Cut(rev, "-")
+	n, _ := strconv.Atoi(gen)
+	return n
+}
+
+// couchRevs returns the CouchDB revisions of a record, newest first. Records
+// never written through a CouchServer have revisions derived from their
+// revision numbers, so they need nothing stored.
+func couchRevs(collection, resource string, m *recordMeta) []string {
+	if len(m.Revs) > 0 {
+		return m.Revs
+	}
+
+	n := m.Revision
+
+	if n == 0 {
+		n = 1
+	}
+
+	var revs []string
+
+	for ; n > 0 && len(revs) < maxRevs; n-- {
+		revs = append(revs, revID(collection, resource, int(n), ""))
+	}
+
+	return revs
+}
+
+// pushRev adds a new revision on top of revs.
+func pushRev(collection, resource string, revs []string, salt string) []string {
+	gen := 1
+
+	if len(revs) > 0 {
+		gen = revGen(revs[0]) + 1
+	}
+
+	revs = append([]string{revID(collection, resource, gen, salt)}, revs...)
+
+	if len(revs) > maxRevs {
+		revs = revs[:maxRevs]
+	}
+
+	return revs
+}
+
+// CouchOptions configures a CouchServer.
+type CouchOptions struct {
+	// Authorize is called before every request, as for Server. Reads,
+	// including the checkpoints replicators keep in _local documents,
+	// need RoleRead; changes to documents need RoleWrite.
+	Authorize AuthorizeFunc
+
+	// LocalCollection holds the _local documents of every database, keyed
+	// by database and id. It defaults to _local.
+	LocalCollection string
+
+	// RateLimit, Burst, MaxConcurrent, MaxBodySize and ClientID limit the
+	// requests of clients as for Server, except that MaxBodySize defaults
+	// to DefaultCouchMaxBodySize. A negative MaxBodySize means no limit.
+	RateLimit     float64
+	Burst         int
+	MaxConcurrent int
+	MaxBodySize   int64
+	ClientID      func(r *http.Request) string
+}
+
+// DefaultCouchMaxBodySize is the default CouchOptions.MaxBodySize, which
+// leaves room for the batches of _bulk_docs replicators send.
+const DefaultCouchMaxBodySize = 64 << 20
+
+// CouchServer serves collections as CouchDB databases, with the subset of
+// the CouchDB API that replication uses, so that CouchDB and PouchDB can
+// replicate to and from them: database info, _changes (normal, longpoll
+// and continuous), _revs_diff, _bulk_get, _bulk_docs, _ensure_full_commit,
+// _local documents, and reading, writing and deleting documents.
+//
+// It needs Options.ChangeLog, which numbers the changes for _changes.
+// Documents keep only their latest revision, with the ones before it
+// remembered as history, and conflicting revisions replicated in are
+// resolved as CouchDB picks its winner rather than kept. Deletes made
+// while Options.Tombstones is off leave no revision to replicate.
+type CouchServer struct {
+	db     *Driver
+	opts   CouchOptions
+	limits clientLimits
+}
+
+func NewCouchServer(db *Driver, opts *CouchOptions) (*CouchServer, error) {
+	if db.changes == nil {
+		return nil, errChangeLogDisabled
+	}
+
+	s := &CouchServer{db: db}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if s.opts.LocalCollection == "" {
+		s.opts.LocalCollection = "_local"
+	}
+
+	if s.opts.MaxBodySize == 0 {
+		s.opts.MaxBodySize = DefaultCouchMaxBodySize
+	}
+
+	if err := checkCollection(s.opts.LocalCollection); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// couchDoc is the current state of a document.
+type couchDoc struct {
+	body    map[string]interface{}
+	revs    []string
+	deleted bool
+}
+
+func (c *couchDoc) rev() string {
+	return c.revs[0]
+}
+
+// json renders the document as CouchDB does, with its history when revs is
+// set.
+func (c *couchDoc) json(id string, revs bool) map[string]interface{} {
+	doc := make(map[string]interface{}, len(c.body)+4)
+
+	for k, v := range c.body {
+		doc[k] = v
+	}
+
+	doc["_id"], doc["_rev"] = id, c.rev()
+
+	if c.deleted {
+		doc["_deleted"] = true
+	}
+
+	if revs {
+		ids := make([]string, len(c.revs))
+
+		for i, rev := range c.revs {
+			_, ids[i], _ = strings.Cut(rev, "-")
+		}
+
+		doc["_revisions"] = map[string]interface{}{"start": revGen(c.rev()), "ids": ids}
+	}
+
+	return doc
+}
+
+// load returns the current state of a document, or nil when there is
+// none, deleted or not.
+func (s *CouchServer) load(db, id string) (*couchDoc, error) {
+	resource := s.db.key(id)
+
+	b, _, err := s.db.current(db, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.db.readMeta(db, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b == nil {
+		if m.Deleted == nil {
+			return nil, nil
+		}
+
+		return &couchDoc{revs: couchRevs(db, resource, m), deleted: true}, nil
+	}
+
+	var body map[string]interface{}
+
+	if err := json.Unmarshal(b, &body); err != nil {
+		// Records that are not objects are shown wrapped in one.
+		var v interface{}
+
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+
+		body = map[string]interface{}{"value": v}
+	}
+
+	return &couchDoc{body: body, revs: couchRevs(db, resource, m)}, nil
+}
+
+var errCouchConflict = errors.New("Document update conflict.")
+
+// save makes a new revision of a document, called with its current state
+// under the collection lock. decide returns the revisions the document is
+// to have, or none to leave it as it is.
+func (s *CouchServer) save(db, id string, body map[string]interface{}, deleted bool, decide func(cur *couchDoc) ([]string, error)) ([]string, error) {
+	mutex := s.db.getOrCreateMutex(db)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	cur, err := s.load(db, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	revs, err := decide(cur)
+
+	if err != nil || revs == nil {
+		return nil, err
+	}
+
+	resource := s.db.key(id)
+
+	if deleted {
+		if cur != nil && !cur.deleted {
+			if err := s.db.delete(db, resource); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		doc := make(map[string]interface{}, len(body))
+
+		for k, v := range body {
+			if !strings.HasPrefix(k, "_") {
+				doc[k] = v
+			}
+		}
+
+		if err := s.db.write(db, resource, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := s.db.readMeta(db, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A delete without tombstones leaves nothing to keep revisions in.
+	if deleted && m.Deleted == nil {
+		return revs, nil
+	}
+
+	if len(revs) > maxRevs {
+		revs = revs[:maxRevs]
+	}
+
+	m.Revs = revs
+
+	return revs, s.db.writeMeta(db, resource, m)
+}
+
+// edit makes a new revision of a document as a client editing it does:
+// rev must be its current revision, or empty for a new document.
+func (s *CouchServer) edit(db, id, rev string, body map[string]interface{}, deleted bool) (string, error) {
+	revs, err := s.save(db, id, body, deleted, func(cur *couchDoc) ([]string, error) {
+		var history []string
+
+		switch {
+		case deleted && (cur == nil || cur.deleted):
+			return nil, ErrRecordNotFound
+		case cur == nil && rev == "":
+		case cur != nil && cur.deleted && rev == "":
+			history = cur.revs
+		case cur != nil && rev == cur.rev():
+			history = cur.revs
+		default:
+			return nil, errCouchConflict
+		}
+
+		salt := make([]byte, 8)
+		rand.Read(salt)
+
+		return pushRev(db, id, history, hex.EncodeToString(salt)), nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return revs[0], nil
+}
+
+// replicate stores a revision replicated from another database, with its
+// history, newest first. A revision that does not descend from the current
+// one replaces it only when CouchDB would pick it as the winner: the one of
+// the higher generation, then of the higher id.
+func (s *CouchServer) replicate(db, id string, history []string, body map[string]interface{}, deleted bool) error {
+	_, err := s.save(db, id, body, deleted, func(cur *couchDoc) ([]string, error) {
+		if cur == nil {
+			return history, nil
+		}
+
+		for _, rev := range cur.revs {
+			if rev == history[0] {
+				return nil, nil
+			}
+		}
+
+		for _, rev := range history {
+			if rev == cur.rev() {
+				return history, nil
+			}
+		}
+
+		newer, ours := history[0], cur.rev()
+
+		if revGen(newer) > revGen(ours) || (revGen(newer) == revGen(ours) && newer > ours) {
+			return history, nil
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+func writeCouch(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeCouchError(w http.ResponseWriter, status int, name, reason string) {
+	writeCouch(w, status, map[string]string{"error": name, "reason": reason})
+}
+
+func writeCouchErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errCouchConflict):
+		writeCouchError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, ErrUnauthorized):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeCouchError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+	case errors.Is(err, ErrForbidden):
+		writeCouchError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, ErrValidation):
+		writeCouchError(w, http.StatusBadRequest, "forbidden", err.Error())
+	case errors.Is(err, ErrInvalidName):
+		writeCouchError(w, http.StatusBadRequest, "illegal_database_name", err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeCouchError(w, http.StatusNotFound, "not_found", "missing")
+	default:
+		writeCouchError(w, http.StatusInternalServerError, "internal_server_error", err.Error())
+	}
+}
+
+// limit applies the limits of the options to r, as Server.limit does, with
+// errors in the form CouchDB gives them.
+func (s *CouchServer) limit(w http.ResponseWriter, r *http.Request) (done func(), ok bool) {
+	opts := ServerOptions{
+		RateLimit:     s.opts.RateLimit,
+		Burst:         s.opts.Burst,
+		MaxConcurrent: s.opts.MaxConcurrent,
+		MaxBodySize:   s.opts.MaxBodySize,
+		ClientID:      s.opts.ClientID,
+	}
+
+	return s.limits.admit(w, r, &opts, func(status int, message string) {
+		name := "too_large"
+
+		if status == http.StatusTooManyRequests {
+			name = "too_many_requests"
+		}
+
+		writeCouchError(w, status, name, message)
+	})
+}
+
+// decodeCouch decodes the JSON body of r into v, answering the request with
+// an error and returning false when it cannot.
+func decodeCouch(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+
+	var tooLarge *http.MaxBytesError
+
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeCouchError(w, http.StatusRequestEntityTooLarge, "too_large", "Request body too large")
+	default:
+		writeCouchError(w, http.StatusBadRequest, "bad_request", err.Error())
+	}
+
+	return false
+}
+
+// couchPath splits a request path into the database, the rest of the path
+// and, for documents, their id. Ids may hold escaped slashes.
+func couchPath(r *http.Request) (db string, parts []string, err error) {
+	for _, p := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		part, err := url.PathUnescape(p)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 1 && parts[0] == "" {
+		return "", nil, nil
+	}
+
+	return parts[0], parts[1:], nil
+}
+
+func (s *CouchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	done, ok := s.limit(w, r)
+
+	if !ok {
+		return
+	}
+
+	defer done()
+
+	db, parts, err := couchPath(r)
+
+	if err != nil {
+		writeCouchError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	if db == "" {
+		writeCouch(w, http.StatusOK, map[string]interface{}{"couchdb": "Welcome", "version": "3.3.0", "vendor": map[string]string{"name": "go-json-database"}})
+		return
+	}
+
+	if err := checkCollection(db); err != nil {
+		writeCouchErr(w, err)
+		return
+	}
+
+	endpoint := ""
+
+	if len(parts) > 0 {
+		endpoint = parts[0]
+	}
+
+	if s.opts.Authorize != nil {
+		need := access(r)
+
+		switch endpoint {
+		case "_changes", "_revs_diff", "_bulk_get", "_ensure_full_commit", "_local":
+			need = RoleRead
+		}
+
+		if err := s.opts.Authorize(r, db, need); err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.info(w, db)
+	case len(parts) == 0 && r.Method == http.MethodPut:
+		writeCouch(w, http.StatusCreated, map[string]bool{"ok": true})
+	case endpoint == "_changes" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		s.changes(w, r, db)
+	case endpoint == "_revs_diff" && r.Method == http.MethodPost:
+		s.revsDiff(w, r, db)
+	case endpoint == "_bulk_get" && r.Method == http.MethodPost:
+		s.bulkGet(w, r, db)
+	case endpoint == "_bulk_docs" && r.Method == http.MethodPost:
+		s.bulkDocs(w, r, db)
+	case endpoint == "_ensure_full_commit" && r.Method == http.MethodPost:
+		writeCouch(w, http.StatusCreated, map[string]interface{}{"ok": true, "instance_start_time": "0"})
+	case endpoint == "_local" && len(parts) > 1:
+		s.local(w, r, db, strings.Join(parts[1:], "/"))
+	case strings.HasPrefix(endpoint, "_"):
+		writeCouchError(w, http.StatusNotFound, "not_found", "Not supported")
+	default:
+		s.document(w, r, db, strings.Join(parts, "/"))
+	}
+}
+
+func (s *CouchServer) info(w http.ResponseWriter, db string) {
+	count, err := s.db.Count(db)
+
+	if errors.Is(err, ErrNotFound) {
+		count, err = 0, nil
+	}
+
+	if err != nil {
+		writeCouchErr(w, err)
+		return
+	}
+
+	seq, _ := s.db.LastChange()
+
+	writeCouch(w, http.StatusOK, map[string]interface{}{
+		"db_name":             db,
+		"doc_count":           count,
+		"doc_del_count":       0,
+		"update_seq":          seq,
+		"purge_seq":           0,
+		"instance_start_time": "0",
+	})
+}
+
+type couchChange struct {
+	Seq     int64                  `json:"seq"`
+	ID      string                 `json:"id"`
+	Changes []map[string]string    `json:"changes"`
+	Deleted bool                   `json:"deleted,omitempty"`
+	Doc     map[string]interface{} `json:"doc,omitempty"`
+}
+
+// changesSince lists the documents of db changed after since, each once at
+// its latest change, and the sequence number to go on from.
+func (s *CouchServer) changesSince(db string, since int64, limit int, includeDocs bool) ([]couchChange, int64, error) {
+	changes, last, err := s.db.readChanges(since, 0)
+
+	if err != nil {
+		return nil, since, err
+	}
+
+	latest := make(map[string]int64)
+
+	for _, c := range changes {
+		if c.Collection == db {
+			latest[c.Resource] = c.Seq
+		}
+	}
+
+	ids := make([]string, 0, len(latest))
+
+	for id := range latest {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return latest[ids[i]] < latest[ids[j]] })
+
+	var results []couchChange
+
+	for _, id := range ids {
+		if limit > 0 && len(results) == limit {
+			last = results[len(results)-1].Seq
+			break
+		}
+
+		doc, err := s.load(db, id)
+
+		if err != nil {
+			return nil, since, err
+		}
+
+		if doc == nil {
+			continue
+		}
+
+		c := couchChange{Seq: latest[id], ID: id, Changes: []map[string]string{{"rev": doc.rev()}}, Deleted: doc.deleted}
+
+		if includeDocs {
+			c.Doc = doc.json(id, false)
+		}
+
+		results = append(results, c)
+	}
+
+	return results, last, nil
+}
+
+func queryMillis(q url.Values, name string, fallback time.Duration) time.Duration {
+	if ms, err := strconv.ParseInt(q.Get(name), 10, 64); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	return fallback
+}
+
+func (s *CouchServer) changes(w http.ResponseWriter, r *http.Request, db string) {
+	q := r.URL.Query()
+
+	var since int64
+
+	switch v := q.Get("since"); v {
+	case "", "0":
+	case "now":
+		since, _ = s.db.LastChange()
+	default:
+		// Sequences may come back in the "N-opaque" form of CouchDB 2.
+		n, err := strconv.ParseInt(strings.SplitN(v, "-", 2)[0], 10, 64)
+
+		if err != nil {
+			writeCouchError(w, http.StatusBadRequest, "bad_request", "Invalid since")
+			return
+		}
+
+		since = n
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	includeDocs := q.Get("include_docs") == "true"
+	timeout := queryMillis(q, "timeout", time.Minute)
+	heartbeat := queryMillis(q, "heartbeat", 0)
+	feed := q.Get("feed")
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if feed == "continuous" {
+		s.continuous(ctx, w, db, since, includeDocs, heartbeat)
+		return
+	}
+
+	for {
+		results, last, err := s.changesSince(db, since, limit, includeDocs)
+
+		if err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		if len(results) > 0 || feed != "longpoll" || s.db.WaitChanges(ctx, last) != nil {
+			if results == nil {
+				results = []couchChange{}
+			}
+
+			writeCouch(w, http.StatusOK, map[string]interface{}{"results": results, "last_seq": last, "pending": 0})
+			return
+		}
+
+		since = last
+	}
+}
+
+// continuous streams changes a line each until ctx is done, writing blank
+// lines as heartbeats in between.
+func (s *CouchServer) continuous(ctx context.Context, w http.ResponseWriter, db string, since int64, includeDocs bool, heartbeat time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	for {
+		results, last, err := s.changesSince(db, since, 0, includeDocs)
+
+		if err != nil {
+			return
+		}
+
+		for _, c := range results {
+			enc.Encode(c)
+		}
+
+		since = last
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		wait, cancel := ctx, context.CancelFunc(func() {})
+
+		if heartbeat > 0 {
+			wait, cancel = context.WithTimeout(ctx, heartbeat)
+		}
+
+		err = s.db.WaitChanges(wait, since)
+		cancel()
+
+		if ctx.Err() != nil {
+			enc.Encode(map[string]int64{"last_seq": since})
+			return
+		}
+
+		if err != nil {
+			w.Write([]byte("\n"))
+		}
+	}
+}
+
+func (s *CouchServer) revsDiff(w http.ResponseWriter, r *http.Request, db string) {
+	var req map[string][]string
+
+	if !decodeCouch(w, r, &req) {
+		return
+	}
+
+	diff := make(map[string]interface{})
+
+	for id, revs := range req {
+		doc, err := s.load(db, id)
+
+		if err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		known := make(map[string]bool)
+
+		if doc != nil {
+			for _, rev := range doc.revs {
+				known[rev] = true
+			}
+		}
+
+		var missing []string
+
+		for _, rev := range revs {
+			if !known[rev] {
+				missing = append(missing, rev)
+			}
+		}
+
+		if len(missing) > 0 {
+			diff[id] = map[string][]string{"missing": missing}
+		}
+	}
+
+	writeCouch(w, http.StatusOK, diff)
+}
+
+func (s *CouchServer) bulkGet(w http.ResponseWriter, r *http.Request, db string) {
+	var req struct {
+		Docs []struct {
+			ID  string `json:"id"`
+			Rev string `json:"rev"`
+		} `json:"docs"`
+	}
+
+	if !decodeCouch(w, r, &req) {
+		return
+	}
+
+	revs := r.URL.Query().Get("revs") == "true"
+	results := make([]interface{}, 0, len(req.Docs))
+
+	for _, want := range req.Docs {
+		doc, err := s.load(db, want.ID)
+
+		if err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		var found interface{}
+
+		// Only the latest revision of a document is kept.
+		if doc != nil && (want.Rev == "" || want.Rev == doc.rev()) {
+			found = map[string]interface{}{"ok": doc.json(want.ID, revs)}
+		} else {
+			found = map[string]interface{}{"error": map[string]string{"id": want.ID, "rev": want.Rev, "error": "not_found", "reason": "missing"}}
+		}
+
+		results = append(results, map[string]interface{}{"id": want.ID, "docs": []interface{}{found}})
+	}
+
+	writeCouch(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// docHistory returns the revisions of a replicated document, newest first,
+// from its _revisions or else its _rev.
+func docHistory(doc map[string]interface{}) []string {
+	if revisions, ok := doc["_revisions"].(map[string]interface{}); ok {
+		start, _ := revisions["start"].(float64)
+		ids, _ := revisions["ids"].([]interface{})
+
+		var history []string
+
+		for i, id := range ids {
+			if s, ok := id.(string); ok {
+				history = append(history, fmt.Sprintf("%d-%s", int(start)-i, s))
+			}
+		}
+
+		if len(history) > 0 {
+			return history
+		}
+	}
+
+	if rev, ok := doc["_rev"].(string); ok && rev != "" {
+		return []string{rev}
+	}
+
+	return nil
+}
+
+func (s *CouchServer) bulkDocs(w http.ResponseWriter, r *http.Request, db string) {
+	var req struct {
+		Docs     []map[string]interface{} `json:"docs"`
+		NewEdits *bool                    `json:"new_edits"`
+	}
+
+	if !decodeCouch(w, r, &req) {
+		return
+	}
+
+	newEdits := req.NewEdits == nil || *req.NewEdits
+	results := make([]interface{}, 0, len(req.Docs))
+
+	for _, doc := range req.Docs {
+		id, _ := doc["_id"].(string)
+		rev, _ := doc["_rev"].(string)
+		deleted, _ := doc["_deleted"].(bool)
+
+		if id == "" && newEdits {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		var err error
+
+		switch {
+		case id == "" || strings.HasPrefix(id, "_"):
+			err = fmt.Errorf("%w: document id %q", ErrInvalidName, id)
+		case newEdits:
+			rev, err = s.edit(db, id, rev, doc, deleted)
+		case docHistory(doc) == nil:
+			err = fmt.Errorf("%w: missing _rev of %q", ErrValidation, id)
+		default:
+			err = s.replicate(db, id, docHistory(doc), doc, deleted)
+		}
+
+		switch {
+		case err == nil && newEdits:
+			results = append(results, map[string]interface{}{"ok": true, "id": id, "rev": rev})
+		case errors.Is(err, errCouchConflict):
+			results = append(results, map[string]string{"id": id, "error": "conflict", "reason": err.Error()})
+		case err != nil:
+			results = append(results, map[string]string{"id": id, "error": "forbidden", "reason": err.Error()})
+		}
+	}
+
+	writeCouch(w, http.StatusCreated, results)
+}
+
+func (s *CouchServer) document(w http.ResponseWriter, r *http.Request, db, id string) {
+	q := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		doc, err := s.load(db, id)
+
+		if err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		revs := q.Get("revs") == "true"
+
+		if openRevs := q.Get("open_revs"); openRevs != "" {
+			var wanted []string
+
+			if openRevs != "all" {
+				if err := json.Unmarshal([]byte(openRevs), &wanted); err != nil {
+					writeCouchError(w, http.StatusBadRequest, "bad_request", "Invalid open_revs")
+					return
+				}
+			}
+
+			results := []interface{}{}
+
+			if doc != nil && openRevs == "all" {
+				results = append(results, map[string]interface{}{"ok": doc.json(id, revs)})
+			}
+
+			for _, rev := range wanted {
+				if doc != nil && rev == doc.rev() {
+					results = append(results, map[string]interface{}{"ok": doc.json(id, revs)})
+				} else {
+					results = append(results, map[string]string{"missing": rev})
+				}
+			}
+
+			writeCouch(w, http.StatusOK, results)
+			return
+		}
+
+		if doc == nil || doc.deleted {
+			reason := "missing"
+
+			if doc != nil {
+				reason = "deleted"
+			}
+
+			writeCouchError(w, http.StatusNotFound, "not_found", reason)
+			return
+		}
+
+		if rev := q.Get("rev"); rev != "" && rev != doc.rev() {
+			writeCouchError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+
+		w.Header().Set("ETag", `"`+doc.rev()+`"`)
+		writeCouch(w, http.StatusOK, doc.json(id, revs))
+
+	case http.MethodPut, http.MethodDelete:
+		var body map[string]interface{}
+
+		if r.Method == http.MethodPut {
+			if !decodeCouch(w, r, &body) {
+				return
+			}
+		}
+
+		rev := q.Get("rev")
+
+		if v, ok := body["_rev"].(string); ok && rev == "" {
+			rev = v
+		}
+
+		if v := r.Header.Get("If-Match"); v != "" && rev == "" {
+			rev = strings.Trim(v, `"`)
+		}
+
+		deleted, _ := body["_deleted"].(bool)
+
+		if strings.HasPrefix(id, "_") {
+			writeCouchError(w, http.StatusBadRequest, "bad_request", "Only reserved document ids may start with underscore.")
+			return
+		}
+
+		if q.Get("new_edits") == "false" {
+			if history := docHistory(body); history != nil {
+				if err := s.replicate(db, id, history, body, deleted); err != nil {
+					writeCouchErr(w, err)
+					return
+				}
+
+				writeCouch(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": history[0]})
+				return
+			}
+		}
+
+		rev, err := s.edit(db, id, rev, body, deleted || r.Method == http.MethodDelete)
+
+		if err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", `"`+rev+`"`)
+		writeCouch(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": rev})
+
+	default:
+		writeCouchError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+// local serves the _local documents of db, which replicators keep their
+// checkpoints in. They are not replicated and keep no revisions.
+func (s *CouchServer) local(w http.ResponseWriter, r *http.Request, db, id string) {
+	resource := db + "/" + id
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var doc map[string]interface{}
+
+		if err := s.db.Read(s.opts.LocalCollection, resource, &doc); err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		doc["_id"], doc["_rev"] = "_local/"+id, "0-1"
+		writeCouch(w, http.StatusOK, doc)
+
+	case http.MethodPut:
+		var doc map[string]interface{}
+
+		if !decodeCouch(w, r, &doc) {
+			return
+		}
+
+		for k := range doc {
+			if strings.HasPrefix(k, "_") {
+				delete(doc, k)
+			}
+		}
+
+		if err := s.db.Write(s.opts.LocalCollection, resource, doc); err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		writeCouch(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": "_local/" + id, "rev": "0-1"})
+
+	case http.MethodDelete:
+		if err := s.db.Delete(s.opts.LocalCollection, resource); err != nil {
+			writeCouchErr(w, err)
+			return
+		}
+
+		writeCouch(w, http.StatusOK, map[string]interface{}{"ok": true, "id": "_local/" + id, "rev": "0-0"})
+
+	default:
+		writeCouchError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CRDTKind is the conflict-free replicated data type the records of a
+// collection hold. Changes to them made on different replicas, each with
+// its own Options.NodeID, merge to the same value whatever order they are
+// merged in.
+type CRDTKind string
+
+const (
+	// CRDTMap records are maps whose fields keep the last value written,
+	// as ordered by the clocks stamped on the writes.
+	CRDTMap CRDTKind = "lww-map"
+
+	// CRDTSet records are sets where an element added concurrently with
+	// its removal stays in the set.
+	CRDTSet CRDTKind = "or-set"
+
+	// CRDTCounter records are counters that can be incremented and
+	// decremented on each replica.
+	CRDTCounter CRDTKind = "counter"
+)
+
+// crdtState is the stored form of a CRDT record; only the fields of its
+// kind are used.
+type crdtState struct {
+	Kind CRDTKind `json:"crdt"`
+
+	Fields map[string]*lwwEntry `json:"fields,omitempty"`
+
+	Elements map[string]*setElement `json:"elements,omitempty"`
+	Removed  map[string]bool        `json:"removed,omitempty"`
+
+	Increments map[string]int64 `json:"increments,omitempty"`
+	Decrements map[string]int64 `json:"decrements,omitempty"`
+}
+
+type lwwEntry struct {
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Clock   HLC             `json:"clock"`
+}
+
+// setElement is an element of a set together with the tags of the adds
+// that put it there and have not been removed.
+type setElement struct {
+	Value json.RawMessage `json:"value"`
+	Tags  []string        `json:"tags"`
+}
+
+// SetCRDT makes collection hold CRDT records of kind, changed with the
+// CRDT methods and read with ReadCRDT. An empty kind makes it a plain
+// collection again; the records already stored are left as they are.
+func (d *Driver) SetCRDT(collection string, kind CRDTKind) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	switch kind {
+	case "", CRDTMap, CRDTSet, CRDTCounter:
+	default:
+		return fmt.Errorf("Unknown CRDT %q", kind)
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.crdt = kind
+	})
+
+	return nil
+}
+
+// CRDTPut sets field of a CRDTMap record to v.
+func (d *Driver) CRDTPut(collection, resource, field string, v interface{}) error {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return d.updateCRDT(collection, resource, CRDTMap, func(s *crdtState) {
+		s.Fields[field] = &lwwEntry{Value: b, Clock: d.clock.now(s.fieldClock(field))}
+	})
+}
+
+// CRDTDelete removes field from a CRDTMap record.
+func (d *Driver) CRDTDelete(collection, resource, field string) error {
+	return d.updateCRDT(collection, resource, CRDTMap, func(s *crdtState) {
+		s.Fields[field] = &lwwEntry{Deleted: true, Clock: d.clock.now(s.fieldClock(field))}
+	})
+}
+
+// CRDTAdd adds v to a CRDTSet record.
+func (d *Driver) CRDTAdd(collection, resource string, v interface{}) error {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	key := normalizedKey(v)
+
+	return d.updateCRDT(collection, resource, CRDTSet, func(s *crdtState) {
+		e := s.Elements[key]
+
+		if e == nil {
+			e = &setElement{Value: b}
+			s.Elements[key] = e
+		}
+
+		e.Tags = append(e.Tags, d.clock.now(nil).String())
+	})
+}
+
+// CRDTRemove removes v from a CRDTSet record, as far as the adds this
+// replica has seen are concerned.
+func (d *Driver) CRDTRemove(collection, resource string, v interface{}) error {
+	key := normalizedKey(v)
+
+	return d.updateCRDT(collection, resource, CRDTSet, func(s *crdtState) {
+		if e := s.Elements[key]; e != nil {
+			for _, tag := range e.Tags {
+				s.Removed[tag] = true
+			}
+
+			delete(s.Elements, key)
+		}
+	})
+}
+
+// CRDTIncrement adds delta, which may be negative, to a CRDTCounter record.
+func (d *Driver) CRDTIncrement(collection, resource string, delta int64) error {
+	return d.updateCRDT(collection, resource, CRDTCounter, func(s *crdtState) {
+		if delta >= 0 {
+			s.Increments[d.opts.NodeID] += delta
+		} else {
+			s.Decrements[d.opts.NodeID] -= delta
+		}
+	})
+}
+
+// MergeCRDT merges state, a CRDT record as stored by another replica and
+// read there with ReadRaw, into the record of the same name.
+func (d *Driver) MergeCRDT(collection, resource string, state json.RawMessage) error {
+	var remote crdtState
+
+	if err := json.Unmarshal(state, &remote); err != nil {
+		return fmt.Errorf("Invalid CRDT state: %w", err)
+	}
+
+	if remote.Kind == "" {
+		return fmt.Errorf("Invalid CRDT state: missing kind")
+	}
+
+	remote.init()
+
+	for _, f := range remote.Fields {
+		d.ObserveClock(f.Clock)
+	}
+
+	return d.updateCRDT(collection, resource, remote.Kind, func(s *crdtState) {
+		s.merge(&remote)
+	})
+}
+
+// ReadCRDT decodes the value of a CRDT record into v: an object for a
+// CRDTMap, an array ordered by value for a CRDTSet and a number for a
+// CRDTCounter.
+func (d *Driver) ReadCRDT(collection, resource string, v interface{}) error {
+	b, err := d.ReadRaw(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	var s crdtState
+
+	if err := json.Unmarshal(b, &s); err != nil || s.Kind == "" {
+		return fmt.Errorf("%v/%v is not a CRDT", collection, resource)
+	}
+
+	if b, err = json.Marshal(s.value()); err != nil {
+		return err
+	}
+
+	return d.decode(collection, b, v)
+}
+
+func (d *Driver) updateCRDT(collection, resource string, kind CRDTKind, fn func(s *crdtState)) (err error) {
+	defer d.observe(time.Now(), &err, "update", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	if kind == "" || d.config(collection).crdt != kind {
+		return fmt.Errorf("Collection %v does not hold %v CRDTs", collection, kind)
+	}
+
+	resource = d.key(resource)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, _, err := d.current(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	s := &crdtState{Kind: kind}
+
+	if current != nil {
+		if err := json.Unmarshal(current, s); err != nil {
+			return err
+		}
+
+		if s.Kind != kind {
+			return fmt.Errorf("%v/%v is not a %v CRDT", collection, resource, kind)
+		}
+	}
+
+	s.init()
+	fn(s)
+
+	return d.write(collection, resource, s)
+}
+
+func (s *crdtState) init() {
+	if s.Fields == nil {
+		s.Fields = make(map[string]*lwwEntry)
+	}
+
+	if s.Elements == nil {
+		s.Elements = make(map[string]*setElement)
+	}
+
+	if s.Removed == nil {
+		s.Removed = make(map[string]bool)
+	}
+
+	if s.Increments == nil {
+		s.Increments = make(map[string]int64)
+	}
+
+	if s.Decrements == nil {
+		s.Decrements = make(map[string]int64)
+	}
+}
+
+func (s *crdtState) fieldClock(field string) *HLC {
+	if e := s.Fields[field]; e != nil {
+		return &e.Clock
+	}
+
+	return nil
+}
+
+func (s *crdtState) merge(o *crdtState) {
+	for field, e := range o.Fields {
+		if cur := s.Fields[field]; cur == nil || cur.Clock.Compare(e.Clock) < 0 {
+			s.Fields[field] = e
+		}
+	}
+
+	for tag := range o.Removed {
+		s.Removed[tag] = true
+	}
+
+	for key, e := range o.Elements {
+		cur := s.Elements[key]
+
+		if cur == nil {
+			cur = &setElement{Value: e.Value}
+			s.Elements[key] = cur
+		}
+
+		cur.Tags = append(cur.Tags, e.Tags...)
+	}
+
+	// Tags removed on either side are dropped from the elements; an element
+	// left without tags is no longer in the set.
+	for key, e := range s.Elements {
+		seen := make(map[string]bool, len(e.Tags))
+		tags := e.Tags[:0]
+
+		for _, tag := range e.Tags {
+			if !s.Removed[tag] && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+
+		sort.Strings(tags)
+		e.Tags = tags
+
+		if len(tags) == 0 {
+			delete(s.Elements, key)
+		}
+	}
+
+	for node, n := range o.Increments {
+		if n > s.Increments[node] {
+			s.Increments[node] = n
+		}
+	}
+
+	for node, n := range o.Decrements {
+		if n > s.Decrements[node] {
+			s.Decrements[node] = n
+		}
+	}
+}
+
+func (s *crdtState) value() interface{} {
+	switch s.Kind {
+	case CRDTMap:
+		m := make(map[string]json.RawMessage)
+
+		for field, e := range s.Fields {
+			if !e.Deleted {
+				m[field] = e.Value
+			}
+		}
+
+		return m
+
+	case CRDTSet:
+		keys := make([]string, 0, len(s.Elements))
+
+		for key := range s.Elements {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		values := make([]json.RawMessage, len(keys))
+
+		for i, key := range keys {
+			values[i] = s.Elements[key].Value
+		}
+
+		return values
+	}
+
+	var n int64
+
+	for _, i := range s.Increments {
+		n += i
+	}
+
+	for _, i := range s.Decrements {
+		n -= i
+	}
+
+	return n
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DebugReport is a snapshot of the driver's internal state, for diagnosing
+// a running database.
+type DebugReport struct {
+	// Locks lists the collections whose lock is held or waited for.
+	Locks []CollectionLock `json:"locks"`
+
+	// TxWaits counts the transactions waiting for a lock held by another.
+	TxWaits int `json:"txWaits"`
+
+	Cache CacheStats `json:"cache"`
+
+	// Snapshots lists the snapshots and read transactions not yet closed,
+	// oldest first.
+	Snapshots []time.Time `json:"snapshots"`
+}
+
+type CollectionLock struct {
+	Collection string `json:"collection"`
+	Held       bool   `json:"held"`
+
+	// Tx tells whether a transaction holds the lock.
+	Tx      bool `json:"tx"`
+	Waiting int  `json:"waiting"`
+}
+
+type CacheStats struct {
+	Capacity int   `json:"capacity"`
+	Entries  int   `json:"entries"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+
+	// TierHits counts the memory cache misses served by CacheTiers.
+	TierHits int64 `json:"tierHits"`
+}
+
+// Debug reports the locks held and waited for, the record cache and the
+// open snapshots. The locks are seen one at a time, so the report is not
+// a consistent view of them.
+func (d *Driver) Debug() (DebugReport, error) {
+	report := DebugReport{Locks: []CollectionLock{}, Snapshots: []time.Time{}}
+
+	d.mutex.Lock()
+	mutexes := make(map[string]*collectionMutex, len(d.mutexes))
+
+	for collection, m := range d.mutexes {
+		mutexes[collection] = m
+	}
+
+	d.mutex.Unlock()
+
+	d.locks.mutex.Lock()
+	owned := make(map[string]bool, len(d.locks.owners))
+
+	for collection := range d.locks.owners {
+		owned[collection] = true
+	}
+
+	report.TxWaits = len(d.locks.waits)
+	d.locks.mutex.Unlock()
+
+	for collection, m := range mutexes {
+		l := CollectionLock{Collection: collection, Tx: owned[collection], Waiting: int(atomic.LoadInt32(&m.waiting))}
+
+		if m.Mutex.TryLock() {
+			m.Mutex.Unlock()
+		} else {
+			l.Held = true
+		}
+
+		if l.Held || l.Tx || l.Waiting > 0 {
+			report.Locks = append(report.Locks, l)
+		}
+	}
+
+	sort.Slice(report.Locks, func(i, j int) bool { return report.Locks[i].Collection < report.Locks[j].Collection })
+
+	report.Cache = d.cache.stats()
+
+	files, err := d.readDir(filepath.Join(d.dir, snapshotsDir))
+
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+
+	for _, file := range files {
+		if ns, err := strconv.ParseInt(file.Name(), 10, 64); err == nil && file.IsDir() {
+			report.Snapshots = append(report.Snapshots, time.Unix(0, ns))
+		}
+	}
+
+	sort.Slice(report.Snapshots, func(i, j int) bool { return report.Snapshots[i].Before(report.Snapshots[j]) })
+
+	return report, nil
+}
+
+// serveDebug serves the profiles of net/http/pprof under /debug/pprof/ and
+// the report of Debug at /debug/db, when the server is set up to.
+func (s *Server) serveDebug(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.Debug || (r.URL.Path != "/debug/db" && !strings.HasPrefix(r.URL.Path, "/debug/pprof/")) {
+		return false
+	}
+
+	if s.opts.Authorize != nil {
+		if err := s.opts.Authorize(r, "*", RoleAdmin); err != nil {
+			writeError(w, err)
+			return true
+		}
+	}
+
+	switch r.URL.Path {
+	case "/debug/db":
+		report, err := s.db.Debug()
+
+		if err != nil {
+			writeError(w, err)
+			return true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(report)
+
+	case "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+
+	return true
+}
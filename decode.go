@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts of DecodeOptions.TimeFormats for timestamps stored as numbers of
+// seconds or milliseconds since the Unix epoch.
+const (
+	TimeUnix      = "unix"
+	TimeUnixMilli = "unixmilli"
+)
+
+type DecodeOptions struct {
+	// Strict fails decoding of documents with fields the value decoded into
+	// has no place for, instead of ignoring them.
+	Strict bool
+
+	// CoerceNumbers decodes numbers stored as strings into number fields,
+	// and numbers into string fields.
+	CoerceNumbers bool
+
+	// TimeFormats are the layouts, besides RFC 3339, accepted for
+	// time.Time fields, tried in order.
+	TimeFormats []string
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// SetDecodeOptions changes how the records of collection are decoded into
+// Go values by Read and the other methods that decode. A nil DecodeOptions
+// restores the default of encoding/json.
+func (d *Driver) SetDecodeOptions(collection string, opts *DecodeOptions) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	var o *DecodeOptions
+
+	if opts != nil {
+		o = &DecodeOptions{Strict: opts.Strict, CoerceNumbers: opts.CoerceNumbers}
+		o.TimeFormats = append(o.TimeFormats, opts.TimeFormats...)
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.decode = o
+	})
+
+	return nil
+}
+
+// decode unmarshals records of collection into v according to the decode
+// options of the collection.
+func (d *Driver) decode(collection string, b []byte, v interface{}) error {
+	o := d.config(collection).decode
+
+	if o == nil {
+		return json.Unmarshal(b, v)
+	}
+
+	if o.CoerceNumbers || len(o.TimeFormats) > 0 {
+		var doc interface{}
+
+		if err := decodeNumbers(b, &doc); err != nil {
+			return err
+		}
+
+		if t := reflect.TypeOf(v); t != nil {
+			doc = o.conform(doc, t)
+		}
+
+		var err error
+
+		if b, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	if o.Strict {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec.Decode(v)
+}
+
+// conform rewrites the decoded JSON value doc so encoding/json accepts it
+// for type t, coercing the values the options allow.
+func (o *DecodeOptions) conform(doc interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return o.conformTime(doc)
+	}
+
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return doc
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if n, ok := doc.(json.Number); ok && o.CoerceNumbers {
+			return n.String()
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if s, ok := doc.(string); ok && o.CoerceNumbers {
+			s = strings.TrimSpace(s)
+
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				return json.Number(s)
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		if items, ok := doc.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = o.conform(item, t.Elem())
+			}
+		}
+
+	case reflect.Map:
+		if m, ok := doc.(map[string]interface{}); ok {
+			for k, item := range m {
+				m[k] = o.conform(item, t.Elem())
+			}
+		}
+
+	case reflect.Struct:
+		if m, ok := doc.(map[string]interface{}); ok {
+			for k, item := range m {
+				if f, ok := jsonField(t, k); ok {
+					m[k] = o.conform(item, f.Type)
+				}
+			}
+		}
+	}
+
+	return doc
+}
+
+func (o *DecodeOptions) conformTime(doc interface{}) interface{} {
+	var t time.Time
+
+	switch v := doc.(type) {
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return doc
+		}
+
+		for _, layout := range o.TimeFormats {
+			if layout == TimeUnix || layout == TimeUnixMilli {
+				continue
+			}
+
+			if parsed, err := time.Parse(layout, v); err == nil {
+				t = parsed
+				break
+			}
+		}
+
+	case json.Number:
+		n, err := v.Int64()
+
+		if err != nil {
+			return doc
+		}
+
+		for _, layout := range o.TimeFormats {
+			if layout == TimeUnix {
+				t = time.Unix(n, 0).UTC()
+				break
+			}
+
+			if layout == TimeUnixMilli {
+				t = time.UnixMilli(n).UTC()
+				break
+			}
+		}
+	}
+
+	if t.IsZero() {
+		return doc
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+// jsonField finds the field of struct type t that encoding/json decodes
+// the key into: the one named key by its tag or its name, or failing that
+// one matching key regardless of case.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var (
+		fold   reflect.StructField
+		folded bool
+	)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				if e, ok := jsonField(ft, key); ok {
+					if jsonName(e) == key {
+						return e, true
+					}
+
+					if !folded {
+						fold, folded = e, true
+					}
+				}
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name := jsonName(f); name == key {
+			return f, true
+		} else if !folded && strings.EqualFold(name, key) {
+			fold, folded = f, true
+		}
+	}
+
+	return fold, folded
+}
+
+func jsonName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+
+	return f.Name
+}
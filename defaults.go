@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// SetDefaults registers values for fields of the documents of collection,
+// written in place of the field when it is missing or holds a zero value:
+// null, false, 0 or "". Fields may name nested fields with dots. Nil
+// defaults remove them.
+//
+// Struct fields can also carry their defaults in a tag, as in
+// `default:"10"`, applied to a copy of the value before it is written.
+func (d *Driver) SetDefaults(collection string, defaults map[string]interface{}) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	normalized := make(map[string]interface{}, len(defaults))
+
+	for field, v := range defaults {
+		if field == "" {
+			return fmt.Errorf("Missing field")
+		}
+
+		b, err := json.Marshal(v)
+
+		if err != nil {
+			return fmt.Errorf("Invalid default for %v: %w", field, err)
+		}
+
+		var value interface{}
+
+		if err := decodeNumbers(b, &value); err != nil {
+			return err
+		}
+
+		normalized[field] = value
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.defaults = normalized
+	})
+
+	return nil
+}
+
+// marshalDocument encodes a document about to be written to collection,
+// with its defaults filled in, once it passes validation.
+func (d *Driver) marshalDocument(collection string, v interface{}) ([]byte, error) {
+	v, err := withDefaults(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validate(v); err != nil {
+		return nil, err
+	}
+
+	b, err := marshalRecord(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = d.applyDefaults(collection, b); err != nil {
+		return nil, err
+	}
+
+	if err := d.runValidator(collection, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// rewritesDocuments reports whether writing a document to collection does
+// more than store its JSON as is: marshalDocument fills in defaults and runs
+// the schema and validator, encodeRecord compresses, encrypts, signs and
+// chunks it, and the write updates indexes, history and listeners. Only
+// when it does not can a document be streamed to disk unread.
+func (d *Driver) rewritesDocuments(collection string) bool {
+	cfg := d.config(collection)
+
+	if len(cfg.defaults) > 0 || cfg.schema != nil || cfg.validator != nil || cfg.subjectField != "" {
+		return true
+	}
+
+	if enc, _ := d.encryption(collection); enc != nil || d.compression(collection) != "" {
+		return true
+	}
+
+	if len(d.opts.SigningKey) > 0 || d.opts.ChunkSize > 0 || d.opts.History || d.listening() {
+		return true
+	}
+
+	return len(d.collectionIndexes(collection)) > 0
+}
+
+// withDefaults returns v with the defaults of its struct tags filled in,
+// without modifying the value the caller passed.
+func withDefaults(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct || !hasDefaults(rv.Type()) {
+		return v, nil
+	}
+
+	c := reflect.New(rv.Type()).Elem()
+	c.Set(rv)
+
+	if err := setDefaults(c); err != nil {
+		return nil, err
+	}
+
+	return c.Addr().Interface(), nil
+}
+
+func hasDefaults(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if _, ok := f.Tag.Lookup("default"); ok {
+			return true
+		}
+
+		ft := f.Type
+
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() == reflect.Struct && ft != timeType && hasDefaults(ft) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setDefaults fills the zero fields of the addressable struct v from their
+// default tags, copying nested structs reached through pointers before
+// filling them in.
+func setDefaults(v reflect.Value) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+
+		if !fv.CanSet() {
+			continue
+		}
+
+		if tag, ok := f.Tag.Lookup("default"); ok && fv.IsZero() {
+			if err := parseDefault(fv, tag); err != nil {
+				return fmt.Errorf("Invalid default %q of %v: %w", tag, f.Name, err)
+			}
+			continue
+		}
+
+		switch {
+		case f.Type.Kind() == reflect.Struct && f.Type != timeType:
+			if err := setDefaults(fv); err != nil {
+				return err
+			}
+
+		case f.Type.Kind() == reflect.Ptr && !fv.IsNil() && f.Type.Elem().Kind() == reflect.Struct && hasDefaults(f.Type.Elem()):
+			c := reflect.New(f.Type.Elem())
+			c.Elem().Set(fv.Elem())
+
+			if err := setDefaults(c.Elem()); err != nil {
+				return err
+			}
+
+			fv.Set(c)
+		}
+	}
+
+	return nil
+}
+
+func parseDefault(v reflect.Value, tag string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(tag)
+
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(int64(d))
+
+		return nil
+
+	case v.Kind() == reflect.String:
+		v.SetString(tag)
+		return nil
+	}
+
+	p := reflect.New(v.Type())
+
+	if err := json.Unmarshal([]byte(tag), p.Interface()); err != nil {
+		// Values such as timestamps are JSON strings, written without
+		// their quotes in tags.
+		if json.Unmarshal([]byte(strconv.Quote(tag)), p.Interface()) != nil {
+			return err
+		}
+	}
+
+	v.Set(p.Elem())
+
+	return nil
+}
+
+// applyDefaults writes the registered defaults of collection into the
+// zero fields of the encoded document b.
+func (d *Driver) applyDefaults(collection string, b []byte) ([]byte, error) {
+	defaults := d.config(collection).defaults
+
+	if len(defaults) == 0 {
+		return b, nil
+	}
+
+	var doc map[string]interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil || doc == nil {
+		// Only objects have fields to default.
+		return b, nil
+	}
+
+	fields := make([]string, 0, len(defaults))
+
+	for field := range defaults {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+	changed := false
+
+	for _, field := range fields {
+		if v, ok := lookupField(doc, field); ok && !isZeroJSON(v) {
+			continue
+		}
+
+		setPath(doc, strings.Split(field, "."), defaults[field])
+		changed = true
+	}
+
+	if !changed {
+		return b, nil
+	}
+
+	return marshalRecord(doc)
+}
+
+func isZeroJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	}
+
+	return false
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing writes to disk to the operating system,
+	// so a crash can lose recent writes.
+	DurabilityNone Durability = iota
+
+	// DurabilitySync flushes each write, and the directory entry that
+	// publishes it, to disk before the write returns.
+	DurabilitySync
+)
+
+// syncer flushes paths to disk. With a group commit window, the syncs of
+// concurrent writers are collected for that long and flushed together, with
+// a single filesystem-wide sync where the platform has one.
+type syncer struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	pending *syncBatch
+}
+
+type syncBatch struct {
+	paths map[string]bool
+	done  chan struct{}
+	err   error
+}
+
+func (s *syncer) sync(dir string, paths ...string) error {
+	if s.window <= 0 {
+		return syncPaths(dir, paths)
+	}
+
+	b := s.enqueue(dir, paths...)
+	<-b.done
+
+	return b.err
+}
+
+// enqueue adds paths to the pending batch, starting one if need be, and
+// returns it without waiting for it to be flushed.
+func (s *syncer) enqueue(dir string, paths ...string) *syncBatch {
+	s.mutex.Lock()
+
+	b := s.pending
+
+	if b == nil {
+		b = &syncBatch{paths: make(map[string]bool), done: make(chan struct{})}
+		s.pending = b
+
+		time.AfterFunc(s.window, func() { s.flush(dir) })
+	}
+
+	for _, path := range paths {
+		b.paths[path] = true
+	}
+
+	s.mutex.Unlock()
+
+	return b
+}
+
+func (s *syncer) flush(dir string) {
+	s.mutex.Lock()
+	b := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	paths := make([]string, 0, len(b.paths))
+
+	for path := range b.paths {
+		paths = append(paths, path)
+	}
+
+	b.err = syncPaths(dir, paths)
+	close(b.done)
+}
+
+// WriteDurable writes a record and flushes it to disk before returning,
+// whatever Options.Durability says.
+func (d *Driver) WriteDurable(collection, resource string, v interface{}) error {
+	return d.writeWith(collection, resource, v, DurabilitySync)
+}
+
+// WriteBuffered writes a record and leaves flushing it to the operating
+// system, whatever Options.Durability says.
+func (d *Driver) WriteBuffered(collection, resource string, v interface{}) error {
+	return d.writeWith(collection, resource, v, DurabilityNone)
+}
+
+func (d *Driver) writeWith(collection, resource string, v interface{}, durability Durability) (err error) {
+	defer d.observe(time.Now(), &err, "write", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	if durability == DurabilitySync {
+		return d.writeStaged(collection, resource, v, durability)
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.journaled(OpWrite, collection, resource, func() error {
+		return d.storeWith(collection, resource, v, durability)
+	})
+}
+
+// writeStaged writes a record without waiting on the disk while holding the
+// collection lock: the stored bytes are written and synced to a staged file
+// before the lock is taken, and the sync of the directory after the rename
+// is waited for once it is released. Concurrent writers to a collection so
+// share group commits instead of taking turns at them.
+func (d *Driver) writeStaged(collection, resource string, v interface{}, durability Durability) (err error) {
+	path := d.recordPath(collection, resource)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	b, stored, err := d.encodeDocument(collection, resource, v)
+
+	if err != nil {
+		return err
+	}
+
+	staged := d.stagePath(path)
+
+	defer func() {
+		if err != nil {
+			os.Remove(staged)
+		}
+	}()
+
+	if err := d.writeFile(staged, stored, 0644); err != nil {
+		return err
+	}
+
+	if err := d.syncWrite(durability, staged); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	mutex.deferSyncs()
+
+	err = d.journaled(OpWrite, collection, resource, func() error {
+		return d.storeEncoded(collection, resource, b, stored, staged, durability)
+	})
+
+	wait := mutex.takeSyncs()
+	mutex.Unlock()
+
+	if synced := wait(); err == nil {
+		err = synced
+	}
+
+	return err
+}
+
+var stageSeq uint64
+
+// stageGrace is how old a temporary record file must be before compaction
+// removes it. Files are staged before the collection lock is taken, so a
+// recent one may belong to a write still in progress.
+const stageGrace = 10 * time.Minute
+
+// stagePath is a file to stage the record at path in, unique to the caller.
+func (d *Driver) stagePath(path string) string {
+	return fmt.Sprintf("%s.%d.tmp", path, atomic.AddUint64(&stageSeq, 1))
+}
+
+// deferSyncs makes syncPublished leave the syncs of the changes made under
+// the lock for its holder to wait for with takeSyncs. Callers must hold
+// the lock.
+func (m *collectionMutex) deferSyncs() {
+	m.deferring = true
+}
+
+// takeSyncs stops deferring syncs and returns a function waiting for those
+// deferred, to be called once the lock is released. Callers must hold the
+// lock.
+func (m *collectionMutex) takeSyncs() func() error {
+	syncs := m.syncs
+	m.syncs, m.deferring = nil, false
+
+	return func() error {
+		for _, b := range syncs {
+			<-b.done
+
+			if b.err != nil {
+				return b.err
+			}
+		}
+
+		return nil
+	}
+}
+
+// syncPublished makes the directory a record was renamed into durable. With
+// a group commit window, and a lock holder deferring syncs, the directory
+// joins the pending batch and is waited for after the lock is released.
+// Callers must hold the collection lock.
+func (d *Driver) syncPublished(durability Durability, collection, dir string) error {
+	if durability != DurabilitySync {
+		return nil
+	}
+
+	m := d.getOrCreateMutex(collection)
+
+	if !m.deferring || d.syncer.window <= 0 {
+		return d.syncWrite(durability, dir)
+	}
+
+	if _, err := d.fault(FaultSync, dir); err != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: err}
+	}
+
+	m.syncs = append(m.syncs, d.syncer.enqueue(d.dir, dir))
+
+	return nil
+}
+
+// syncWrite makes a written file, or the directory holding a renamed one,
+// durable according to durability.
+func (d *Driver) syncWrite(durability Durability, paths ...string) error {
+	if durability != DurabilitySync {
+		return nil
+	}
+
+	for _, path := range paths {
+		if _, err := d.fault(FaultSync, path); err != nil {
+			return &os.PathError{Op: "sync", Path: path, Err: err}
+		}
+	}
+
+	return d.syncer.sync(d.dir, paths...)
+}
+
+// fsyncEach flushes every path on its own. Directories that cannot be
+// synced, as on Windows, are skipped.
+func fsyncEach(paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		fi, err := f.Stat()
+
+		if err == nil {
+			err = f.Sync()
+
+			if err != nil && fi.IsDir() {
+				err = nil
+			}
+		}
+
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncPaths flushes paths to disk. A batch of several paths is flushed with
+// one syncfs of the filesystem holding the database.
+func syncPaths(dir string, paths []string) error {
+	if len(paths) <= 1 {
+		return fsyncEach(paths)
+	}
+
+	f, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return unix.Syncfs(int(f.Fd()))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// syncPaths flushes paths to disk, one at a time.
+func syncPaths(dir string, paths []string) error {
+	return fsyncEach(paths)
+}
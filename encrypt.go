@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// Encryption seals records before they are written to disk and opens them
+// again on read.
+type Encryption interface {
+	Name() string
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+type aesEncryption struct {
+	aead cipher.AEAD
+}
+
+// NewSymmetricEncryption encrypts records with AES-GCM under a 16, 24 or 32
+// byte key.
+func NewSymmetricEncryption(key []byte) (Encryption, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesEncryption{aead: aead}, nil
+}
+
+func (e *aesEncryption) Name() string {
+	return "aes-gcm"
+}
+
+func (e *aesEncryption) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *aesEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+
+	if len(ciphertext) < n {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+
+	return e.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+type ageEncryption struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewAgeEncryption encrypts records to age or SSH recipients. Records can
+// only be read back when identities holding a matching private key are
+// given; without them the driver can write but never read its data.
+func NewAgeEncryption(recipients []age.Recipient, identities []age.Identity) (Encryption, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("Missing recipients")
+	}
+
+	return &ageEncryption{recipients: recipients, identities: identities}, nil
+}
+
+func (e *ageEncryption) Name() string {
+	return "age"
+}
+
+func (e *ageEncryption) Encrypt(plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := age.Encrypt(&buf, e.recipients...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *ageEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(e.identities) == 0 {
+		return nil, fmt.Errorf("No identity available to decrypt age records")
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), e.identities...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// ParseRecipients parses one recipient per line, accepting age X25519
+// recipients ("age1...") as well as "ssh-ed25519" and "ssh-rsa" public keys.
+// Blank lines and lines starting with "#" are ignored.
+func ParseRecipients(r io.Reader) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var (
+			recipient age.Recipient
+			err       error
+		)
+
+		if strings.HasPrefix(line, "ssh-") {
+			recipient, err = agessh.ParseRecipient(line)
+		} else {
+			recipient, err = age.ParseX25519Recipient(line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient %q: %w", line, err)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, scanner.Err()
+}
+
+// ParseIdentity parses an age identity file or an unencrypted SSH private
+// key in PEM form.
+func ParseIdentity(b []byte) ([]age.Identity, error) {
+	if bytes.Contains(b, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []age.Identity{identity}, nil
+	}
+
+	return age.ParseIdentities(bytes.NewReader(b))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Records that are stored transformed are wrapped in an envelope: the magic
+// bytes, a big endian uint16 header length, a JSON header describing the
+// transformations and the transformed payload. Files without the magic are
+// plain JSON, so records written before a transformation was enabled stay
+// readable.
+var envelopeMagic = []byte("GJDB\x01")
+
+type envelopeHeader struct {
+	Compression string `json:"zip,omitempty"`
+	Encryption  string `json:"enc,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Signature   string `json:"sig,omitempty"`
+
+	// Subject is the ID of the subject whose data key, rather than the
+	// collection's, encrypts the record.
+	Subject string `json:"subj,omitempty"`
+
+	// Chunks lists, in order, the chunks holding the stored bytes of a
+	// chunked record, whose envelope has no payload of its own.
+	Chunks []string `json:"chunks,omitempty"`
+	Size   int64    `json:"size,omitempty"`
+
+	// Cold is the hash of the stored bytes of a record demoted to cold
+	// storage, which are kept there under its name. The envelope has no
+	// payload of its own.
+	Cold string `json:"cold,omitempty"`
+}
+
+func sealEnvelope(h envelopeHeader, payload []byte) ([]byte, error) {
+	hb, err := json.Marshal(h)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hb) > math.MaxUint16 {
+		return nil, fmt.Errorf("Record envelope header of %d bytes is too large", len(hb))
+	}
+
+	b := make([]byte, 0, len(envelopeMagic)+2+len(hb)+len(payload))
+	b = append(b, envelopeMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(hb)))
+	b = append(b, hb...)
+
+	return append(b, payload...), nil
+}
+
+func openEnvelope(b []byte) (*envelopeHeader, []byte, error) {
+	if !bytes.HasPrefix(b, envelopeMagic) {
+		return nil, b, nil
+	}
+
+	b = b[len(envelopeMagic):]
+
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("Truncated record envelope")
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("Truncated record envelope")
+	}
+
+	var h envelopeHeader
+
+	if err := json.Unmarshal(b[:n], &h); err != nil {
+		return nil, nil, fmt.Errorf("Invalid record envelope: %w", err)
+	}
+
+	return &h, b[n:], nil
+}
+
+// encodeRecord turns the JSON of a record into the bytes stored on disk,
+// compressing and then encrypting it as configured, and last chunking it
+// when it is larger than Options.ChunkSize.
+func (d *Driver) encodeRecord(collection, resource string, b []byte) ([]byte, error) {
+	b, err := d.sealRecord(collection, resource, b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.chunkRecord(b)
+}
+
+// sealRecord is encodeRecord without the chunking.
+func (d *Driver) sealRecord(collection, resource string, b []byte) ([]byte, error) {
+	var h envelopeHeader
+
+	enc, id := d.encryption(collection)
+
+	if subject := d.subject(collection, b); subject != "" {
+		key, err := d.subjectKey(subject, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		enc, id = key, ""
+		h.Subject = subject
+	}
+
+	if algorithm := d.compression(collection); algorithm != "" {
+		c, err := compressor(algorithm)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if b, err = c.Compress(b); err != nil {
+			return nil, err
+		}
+
+		h.Compression = algorithm
+	}
+
+	if enc != nil {
+		sealed, err := enc.Encrypt(b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b = sealed
+		h.Encryption, h.Key = enc.Name(), id
+	}
+
+	if len(d.opts.SigningKey) > 0 {
+		sig, err := d.sign(collection, resource, h, b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Signature = sig
+	}
+
+	if h.Compression != "" || h.Encryption != "" || h.Signature != "" {
+		sealed, err := sealEnvelope(h, b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b = sealed
+	}
+
+	return b, nil
+}
+
+// decodeRecord reverses encodeRecord using the transformations recorded in
+// the envelope rather than the current settings.
+func (d *Driver) decodeRecord(collection, resource string, b []byte) ([]byte, error) {
+	h, payload, err := openEnvelope(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if h != nil && len(h.Chunks) > 0 {
+		b, err := d.readChunks(h)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeRecord(collection, resource, b)
+	}
+
+	if h != nil && h.Cold != "" {
+		b, err := d.readCold(h)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeRecord(collection, resource, b)
+	}
+
+	if err := d.verifySignature(collection, resource, h, payload); err != nil {
+		return nil, err
+	}
+
+	if h == nil {
+		return payload, nil
+	}
+
+	if h.Encryption != "" {
+		var enc Encryption
+
+		switch {
+		case h.Subject == "":
+			enc, err = d.decryption(h.Encryption, h.Key)
+		case d.opts.Shredding == nil:
+			err = fmt.Errorf("Record is encrypted with a subject key, but crypto-shredding is not configured")
+		default:
+			enc, err = d.subjectKey(h.Subject, false)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if payload, err = enc.Decrypt(payload); err != nil {
+			return nil, fmt.Errorf("Unable to decrypt record: %w", err)
+		}
+	}
+
+	if h.Compression != "" {
+		c, err := compressor(h.Compression)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if payload, err = c.Decompress(payload); err != nil {
+			return nil, fmt.Errorf("Unable to decompress record: %w", err)
+		}
+	}
+
+	return payload, nil
+}
+
+// readRecord returns the decoded JSON of a stored record.
+func (d *Driver) readRecord(collection, resource string) ([]byte, error) {
+	b, ok := d.cache.get(collection, resource)
+
+	if ok {
+		return b, nil
+	}
+
+	gen := d.Generation(collection)
+
+	stored, err := d.readFile(d.recordPath(collection, resource))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = d.decodeRecord(collection, resource, stored); err != nil {
+		return nil, err
+	}
+
+	d.coldRead(collection, resource, stored)
+
+	if b, err = d.upgrade(collection, resource, b); err != nil {
+		return nil, err
+	}
+
+	d.cache.fill(collection, resource, b, func() bool { return d.Generation(collection) == gen })
+
+	return b, nil
+}
+
+func (d *Driver) readRecordFile(collection, resource, path string) ([]byte, error) {
+	b, err := d.readFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decodeRecord(collection, resource, b)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFound is matched by ErrCollectionNotFound and ErrRecordNotFound, for
+// callers that do not care which is missing. Both also match os.ErrNotExist.
+var ErrNotFound = errors.New("Not found")
+
+var (
+	ErrCollectionNotFound error = &notFoundError{"Collection not found"}
+	ErrRecordNotFound     error = &notFoundError{"Record not found"}
+)
+
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrNotFound || target == os.ErrNotExist
+}
+
+// OpError records the operation and record behind an error returned by the
+// driver, e.g. "write Users/Prasad: Quota exceeded". Use errors.Is and
+// errors.As to look at the underlying error.
+type OpError struct {
+	Op         string
+	Collection string
+
+	// Resource is empty for operations on a whole collection.
+	Resource string
+	Err      error
+}
+
+func (e *OpError) Error() string {
+	name := e.Collection
+
+	if e.Resource != "" {
+		name += "/" + e.Resource
+	}
+
+	return e.Op + " " + name + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// wrapOp wraps a non-nil *err in an OpError, unless an inner call already
+// did.
+func wrapOp(err *error, op, collection, resource string) {
+	var opErr *OpError
+
+	if *err == nil || errors.As(*err, &opErr) {
+		return
+	}
+
+	*err = &OpError{Op: op, Collection: collection, Resource: resource, Err: *err}
+}
+
+// notFound tells whether a missing record is missing together with its
+// collection.
+func (d *Driver) notFound(collection string) error {
+	if _, err := os.Stat(filepath.Join(d.dir, collection)); os.IsNotExist(err) {
+		return ErrCollectionNotFound
+	}
+
+	return ErrRecordNotFound
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchHeartbeat is how often a quiet watch stream gets a comment, which
+// keeps proxies from closing it.
+const watchHeartbeat = 30 * time.Second
+
+// watchBatch is the most changes read from the change log at a time.
+const watchBatch = 1000
+
+// serveWatch streams the changes of a collection at /watch/{collection} as
+// server-sent events, in order, each with its sequence number as event ID.
+// The stream starts after the change numbered by the since parameter, or
+// by the Last-Event-ID header of a reconnecting client, and "now" starts
+// it at the latest change. It needs Options.ChangeLog, and RoleRead on the
+// collection when Authorize is set.
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.Watch || !strings.HasPrefix(r.URL.Path, "/watch/") || r.Method != http.MethodGet {
+		return false
+	}
+
+	collection := strings.TrimPrefix(r.URL.Path, "/watch/")
+
+	if err := checkCollection(collection); err != nil {
+		writeError(w, err)
+		return true
+	}
+
+	if s.opts.Authorize != nil {
+		if err := s.opts.Authorize(r, collection, RoleRead); err != nil {
+			writeError(w, err)
+			return true
+		}
+	}
+
+	since, err := watchSince(s.db, r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	if _, err := s.db.LastChange(); err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	s.watch(r.Context(), w, collection, since)
+
+	return true
+}
+
+// watchSince returns the sequence number a watch stream starts after.
+func watchSince(db *Driver, r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+
+	if v == "" {
+		v = r.URL.Query().Get("since")
+	}
+
+	switch v {
+	case "", "0":
+		return 0, nil
+	case "now":
+		return db.LastChange()
+	}
+
+	since, err := strconv.ParseInt(v, 10, 64)
+
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("Invalid since %q", v)
+	}
+
+	return since, nil
+}
+
+// watch writes the changes of collection logged after since until ctx is
+// done.
+func (s *Server) watch(ctx context.Context, w http.ResponseWriter, collection string, since int64) {
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		changes, last, err := s.db.readChanges(since, watchBatch)
+
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strconv.Quote(err.Error()))
+			return
+		}
+
+		for _, c := range changes {
+			if c.Collection != collection {
+				continue
+			}
+
+			b, err := json.Marshal(c)
+
+			if err != nil {
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", c.Seq, b); err != nil {
+				return
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		since = last
+
+		if len(changes) == watchBatch {
+			continue
+		}
+
+		wait, cancel := context.WithTimeout(ctx, watchHeartbeat)
+		err = s.db.WaitChanges(wait, since)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads n change events from a watch stream.
+func readEvents(t *testing.T, url, lastEventID string, n int) []Change {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %v = %v", url, resp.Status)
+	}
+
+	var changes []Change
+	sc := bufio.NewScanner(resp.Body)
+
+	for len(changes) < n && sc.Scan() {
+		if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+			var c Change
+
+			if err := json.Unmarshal([]byte(data), &c); err != nil {
+				t.Fatal(err)
+			}
+
+			changes = append(changes, c)
+		}
+	}
+
+	return changes
+}
+
+func TestServerWatch(t *testing.T) {
+	db, err := New(t.TempDir(), &Options{ChangeLog: &ChangeLogOptions{}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for _, w := range []struct{ collection, resource string }{{"Users", "a"}, {"Other", "x"}, {"Users", "b"}} {
+		if err := db.Write(w.collection, w.resource, map[string]string{"name": w.resource}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(NewServer(db, &ServerOptions{Watch: true}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		query       string
+		lastEventID string
+		want        []string
+	}{
+		{name: "from the start", query: "?since=0", want: []string{"a", "b"}},
+		{name: "since", query: "?since=1", want: []string{"b"}},
+		{name: "resumed", lastEventID: "2", want: []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := readEvents(t, srv.URL+"/watch/Users"+tt.query, tt.lastEventID, len(tt.want))
+
+			if len(changes) != len(tt.want) {
+				t.Fatalf("Got %d changes, want %d", len(changes), len(tt.want))
+			}
+
+			for i, c := range changes {
+				if c.Collection != "Users" || c.Resource != tt.want[i] {
+					t.Errorf("Change %d is %v/%v, want Users/%v", i, c.Collection, c.Resource, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("live", func(t *testing.T) {
+		last, err := db.LastChange()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			db.Write("Users", "c", map[string]string{"name": "c"})
+		}()
+
+		changes := readEvents(t, srv.URL+"/watch/Users?since="+strconv.FormatInt(last, 10), "", 1)
+
+		if len(changes) != 1 || changes[0].Resource != "c" {
+			t.Errorf("Got %+v, want the write of Users/c", changes)
+		}
+	})
+}
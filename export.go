@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// tarKeyRecord holds, in the PAX header of a tar entry, the key of a record
+// whose file name is hashed.
+const tarKeyRecord = "GOJSONDB.key"
+
+type ExportOptions struct {
+	// Format is FormatNDJSON (the default) or FormatTar, matching what
+	// ImportBulk reads.
+	Format string
+
+	// Collections to export; all collections when empty.
+	Collections []string
+
+	// Filter and Fields select and project the records of every exported
+	// collection.
+	Filter Filter
+	Fields []string
+
+	// Masks hide fields of the exported records, by collection; the masks
+	// under "*" apply to every collection. MaskKey keys the hashes of
+	// MaskHash, and should be kept secret so hashed values cannot be
+	// guessed back.
+	Masks   map[string][]Mask
+	MaskKey []byte
+
+	// Recipients, if set, encrypt the whole export with age so that only
+	// holders of a matching private key can restore it.
+	Recipients []age.Recipient
+}
+
+// Export streams the selected records to w one at a time, so it can write
+// directly to an http.ResponseWriter without holding the export in memory.
+func (d *Driver) Export(w io.Writer, opts *ExportOptions) error {
+	o := ExportOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	var (
+		emit   func(collection, resource string, b []byte) error
+		finish func() error
+	)
+
+	var sealed io.WriteCloser
+
+	if len(o.Recipients) > 0 {
+		var err error
+
+		if sealed, err = age.Encrypt(w, o.Recipients...); err != nil {
+			return err
+		}
+
+		w = sealed
+	}
+
+	switch o.Format {
+	case "", FormatNDJSON:
+		bw := bufio.NewWriter(w)
+		emit = func(collection, resource string, b []byte) error {
+			return writeNDJSON(bw, collection, resource, b)
+		}
+		finish = bw.Flush
+
+	case FormatTar:
+		tw := tar.NewWriter(w)
+		emit = func(collection, resource string, b []byte) error {
+			return writeTarEntry(tw, collection, resource, b)
+		}
+		finish = tw.Close
+
+	default:
+		return fmt.Errorf("Unknown export format %v", o.Format)
+	}
+
+	collections := o.Collections
+
+	if len(collections) == 0 {
+		var err error
+
+		if collections, err = d.listCollections(); err != nil {
+			return err
+		}
+	}
+
+	q, err := d.Prepare(o.Filter)
+
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		masks := append(append([]Mask(nil), o.Masks["*"]...), o.Masks[collection]...)
+
+		err := q.each(collection, nil, "", func(resource string, b []byte, doc map[string]interface{}) error {
+			if len(o.Fields) > 0 {
+				p, err := project(b, o.Fields)
+
+				if err != nil {
+					return err
+				}
+
+				b = p
+			}
+
+			if len(masks) > 0 {
+				m, err := mask(b, masks, o.MaskKey)
+
+				if err != nil {
+					return err
+				}
+
+				b = m
+			}
+
+			return emit(collection, resource, b)
+		})
+
+		if err != nil {
+			return fmt.Errorf("Unable to export %v: %w", collection, err)
+		}
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	if sealed != nil {
+		return sealed.Close()
+	}
+
+	return nil
+}
+
+func writeNDJSON(w io.Writer, collection, resource string, b []byte) error {
+	var data bytes.Buffer
+
+	if err := json.Compact(&data, b); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(importRecord{
+		Collection: collection,
+		Resource:   resource,
+		Data:       data.Bytes(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(line, '\n'))
+
+	return err
+}
+
+func writeTarEntry(tw *tar.Writer, collection, resource string, b []byte) error {
+	name := fileName(resource)
+
+	hdr := &tar.Header{
+		Name:    collection + "/" + name + ".json",
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}
+
+	if strings.Contains(name, hashMarker) {
+		hdr.PAXRecords = map[string]string{tarKeyRecord: resource}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(b)
+
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// FaultOp is a point in the driver's file handling where a fault can be
+// injected.
+type FaultOp int
+
+const (
+	FaultWrite FaultOp = iota
+	FaultRename
+	FaultRemove
+	FaultRead
+	FaultSync
+)
+
+var faultOpNames = map[FaultOp]string{
+	FaultWrite:  "write",
+	FaultRename: "rename",
+	FaultRemove: "remove",
+	FaultRead:   "open",
+	FaultSync:   "sync",
+}
+
+type FaultKind int
+
+const (
+	// FaultIOError fails the operation with EIO.
+	FaultIOError FaultKind = iota
+
+	// FaultDiskFull fails the operation with ENOSPC. Writes leave the file
+	// they were writing empty.
+	FaultDiskFull
+
+	// FaultTornWrite writes the first half of the data and fails with
+	// EIO, as a crash in the middle of a write would. On other operations
+	// it acts as FaultIOError.
+	FaultTornWrite
+)
+
+// Fault describes failures to inject. A failed rename is a FaultRename
+// with FaultIOError.
+type Fault struct {
+	Op   FaultOp
+	Kind FaultKind
+
+	// Path is a pattern, in the syntax of path.Match, that limits the fault
+	// to the files it matches. It is matched against the path relative to
+	// the database directory, with '/' separators, and against its base
+	// name. An empty Path matches every file.
+	Path string
+
+	// After lets the first After matching operations succeed. Times is the
+	// number of operations that fail after them; zero fails every one.
+	After int
+	Times int
+}
+
+// FaultInjector makes the driver fail file operations on purpose, so that
+// applications, and the driver's own recovery, can be tested against disk
+// failures and crashes. It is set with Options.Faults and is safe to change
+// while the driver runs.
+type FaultInjector struct {
+	mutex    sync.Mutex
+	faults   []*faultState
+	injected int
+}
+
+type faultState struct {
+	Fault
+	seen int
+}
+
+func NewFaultInjector(faults ...Fault) *FaultInjector {
+	f := &FaultInjector{}
+
+	for _, fault := range faults {
+		f.Add(fault)
+	}
+
+	return f
+}
+
+func (f *FaultInjector) Add(fault Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faults = append(f.faults, &faultState{Fault: fault})
+}
+
+// Clear removes every fault, letting the driver run normally again.
+func (f *FaultInjector) Clear() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faults = nil
+}
+
+// Injected returns the number of operations failed so far.
+func (f *FaultInjector) Injected() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.injected
+}
+
+// match returns the fault to inject into op on rel, if any. The nil
+// injector never injects.
+func (f *FaultInjector) match(op FaultOp, rel string) (*Fault, bool) {
+	if f == nil {
+		return nil, false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.Op != op || !fault.matches(rel) {
+			continue
+		}
+
+		fault.seen++
+
+		if fault.seen <= fault.After || (fault.Times > 0 && fault.seen > fault.After+fault.Times) {
+			continue
+		}
+
+		f.injected++
+
+		return &fault.Fault, true
+	}
+
+	return nil, false
+}
+
+func (f *faultState) matches(rel string) bool {
+	if f.Path == "" {
+		return true
+	}
+
+	if ok, _ := path.Match(f.Path, rel); ok {
+		return true
+	}
+
+	ok, _ := path.Match(f.Path, path.Base(rel))
+
+	return ok
+}
+
+// fault returns the fault to inject into op on the file at p, and the errno
+// to fail it with, which callers wrap the way the real operation would.
+func (d *Driver) fault(op FaultOp, p string) (*Fault, error) {
+	if d.opts.Faults == nil {
+		return nil, nil
+	}
+
+	rel, err := filepath.Rel(d.dir, p)
+
+	if err != nil {
+		rel = p
+	}
+
+	fault, ok := d.opts.Faults.match(op, filepath.ToSlash(rel))
+
+	if !ok {
+		return nil, nil
+	}
+
+	errno := syscall.EIO
+
+	if fault.Kind == FaultDiskFull {
+		errno = syscall.ENOSPC
+	}
+
+	d.log.Debug("Injecting %v into %s of '%s'\n", errno, faultOpNames[op], rel)
+
+	return fault, errno
+}
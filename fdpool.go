@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const defaultMaxOpenFiles = 256
+
+// fdPool bounds the number of files the driver holds open at once, so that
+// parallel scans of large collections stay within the process limit.
+type fdPool chan struct{}
+
+func newFDPool(size int) fdPool {
+	if size <= 0 {
+		size = defaultMaxOpenFiles
+	}
+
+	return make(fdPool, size)
+}
+
+func (p fdPool) acquire() {
+	p <- struct{}{}
+}
+
+func (p fdPool) release() {
+	<-p
+}
+
+func (d *Driver) readFile(path string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := d.readFileTo(path, &buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readFileTo reads the file at path into buf, growing it once to the size
+// of the file.
+func (d *Driver) readFileTo(path string, buf *bytes.Buffer) error {
+	d.files.acquire()
+	defer d.files.release()
+
+	if _, err := d.fault(FaultRead, path); err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	f, err := d.openFile(path, os.O_RDONLY, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil {
+		buf.Grow(int(fi.Size()) + bytes.MinRead)
+	}
+
+	_, err = buf.ReadFrom(f)
+
+	return err
+}
+
+func (d *Driver) writeFile(path string, b []byte, perm os.FileMode) error {
+	return d.retry("write", path, func() error {
+		return d.writeFileOnce(path, b, perm)
+	})
+}
+
+func (d *Driver) writeFileOnce(path string, b []byte, perm os.FileMode) error {
+	d.files.acquire()
+	defer d.files.release()
+
+	f, err := d.openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+
+	if err != nil {
+		return err
+	}
+
+	if fault, err := d.fault(FaultWrite, path); err != nil {
+		if fault.Kind == FaultTornWrite {
+			f.Write(b[:len(b)/2])
+		}
+
+		f.Close()
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (d *Driver) readDir(dir string) ([]os.FileInfo, error) {
+	if err := d.checkNoSymlinks(dir, true); err != nil {
+		return nil, err
+	}
+
+	d.files.acquire()
+	defer d.files.release()
+
+	return ioutil.ReadDir(dir)
+}
+
+// treeFile is a file found by readTree, named by its path below the
+// directory that was read.
+type treeFile struct {
+	os.FileInfo
+	name string
+}
+
+func (f treeFile) Name() string {
+	return f.name
+}
+
+// readTree lists the files below dir, descending into subdirectories, which
+// hold the records of hierarchical keys. Names are relative to dir and
+// separated by '/'.
+func (d *Driver) readTree(dir string) ([]os.FileInfo, error) {
+	files, err := d.readDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tree []os.FileInfo
+
+	for _, file := range files {
+		if !file.IsDir() {
+			tree = append(tree, file)
+			continue
+		}
+
+		sub, err := d.readTree(filepath.Join(dir, file.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range sub {
+			tree = append(tree, treeFile{f, file.Name() + "/" + f.Name()})
+		}
+	}
+
+	return tree, nil
+}
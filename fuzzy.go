@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func (d *Driver) SearchFuzzy(collection, field, term string, threshold float64) ([]string, error) {
+	if field == "" {
+		return nil, fmt.Errorf("Missing field")
+	}
+
+	if threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("Threshold must be in (0, 1], got %v", threshold)
+	}
+
+	records, err := d.ReadAll(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+
+	for _, record := range records {
+		var doc map[string]interface{}
+
+		if err := json.Unmarshal([]byte(record), &doc); err != nil {
+			return nil, err
+		}
+
+		value, ok := lookupField(doc, field)
+
+		if !ok {
+			continue
+		}
+
+		if s, ok := value.(string); ok && similarity(s, term) >= threshold {
+			matches = append(matches, record)
+		}
+	}
+
+	return matches, nil
+}
+
+func lookupField(doc map[string]interface{}, field string) (interface{}, bool) {
+	return lookupPath(doc, strings.Split(field, "."))
+}
+
+func lookupPath(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = doc
+
+	for _, part := range path {
+		m, ok := value.(map[string]interface{})
+
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// similarity is 1 minus the case-insensitive edit distance normalised by the
+// longer string, so 1 means identical and 0 means nothing in common.
+func similarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(a))
+	rb := []rune(strings.ToLower(b))
+
+	longest := len(ra)
+
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+
+	if longest == 0 {
+		return 1
+	}
+
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Generation returns a counter that grows with every change to the records
+// of collection. Reading it never blocks, so callers can cheaply tell
+// whether anything they read earlier may have changed.
+func (d *Driver) Generation(collection string) uint64 {
+	if g, ok := d.generations.Load(collection); ok {
+		return atomic.LoadUint64(g.(*uint64))
+	}
+
+	return 0
+}
+
+// changedRecord publishes a change to a record: it moves the generation of
+// the collection and puts the new value b in the caches, or evicts the
+// record, or the whole collection when resource is empty, if b is nil. It
+// must be called once the change is on disk, with the collection lock held.
+func (d *Driver) changedRecord(collection, resource string, b []byte) {
+	g, _ := d.generations.LoadOrStore(collection, new(uint64))
+
+	d.cache.publish(collection, resource, b, func() {
+		atomic.AddUint64(g.(*uint64), 1)
+	})
+}
@@ -2,4 +2,22 @@ module github.com/prasad89/go-json-database
 
 go 1.20
 
-require github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25 // indirect
+require (
+	filippo.io/age v1.1.1
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25
+	github.com/klauspost/compress v1.17.0
+	github.com/nats-io/nats.go v1.31.0
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/sync v0.4.0
+	golang.org/x/sys v0.13.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	filippo.io/edwards25519 v1.0.0 // indirect
+	github.com/nats-io/nkeys v0.4.5 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// HealthReport is the result of Ping: the checks it ran and whether all
+// of them passed.
+type HealthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name    string     `json:"name"`
+	OK      bool       `json:"ok"`
+	Error   string     `json:"error,omitempty"`
+	LastRun *time.Time `json:"lastRun,omitempty"`
+}
+
+// Ping checks that the database is usable: that the driver is open, that
+// its directory can be written and cleaned up, within ctx, and that its
+// background tasks are running rather than restarting or given up on, have
+// not stalled for three of their intervals, and did not fail on their last
+// run. The error names the first check that failed; the report lists them
+// all.
+func (d *Driver) Ping(ctx context.Context) (HealthReport, error) {
+	var report HealthReport
+
+	closed := false
+
+	select {
+	case <-d.done:
+		closed = true
+	default:
+	}
+
+	add := func(name string, err error, last *time.Time) {
+		c := HealthCheck{Name: name, OK: err == nil, LastRun: last}
+
+		if err != nil {
+			c.Error = err.Error()
+		}
+
+		report.Checks = append(report.Checks, c)
+	}
+
+	if closed {
+		add("driver", fmt.Errorf("Driver is closed"), nil)
+	} else {
+		add("driver", nil, nil)
+	}
+
+	add("directory", d.probe(ctx), nil)
+
+	for _, st := range d.Tasks() {
+		var err error
+
+		if st.Error != "" {
+			err = fmt.Errorf("%v", st.Error)
+		}
+
+		switch {
+		case st.State == TaskFailed:
+			err = fmt.Errorf("Failed: %v", st.Error)
+		case st.State == TaskRestarting:
+			err = fmt.Errorf("Restarting after failing: %v", st.Error)
+		case st.State == TaskStopped && !closed:
+			err = fmt.Errorf("Stopped unexpectedly")
+		case st.Interval > 0 && time.Since(st.LastRun) > 3*st.Interval:
+			err = fmt.Errorf("Stalled: last ran %v ago, every %v expected", time.Since(st.LastRun).Round(time.Millisecond), st.Interval)
+		}
+
+		last := st.LastRun
+		add(st.Name, err, &last)
+	}
+
+	report.OK = true
+
+	for _, c := range report.Checks {
+		if !c.OK {
+			report.OK = false
+			return report, fmt.Errorf("Health check %v failed: %v", c.Name, c.Error)
+		}
+	}
+
+	return report, nil
+}
+
+// probe writes and removes a small file in the database directory, giving
+// up when ctx is done so a hung filesystem cannot block the caller.
+func (d *Driver) probe(ctx context.Context) error {
+	done := make(chan error, 1)
+
+	go func() {
+		f, err := os.CreateTemp(d.dir, ".probe-")
+
+		if err == nil {
+			_, err = f.Write([]byte{0})
+
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+
+			if rerr := os.Remove(f.Name()); err == nil {
+				err = rerr
+			}
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveHealth answers /healthz with the report of Ping, with 503 Service
+// Unavailable when a check fails, returning false for any other request.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.Health || r.URL.Path != "/healthz" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	report, err := s.db.Ping(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+
+	return true
+}
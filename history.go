@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyDir = ".history"
+
+// Each version of a record is kept as its own file under
+// .history/<collection>/<resource>/, named after the time it was written.
+// Versions hold the record as stored, so history is compressed and
+// encrypted like the records themselves; a deletion is an empty file with
+// the .deleted suffix.
+const (
+	versionSuffix  = ".json"
+	deletedSuffix  = ".deleted"
+	versionNameLen = 20
+)
+
+type version struct {
+	at      time.Time
+	deleted bool
+	name    string
+}
+
+// ReadAsOf reads the value a record had at time t. Only changes made while
+// Options.History was enabled, and within its retention, are known.
+func (d *Driver) ReadAsOf(collection, resource string, t time.Time, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	d.flushCollection(collection)
+
+	b, err := d.versionAt(collection, resource, d.historyPath(collection, resource), t)
+
+	if err != nil {
+		return err
+	}
+
+	return d.decode(collection, b, v)
+}
+
+// ReadAllAsOf reads the records a collection held at time t, in resource
+// order.
+func (d *Driver) ReadAllAsOf(collection string, t time.Time) (_ []string, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, "")
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	d.flushCollection(collection)
+
+	dirs, err := d.historyDirs(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(dirs)
+
+	var records []string
+
+	root := filepath.Join(d.dir, historyDir, collection)
+
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(root, dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := d.versionAt(collection, d.recordKey(collection, filepath.ToSlash(rel)), dir, t)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, string(b))
+	}
+
+	return records, nil
+}
+
+func (d *Driver) historyPath(collection, resource string) string {
+	return filepath.Join(d.dir, historyDir, collection, fileName(resource))
+}
+
+// versionAt reads the version current at time t from the history directory
+// dir of a record.
+func (d *Driver) versionAt(collection, resource, dir string, t time.Time) ([]byte, error) {
+	versions, err := d.versions(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].at.After(t) })
+
+	if i == 0 || versions[i-1].deleted {
+		return nil, &os.PathError{Op: "read", Path: dir, Err: os.ErrNotExist}
+	}
+
+	b, err := d.readFile(filepath.Join(dir, versions[i-1].name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decodeRecord(collection, resource, b)
+}
+
+// versions lists the versions in dir, oldest first.
+func (d *Driver) versions(dir string) ([]version, error) {
+	files, err := d.readDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []version
+
+	for _, file := range files {
+		name := file.Name()
+		v := version{name: name}
+
+		switch {
+		case strings.HasSuffix(name, versionSuffix):
+		case strings.HasSuffix(name, deletedSuffix):
+			v.deleted = true
+		default:
+			continue
+		}
+
+		ns, err := strconv.ParseInt(name[:strings.IndexByte(name, '.')], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		v.at = time.Unix(0, ns)
+		versions = append(versions, v)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].at.Before(versions[j].at) })
+
+	return versions, nil
+}
+
+// recordHistory adds a version of a record holding stored, or a deletion
+// when stored is nil, and prunes versions past the retention. Callers must
+// hold the collection lock.
+func (d *Driver) recordHistory(collection, resource string, stored []byte) {
+	if !d.opts.History {
+		return
+	}
+
+	dir := d.historyPath(collection, resource)
+	name := fmt.Sprintf("%0*d", versionNameLen, time.Now().UnixNano())
+
+	if stored == nil {
+		name += deletedSuffix
+	} else {
+		name += versionSuffix
+	}
+
+	err := os.MkdirAll(dir, 0755)
+
+	if err == nil {
+		err = d.writeFile(filepath.Join(dir, name), stored, 0644)
+	}
+
+	if err == nil {
+		err = d.pruneHistory(dir, time.Now())
+	}
+
+	if err != nil {
+		d.log.Warn("Unable to record history of '%s/%s': %v\n", collection, resource, err)
+	}
+}
+
+// pruneHistory drops the versions in the history directory of a record that
+// are no longer needed to answer reads within the retention: all but the
+// newest version older than the cutoff, and the whole history once that is
+// a deletion.
+func (d *Driver) pruneHistory(dir string, now time.Time) error {
+	if d.opts.HistoryRetention <= 0 {
+		return nil
+	}
+
+	versions, err := d.versions(dir)
+
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-d.opts.HistoryRetention)
+	old := sort.Search(len(versions), func(i int) bool { return !versions[i].at.Before(cutoff) })
+
+	drop := versions[:maxInt(old-1, 0)]
+
+	if old == len(versions) && old > 0 && versions[old-1].deleted {
+		drop = versions
+	}
+
+	for _, v := range drop {
+		if err := os.Remove(filepath.Join(dir, v.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// The directory also holds the histories of keys in the namespace of
+	// the record, if any, so it is only removed once empty.
+	if len(drop) == len(versions) && os.Remove(dir) == nil {
+		removeEmptyParents(filepath.Join(d.dir, historyDir), dir)
+	}
+
+	return nil
+}
+
+// historyDirs lists the history directories of the records of a collection,
+// deepest first.
+func (d *Driver) historyDirs(collection string) ([]string, error) {
+	root := d.historyPath(collection, "")
+
+	if err := d.checkNoSymlinks(root, true); err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != root {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+
+	for i, j := 0, len(dirs)-1; i < j; i, j = i+1, j-1 {
+		dirs[i], dirs[j] = dirs[j], dirs[i]
+	}
+
+	return dirs, err
+}
+
+// PruneHistory applies Options.HistoryRetention to the history of every
+// record.
+func (d *Driver) PruneHistory() error {
+	collections, err := ioutil.ReadDir(filepath.Join(d.dir, historyDir))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, collection := range collections {
+		mutex := d.getOrCreateMutex(collection.Name())
+		mutex.Lock()
+
+		dirs, err := d.historyDirs(collection.Name())
+
+		for _, dir := range dirs {
+			if err = d.pruneHistory(dir, now); err != nil {
+				break
+			}
+		}
+
+		mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func maxInt(values ...int) int {
+	m := values[0]
+
+	for _, v := range values[1:] {
+		if v > m {
+			m = v
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock timestamp. Wall is the largest wall clock
+// time, in nanoseconds, the node had seen when the event happened, and
+// Logical orders events that share it, so that an event is always stamped
+// after every event its node knew about, even when wall clocks disagree.
+// Node breaks ties between replicas.
+type HLC struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical,omitempty"`
+	Node    string `json:"node,omitempty"`
+}
+
+func (h HLC) IsZero() bool {
+	return h.Wall == 0 && h.Logical == 0
+}
+
+// Compare returns -1, 0 or 1 as h happened before, at the same time as, or
+// after o.
+func (h HLC) Compare(o HLC) int {
+	switch {
+	case h.Wall != o.Wall:
+		return compareInt64(h.Wall, o.Wall)
+	case h.Logical != o.Logical:
+		return compareInt64(int64(h.Logical), int64(o.Logical))
+	case h.Node < o.Node:
+		return -1
+	case h.Node > o.Node:
+		return 1
+	}
+
+	return 0
+}
+
+func (h HLC) String() string {
+	s := strconv.FormatInt(h.Wall, 10) + "." + strconv.FormatUint(uint64(h.Logical), 10)
+
+	if h.Node != "" {
+		s += "@" + h.Node
+	}
+
+	return s
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+type hlcClock struct {
+	mutex sync.Mutex
+	node  string
+	last  HLC
+}
+
+// now stamps a local event, after seen, the clock of the value it
+// replaces.
+func (c *hlcClock) now(seen *HLC) HLC {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if seen != nil {
+		c.observeLocked(*seen)
+	}
+
+	wall := time.Now().UnixNano()
+
+	if wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+
+	c.last.Node = c.node
+
+	return c.last
+}
+
+func (c *hlcClock) observeLocked(h HLC) {
+	if h.Wall > c.last.Wall || (h.Wall == c.last.Wall && h.Logical > c.last.Logical) {
+		c.last.Wall, c.last.Logical = h.Wall, h.Logical
+	}
+}
+
+// ObserveClock advances the clock of the driver past h, a timestamp
+// received from another replica, so that changes made from now on are
+// ordered after the ones it stamps.
+func (d *Driver) ObserveClock(h HLC) {
+	d.clock.mutex.Lock()
+	defer d.clock.mutex.Unlock()
+
+	d.clock.observeLocked(h)
+}
+
+// Clock returns the hybrid logical clock timestamp of the last change to a
+// record, its deletion included while tombstones keep it.
+func (d *Driver) Clock(collection, resource string) (_ HLC, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return HLC{}, err
+	}
+
+	resource = d.key(resource)
+
+	d.flushCollection(collection)
+
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return HLC{}, err
+	}
+
+	if m.Clock == nil {
+		return HLC{}, d.notFound(collection)
+	}
+
+	return *m.Clock, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatTar    = "tar"
+	FormatMongo  = "mongo"
+)
+
+type ImportOptions struct {
+	// Format is FormatNDJSON (the default), FormatTar or FormatMongo.
+	// NDJSON lines hold {"collection": ..., "resource": ..., "data": ...};
+	// tar entries are named collection/resource.json. Mongo input is the
+	// extended JSON written by mongoexport, one document per line or as an
+	// array, imported into Collection with each _id as resource.
+	Format     string
+	Collection string
+
+	// BatchSize is the number of records written per collection lock.
+	BatchSize int
+
+	// Validate, if set, is called for every record before it is written.
+	Validate func(collection, resource string, doc interface{}) error
+
+	// SkipInvalid skips records that fail to decode or validate instead of
+	// aborting the import.
+	SkipInvalid bool
+
+	// Checkpoint names a file recording how far the import got. An import
+	// started with an existing checkpoint resumes after the records it
+	// covers; the file is removed when the import completes.
+	Checkpoint string
+
+	Progress func(ImportStats)
+
+	// Identities decrypt an input produced by an Export with Recipients.
+	Identities []age.Identity
+}
+
+type ImportStats struct {
+	Records int
+	Skipped int
+	Resumed int
+	Batches int
+}
+
+type importRecord struct {
+	Collection string          `json:"collection"`
+	Resource   string          `json:"resource"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// invalidRecordError reports an input record that could not be decoded, as
+// opposed to a failure to read the input at all.
+type invalidRecordError struct {
+	err error
+}
+
+func (e invalidRecordError) Error() string {
+	return e.err.Error()
+}
+
+type importCheckpoint struct {
+	Records int `json:"records"`
+}
+
+// ImportBulk reads records from r and writes them in batches.
+func (d *Driver) ImportBulk(r io.Reader, opts *ImportOptions) (ImportStats, error) {
+	o := ImportOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+
+	if len(o.Identities) > 0 {
+		dr, err := age.Decrypt(r, o.Identities...)
+
+		if err != nil {
+			return ImportStats{}, err
+		}
+
+		r = dr
+	}
+
+	var next func() (*importRecord, error)
+
+	switch o.Format {
+	case "", FormatNDJSON:
+		next = ndjsonReader(r)
+	case FormatTar:
+		next = tarReader(r)
+	case FormatMongo:
+		if err := checkCollection(o.Collection); err != nil {
+			return ImportStats{}, err
+		}
+
+		next = mongoReader(r, o.Collection)
+	default:
+		return ImportStats{}, fmt.Errorf("Unknown import format %v", o.Format)
+	}
+
+	return d.importRecords(next, o)
+}
+
+// importRecords writes the records returned by next until it reports
+// io.EOF, batching, checkpointing and reporting progress as o asks.
+func (d *Driver) importRecords(next func() (*importRecord, error), o ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	resume := 0
+
+	if o.Checkpoint != "" {
+		n, err := readCheckpoint(o.Checkpoint)
+
+		if err != nil {
+			return stats, err
+		}
+
+		resume = n
+	}
+
+	var (
+		batch    []importRecord
+		consumed int
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := d.writeBatch(batch); err != nil {
+			return err
+		}
+
+		stats.Records += len(batch)
+		stats.Batches++
+		batch = batch[:0]
+
+		if o.Checkpoint != "" {
+			if err := writeCheckpoint(o.Checkpoint, consumed); err != nil {
+				return err
+			}
+		}
+
+		if o.Progress != nil {
+			o.Progress(stats)
+		}
+
+		return nil
+	}
+
+	for {
+		rec, err := next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if _, invalid := err.(invalidRecordError); invalid && o.SkipInvalid {
+			consumed++
+			stats.Skipped++
+			continue
+		}
+
+		if err != nil {
+			return stats, fmt.Errorf("Record %d: %w", consumed+1, err)
+		}
+
+		consumed++
+
+		if consumed <= resume {
+			stats.Resumed++
+			continue
+		}
+
+		if err := d.checkImport(rec, o.Validate); err != nil {
+			if !o.SkipInvalid {
+				return stats, fmt.Errorf("Record %d (%v/%v): %w", consumed, rec.Collection, rec.Resource, err)
+			}
+
+			stats.Skipped++
+			continue
+		}
+
+		batch = append(batch, *rec)
+
+		if len(batch) >= o.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	if o.Checkpoint != "" {
+		if err := os.Remove(o.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (d *Driver) checkImport(rec *importRecord, validate func(collection, resource string, doc interface{}) error) error {
+	if err := checkCollection(rec.Collection); err != nil {
+		return err
+	}
+
+	if rec.Resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	rec.Resource = d.key(rec.Resource)
+
+	if err := d.checkDocumentSize(rec.Collection, rec.Resource, len(rec.Data)); err != nil {
+		return err
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(rec.Data, &doc); err != nil {
+		return err
+	}
+
+	if validate != nil {
+		return validate(rec.Collection, rec.Resource, doc)
+	}
+
+	return nil
+}
+
+// writeBatch writes the records grouped by collection, taking each
+// collection lock once for all of its records in the batch.
+func (d *Driver) writeBatch(batch []importRecord) error {
+	byCollection := make(map[string][]importRecord)
+
+	for _, rec := range batch {
+		byCollection[rec.Collection] = append(byCollection[rec.Collection], rec)
+	}
+
+	collections := make([]string, 0, len(byCollection))
+
+	for collection := range byCollection {
+		collections = append(collections, collection)
+	}
+
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		if err := d.writeLocked(collection, byCollection[collection]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) writeLocked(collection string, records []importRecord) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, rec := range records {
+		if err := d.write(collection, rec.Resource, rec.Data); err != nil {
+			return fmt.Errorf("Unable to write %v/%v: %w", collection, rec.Resource, err)
+		}
+	}
+
+	return nil
+}
+
+func ndjsonReader(r io.Reader) func() (*importRecord, error) {
+	br := bufio.NewReader(r)
+
+	return func() (*importRecord, error) {
+		for {
+			line, err := br.ReadBytes('\n')
+
+			if len(bytes.TrimSpace(line)) == 0 {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			var rec importRecord
+
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return nil, invalidRecordError{err}
+			}
+
+			return &rec, nil
+		}
+	}
+}
+
+func tarReader(r io.Reader) func() (*importRecord, error) {
+	tr := tar.NewReader(r)
+
+	return func() (*importRecord, error) {
+		for {
+			hdr, err := tr.Next()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".json") {
+				continue
+			}
+
+			collection, file := strings.TrimPrefix(path.Clean(hdr.Name), "/"), ""
+
+			if i := strings.IndexByte(collection, '/'); i >= 0 {
+				collection, file = collection[:i], collection[i+1:]
+			}
+
+			b, err := ioutil.ReadAll(tr)
+
+			if err != nil {
+				return nil, err
+			}
+
+			resource, ok := hdr.PAXRecords[tarKeyRecord]
+
+			if !ok {
+				resource = keyName(strings.TrimSuffix(file, ".json"))
+			}
+
+			return &importRecord{
+				Collection: collection,
+				Resource:   resource,
+				Data:       b,
+			}, nil
+		}
+	}
+}
+
+func readCheckpoint(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var cp importCheckpoint
+
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return 0, fmt.Errorf("Invalid import checkpoint %v: %w", path, err)
+	}
+
+	return cp.Records, nil
+}
+
+func writeCheckpoint(path string, records int) error {
+	b, err := json.Marshal(importCheckpoint{Records: records})
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+
+	return replaceFile(path+".tmp", path)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type fieldIndex struct {
+	mutex   sync.RWMutex
+	field   string
+	entries map[string]map[string]struct{}
+	values  map[string]string
+}
+
+func newFieldIndex(field string) *fieldIndex {
+	return &fieldIndex{
+		field:   field,
+		entries: make(map[string]map[string]struct{}),
+		values:  make(map[string]string),
+	}
+}
+
+func (d *Driver) EnsureIndex(collection, field string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if field == "" {
+		return fmt.Errorf("Missing field")
+	}
+
+	if d.index(collection, field) != nil {
+		return nil
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.index(collection, field) != nil {
+		return nil
+	}
+
+	idx := newFieldIndex(field)
+
+	if _, err := stat(filepath.Join(d.dir, collection)); err == nil {
+		err := d.eachRecord(collection, "", func(resource string, b []byte) error {
+			b, _, err := d.withComputed(collection, b)
+
+			if err != nil {
+				return err
+			}
+
+			return idx.put(resource, b)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	d.setIndex(collection, field, idx)
+
+	d.log.Debug("Built index on '%s.%s' with %d entries\n", collection, field, len(idx.values))
+
+	return nil
+}
+
+func (d *Driver) DropIndex(collection, field string) {
+	d.setIndex(collection, field, nil)
+}
+
+// setIndex publishes a new set of indexes with idx as the index on field,
+// or without an index on field when idx is nil. The sets are never modified
+// once published, so readers load them without locking.
+func (d *Driver) setIndex(collection, field string, idx *fieldIndex) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	old := d.loadIndexes()
+	indexes := make(map[string]map[string]*fieldIndex, len(old)+1)
+
+	for name, fields := range old {
+		indexes[name] = fields
+	}
+
+	fields := make(map[string]*fieldIndex, len(old[collection])+1)
+
+	for name, i := range old[collection] {
+		fields[name] = i
+	}
+
+	if idx == nil {
+		delete(fields, field)
+	} else {
+		fields[field] = idx
+	}
+
+	indexes[collection] = fields
+
+	d.indexes.Store(indexes)
+}
+
+func (d *Driver) loadIndexes() map[string]map[string]*fieldIndex {
+	indexes, _ := d.indexes.Load().(map[string]map[string]*fieldIndex)
+	return indexes
+}
+
+func (d *Driver) index(collection, field string) *fieldIndex {
+	return d.loadIndexes()[collection][field]
+}
+
+func (d *Driver) collectionIndexes(collection string) []*fieldIndex {
+	var indexes []*fieldIndex
+
+	for _, idx := range d.loadIndexes()[collection] {
+		indexes = append(indexes, idx)
+	}
+
+	return indexes
+}
+
+// chooseIndex picks the indexed $eq or $in condition that narrows the
+// candidates the most. It returns a nil index when the conditions have to be
+// answered with a collection scan.
+func (d *Driver) chooseIndex(collection string, conds []condition) (*fieldIndex, []string) {
+	var (
+		best *fieldIndex
+		keys []string
+	)
+
+	for _, c := range conds {
+		if !indexOperators[c.op] {
+			continue
+		}
+
+		idx := d.index(collection, c.field)
+
+		if idx == nil {
+			continue
+		}
+
+		values := []interface{}{c.arg}
+
+		if c.op == "$in" {
+			values = c.arg.([]interface{})
+		}
+
+		found := idx.lookup(values)
+
+		if best == nil || len(found) < len(keys) {
+			best, keys = idx, found
+		}
+	}
+
+	return best, keys
+}
+
+func (idx *fieldIndex) lookup(values []interface{}) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	seen := make(map[string]struct{})
+
+	for _, v := range values {
+		for resource := range idx.entries[normalizedKey(v)] {
+			seen[resource] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+
+	for resource := range seen {
+		keys = append(keys, resource)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (idx *fieldIndex) put(resource string, b []byte) error {
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.removeLocked(resource)
+
+	value, ok := lookupField(doc, idx.field)
+
+	if !ok {
+		return nil
+	}
+
+	key := valueKey(value)
+
+	if idx.entries[key] == nil {
+		idx.entries[key] = make(map[string]struct{})
+	}
+
+	idx.entries[key][resource] = struct{}{}
+	idx.values[resource] = key
+
+	return nil
+}
+
+func (idx *fieldIndex) remove(resource string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.removeLocked(resource)
+}
+
+func (idx *fieldIndex) removeLocked(resource string) {
+	key, ok := idx.values[resource]
+
+	if !ok {
+		return
+	}
+
+	delete(idx.entries[key], resource)
+
+	if len(idx.entries[key]) == 0 {
+		delete(idx.entries, key)
+	}
+
+	delete(idx.values, resource)
+}
+
+func (idx *fieldIndex) clear() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.entries = make(map[string]map[string]struct{})
+	idx.values = make(map[string]string)
+}
+
+func (d *Driver) updateIndexes(collection, resource string, b []byte) {
+	d.indexKey(collection, resource, true)
+
+	indexes := d.collectionIndexes(collection)
+
+	if len(indexes) == 0 {
+		return
+	}
+
+	b, _, err := d.withComputed(collection, b)
+
+	if err != nil {
+		d.log.Warn("Unable to index '%s/%s': %v\n", collection, resource, err)
+		return
+	}
+
+	for _, idx := range indexes {
+		if err := idx.put(resource, b); err != nil {
+			d.log.Warn("Unable to index '%s/%s' on %s: %v\n", collection, resource, idx.field, err)
+		}
+	}
+}
+
+func (d *Driver) removeFromIndexes(collection, resource string) {
+	if resource == "" {
+		d.forgetKeyIndex(collection)
+	} else {
+		d.indexKey(collection, resource, false)
+	}
+
+	for _, idx := range d.collectionIndexes(collection) {
+		if resource == "" {
+			idx.clear()
+		} else {
+			idx.remove(resource)
+		}
+	}
+}
+
+// normalizedKey round-trips v through JSON so filter values supplied as Go
+// ints or structs key the same way as the decoded documents do.
+func normalizedKey(v interface{}) string {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return valueKey(v)
+	}
+
+	var decoded interface{}
+
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return valueKey(v)
+	}
+
+	return valueKey(decoded)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// IndexBuild chooses when the key indexes, and the field indexes declared
+// in Options.Indexes and collection policies, are built.
+type IndexBuild int
+
+const (
+	// IndexBuildLazy builds the indexes of a collection the first time a
+	// query, scan or count needs them, keeping New fast.
+	IndexBuildLazy IndexBuild = iota
+
+	// IndexBuildEager builds every index in New, so that the first queries
+	// do not pay for it.
+	IndexBuildEager
+)
+
+// buildIndexes builds the key index of every collection and the field
+// indexes declared for it, logging its progress.
+func (d *Driver) buildIndexes() error {
+	collections, err := d.listCollections()
+
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(collections))
+
+	for _, collection := range collections {
+		seen[collection] = true
+	}
+
+	for collection := range d.opts.Indexes {
+		if !seen[collection] {
+			seen[collection] = true
+			collections = append(collections, collection)
+		}
+	}
+
+	for collection := range d.Policies() {
+		if !seen[collection] {
+			collections = append(collections, collection)
+		}
+	}
+
+	sort.Strings(collections)
+
+	d.log.Info("Building indexes of %d collections\n", len(collections))
+
+	start := time.Now()
+
+	for i, collection := range collections {
+		began := time.Now()
+
+		idx, err := d.keyIndex(collection)
+
+		if err != nil {
+			return err
+		}
+
+		for _, field := range d.declared(collection) {
+			if err := d.EnsureIndex(collection, field); err != nil {
+				return err
+			}
+		}
+
+		d.log.Info("Built indexes of '%s' with %d keys (%d/%d) in %v\n", collection, len(idx.between("", "")), i+1, len(collections), time.Since(began))
+	}
+
+	d.log.Info("Built indexes in %v\n", time.Since(start))
+
+	return nil
+}
+
+// declared lists the field indexes of collection declared in
+// Options.Indexes and by its policy.
+func (d *Driver) declared(collection string) []string {
+	fields := d.opts.Indexes[collection]
+	policy := d.config(collection).indexes
+
+	if len(policy) == 0 {
+		return fields
+	}
+
+	return append(append([]string(nil), fields...), policy...)
+}
+
+// declaredIndexes builds the field indexes declared for collection that
+// have not been built yet. A failed build is logged and leaves queries to
+// scan the collection.
+func (d *Driver) declaredIndexes(collection string) {
+	for _, field := range d.declared(collection) {
+		if d.index(collection, field) != nil {
+			continue
+		}
+
+		began := time.Now()
+
+		if err := d.EnsureIndex(collection, field); err != nil {
+			d.log.Warn("Unable to build index on '%s.%s': %v\n", collection, field, err)
+			continue
+		}
+
+		d.log.Info("Built index on '%s.%s' on first use in %v\n", collection, field, time.Since(began))
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OpWrite  = "write"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Operation is a mutation kept in the journal.
+type Operation struct {
+	ID         int64
+	Time       time.Time
+	Kind       string
+	Collection string
+
+	// Resource is empty when a whole collection was deleted.
+	Resource string
+
+	// Before holds the value each affected record had before the
+	// operation. A record missing from it did not exist.
+	Before map[string]json.RawMessage
+
+	// Forgotten is set once Before held the data of a subject since
+	// forgotten, which was dropped. The operation can no longer be undone.
+	Forgotten bool
+}
+
+// journal keeps the last Options.JournalSize operations in memory.
+type journal struct {
+	mutex  sync.Mutex
+	size   int
+	nextID int64
+	ops    []Operation
+}
+
+func newJournal(size int) *journal {
+	if size <= 0 {
+		return nil
+	}
+
+	return &journal{size: size, nextID: 1}
+}
+
+func (j *journal) add(op Operation) {
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	op.ID = j.nextID
+	op.Time = time.Now()
+	j.nextID++
+
+	j.ops = append(j.ops, op)
+
+	if len(j.ops) > j.size {
+		j.ops = append(j.ops[:0:0], j.ops[len(j.ops)-j.size:]...)
+	}
+}
+
+// Journal returns the journaled operations, oldest first.
+func (d *Driver) Journal() []Operation {
+	j := d.journal
+
+	if j == nil {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return append([]Operation(nil), j.ops...)
+}
+
+// Undo reverts the last n journaled operations, newest first, and drops them
+// from the journal. Reverting is not itself journaled.
+func (d *Driver) Undo(n int) error {
+	if d.journal == nil {
+		return fmt.Errorf("Journal is disabled")
+	}
+
+	for i := 0; i < n; i++ {
+		j := d.journal
+		j.mutex.Lock()
+
+		if len(j.ops) == 0 {
+			j.mutex.Unlock()
+			return fmt.Errorf("Nothing left to undo")
+		}
+
+		op := j.ops[len(j.ops)-1]
+		j.mutex.Unlock()
+
+		if err := d.UndoOperation(op.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UndoOperation reverts a single journaled operation. It fails when a later
+// operation changed the same records, since reverting would discard that
+// change too.
+func (d *Driver) UndoOperation(id int64) error {
+	j := d.journal
+
+	if j == nil {
+		return fmt.Errorf("Journal is disabled")
+	}
+
+	op, ok := j.find(id)
+
+	if !ok {
+		return fmt.Errorf("No operation %d in the journal", id)
+	}
+
+	// The check for later operations is made under the collection lock,
+	// which every operation journaled on the collection holds, so none can
+	// come in between it and the revert. Taking the lock also writes out
+	// the buffered writes, which are journaled first.
+	mutex := d.getOrCreateMutex(op.Collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	j.mutex.Lock()
+
+	index := -1
+
+	for i := range j.ops {
+		if j.ops[i].ID == id {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		j.mutex.Unlock()
+		return fmt.Errorf("No operation %d in the journal", id)
+	}
+
+	if op = j.ops[index]; op.Forgotten {
+		j.mutex.Unlock()
+		return fmt.Errorf("Operation %d held data of a forgotten subject", id)
+	}
+
+	for _, later := range j.ops[index+1:] {
+		if later.Collection == op.Collection && (later.Resource == "" || op.Resource == "" || later.Resource == op.Resource) {
+			j.mutex.Unlock()
+			return fmt.Errorf("Operation %d was followed by operation %d on %v", id, later.ID, later.Collection)
+		}
+	}
+
+	j.mutex.Unlock()
+
+	if err := d.revert(op); err != nil {
+		return fmt.Errorf("Unable to undo operation %d: %w", id, err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for i := range j.ops {
+		if j.ops[i].ID == id {
+			j.ops = append(j.ops[:i], j.ops[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// collections returns the collections of the journaled operations.
+func (j *journal) collections() []string {
+	if j == nil {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	seen := make(map[string]bool)
+	var collections []string
+
+	for _, op := range j.ops {
+		if !seen[op.Collection] {
+			seen[op.Collection] = true
+			collections = append(collections, op.Collection)
+		}
+	}
+
+	return collections
+}
+
+// forgetJournaled drops from the journaled operations on collection the
+// values of subject id. The operations are kept, marked Forgotten, so that
+// the records cannot be reverted past them either. Callers must hold the
+// collection lock.
+func (d *Driver) forgetJournaled(collection, id string) {
+	j := d.journal
+
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for i := range j.ops {
+		op := &j.ops[i]
+
+		if op.Collection != collection {
+			continue
+		}
+
+		for _, b := range op.Before {
+			if d.subject(collection, b) == id {
+				op.Before, op.Forgotten = nil, true
+				break
+			}
+		}
+	}
+}
+
+// find returns the journaled operation id.
+func (j *journal) find(id int64) (Operation, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for _, op := range j.ops {
+		if op.ID == id {
+			return op, true
+		}
+	}
+
+	return Operation{}, false
+}
+
+// revert restores the records touched by op. Callers must hold the
+// collection lock.
+func (d *Driver) revert(op Operation) error {
+	if _, ok := op.Before[op.Resource]; op.Resource != "" && !ok {
+		return d.removeIfExists(op.Collection, op.Resource)
+	}
+
+	resources := make([]string, 0, len(op.Before))
+
+	for resource := range op.Before {
+		resources = append(resources, resource)
+	}
+
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		if err := d.store(op.Collection, resource, op.Before[resource]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// journaled runs fn, which performs an operation of the given kind, and
+// journals it together with the values it replaced.
+func (d *Driver) journaled(kind, collection, resource string, fn func() error) error {
+	if d.journal == nil {
+		return fn()
+	}
+
+	before, err := d.prior(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	d.journal.add(Operation{Kind: kind, Collection: collection, Resource: resource, Before: before})
+
+	return nil
+}
+
+// prior captures the current values of the records an operation is about
+// to change, or of the whole collection when resource is empty. Callers must
+// hold the collection lock.
+func (d *Driver) prior(collection, resource string) (map[string]json.RawMessage, error) {
+	before := make(map[string]json.RawMessage)
+
+	resources := []string{resource}
+
+	if resource == "" {
+		all, err := d.resources(collection)
+
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		resources = all
+	}
+
+	for _, r := range resources {
+		b, err := d.readRecord(collection, r)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		before[r] = b
+	}
+
+	return before, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type KafkaOptions struct {
+	Brokers []string
+
+	// Topic is the topic changes are published to, db.changes by default.
+	Topic string
+
+	TLSConfig *tls.Config
+
+	// Avro, if set, encodes messages with Avro instead of JSON.
+	Avro *KafkaAvroOptions
+}
+
+type KafkaAvroOptions struct {
+	// ValueSchema is the Avro schema of the documents, which are otherwise
+	// carried as JSON text.
+	ValueSchema string
+
+	// Registry, if set, has the message schema registered under Subject,
+	// the topic followed by -value by default, and messages framed in the
+	// Confluent wire format with its id.
+	Registry *SchemaRegistry
+	Subject  string
+}
+
+// changeSchema is the Avro schema of the messages of a KafkaSink, with
+// value documents of the given schema.
+func changeSchema(value string) string {
+	if value == "" {
+		value = `"string"`
+	}
+
+	return `{"type":"record","name":"Change","namespace":"gojsondb","fields":[` +
+		`{"name":"seq","type":"long"},` +
+		`{"name":"collection","type":"string"},` +
+		`{"name":"resource","type":"string"},` +
+		`{"name":"value","type":["null",` + value + `],"default":null},` +
+		`{"name":"time","type":{"type":"long","logicalType":"timestamp-micros"}}]}`
+}
+
+// KafkaSink publishes changes as JSON or Avro messages keyed by collection and
+// resource, so the changes of each record keep their order within a
+// partition. Messages carry the sequence number in a seq header, for
+// consumers to drop redeliveries with.
+type KafkaSink struct {
+	w *kafka.Writer
+
+	avro     *AvroSchema
+	carryRaw bool
+	registry *SchemaRegistry
+	subject  string
+}
+
+func NewKafkaSink(opts *KafkaOptions) (*KafkaSink, error) {
+	if opts == nil || len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("Missing brokers")
+	}
+
+	topic := opts.Topic
+
+	if topic == "" {
+		topic = "db.changes"
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(opts.Brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+
+	if opts.TLSConfig != nil {
+		w.Transport = &kafka.Transport{TLS: opts.TLSConfig}
+	}
+
+	s := &KafkaSink{w: w}
+
+	if a := opts.Avro; a != nil {
+		schema, err := ParseAvroSchema(changeSchema(a.ValueSchema))
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.avro, s.carryRaw, s.registry, s.subject = schema, a.ValueSchema == "", a.Registry, a.Subject
+
+		if s.subject == "" {
+			s.subject = topic + "-value"
+		}
+	}
+
+	return s, nil
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, changes []Change) error {
+	messages := make([]kafka.Message, len(changes))
+
+	for i, c := range changes {
+		value, err := s.encode(ctx, c)
+
+		if err != nil {
+			return err
+		}
+
+		messages[i] = kafka.Message{
+			Key:     []byte(c.Collection + "/" + c.Resource),
+			Value:   value,
+			Headers: []kafka.Header{{Key: "seq", Value: []byte(strconv.FormatInt(c.Seq, 10))}},
+		}
+	}
+
+	return s.w.WriteMessages(ctx, messages...)
+}
+
+func (s *KafkaSink) encode(ctx context.Context, c Change) ([]byte, error) {
+	if s.avro == nil {
+		return json.Marshal(c)
+	}
+
+	m := map[string]interface{}{
+		"seq":        c.Seq,
+		"collection": c.Collection,
+		"resource":   c.Resource,
+		"time":       c.Time.UnixMicro(),
+	}
+
+	if c.Value != nil {
+		var value interface{} = string(c.Value)
+
+		if !s.carryRaw {
+			if err := decodeNumbers(c.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+
+		m["value"] = value
+	}
+
+	b, err := s.avro.root.encode(nil, m)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode change %d of %v/%v: %w", c.Seq, c.Collection, c.Resource, err)
+	}
+
+	if s.registry == nil {
+		return b, nil
+	}
+
+	id, err := s.registry.Register(ctx, s.subject, s.avro)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return frameSchema(id, b), nil
+}
+
+func (s *KafkaSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const indexesDir = ".indexes"
+
+// With Options.KeyIndex, the key index of a collection is kept under
+// .indexes/<collection>/ as keys.json, a sorted array of keys, and keys.log,
+// the keys added and removed since, one JSON object per line. The log is
+// folded into keys.json once it outgrows it. An index that cannot be read
+// back in full is rebuilt from the collection directory.
+const (
+	keyIndexFile  = "keys.json"
+	keyLogFile    = "keys.log"
+	minKeyLogFold = 1024
+)
+
+// keyIndex keeps the keys of a collection in order for range scans. It is
+// built by the first use of the collection and kept up to date with the
+// field indexes from then on.
+type keyIndex struct {
+	mutex  sync.RWMutex
+	keys   []string
+	logged int
+}
+
+type keyLogEntry struct {
+	Add    string `json:"add,omitempty"`
+	Remove string `json:"remove,omitempty"`
+}
+
+// add inserts resource, reporting whether it was missing.
+func (idx *keyIndex) add(resource string) bool {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	i := sort.SearchStrings(idx.keys, resource)
+
+	if i < len(idx.keys) && idx.keys[i] == resource {
+		return false
+	}
+
+	idx.keys = append(idx.keys, "")
+	copy(idx.keys[i+1:], idx.keys[i:])
+	idx.keys[i] = resource
+
+	return true
+}
+
+// remove drops resource, reporting whether it was present.
+func (idx *keyIndex) remove(resource string) bool {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	i := sort.SearchStrings(idx.keys, resource)
+
+	if i < len(idx.keys) && idx.keys[i] == resource {
+		idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+// between returns the keys from start up to, but not including, end, or to
+// the last key when end is empty.
+func (idx *keyIndex) between(start, end string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	i := sort.SearchStrings(idx.keys, start)
+	j := len(idx.keys)
+
+	if end != "" {
+		j = sort.SearchStrings(idx.keys, end)
+	}
+
+	if j < i {
+		j = i
+	}
+
+	return append([]string(nil), idx.keys[i:j]...)
+}
+
+// loadedKeyIndex returns the key index of collection if it was built.
+func (d *Driver) loadedKeyIndex(collection string) *keyIndex {
+	if idx, ok := d.keys.Load(collection); ok {
+		return idx.(*keyIndex)
+	}
+
+	return nil
+}
+
+func (d *Driver) keyIndex(collection string) (*keyIndex, error) {
+	if idx := d.loadedKeyIndex(collection); idx != nil {
+		return idx, nil
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.loadKeyIndex(collection)
+}
+
+// loadKeyIndex builds the key index of collection, from its persisted copy
+// when there is one. Callers must hold the collection lock.
+func (d *Driver) loadKeyIndex(collection string) (*keyIndex, error) {
+	if idx := d.loadedKeyIndex(collection); idx != nil {
+		return idx, nil
+	}
+
+	var (
+		keys []string
+		ok   bool
+	)
+
+	if d.opts.KeyIndex {
+		keys, ok = d.readKeyIndex(collection)
+	}
+
+	if !ok {
+		var err error
+
+		if keys, err = d.resources(collection); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if d.opts.KeyIndex {
+			if err := d.writeKeyIndex(collection, keys); err != nil {
+				d.log.Warn("Unable to persist key index of '%s': %v\n", collection, err)
+			}
+		}
+
+		d.log.Debug("Built key index of '%s' with %d keys\n", collection, len(keys))
+	}
+
+	idx := &keyIndex{keys: keys}
+	d.keys.Store(collection, idx)
+
+	return idx, nil
+}
+
+// RebuildKeyIndex rebuilds the key index of collection from the records on
+// disk, for when they were changed behind the driver's back without
+// Options.Watch.
+func (d *Driver) RebuildKeyIndex(collection string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.keys.Delete(collection)
+
+	if err := d.removeAll(filepath.Join(d.dir, indexesDir, collection)); err != nil {
+		return err
+	}
+
+	_, err := d.loadKeyIndex(collection)
+
+	return err
+}
+
+// indexKey records that resource was written, or removed when added is
+// false. Callers must hold the collection lock.
+func (d *Driver) indexKey(collection, resource string, added bool) {
+	idx := d.loadedKeyIndex(collection)
+
+	if idx == nil && d.opts.KeyIndex {
+		var err error
+
+		if idx, err = d.loadKeyIndex(collection); err != nil {
+			d.log.Warn("Unable to load key index of '%s': %v\n", collection, err)
+			return
+		}
+	}
+
+	if idx == nil {
+		return
+	}
+
+	entry := keyLogEntry{Add: resource}
+	changed := false
+
+	if added {
+		changed = idx.add(resource)
+	} else {
+		entry = keyLogEntry{Remove: resource}
+		changed = idx.remove(resource)
+	}
+
+	if changed && d.opts.KeyIndex {
+		if err := d.logKey(collection, idx, entry); err != nil {
+			d.log.Warn("Unable to persist key index of '%s': %v\n", collection, err)
+			d.removeAll(filepath.Join(d.dir, indexesDir, collection))
+		}
+	}
+}
+
+// forgetKeyIndex drops the key index of a deleted collection.
+func (d *Driver) forgetKeyIndex(collection string) {
+	d.keys.Delete(collection)
+
+	if d.opts.KeyIndex {
+		if err := d.removeAll(filepath.Join(d.dir, indexesDir, collection)); err != nil {
+			d.log.Warn("Unable to remove key index of '%s': %v\n", collection, err)
+		}
+	}
+}
+
+func (d *Driver) logKey(collection string, idx *keyIndex, entry keyLogEntry) error {
+	dir := filepath.Join(d.dir, indexesDir, collection)
+
+	idx.mutex.Lock()
+	idx.logged++
+	fold := idx.logged > minKeyLogFold && idx.logged > len(idx.keys)
+	idx.mutex.Unlock()
+
+	if fold {
+		idx.mutex.RLock()
+		keys := append([]string(nil), idx.keys...)
+		idx.mutex.RUnlock()
+
+		if err := d.writeKeyIndex(collection, keys); err != nil {
+			return err
+		}
+
+		idx.mutex.Lock()
+		idx.logged = 0
+		idx.mutex.Unlock()
+
+		return nil
+	}
+
+	b, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := d.openFile(filepath.Join(dir, keyLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readKeyIndex reads the persisted key index of collection, reporting false
+// when there is none or it cannot be trusted.
+func (d *Driver) readKeyIndex(collection string) ([]string, bool) {
+	dir := filepath.Join(d.dir, indexesDir, collection)
+	b, err := d.readFile(filepath.Join(dir, keyIndexFile))
+
+	if err != nil {
+		return nil, false
+	}
+
+	var base []string
+
+	if err := json.Unmarshal(b, &base); err != nil {
+		d.log.Warn("Rebuilding corrupt key index of '%s': %v\n", collection, err)
+		return nil, false
+	}
+
+	log, err := d.readFile(filepath.Join(dir, keyLogFile))
+
+	if os.IsNotExist(err) {
+		return base, true
+	}
+
+	if err != nil {
+		return nil, false
+	}
+
+	set := make(map[string]bool, len(base))
+
+	for _, key := range base {
+		set[key] = true
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	scanner.Buffer(nil, len(log)+1)
+
+	for scanner.Scan() {
+		var entry keyLogEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			d.log.Warn("Rebuilding corrupt key index of '%s': %v\n", collection, err)
+			return nil, false
+		}
+
+		if entry.Add != "" {
+			set[entry.Add] = true
+		} else {
+			delete(set, entry.Remove)
+		}
+	}
+
+	keys := make([]string, 0, len(set))
+
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys, true
+}
+
+// writeKeyIndex persists keys as the whole key index of collection.
+func (d *Driver) writeKeyIndex(collection string, keys []string) error {
+	dir := filepath.Join(d.dir, indexesDir, collection)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if keys == nil {
+		keys = []string{}
+	}
+
+	b, err := json.Marshal(keys)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeFile(filepath.Join(dir, keyIndexFile+".tmp"), b, 0644); err != nil {
+		return err
+	}
+
+	if err := d.replaceFile(filepath.Join(dir, keyIndexFile+".tmp"), filepath.Join(dir, keyIndexFile)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, keyLogFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Keyring holds the encryption keys of a database by key ID, so that
+// collections can be encrypted under keys of their own. The ID of the key
+// is kept in the envelope of every record it encrypts, and keys no
+// collection uses any more can stay in Keys to read the records they
+// encrypted.
+type Keyring struct {
+	Keys map[string]Encryption
+
+	// Collections maps collections to the ID of the key their records
+	// are encrypted with. Other collections use Default. An empty ID
+	// leaves a collection to Options.Encryption.
+	Collections map[string]string
+	Default     string
+}
+
+func (k *Keyring) check() error {
+	ids := make([]string, 0, len(k.Collections)+1)
+
+	for _, id := range k.Collections {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	if k.Default != "" {
+		ids = append(ids, k.Default)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if k.Keys[id] == nil {
+			return fmt.Errorf("Missing encryption key %q", id)
+		}
+	}
+
+	return nil
+}
+
+// encryption returns the encryption of the records written to collection
+// and the ID of its key, which is empty for Options.Encryption.
+func (d *Driver) encryption(collection string) (Encryption, string) {
+	if k := d.opts.Keyring; k != nil {
+		id, ok := k.Collections[collection]
+
+		if !ok {
+			id = k.Default
+		}
+
+		if id != "" {
+			return k.Keys[id], id
+		}
+	}
+
+	return d.opts.Encryption, ""
+}
+
+// decryption returns the encryption that opens a record sealed with the
+// named algorithm under key ID id.
+func (d *Driver) decryption(algorithm, id string) (Encryption, error) {
+	enc := d.opts.Encryption
+
+	if id != "" {
+		if d.opts.Keyring == nil || d.opts.Keyring.Keys[id] == nil {
+			return nil, fmt.Errorf("Record is encrypted with key %q, which is not in the keyring", id)
+		}
+
+		enc = d.opts.Keyring.Keys[id]
+	}
+
+	if enc == nil || enc.Name() != algorithm {
+		return nil, fmt.Errorf("Record is encrypted with %v, which is not configured", algorithm)
+	}
+
+	return enc, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Resource keys may be any string. Each record is stored under a file name
+// derived from its key: bytes that are unsafe in a file name on some
+// platform are percent-encoded, as are a leading '.', a trailing '.' or
+// space, and the first letter of names Windows reserves for devices. Keys
+// that need no encoding are their own file name, so existing databases keep
+// their layout.
+//
+// A '/' separates the namespaces of a hierarchical key, each of which but
+// the last is a subdirectory: "orders/2024/05/17" is stored as
+// orders/2024/05/17.json. Keys with an empty namespace, such as "a//b" or
+// "a/", are stored flat with their slashes encoded. A namespace containing
+// ".json" has its dots encoded, so its directory never shares a name with a
+// record file.
+
+// Keys whose encoded name would be longer than maxFileNameLen bytes, leaving
+// room for the suffixes the driver adds, are stored under a prefix of the
+// name followed by hashMarker and a hash of the key. fileName never
+// produces hashMarker otherwise, since it escapes every '%'. The key of a
+// hashed name is read back from the record's metadata.
+const (
+	maxFileNameLen = 200
+	hashMarker     = "%~"
+	hashLen        = 32
+)
+
+// fileName returns the file name, without the .json suffix, a key is stored
+// under, relative to its collection.
+func fileName(key string) string {
+	segments := strings.Split(key, "/")
+
+	for _, s := range segments {
+		if s == "" {
+			return segmentName(key, false)
+		}
+	}
+
+	for i, s := range segments {
+		segments[i] = segmentName(s, i < len(segments)-1)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func segmentName(key string, dir bool) string {
+	name := encodeKey(key, dir)
+
+	if len(name) <= maxFileNameLen {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	prefix := name[:maxFileNameLen-len(hashMarker)-hashLen]
+
+	// Cut at the start of an escape or a UTF-8 sequence, so the prefix
+	// stays a valid name.
+	for len(prefix) > 0 && !utf8.RuneStart(name[len(prefix)]) {
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	if i := strings.LastIndexByte(prefix, '%'); i >= 0 && i > len(prefix)-3 {
+		prefix = prefix[:i]
+	}
+
+	return prefix + hashMarker + hex.EncodeToString(sum[:])[:hashLen]
+}
+
+func encodeKey(key string, dir bool) string {
+	var b strings.Builder
+
+	dots := dir && strings.Contains(key, ".json")
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+
+		if unsafeFileByte(c) || (c == '.' && (i == 0 || i == len(key)-1 || dots)) || (i == len(key)-1 && c == ' ') || (i == 0 && reservedDeviceName(key)) {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// keyName reverses fileName.
+func keyName(file string) string {
+	if strings.IndexByte(file, '%') < 0 {
+		return file
+	}
+
+	segments := strings.Split(file, "/")
+
+	for i, s := range segments {
+		segments[i] = decodeSegment(s)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func decodeSegment(file string) string {
+	if strings.IndexByte(file, '%') < 0 {
+		return file
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(file); i++ {
+		if file[i] == '%' && i+2 < len(file) && isHex(file[i+1]) && isHex(file[i+2]) {
+			b.WriteByte(unhex(file[i+1])<<4 | unhex(file[i+2]))
+			i += 2
+			continue
+		}
+
+		b.WriteByte(file[i])
+	}
+
+	return b.String()
+}
+
+// namespaceDir returns the directory, relative to its collection, that holds
+// the keys of namespace ns, which ends with '/'. It fails for namespaces
+// with an empty segment, whose keys are stored flat.
+func namespaceDir(ns string) (string, bool) {
+	if ns == "" {
+		return "", true
+	}
+
+	segments := strings.Split(strings.TrimSuffix(ns, "/"), "/")
+
+	for i, s := range segments {
+		if s == "" {
+			return "", false
+		}
+
+		segments[i] = segmentName(s, true)
+	}
+
+	return strings.Join(segments, "/"), true
+}
+
+// removeEmptyParents removes the directories between root and path that
+// removing path left empty.
+func removeEmptyParents(root, path string) {
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// recordPath returns the path of the file holding a record.
+func (d *Driver) recordPath(collection, resource string) string {
+	return filepath.Join(d.dir, collection, fileName(resource)+".json")
+}
+
+// recordKey returns the key of the record stored in a file of a collection
+// directory, looking up the metadata of hashed names.
+func (d *Driver) recordKey(collection, file string) string {
+	name := strings.TrimSuffix(file, ".json")
+
+	if !strings.Contains(name, hashMarker) {
+		return keyName(name)
+	}
+
+	b, err := d.readFile(filepath.Join(d.metaPath(collection, ""), name+".json"))
+	m := recordMeta{}
+
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+
+	if err == nil && m.Key == "" {
+		err = fmt.Errorf("Missing key in metadata")
+	}
+
+	if err != nil {
+		d.log.Warn("Unable to find the key of '%s/%s': %v\n", collection, file, err)
+		return keyName(name)
+	}
+
+	return m.Key
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+func unsafeFileByte(c byte) bool {
+	return c < 0x20 || c == 0x7f || strings.IndexByte(`%/\:*?"<>|`, c) >= 0
+}
+
+// reservedDeviceName reports whether Windows would open a device instead of
+// a file named key, whatever its extension.
+func reservedDeviceName(key string) bool {
+	base := strings.ToUpper(key)
+
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+
+	base = strings.TrimRight(base, " ")
+
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+
+	return len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) && base[3] >= '0' && base[3] <= '9'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+
+	return c - 'A' + 10
+}
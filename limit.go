@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("Too many requests")
+
+// clientIdle is how long a client has to be quiet before its limits are
+// forgotten.
+const clientIdle = 10 * time.Minute
+
+// clientLimits tracks the requests of each client against the limits of a
+// Server.
+type clientLimits struct {
+	mutex   sync.Mutex
+	clients map[string]*clientState
+	swept   time.Time
+}
+
+type clientState struct {
+	tokens   float64
+	seen     time.Time
+	inFlight int
+}
+
+// ClientAddr identifies clients by the host of their remote address. It is
+// the default ServerOptions.ClientID.
+func ClientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// acquire admits a request of client, returning how long to wait before
+// retrying when it is over its limits. Admitted requests must be released.
+func (l *clientLimits) acquire(opts *ServerOptions, client string) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	if l.clients == nil {
+		l.clients = make(map[string]*clientState)
+	}
+
+	if now.Sub(l.swept) > clientIdle {
+		for id, c := range l.clients {
+			if c.inFlight == 0 && now.Sub(c.seen) > clientIdle {
+				delete(l.clients, id)
+			}
+		}
+
+		l.swept = now
+	}
+
+	burst := float64(opts.Burst)
+
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(opts.RateLimit))
+	}
+
+	c, ok := l.clients[client]
+
+	if !ok {
+		c = &clientState{tokens: burst, seen: now}
+		l.clients[client] = c
+	}
+
+	if opts.MaxConcurrent > 0 && c.inFlight >= opts.MaxConcurrent {
+		return time.Second, ErrRateLimited
+	}
+
+	if opts.RateLimit > 0 {
+		c.tokens = math.Min(burst, c.tokens+now.Sub(c.seen).Seconds()*opts.RateLimit)
+		c.seen = now
+
+		if c.tokens < 1 {
+			wait := time.Duration((1 - c.tokens) / opts.RateLimit * float64(time.Second))
+			return wait, ErrRateLimited
+		}
+
+		c.tokens--
+	}
+
+	c.seen = now
+	c.inFlight++
+
+	return 0, nil
+}
+
+func (l *clientLimits) release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if c, ok := l.clients[client]; ok {
+		c.inFlight--
+	}
+}
+
+// limit applies the limits of the server to r, writing an error response
+// and returning false when it is not to be served. When it is, done must be
+// called once it has been.
+func (s *Server) limit(w http.ResponseWriter, r *http.Request) (done func(), ok bool) {
+	return s.limits.admit(w, r, &s.opts, func(status int, message string) {
+		http.Error(w, message, status)
+	})
+}
+
+// admit applies the limits of opts to r, answering it with fail when it is
+// not to be served, as for Server.limit.
+func (l *clientLimits) admit(w http.ResponseWriter, r *http.Request, opts *ServerOptions, fail func(status int, message string)) (done func(), ok bool) {
+	if opts.MaxBodySize > 0 {
+		if r.ContentLength > opts.MaxBodySize {
+			fail(http.StatusRequestEntityTooLarge, "Request body too large")
+			return nil, false
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, opts.MaxBodySize)
+	}
+
+	if opts.RateLimit <= 0 && opts.MaxConcurrent <= 0 {
+		return func() {}, true
+	}
+
+	clientID := opts.ClientID
+
+	if clientID == nil {
+		clientID = ClientAddr
+	}
+
+	client := clientID(r)
+
+	if wait, err := l.acquire(opts, client); err != nil {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		fail(http.StatusTooManyRequests, err.Error())
+		return nil, false
+	}
+
+	return func() { l.release(client) }, true
+}
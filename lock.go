@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDeadlock is returned to the transaction chosen as the victim when
+// transactions wait on each other's collection locks. The victim is rolled
+// back, releasing its locks so the others can proceed.
+var ErrDeadlock = errors.New("Deadlock detected")
+
+const maxLockBackoff = 10 * time.Millisecond
+
+// lockTable records which transaction holds each collection lock and which
+// transaction each waiting one waits for, so cycles can be detected.
+type lockTable struct {
+	mutex  sync.Mutex
+	owners map[string]*Tx
+	waits  map[*Tx]*Tx
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		owners: make(map[string]*Tx),
+		waits:  make(map[*Tx]*Tx),
+	}
+}
+
+// Lock takes the locks of the given collections for the rest of the
+// transaction, in the order given, so reads made after it see no concurrent
+// changes to them. Collections not locked explicitly are locked by Commit.
+// If the transaction would deadlock with another, it is rolled back and
+// ErrDeadlock is returned.
+func (tx *Tx) Lock(collections ...string) error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+
+	for _, collection := range collections {
+		if err := tx.lock(collection); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *Tx) lock(collection string) error {
+	if tx.held[collection] != nil {
+		return nil
+	}
+
+	lt := tx.d.locks
+	m := tx.d.getOrCreateMutex(collection)
+	backoff := time.Millisecond / 10
+
+	for {
+		if m.Mutex.TryLock() {
+			lt.mutex.Lock()
+			lt.owners[collection] = tx
+			delete(lt.waits, tx)
+			lt.mutex.Unlock()
+
+			if tx.held == nil {
+				tx.held = make(map[string]*collectionMutex)
+			}
+
+			tx.held[collection] = m
+
+			return nil
+		}
+
+		lt.mutex.Lock()
+
+		if owner := lt.owners[collection]; owner != nil {
+			lt.waits[tx] = owner
+
+			if lt.cycle(tx) {
+				delete(lt.waits, tx)
+				lt.mutex.Unlock()
+				return ErrDeadlock
+			}
+		}
+
+		lt.mutex.Unlock()
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxLockBackoff {
+			backoff = maxLockBackoff
+		}
+	}
+}
+
+// unlock releases every collection lock held by the transaction.
+func (tx *Tx) unlock() {
+	if len(tx.held) == 0 {
+		return
+	}
+
+	lt := tx.d.locks
+	lt.mutex.Lock()
+
+	for collection := range tx.held {
+		if lt.owners[collection] == tx {
+			delete(lt.owners, collection)
+		}
+	}
+
+	delete(lt.waits, tx)
+	lt.mutex.Unlock()
+
+	for _, m := range tx.held {
+		m.Mutex.Unlock()
+	}
+
+	tx.held = nil
+}
+
+// cycle reports whether following the waits-for edges from tx leads back to
+// it. Callers must hold lt.mutex.
+func (lt *lockTable) cycle(tx *Tx) bool {
+	seen := make(map[*Tx]bool)
+
+	for next := lt.waits[tx]; next != nil; next = lt.waits[next] {
+		if next == tx {
+			return true
+		}
+
+		if seen[next] {
+			return false
+		}
+
+		seen[next] = true
+	}
+
+	return false
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
@@ -24,20 +27,195 @@ type Driver struct {
 	mutex   sync.Mutex
 	dir     string
 	log     Logger
-	mutexes map[string]*sync.Mutex
+	opts    Options
+	mutexes map[string]*collectionMutex
+	indexes atomic.Value
+	keys    sync.Map
+
+	comparators map[string]Comparator
+	collections atomic.Value
+	generations sync.Map
+	capOrders   sync.Map
+	expiries    *expiries
+	sweepStats  SweepStats
+	compaction  CompactionStatus
+	quota       *quota
+	files       fdPool
+	cache       *tieredCache
+	journal     *journal
+	locks       *lockTable
+	syncer      *syncer
+	verified    *VerifyReport
+	buffer      *writeBuffer
+	clock       hlcClock
+	subjects    subjectKeys
+	floors      revisionFloors
+	listeners   atomic.Value
+	changes     *changeLog
+	tiering     *tiering
+
+	policyMutex sync.Mutex
+	policies    map[string]CollectionPolicy
+	lock        *os.File
+	tasks       *supervisor
+	metrics     metrics
+
+	serviceMutex sync.Mutex
+	services     map[shutdowner]bool
+	closed       int32
+
+	fence     sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type Options struct {
 	Logger
+
+	SweepInterval time.Duration
+	Compaction    *CompactionOptions
+
+	Tombstones         bool
+	TombstoneRetention time.Duration
+
+	Encryption Encryption
+
+	// Keyring encrypts collections under keys of their own.
+	Keyring *Keyring
+
+	// SigningKey signs every stored record with an HMAC under it, checked
+	// on read, so that records changed on disk other than through the
+	// driver fail to read with ErrTampered. Records written without it
+	// are rejected too once it is set.
+	SigningKey []byte
+
+	// Shredding gives the records of each subject, as named by the field
+	// set with SetSubjectField, a data key of their own, which Forget
+	// destroys to erase them.
+	Shredding *ShreddingOptions
+
+	// MaxBytes limits the bytes taken by the records of the database and
+	// MaxRecords the number of records in each collection. Writes that would
+	// exceed them fail with ErrQuotaExceeded.
+	MaxBytes   int64
+	MaxRecords int
+
+	// MaxDocumentSize limits the size of a single document, as serialized
+	// JSON before compression and encryption.
+	MaxDocumentSize int
+
+	// MaxOpenFiles bounds the files the driver holds open at once. It
+	// defaults to 256.
+	MaxOpenFiles int
+
+	// RejectSymlinkDir makes New fail when the database directory is a
+	// symbolic link. Links inside the database are never followed.
+	RejectSymlinkDir bool
+
+	// Watch keeps indexes, expiries and usage up to date with records
+	// changed on disk by other processes.
+	Watch bool
+
+	// CacheSize is the number of decoded records kept in memory for reads.
+	// The cache is disabled when it is zero.
+	CacheSize int
+
+	// CacheTiers are caches of decoded records behind the memory cache,
+	// fastest first, such as a MirrorTier. Records read from disk are put
+	// in each, and writes go through to them. The driver closes them when
+	// it is closed.
+	CacheTiers []CacheTier
+
+	// JournalSize is the number of recent operations kept, with the values
+	// they replaced, for Undo. The journal is disabled when it is zero.
+	JournalSize int
+
+	// History keeps every version of each record for ReadAsOf, pruning
+	// versions once HistoryRetention has passed. A zero retention keeps
+	// history forever.
+	History          bool
+	HistoryRetention time.Duration
+
+	// Durability controls whether writes are flushed to disk before they
+	// return. With DurabilitySync, GroupCommit batches the flushes of
+	// concurrent writers over this window.
+	Durability  Durability
+	GroupCommit time.Duration
+
+	// KeyNormalization is the Unicode form resource names are normalized
+	// to before they reach the filesystem. It defaults to NFC.
+	KeyNormalization KeyNormalization
+
+	// KeyIndex keeps the sorted key index of each collection on disk,
+	// under .indexes, so Scan, Keys and Count do not list the collection
+	// directory even after a restart.
+	KeyIndex bool
+
+	// Indexes declares the field indexes to keep, by collection. IndexBuild
+	// chooses whether they and the key indexes are built by New or on
+	// first use.
+	Indexes    map[string][]string
+	IndexBuild IndexBuild
+
+	// VerifyOnOpen makes New scan the database for files left broken by a
+	// crash and clean them up. See Driver.Verification for the report.
+	VerifyOnOpen bool
+
+	// MinFreeSpace is the free space, in bytes, Open requires on the
+	// filesystem of the database. It defaults to 16 MiB; a negative value
+	// skips the check.
+	MinFreeSpace int64
+
+	// Retry controls the retries of renames, writes and removals that fail
+	// with transient errors. Nil uses the default policy.
+	Retry *RetryPolicy
+
+	// ChunkSize splits records whose stored form is larger than it into
+	// chunks of that many bytes, kept under .chunks, so that no single file
+	// grows past it. Records that would need more than 512 chunks get
+	// larger ones, to keep their manifest small. Zero stores every record
+	// in one file.
+	ChunkSize int
+
+	// ArraySegmentSize is the number of items in each segment of the
+	// arrays written with ArrayAppend. It defaults to 1000.
+	ArraySegmentSize int
+
+	// WriteBuffer holds Writes in memory and writes them out in batches, on
+	// Flush, on Close, or when one of its limits is reached. Until then
+	// they can be lost in a crash. Any other change to a collection, and
+	// reads of it, write out its buffered writes first.
+	WriteBuffer *WriteBufferOptions
+
+	// Faults injects failures into file operations, for crash testing.
+	Faults *FaultInjector
+
+	// NodeID names this database among its replicas in the clocks stamped
+	// on its changes.
+	NodeID string
+
+	// ChangeLog keeps the changes made through the driver on disk, for
+	// Changes and StartSink.
+	ChangeLog *ChangeLogOptions
+
+	// Tiering moves records to cold storage in an object store, as the
+	// tier policies of their collections decide. Cold records stay
+	// readable, fetched from the store on read.
+	Tiering *TieringOptions
 }
 
-func New(dir string, options *Options) (*Driver, error) {
+// New opens the database in dir, creating it if needed, configured by
+// options: either an *Options, which may be nil, or With options such as
+// WithCache and WithFsync, applied in order.
+func New(dir string, options ...Option) (*Driver, error) {
 	dir = filepath.Clean(dir)
 
 	opts := Options{}
 
-	if options != nil {
-		opts = *options
+	for _, option := range options {
+		if option != nil {
+			option.apply(&opts)
+		}
 	}
 
 	if opts.Logger == nil {
@@ -47,96 +225,370 @@ func New(dir string, options *Options) (*Driver, error) {
 	driver := &Driver{
 		dir:     dir,
 		log:     opts.Logger,
-		mutexes: make(map[string]*sync.Mutex),
+		opts:    opts,
+		mutexes: make(map[string]*collectionMutex),
+
+		comparators: map[string]Comparator{"semver": compareSemver},
+		expiries:    newExpiries(),
+		files:       newFDPool(opts.MaxOpenFiles),
+		journal:     newJournal(opts.JournalSize),
+		locks:       newLockTable(),
+		syncer:      &syncer{window: opts.GroupCommit},
+		clock:       hlcClock{node: opts.NodeID},
+		tasks:       newSupervisor(opts.Logger),
+		done:        make(chan struct{}),
+	}
+
+	driver.cache = driver.newTieredCache(newRecordCache(opts.CacheSize), opts.CacheTiers)
+
+	if opts.WriteBuffer != nil {
+		driver.buffer = newWriteBuffer(*opts.WriteBuffer)
+	}
+
+	if opts.Keyring != nil {
+		if err := opts.Keyring.check(); err != nil {
+			return driver, err
+		}
+	}
+
+	if opts.Shredding != nil && opts.Shredding.MasterKey == nil {
+		return driver, fmt.Errorf("Missing master key")
+	}
+
+	if opts.Tiering != nil {
+		t, err := newTiering(*opts.Tiering)
+
+		if err != nil {
+			return driver, err
+		}
+
+		driver.tiering = t
+	}
+
+	if opts.RejectSymlinkDir {
+		if err := checkDatabaseDir(dir); err != nil && !os.IsNotExist(err) {
+			return driver, err
+		}
 	}
 
 	if _, err := stat(dir); err == nil {
 		opts.Logger.Debug("'%s' Database is already exists\n", dir)
-		return driver, nil
+	} else {
+		opts.Logger.Debug("Creating the database at '%s'\n", dir)
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return driver, err
+		}
+	}
+
+	if opts.ChangeLog != nil {
+		changes, err := driver.openChangeLog(*opts.ChangeLog)
+
+		if err != nil {
+			return driver, err
+		}
+
+		driver.changes = changes
+	}
+
+	if err := driver.loadPolicies(); err != nil {
+		return driver, err
+	}
+
+	if opts.VerifyOnOpen {
+		report, err := driver.verify()
+
+		if err != nil {
+			return driver, err
+		}
+
+		report.log(driver.log)
+		driver.verified = report
+	}
+
+	if opts.MaxBytes > 0 || opts.MaxRecords > 0 {
+		if err := driver.loadQuota(); err != nil {
+			return driver, err
+		}
+	}
+
+	if opts.IndexBuild == IndexBuildEager {
+		if err := driver.buildIndexes(); err != nil {
+			return driver, err
+		}
+	}
+
+	if opts.Watch {
+		if err := driver.watch(); err != nil {
+			return driver, err
+		}
+	}
+
+	if opts.SweepInterval > 0 {
+		driver.tasks.start("sweeper", opts.SweepInterval, restartAlways, driver.sweeper)
+	}
+
+	if opts.Compaction != nil && opts.Compaction.Interval > 0 {
+		o := *opts.Compaction
+
+		driver.tasks.start("compactor", o.Interval, restartAlways, func(ctx context.Context, t *task) error {
+			return driver.compactor(ctx, t, o)
+		})
+	}
+
+	if opts.WriteBuffer != nil && opts.WriteBuffer.MaxDelay > 0 {
+		driver.tasks.start("flusher", opts.WriteBuffer.MaxDelay, restartAlways, driver.flusher)
+	}
+
+	if opts.Tiering != nil && opts.Tiering.Interval > 0 {
+		driver.tasks.start("tierer", opts.Tiering.Interval, restartAlways, driver.tierer)
+	}
+
+	return driver, nil
+}
+
+// Close stops the background work started by New and flushes the buffered
+// writes. The driver must not be used afterwards.
+func (d *Driver) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+
+	d.tasks.close()
+
+	err := d.Flush()
+
+	if d.changes != nil {
+		d.changes.close()
 	}
 
-	opts.Logger.Debug("Creating the database at '%s'\n", dir)
+	d.cache.close()
+
+	if d.lock != nil {
+		d.lock.Close()
+	}
 
-	return driver, os.MkdirAll(dir, 0755)
+	return err
 }
 
-func (d *Driver) Write(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("Missing collection")
+func (d *Driver) Write(collection, resource string, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "write", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
 	}
 
 	if resource == "" {
 		return fmt.Errorf("Missing resource")
 	}
 
+	resource = d.key(resource)
+
+	if d.buffer != nil {
+		return d.bufferWrite(collection, resource, v)
+	}
+
+	if d.opts.Durability == DurabilitySync {
+		return d.writeStaged(collection, resource, v, d.opts.Durability)
+	}
+
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resource+".json")
-	tmpPath := fnlPath + ".tmp"
+	return d.write(collection, resource, v)
+}
+
+// write stores v as the new value of a record and journals the change.
+// Callers must hold the collection lock.
+func (d *Driver) write(collection, resource string, v interface{}) error {
+	return d.journaled(OpWrite, collection, resource, func() error {
+		return d.store(collection, resource, v)
+	})
+}
+
+// store writes v as the new value of a record. Callers must hold the
+// collection lock.
+func (d *Driver) store(collection, resource string, v interface{}) error {
+	return d.storeWith(collection, resource, v, d.opts.Durability)
+}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
+func (d *Driver) storeWith(collection, resource string, v interface{}, durability Durability) error {
+	if err := os.MkdirAll(filepath.Dir(d.recordPath(collection, resource)), 0755); err != nil {
 		return err
 	}
 
-	b, err := json.MarshalIndent(v, "", "\t")
+	b, stored, err := d.encodeDocument(collection, resource, v)
 
 	if err != nil {
 		return err
 	}
 
-	b = append(b, byte('\n'))
+	return d.storeEncoded(collection, resource, b, stored, "", durability)
+}
+
+// encodeDocument marshals v and encodes it for storage, returning both the
+// JSON and the stored bytes. It needs no lock.
+func (d *Driver) encodeDocument(collection, resource string, v interface{}) ([]byte, []byte, error) {
+	b, err := d.marshalDocument(collection, v)
 
-	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
-		return err
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return os.Rename(tmpPath, fnlPath)
+	if err := d.checkDocumentSize(collection, resource, len(b)); err != nil {
+		return nil, nil, err
+	}
+
+	stored, err := d.encodeRecord(collection, resource, b)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, stored, nil
 }
 
-func (d *Driver) Read(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("Missing collection")
+// storeEncoded makes stored the new value of a record. The bytes are
+// written to the record's temporary file, unless staged names a file they
+// were already written and synced to, which is removed if the store fails.
+// Callers must hold the collection lock.
+func (d *Driver) storeEncoded(collection, resource string, b, stored []byte, staged string, durability Durability) (err error) {
+	if err := d.writable(); err != nil {
+		return err
 	}
 
-	if resource == "" {
-		return fmt.Errorf("Missing resource")
+	fnlPath := d.recordPath(collection, resource)
+	tmpPath := fnlPath + ".tmp"
+	dir := filepath.Dir(fnlPath)
+
+	if staged != "" {
+		tmpPath = staged
+
+		defer func() {
+			if err != nil {
+				os.Remove(staged)
+			}
+		}()
+	}
+
+	if err := d.checkKeyCollision(collection, resource); err != nil {
+		return err
+	}
+
+	oldSize := d.recordSize(fnlPath)
+	newSize := storedSize(stored)
+
+	d.bloomAdd(collection, resource)
+
+	if err := d.reserve(collection, oldSize, newSize); err != nil {
+		return err
+	}
+
+	if staged == "" {
+		if err := d.writeFile(tmpPath, stored, 0644); err != nil {
+			d.unreserve(collection, oldSize, newSize)
+			return err
+		}
+
+		if err := d.syncWrite(durability, tmpPath); err != nil {
+			d.unreserve(collection, oldSize, newSize)
+			return err
+		}
+	}
+
+	written, err := d.recordWritten(collection, resource, false)
+
+	if err != nil {
+		d.unreserve(collection, oldSize, newSize)
+		return err
+	}
+
+	if err := d.replaceFile(tmpPath, fnlPath); err != nil {
+		written(false)
+		d.unreserve(collection, oldSize, newSize)
+		return err
+	}
+
+	written(true)
+
+	// The record is in place once renamed, so the change is published even
+	// if syncing the directory fails.
+	synced := d.syncPublished(durability, collection, dir)
+
+	d.changedRecord(collection, resource, b)
+	d.updateIndexes(collection, resource, b)
+	d.recordHistory(collection, resource, stored)
+	d.notify(collection, resource, b)
+
+	if err := d.evict(collection, resource); err != nil {
+		return err
 	}
 
-	record := filepath.Join(d.dir, collection, resource)
+	return synced
+}
+
+func (d *Driver) Read(collection, resource string, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	resource, err = d.checkRead(collection, resource)
 
-	if _, err := stat(record); err != nil {
+	if err != nil {
 		return err
 	}
 
-	b, err := ioutil.ReadFile(record + ".json")
+	b, err := d.readRecord(collection, resource)
 
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(b, &v)
+	return d.decode(collection, b, v)
 }
 
-func (d *Driver) ReadAll(collection string) ([]string, error) {
-	if collection == "" {
-		return nil, fmt.Errorf("Missing collection")
+func (d *Driver) ReadAll(collection string) (_ []string, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, "")
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
 	}
 
+	d.flushCollection(collection)
+
 	dir := filepath.Join(d.dir, collection)
 
 	if _, err := stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCollectionNotFound
+		}
 		return nil, err
 	}
 
-	files, _ := ioutil.ReadDir(dir)
+	files, _ := d.readTree(dir)
 
 	var records []string
 
 	for _, file := range files {
-		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		resource := d.recordKey(collection, file.Name())
+
+		if d.expired(collection, resource) {
+			continue
+		}
+
+		var (
+			b   []byte
+			err error
+		)
+
+		if isRecordFile(file) {
+			b, err = d.readRecord(collection, resource)
+		} else {
+			b, err = d.readRecordFile(collection, resource, filepath.Join(dir, file.Name()))
+		}
+
+		if errors.Is(err, ErrForgotten) {
+			continue
+		}
 
 		if err != nil {
 			return nil, err
@@ -148,66 +600,299 @@ func (d *Driver) ReadAll(collection string) ([]string, error) {
 	return records, nil
 }
 
-func (d *Driver) Update(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("Missing collection")
+func (d *Driver) Update(collection, resource string, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "update", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
 	}
 
 	if resource == "" {
 		return fmt.Errorf("Missing resource")
 	}
 
+	resource = d.key(resource)
+
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	dir := filepath.Join(d.dir, collection, resource+".json")
+	return d.journaled(OpUpdate, collection, resource, func() error {
+		return d.update(collection, resource, v)
+	})
+}
 
-	if _, err := stat(dir); err != nil {
+// update replaces the value of an existing record, keeping its expiry. Callers must hold the collection lock.
+func (d *Driver) update(collection, resource string, v interface{}) error {
+	dir := d.recordPath(collection, resource)
+
+	fi, err := stat(dir)
+
+	if os.IsNotExist(err) {
+		return d.notFound(collection)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b, err := d.marshalDocument(collection, v)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.checkDocumentSize(collection, resource, len(b)); err != nil {
+		return err
+	}
+
+	stored, err := d.encodeRecord(collection, resource, b)
+
+	if err != nil {
+		return err
+	}
+
+	oldSize, newSize := d.fileSize(dir, fi), storedSize(stored)
+
+	if err := d.reserve(collection, oldSize, newSize); err != nil {
+		return err
+	}
+
+	if err := d.writeFile(dir+".tmp", stored, 0644); err != nil {
+		d.unreserve(collection, oldSize, newSize)
+		return err
+	}
+
+	if err := d.syncWrite(d.opts.Durability, dir+".tmp"); err != nil {
+		d.unreserve(collection, oldSize, newSize)
 		return err
 	}
 
-	b, err := json.MarshalIndent(v, "", "\t")
+	written, err := d.recordWritten(collection, resource, true)
 
 	if err != nil {
+		d.unreserve(collection, oldSize, newSize)
 		return err
 	}
 
-	b = append(b, byte('\n'))
+	if err := d.replaceFile(dir+".tmp", dir); err != nil {
+		written(false)
+		d.unreserve(collection, oldSize, newSize)
+		return err
+	}
+
+	written(true)
+
+	synced := d.syncPublished(d.opts.Durability, collection, filepath.Dir(dir))
 
-	return ioutil.WriteFile(dir, b, 0644)
+	d.changedRecord(collection, resource, b)
+	d.updateIndexes(collection, resource, b)
+	d.recordHistory(collection, resource, stored)
+	d.notify(collection, resource, b)
+
+	if err := d.evict(collection, resource); err != nil {
+		return err
+	}
+
+	return synced
 }
 
-func (d *Driver) Delete(collection, resource string) error {
-	path := filepath.Join(collection, resource)
+func (d *Driver) Delete(collection, resource string) (err error) {
+	defer d.observe(time.Now(), &err, "delete", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	resource = d.key(resource)
 
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	dir := filepath.Join(d.dir, path)
+	return d.delete(collection, resource)
+}
+
+// delete removes a record, or the whole collection when resource is empty,
+// and journals the change. Callers must hold the collection lock.
+func (d *Driver) delete(collection, resource string) error {
+	return d.journaled(OpDelete, collection, resource, func() error {
+		return d.remove(collection, resource)
+	})
+}
+
+// remove deletes a record, or the whole collection when resource is empty.
+// Callers must hold the collection lock.
+func (d *Driver) remove(collection, resource string) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
 
-	switch fi, err := stat(dir); {
-	case fi == nil, err != nil:
-		return fmt.Errorf("Unable to find file or directory named %v", path)
+	dir := filepath.Join(d.dir, collection)
+	path := dir
+
+	if resource != "" {
+		path = d.recordPath(collection, resource)
+	}
+
+	switch fi, err := os.Stat(path); {
+	case os.IsNotExist(err) && resource == "":
+		return ErrCollectionNotFound
+
+	case os.IsNotExist(err):
+		return d.notFound(collection)
+
+	case err != nil:
+		return err
 
 	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
+		var removed []string
+
+		if d.opts.History || d.listening() {
+			removed, _ = d.resources(collection)
+		}
+
+		if d.opts.Tombstones && resource == "" {
+			if err := d.tombstoneAll(collection); err != nil {
+				return err
+			}
+		}
+
+		if err := d.removeAll(dir); err != nil {
+			return err
+		}
+
+		for _, r := range removed {
+			d.recordHistory(collection, r, nil)
+			d.notify(collection, r, nil)
+		}
+
+		d.releaseCollection(collection)
+		d.changedRecord(collection, resource, nil)
+		d.removeFromIndexes(collection, resource)
+		d.forgetExpiries(collection, resource)
+		d.forgetCapped(collection, resource)
+
+		if d.opts.Tombstones {
+			return nil
+		}
+
+		if err := d.retireMetas(collection); err != nil {
+			return err
+		}
+
+		return d.removeMeta(collection, resource)
 
 	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json")
+		size := d.fileSize(path, fi)
+
+		defer d.changedRecord(collection, resource, nil)
+		d.removeFromIndexes(collection, resource)
+		d.forgetExpiries(collection, resource)
+		d.forgetCapped(collection, resource)
+
+		if d.opts.Tombstones {
+			if err := d.tombstone(collection, resource); err != nil {
+				return err
+			}
+
+			d.recordHistory(collection, resource, nil)
+			d.notify(collection, resource, nil)
+
+			if err := d.syncWrite(d.opts.Durability, filepath.Dir(path)); err != nil {
+				return err
+			}
+
+			removeEmptyParents(dir, path)
+
+			return nil
+		}
+
+		if err := d.removeAll(path); err != nil {
+			return err
+		}
+
+		if err := d.syncWrite(d.opts.Durability, filepath.Dir(path)); err != nil {
+			return err
+		}
+
+		removeEmptyParents(dir, path)
+		d.release(collection, size)
+		d.recordHistory(collection, resource, nil)
+		d.notify(collection, resource, nil)
+
+		return d.retireMeta(collection, resource)
 	}
 
 	return nil
 }
 
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
+// collectionMutex serializes the changes to a collection. Holding it also
+// holds off Snapshot, which takes the fence exclusively. The fence is always
+// taken after the collection mutex, so a transaction holding collection
+// mutexes while it waits for a snapshot cannot deadlock with it.
+type collectionMutex struct {
+	sync.Mutex
+	fence *sync.RWMutex
+	flush func()
+
+	// waiting counts the callers blocked in Lock, for Debug.
+	waiting int32
+
+	// deferring and syncs hold the directory syncs a holder of the lock
+	// waits for once it is released. See deferSyncs.
+	deferring bool
+	syncs     []*syncBatch
+}
+
+// Lock also writes out the buffered writes of the collection, so that every
+// change made under the lock comes after them.
+func (m *collectionMutex) Lock() {
+	atomic.AddInt32(&m.waiting, 1)
+	m.Mutex.Lock()
+	atomic.AddInt32(&m.waiting, -1)
+	m.fence.RLock()
+
+	if m.flush != nil {
+		m.flush()
+	}
+}
+
+// TryLock is Lock for callers that would rather give up than wait.
+func (m *collectionMutex) TryLock() bool {
+	if !m.Mutex.TryLock() {
+		return false
+	}
+
+	if !m.fence.TryRLock() {
+		m.Mutex.Unlock()
+		return false
+	}
+
+	if m.flush != nil {
+		m.flush()
+	}
+
+	return true
+}
+
+func (m *collectionMutex) Unlock() {
+	m.fence.RUnlock()
+	m.Mutex.Unlock()
+}
+
+func (d *Driver) getOrCreateMutex(collection string) *collectionMutex {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	m, ok := d.mutexes[collection]
 
 	if !ok {
-		m = &sync.Mutex{}
+		m = &collectionMutex{fence: &d.fence}
+
+		if d.buffer != nil {
+			m.flush = func() { d.applyBuffered(collection) }
+		}
+
 		d.mutexes[collection] = m
 	}
 
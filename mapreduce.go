@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type MapFunc func(resource string, doc map[string]interface{}, emit func(key string, value interface{})) error
+
+type ReduceFunc func(key string, values []interface{}) (interface{}, error)
+
+type MapReduceOptions struct {
+	Filter  Filter
+	Workers int
+}
+
+type mapJob struct {
+	resource string
+	b        []byte
+	doc      map[string]interface{}
+}
+
+// MapReduce streams the records of collection through mapFn on a pool of
+// workers and then reduces the values emitted for each key with reduceFn.
+// Workers keep their own emitted values, which are merged once the scan has
+// finished, so mapFn never contends on shared state.
+func (d *Driver) MapReduce(collection string, mapFn MapFunc, reduceFn ReduceFunc, opts *MapReduceOptions) (map[string]interface{}, error) {
+	if mapFn == nil || reduceFn == nil {
+		return nil, fmt.Errorf("Missing map or reduce function")
+	}
+
+	o := MapReduceOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	q, err := d.Prepare(o.Filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		jobs    = make(chan mapJob)
+		done    = make(chan struct{})
+		wg      sync.WaitGroup
+		once    sync.Once
+		mapErr  error
+		emitted = make([]map[string][]interface{}, o.Workers)
+	)
+
+	fail := func(err error) {
+		once.Do(func() {
+			mapErr = err
+			close(done)
+		})
+	}
+
+	for w := 0; w < o.Workers; w++ {
+		out := make(map[string][]interface{})
+		emitted[w] = out
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			emit := func(key string, value interface{}) {
+				out[key] = append(out[key], value)
+			}
+
+			for job := range jobs {
+				doc := job.doc
+
+				if doc == nil {
+					if err := json.Unmarshal(job.b, &doc); err != nil {
+						fail(fmt.Errorf("Unable to decode %v/%v: %w", collection, job.resource, err))
+						continue
+					}
+				}
+
+				if err := mapFn(job.resource, doc, emit); err != nil {
+					fail(fmt.Errorf("Map %v/%v: %w", collection, job.resource, err))
+				}
+			}
+		}()
+	}
+
+	err = q.each(collection, nil, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		select {
+		case jobs <- mapJob{resource: resource, b: b, doc: doc}:
+			return nil
+		case <-done:
+			return errStop
+		}
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if mapErr != nil {
+		return nil, mapErr
+	}
+
+	merged := make(map[string][]interface{})
+
+	for _, out := range emitted {
+		for key, values := range out {
+			merged[key] = append(merged[key], values...)
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+
+	for key := range merged {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	results := make(map[string]interface{}, len(keys))
+
+	for _, key := range keys {
+		v, err := reduceFn(key, merged[key])
+
+		if err != nil {
+			return nil, fmt.Errorf("Reduce %v: %w", key, err)
+		}
+
+		results[key] = v
+	}
+
+	return results, nil
+}
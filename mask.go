@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type MaskAction int
+
+const (
+	// MaskRedact replaces the value of the field with "[REDACTED]".
+	MaskRedact MaskAction = iota
+
+	// MaskHash replaces the value of the field with a hash of it, keyed
+	// with ExportOptions.MaskKey, so equal values still match each other
+	// across records and collections.
+	MaskHash
+
+	// MaskRemove drops the field.
+	MaskRemove
+)
+
+const redacted = "[REDACTED]"
+
+// Mask hides a field, a dotted path, of the exported documents.
+type Mask struct {
+	Field  string
+	Action MaskAction
+}
+
+// mask applies the masks to the record b.
+func mask(b []byte, masks []Mask, key []byte) ([]byte, error) {
+	var doc map[string]interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, m := range masks {
+		v, ok := lookupField(doc, m.Field)
+
+		if !ok {
+			continue
+		}
+
+		path := strings.Split(m.Field, ".")
+
+		switch m.Action {
+		case MaskRedact:
+			setPath(doc, path, redacted)
+
+		case MaskHash:
+			raw, err := json.Marshal(v)
+
+			if err != nil {
+				return nil, err
+			}
+
+			mac := hmac.New(sha256.New, key)
+			mac.Write(raw)
+			setPath(doc, path, hex.EncodeToString(mac.Sum(nil)))
+
+		case MaskRemove:
+			deleteField(doc, m.Field)
+
+		default:
+			return nil, fmt.Errorf("Unknown mask action %v", m.Action)
+		}
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MemcacheOptions configures a MemcacheServer.
+type MemcacheOptions struct {
+	// Collection holds the items, "cache" by default.
+	Collection string
+
+	// MaxItemSize caps the size of item values, 1 MiB by default as in
+	// memcached.
+	MaxItemSize int
+}
+
+// MemcacheServer serves the memcached text protocol from a collection:
+// get, gets, set, add, replace, cas, delete, touch, version and quit. Items
+// are records holding their value and flags, and expire like records
+// written with WriteWithTTL. CAS values are record revisions.
+type MemcacheServer struct {
+	db   *Driver
+	opts MemcacheOptions
+
+	tcp tcpServer
+}
+
+// memcacheItem is the record an item is stored as. Values that are valid
+// UTF-8 are kept readable in Value, others in Data.
+type memcacheItem struct {
+	Value string `json:"value,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	Flags uint32 `json:"flags,omitempty"`
+}
+
+func (i *memcacheItem) bytes() []byte {
+	if i.Data != nil {
+		return i.Data
+	}
+
+	return []byte(i.Value)
+}
+
+func NewMemcacheServer(db *Driver, opts *MemcacheOptions) (*MemcacheServer, error) {
+	s := &MemcacheServer{db: db}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if s.opts.Collection == "" {
+		s.opts.Collection = "cache"
+	}
+
+	if s.opts.MaxItemSize <= 0 {
+		s.opts.MaxItemSize = 1 << 20
+	}
+
+	if err := checkCollection(s.opts.Collection); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *MemcacheServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *MemcacheServer) Serve(l net.Listener) error {
+	defer s.db.track(s)()
+
+	return s.tcp.serve(l, s.db.log, s.serveConn)
+}
+
+// Close stops the listeners and drops the open connections.
+func (s *MemcacheServer) Close() error {
+	return s.tcp.close()
+}
+
+// Shutdown stops the listeners and waits for the commands being served to
+// finish, dropping the connections that are left when ctx is done.
+func (s *MemcacheServer) Shutdown(ctx context.Context) error {
+	return s.tcp.shutdown(ctx)
+}
+
+func (s *MemcacheServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := readLine(r)
+
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if !s.command(r, w, fields) {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkMemcacheKey applies the memcached rules for keys: at most 250 bytes,
+// without spaces or control characters.
+func checkMemcacheKey(key string) bool {
+	if key == "" || len(key) > 250 {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7F {
+			return false
+		}
+	}
+
+	return true
+}
+
+// command runs one command, returning false when the connection is to be
+// closed.
+func (s *MemcacheServer) command(r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	name, args := fields[0], fields[1:]
+
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	reply := func(msg string) {
+		if !noreply {
+			w.WriteString(msg + "\r\n")
+		}
+	}
+
+	switch name {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+
+		for _, key := range args {
+			if !s.writeItem(w, key, name == "gets") {
+				return true
+			}
+		}
+
+		w.WriteString("END\r\n")
+
+	case "set", "add", "replace", "cas":
+		want := 4
+
+		if name == "cas" {
+			want = 5
+		}
+
+		if len(args) != want {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		size, err3 := strconv.Atoi(args[3])
+
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return true
+		}
+
+		if size > s.opts.MaxItemSize {
+			// The data is dropped unread, as memcached does, leaving the
+			// client to be closed.
+			w.WriteString("SERVER_ERROR object too large for cache\r\n")
+			return false
+		}
+
+		data := make([]byte, size+2)
+
+		if _, err := io.ReadFull(r, data); err != nil {
+			return false
+		}
+
+		if string(data[size:]) != "\r\n" {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return true
+		}
+
+		if !checkMemcacheKey(args[0]) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return true
+		}
+
+		var cond Condition
+
+		switch name {
+		case "add":
+			cond = existsCondition{want: false}
+		case "replace":
+			cond = existsCondition{want: true}
+		case "cas":
+			unique, err := strconv.ParseInt(args[4], 10, 64)
+
+			if err != nil {
+				w.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return true
+			}
+
+			cond = IfRevision(unique)
+		}
+
+		reply(s.store(args[0], data[:size], uint32(flags), exptime, cond))
+
+	case "delete":
+		if len(args) != 1 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+
+		switch err := s.db.Delete(s.opts.Collection, args[0]); {
+		case err == nil:
+			reply("DELETED")
+		case errors.Is(err, ErrNotFound):
+			reply("NOT_FOUND")
+		default:
+			reply("SERVER_ERROR " + err.Error())
+		}
+
+	case "touch":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return true
+		}
+
+		switch err := s.expire(args[0], exptime); {
+		case err == nil:
+			reply("TOUCHED")
+		case errors.Is(err, ErrNotFound):
+			reply("NOT_FOUND")
+		default:
+			reply("SERVER_ERROR " + err.Error())
+		}
+
+	case "version":
+		w.WriteString("VERSION 1.6.0 go-json-database\r\n")
+
+	case "quit":
+		return false
+
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return true
+}
+
+// writeItem writes the VALUE line and data of key when it exists,
+// returning false after writing an error.
+func (s *MemcacheServer) writeItem(w *bufio.Writer, key string, withCAS bool) bool {
+	if !checkMemcacheKey(key) {
+		return true
+	}
+
+	b, revision, err := s.db.current(s.opts.Collection, s.db.key(key))
+
+	if err != nil {
+		w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return false
+	}
+
+	if b == nil {
+		return true
+	}
+
+	var item memcacheItem
+
+	if err := json.Unmarshal(b, &item); err != nil {
+		w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return false
+	}
+
+	data := item.bytes()
+
+	if withCAS {
+		fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.Flags, len(data), revision)
+	} else {
+		fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.Flags, len(data))
+	}
+
+	w.Write(data)
+	w.WriteString("\r\n")
+
+	return true
+}
+
+func (s *MemcacheServer) store(key string, data []byte, flags uint32, exptime int64, cond Condition) string {
+	item := memcacheItem{Flags: flags}
+
+	if utf8.Valid(data) && len(data) > 0 {
+		item.Value = string(data)
+	} else {
+		item.Data = data
+	}
+
+	var err error
+
+	if cond == nil {
+		err = s.db.Write(s.opts.Collection, key, item)
+	} else {
+		err = s.db.WriteIf(s.opts.Collection, key, item, cond)
+	}
+
+	if errors.Is(err, ErrConditionFailed) {
+		if _, ok := cond.(revisionCondition); ok {
+			if b, _, _ := s.db.current(s.opts.Collection, s.db.key(key)); b == nil {
+				return "NOT_FOUND"
+			}
+			return "EXISTS"
+		}
+		return "NOT_STORED"
+	}
+
+	if err == nil && exptime != 0 {
+		err = s.expire(key, exptime)
+	}
+
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+
+	return "STORED"
+}
+
+// expire applies a memcached expiration time: none when zero, seconds from
+// now up to 30 days, a Unix time beyond that, and already expired when
+// negative.
+func (s *MemcacheServer) expire(key string, exptime int64) error {
+	switch {
+	case exptime == 0:
+		err := s.db.Persist(s.opts.Collection, key)
+
+		if err == nil {
+			_, err = s.db.ReadRaw(s.opts.Collection, key)
+		}
+
+		return err
+
+	case exptime < 0:
+		return s.db.Delete(s.opts.Collection, key)
+	}
+
+	ttl := time.Duration(exptime) * time.Second
+
+	if exptime > 30*24*60*60 {
+		ttl = time.Until(time.Unix(exptime, 0))
+
+		if ttl <= 0 {
+			return s.db.Delete(s.opts.Collection, key)
+		}
+	}
+
+	return s.db.Expire(s.opts.Collection, key, ttl)
+}
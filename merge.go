@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMergeConflict is returned by MergeFields when both sides changed the
+// same field differently.
+var ErrMergeConflict = errors.New("Merge conflict")
+
+// MergeFunc merges two concurrent changes to a document: base is the
+// version both changes started from, mine the one being written and theirs
+// the one written in the meantime. It returns the document to write.
+type MergeFunc func(base, mine, theirs json.RawMessage) (interface{}, error)
+
+// SetMergeFunc has fn merge the updates made with UpdateFrom to records of
+// collection that were written since they were read. A nil fn removes it.
+func (d *Driver) SetMergeFunc(collection string, fn MergeFunc) {
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.merge = fn
+	})
+}
+
+// UpdateFrom updates a record that was read as base at revision and
+// changed into v. When the record has been written since, v is merged with
+// its current value by the merge function of the collection, under the
+// collection lock; without one the update fails with ErrConditionFailed.
+func (d *Driver) UpdateFrom(collection, resource string, revision int64, base, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "update", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.journaled(OpUpdate, collection, resource, func() error {
+		current, rev, err := d.current(collection, resource)
+
+		if err != nil {
+			return err
+		}
+
+		if current == nil {
+			return d.notFound(collection)
+		}
+
+		if rev == revision {
+			return d.update(collection, resource, v)
+		}
+
+		fn := d.config(collection).merge
+
+		if fn == nil {
+			return ErrConditionFailed
+		}
+
+		b, err := marshalRecord(base)
+
+		if err != nil {
+			return err
+		}
+
+		mine, err := d.marshalDocument(collection, v)
+
+		if err != nil {
+			return err
+		}
+
+		merged, err := fn(b, mine, current)
+
+		if err != nil {
+			return err
+		}
+
+		return d.update(collection, resource, merged)
+	})
+}
+
+// MergeFields merges documents field by field: a field changed on one side
+// only takes that change, and objects changed on both sides are merged in
+// turn. Other fields changed differently on both sides fail the merge with
+// ErrMergeConflict.
+func MergeFields(base, mine, theirs json.RawMessage) (interface{}, error) {
+	var b, m, t interface{}
+
+	for _, doc := range []struct {
+		raw json.RawMessage
+		v   *interface{}
+	}{{base, &b}, {mine, &m}, {theirs, &t}} {
+		if err := decodeNumbers(doc.raw, doc.v); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := mergeValues("", mergeField{b, true}, mergeField{m, true}, mergeField{t, true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f.value, nil
+}
+
+// mergeField is a value of a merged document, or its absence.
+type mergeField struct {
+	value   interface{}
+	present bool
+}
+
+func (f mergeField) key() string {
+	if !f.present {
+		return ""
+	}
+
+	return valueKey(f.value)
+}
+
+// mergeValues merges one value of the documents. A field missing on one
+// side was deleted there, which is merged like any other change.
+func mergeValues(path string, base, mine, theirs mergeField) (mergeField, error) {
+	switch {
+	case mine.key() == theirs.key(), theirs.key() == base.key():
+		return mine, nil
+	case mine.key() == base.key():
+		return theirs, nil
+	}
+
+	mm, mok := mine.value.(map[string]interface{})
+	tm, tok := theirs.value.(map[string]interface{})
+
+	if !mok || !tok {
+		if path == "" {
+			return mergeField{}, ErrMergeConflict
+		}
+		return mergeField{}, fmt.Errorf("%w on %v", ErrMergeConflict, path)
+	}
+
+	bm, _ := base.value.(map[string]interface{})
+	merged := make(map[string]interface{})
+	seen := make(map[string]bool)
+
+	for _, m := range []map[string]interface{}{bm, mm, tm} {
+		for k := range m {
+			if seen[k] {
+				continue
+			}
+
+			seen[k] = true
+
+			name := k
+
+			if path != "" {
+				name = path + "." + k
+			}
+
+			f, err := mergeValues(name, lookup(bm, k), lookup(mm, k), lookup(tm, k))
+
+			if err != nil {
+				return mergeField{}, err
+			}
+
+			if f.present {
+				merged[k] = f.value
+			}
+		}
+	}
+
+	return mergeField{value: merged, present: true}, nil
+}
+
+func lookup(m map[string]interface{}, k string) mergeField {
+	v, ok := m[k]
+	return mergeField{value: v, present: ok}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metaDir = ".meta"
+
+// revisionsDir, under metaDir, holds the revision floor of each collection.
+// Its name cannot be taken by a collection.
+const revisionsDir = ".revisions"
+
+// recordMeta is kept next to, rather than inside, each record so that the
+// stored documents remain exactly what the caller wrote.
+type recordMeta struct {
+	Expires  *time.Time `json:"expires,omitempty"`
+	Deleted  *time.Time `json:"deleted,omitempty"`
+	Revision int64      `json:"revision,omitempty"`
+	Clock    *HLC       `json:"clock,omitempty"`
+
+	// Revs are the CouchDB revisions of a record, newest first, once it
+	// has been written through a CouchServer. See couchRevs.
+	Revs []string `json:"revs,omitempty"`
+
+	// Key is the original key of a record stored under an encoded file
+	// name.
+	Key string `json:"key,omitempty"`
+}
+
+func (m *recordMeta) empty() bool {
+	return m.Expires == nil && m.Deleted == nil && m.Revision == 0 && m.Clock == nil && m.Key == "" && len(m.Revs) == 0
+}
+
+func (d *Driver) metaPath(collection, resource string) string {
+	if resource == "" {
+		return filepath.Join(d.dir, metaDir, collection)
+	}
+
+	return filepath.Join(d.dir, metaDir, collection, fileName(resource)+".json")
+}
+
+// readMeta returns the metadata of a record, which is empty when none has
+// been stored.
+func (d *Driver) readMeta(collection, resource string) (*recordMeta, error) {
+	m := &recordMeta{}
+
+	b, err := d.readFile(d.metaPath(collection, resource))
+
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, json.Unmarshal(b, m)
+}
+
+func (d *Driver) writeMeta(collection, resource string, m *recordMeta) error {
+	path := d.metaPath(collection, resource)
+
+	if m.empty() {
+		return d.removeMeta(collection, resource)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+
+	return d.replaceFile(path+".tmp", path)
+}
+
+// removeMeta drops the metadata of a record, or of the whole collection when
+// resource is empty.
+func (d *Driver) removeMeta(collection, resource string) error {
+	path := d.metaPath(collection, resource)
+
+	if err := d.removeAll(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	removeEmptyParents(d.metaPath(collection, ""), path)
+
+	return nil
+}
+
+// revisionFloors holds, for each collection, the highest revision a record
+// had when it was deleted. Records written with no revision of their own
+// start above it, so that a revision never names two values of a key.
+type revisionFloors struct {
+	mutex  sync.Mutex
+	floors map[string]int64
+}
+
+func (d *Driver) floorPath(collection string) string {
+	return filepath.Join(d.dir, metaDir, revisionsDir, collection)
+}
+
+// revisionFloor returns the revision floor of collection.
+func (d *Driver) revisionFloor(collection string) (int64, error) {
+	f := &d.floors
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return d.loadFloor(collection)
+}
+
+func (d *Driver) loadFloor(collection string) (int64, error) {
+	f := &d.floors
+
+	if floor, ok := f.floors[collection]; ok {
+		return floor, nil
+	}
+
+	var floor int64
+
+	b, err := d.readFile(d.floorPath(collection))
+
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err == nil {
+		if floor, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return 0, fmt.Errorf("Invalid revision floor of %v: %w", collection, err)
+		}
+	}
+
+	if f.floors == nil {
+		f.floors = make(map[string]int64)
+	}
+
+	f.floors[collection] = floor
+
+	return floor, nil
+}
+
+// raiseFloor raises the revision floor of collection to revision.
+func (d *Driver) raiseFloor(collection string, revision int64) error {
+	f := &d.floors
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	floor, err := d.loadFloor(collection)
+
+	if err != nil || revision <= floor {
+		return err
+	}
+
+	path := d.floorPath(collection)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := d.writeFile(path+".tmp", []byte(strconv.FormatInt(revision, 10)), 0644); err != nil {
+		return err
+	}
+
+	if err := d.replaceFile(path+".tmp", path); err != nil {
+		return err
+	}
+
+	f.floors[collection] = revision
+
+	return nil
+}
+
+// retireRevision raises the revision floor of collection to the revision of
+// a record about to lose its metadata.
+func (d *Driver) retireRevision(collection, resource string) error {
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	return d.raiseFloor(collection, m.Revision)
+}
+
+// retireMeta drops the metadata of a deleted record, keeping its revision
+// in the floor of the collection.
+func (d *Driver) retireMeta(collection, resource string) error {
+	if err := d.retireRevision(collection, resource); err != nil {
+		return err
+	}
+
+	return d.removeMeta(collection, resource)
+}
+
+// retireMetas raises the revision floor of collection to the revisions of
+// all its records, before its metadata is dropped as a whole.
+func (d *Driver) retireMetas(collection string) error {
+	dir := d.metaPath(collection, "")
+	files, err := d.readTree(dir)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var highest int64
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		var m recordMeta
+
+		if b, err := d.readFile(filepath.Join(dir, file.Name())); err == nil && json.Unmarshal(b, &m) == nil && m.Revision > highest {
+			highest = m.Revision
+		}
+	}
+
+	return d.raiseFloor(collection, highest)
+}
+
+// recordWritten bumps the revision of a record, and stamps it with the
+// clock, ahead of storing a new value. The metadata is written before the
+// value is renamed into place, which is the commit point of the write, and
+// the returned function completes the change once the rename was tried. A
+// failed rename restores the old metadata but keeps the revision, which is
+// never handed out twice.
+//
+// A written value is never deleted and, unless keepExpiry is set by an
+// in-place update, does not inherit the expiry of the value it replaced.
+func (d *Driver) recordWritten(collection, resource string, keepExpiry bool) (func(stored bool), error) {
+	old, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := *old
+
+	if m.Revision == 0 {
+		if m.Revision, err = d.revisionFloor(collection); err != nil {
+			return nil, err
+		}
+	}
+
+	if !keepExpiry {
+		m.Expires = nil
+
+		if ttl := d.config(collection).ttl; ttl > 0 {
+			at := time.Now().Add(ttl)
+			m.Expires = &at
+		}
+	}
+
+	m.Deleted = nil
+	m.Revision++
+	clock := d.clock.now(old.Clock)
+	m.Clock = &clock
+
+	if len(m.Revs) > 0 {
+		m.Revs = pushRev(collection, resource, m.Revs, strconv.FormatInt(m.Revision, 10))
+	}
+
+	if fileName(resource) != resource {
+		m.Key = resource
+	}
+
+	if err := d.writeMeta(collection, resource, &m); err != nil {
+		return nil, err
+	}
+
+	return func(stored bool) {
+		if !stored {
+			old.Revision = m.Revision
+
+			if err := d.writeMeta(collection, resource, old); err != nil {
+				d.log.Error("Unable to restore metadata of '%s' in '%s': %v\n", resource, collection, err)
+			}
+
+			return
+		}
+
+		if !keepExpiry {
+			d.forgetExpiries(collection, resource)
+
+			if m.Expires != nil {
+				d.rememberExpiry(collection, resource, *m.Expires)
+			}
+		}
+
+		if old.Deleted != nil {
+			trash := d.trashPath(collection, resource)
+
+			if err := os.Remove(trash); err != nil && !os.IsNotExist(err) {
+				d.log.Warn("Unable to remove trash of '%s' in '%s': %v\n", resource, collection, err)
+			}
+
+			removeEmptyParents(filepath.Join(d.dir, trashDir, collection), trash)
+		}
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRevisionsSurviveDeletes(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(d *Driver) error
+	}{
+		{name: "delete", remove: func(d *Driver) error {
+			return d.Delete("Users", "a")
+		}},
+		{name: "delete collection", remove: func(d *Driver) error {
+			return d.Delete("Users", "")
+		}},
+		{name: "expiry", remove: func(d *Driver) error {
+			if err := d.Expire("Users", "a", time.Millisecond); err != nil {
+				return err
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			_, err := d.Sweep()
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := New(t.TempDir(), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				if err := db.Write("Users", "a", map[string]int{"n": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			before, err := db.Revision("Users", "a")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.remove(db); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := os.Stat(db.metaPath("Users", "a")); !os.IsNotExist(err) {
+				t.Errorf("Metadata of the deleted record is left: %v", err)
+			}
+
+			if err := db.Write("Users", "a", map[string]int{"n": 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := db.Revision("Users", "a")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if after <= before {
+				t.Errorf("Revision after delete and write is %d, want more than %d", after, before)
+			}
+
+			if err := db.WriteIf("Users", "a", map[string]int{"n": 1}, IfRevision(before)); !errors.Is(err, ErrConditionFailed) {
+				t.Errorf("WriteIf with the revision from before the delete returned %v, want ErrConditionFailed", err)
+			}
+		})
+	}
+}
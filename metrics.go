@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms, in
+// seconds.
+var latencyBuckets = []float64{0.000001, 0.0000025, 0.000005, 0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Stats holds the metrics the driver keeps of its operations.
+type Stats struct {
+	Operations []OperationStats
+}
+
+// OperationStats describes the operations of one type, such as read or
+// write, on a collection since the driver was opened. Missing records are
+// not counted as errors, and operations on invalid collection names are
+// counted under the empty name. The percentiles are estimated from a histogram,
+// so they are only as precise as its buckets.
+type OperationStats struct {
+	Collection string
+	Op         string
+	Count      int64
+	Errors     int64
+	ErrorRate  float64
+
+	Mean, P50, P95, P99 time.Duration
+}
+
+// opMetric is the histogram and error count of an operation type on a
+// collection.
+type opMetric struct {
+	collection string
+	op         string
+	count      int64
+	errors     int64
+	nanos      int64
+	buckets    []int64
+}
+
+type metrics struct {
+	ops sync.Map
+}
+
+// observe wraps the error of an operation as wrapOp does, and records the
+// operation in the metrics. Operations defer it with the time they started.
+func (d *Driver) observe(start time.Time, err *error, op, collection, resource string) {
+	wrapOp(err, op, collection, resource)
+	d.metrics.record(collection, op, time.Since(start), *err)
+}
+
+func (m *metrics) record(collection, op string, took time.Duration, err error) {
+	if checkCollection(collection) != nil {
+		collection = ""
+	}
+
+	key := collection + "\x00" + op
+	v, ok := m.ops.Load(key)
+
+	if !ok {
+		v, _ = m.ops.LoadOrStore(key, &opMetric{collection: collection, op: op, buckets: make([]int64, len(latencyBuckets)+1)})
+	}
+
+	o := v.(*opMetric)
+	seconds := took.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	atomic.AddInt64(&o.buckets[i], 1)
+	atomic.AddInt64(&o.nanos, int64(took))
+	atomic.AddInt64(&o.count, 1)
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		atomic.AddInt64(&o.errors, 1)
+	}
+}
+
+// snapshot returns the metrics by collection and operation type.
+func (m *metrics) snapshot() []opMetric {
+	var ops []opMetric
+
+	m.ops.Range(func(_, v interface{}) bool {
+		o := v.(*opMetric)
+
+		s := opMetric{
+			collection: o.collection,
+			op:         o.op,
+			count:      atomic.LoadInt64(&o.count),
+			errors:     atomic.LoadInt64(&o.errors),
+			nanos:      atomic.LoadInt64(&o.nanos),
+			buckets:    make([]int64, len(o.buckets)),
+		}
+
+		for i := range o.buckets {
+			s.buckets[i] = atomic.LoadInt64(&o.buckets[i])
+		}
+
+		ops = append(ops, s)
+		return true
+	})
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].collection != ops[j].collection {
+			return ops[i].collection < ops[j].collection
+		}
+
+		return ops[i].op < ops[j].op
+	})
+
+	return ops
+}
+
+// quantile estimates the q-quantile of the histogram, interpolating within
+// the bucket it falls in.
+func (o *opMetric) quantile(q float64) time.Duration {
+	var total int64
+
+	for _, n := range o.buckets {
+		total += n
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen int64
+
+	for i, n := range o.buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+
+		if i == len(latencyBuckets) {
+			return seconds(latencyBuckets[i-1])
+		}
+
+		lower := 0.0
+
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+
+		upper := latencyBuckets[i]
+
+		return seconds(lower + (upper-lower)*(rank-float64(seen))/float64(n))
+	}
+
+	return seconds(latencyBuckets[len(latencyBuckets)-1])
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Stats returns the metrics of the operations made through the driver,
+// one per collection and operation type.
+func (d *Driver) Stats() Stats {
+	var stats Stats
+
+	for _, o := range d.metrics.snapshot() {
+		s := OperationStats{
+			Collection: o.collection,
+			Op:         o.op,
+			Count:      o.count,
+			Errors:     o.errors,
+			P50:        o.quantile(0.5),
+			P95:        o.quantile(0.95),
+			P99:        o.quantile(0.99),
+		}
+
+		if o.count > 0 {
+			s.ErrorRate = float64(o.errors) / float64(o.count)
+			s.Mean = time.Duration(o.nanos / o.count)
+		}
+
+		stats.Operations = append(stats.Operations, s)
+	}
+
+	return stats
+}
+
+// WriteMetrics writes the metrics of Stats to w in the Prometheus text
+// format: a latency histogram and an error counter per collection and
+// operation type.
+func (d *Driver) WriteMetrics(w io.Writer) error {
+	ops := d.metrics.snapshot()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP gojsondb_operation_duration_seconds Latency of the operations on each collection.\n")
+	fmt.Fprintf(bw, "# TYPE gojsondb_operation_duration_seconds histogram\n")
+
+	for _, o := range ops {
+		labels := `collection="` + escapeLabel(o.collection) + `",op="` + escapeLabel(o.op) + `"`
+		var cumulative int64
+
+		for i, n := range o.buckets {
+			cumulative += n
+			le := "+Inf"
+
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+
+			fmt.Fprintf(bw, "gojsondb_operation_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, le, cumulative)
+		}
+
+		fmt.Fprintf(bw, "gojsondb_operation_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(time.Duration(o.nanos).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "gojsondb_operation_duration_seconds_count{%s} %d\n", labels, cumulative)
+	}
+
+	fmt.Fprintf(bw, "# HELP gojsondb_operation_errors_total Operations on each collection that failed, other than for missing records.\n")
+	fmt.Fprintf(bw, "# TYPE gojsondb_operation_errors_total counter\n")
+
+	for _, o := range ops {
+		fmt.Fprintf(bw, "gojsondb_operation_errors_total{collection=\"%s\",op=\"%s\"} %d\n", escapeLabel(o.collection), escapeLabel(o.op), o.errors)
+	}
+
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// serveMetrics serves WriteMetrics at /metrics, when the server is set up
+// to.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.Metrics || r.URL.Path != "/metrics" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+
+	s.db.WriteMetrics(w)
+
+	return true
+}
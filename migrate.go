@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Migration upgrades a document stored in an older shape, in place, and
+// reports whether it changed anything. Migrations run whenever a record is
+// read, so they must leave documents already in the new shape alone.
+type Migration func(doc map[string]interface{}) bool
+
+type MigrationOptions struct {
+	// WriteBack stores upgraded documents in place of the old ones when
+	// they are read, when the collection is not locked at the time.
+	WriteBack bool
+}
+
+// SetMigrations has the records of collection upgraded by migrations, in
+// order, as they are read, so changes to the shape of documents need no
+// migration of the whole collection up front. No migrations removes them.
+func (d *Driver) SetMigrations(collection string, opts *MigrationOptions, migrations ...Migration) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m == nil {
+			return fmt.Errorf("Missing migration")
+		}
+	}
+
+	if opts == nil {
+		opts = &MigrationOptions{}
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.migrations = append([]Migration(nil), migrations...)
+		cfg.migrationWriteBack = opts.WriteBack
+	})
+
+	// Cached and indexed records were read under the old migrations.
+	d.changedRecord(collection, "", nil)
+
+	for _, idx := range d.collectionIndexes(collection) {
+		d.reindex(collection, idx.field)
+	}
+
+	return nil
+}
+
+// RenameField moves the value of field from to field to, unless to is
+// already set.
+func RenameField(from, to string) Migration {
+	return func(doc map[string]interface{}) bool {
+		v, ok := lookupField(doc, from)
+
+		if !ok {
+			return false
+		}
+
+		if _, ok := lookupField(doc, to); !ok {
+			setPath(doc, strings.Split(to, "."), v)
+		}
+
+		deleteField(doc, from)
+
+		return true
+	}
+}
+
+// SplitField replaces the string field from with the fields to, holding its
+// parts separated by sep. The last field takes the rest of the string.
+func SplitField(from, sep string, to ...string) Migration {
+	return func(doc map[string]interface{}) bool {
+		v, ok := lookupField(doc, from)
+
+		if !ok {
+			return false
+		}
+
+		s, ok := v.(string)
+
+		if !ok || len(to) == 0 {
+			return false
+		}
+
+		deleteField(doc, from)
+
+		for i, part := range strings.SplitN(s, sep, len(to)) {
+			setPath(doc, strings.Split(to[i], "."), part)
+		}
+
+		return true
+	}
+}
+
+// DefaultField sets field to value in documents that lack it.
+func DefaultField(field string, value interface{}) Migration {
+	return func(doc map[string]interface{}) bool {
+		if _, ok := lookupField(doc, field); ok {
+			return false
+		}
+
+		setPath(doc, strings.Split(field, "."), value)
+
+		return true
+	}
+}
+
+func deleteField(doc map[string]interface{}, field string) {
+	path := strings.Split(field, ".")
+
+	if parent, ok := lookupPath(doc, path[:len(path)-1]); ok {
+		if m, ok := parent.(map[string]interface{}); ok {
+			delete(m, path[len(path)-1])
+		}
+	}
+}
+
+// migrate runs the migrations of collection on a record, returning it
+// unchanged, and without decoding it, when the collection has none.
+func (d *Driver) migrate(collection string, b []byte) ([]byte, bool, error) {
+	migrations := d.config(collection).migrations
+
+	if len(migrations) == 0 {
+		return b, false, nil
+	}
+
+	var doc map[string]interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+
+	for _, m := range migrations {
+		if m(doc) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return b, false, nil
+	}
+
+	b, err := marshalRecord(doc)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// upgrade migrates a record just read from disk, writing it back when the
+// collection asks for it.
+func (d *Driver) upgrade(collection, resource string, b []byte) ([]byte, error) {
+	b, migrated, err := d.migrate(collection, b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if migrated && d.config(collection).migrationWriteBack {
+		d.writeBack(collection, resource)
+	}
+
+	return b, nil
+}
+
+// writeBack stores the upgraded version of a record read by who may or may
+// not hold the collection lock. It gives up if the lock is taken, leaving
+// the record to be upgraded again on its next read.
+func (d *Driver) writeBack(collection, resource string) {
+	mutex := d.getOrCreateMutex(collection)
+
+	if !mutex.TryLock() {
+		return
+	}
+
+	defer mutex.Unlock()
+
+	b, err := d.readRecordFile(collection, resource, d.recordPath(collection, resource))
+
+	if err != nil {
+		return
+	}
+
+	b, changed, err := d.migrate(collection, b)
+
+	if err != nil || !changed {
+		return
+	}
+
+	if err := d.write(collection, resource, json.RawMessage(b)); err != nil {
+		d.log.Warn("Unable to write back migrated '%s/%s': %v\n", collection, resource, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MirrorTier is a CacheTier keeping a compact binary copy of the decoded
+// records on disk, one append-only file per collection with an index in
+// memory, so a record is served with a single read however it is stored:
+// encrypted, compressed, chunked or due an upgrade. It holds many more
+// records than fit in memory. The files only live as long as the tier, and
+// hold records in the clear, so dir should be on a fast local disk no one
+// else can read.
+type MirrorTier struct {
+	dir string
+
+	mutex sync.RWMutex
+	files map[string]*mirrorFile
+}
+
+type mirrorFile struct {
+	f     *os.File
+	size  int64
+	live  int64
+	index map[string]mirrorEntry
+}
+
+// mirrorEntry locates the value of a record in its collection's file.
+type mirrorEntry struct {
+	offset int64
+	length int
+	size   int
+}
+
+// mirrorMinCompact is the least garbage compacting a mirror file is worth.
+const mirrorMinCompact = 1 << 20
+
+// NewMirrorTier keeps the mirror in dir, which is created if need be.
+// Mirror files left in it are removed.
+func NewMirrorTier(dir string) (*MirrorTier, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	old, err := filepath.Glob(filepath.Join(dir, "*.mirror"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range old {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return &MirrorTier{dir: dir, files: make(map[string]*mirrorFile)}, nil
+}
+
+func (m *MirrorTier) path(collection string) string {
+	return filepath.Join(m.dir, url.PathEscape(collection)+".mirror")
+}
+
+func (m *MirrorTier) Get(collection, resource string) ([]byte, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mf, ok := m.files[collection]
+
+	if !ok {
+		return nil, false
+	}
+
+	e, ok := mf.index[resource]
+
+	if !ok {
+		return nil, false
+	}
+
+	b := make([]byte, e.length)
+
+	if _, err := mf.f.ReadAt(b, e.offset); err != nil {
+		return nil, false
+	}
+
+	return b, true
+}
+
+func (m *MirrorTier) Put(collection, resource string, b []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mf, ok := m.files[collection]
+
+	if !ok {
+		f, err := os.OpenFile(m.path(collection), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		mf = &mirrorFile{f: f, index: make(map[string]mirrorEntry)}
+		m.files[collection] = mf
+	}
+
+	m.drop(mf, resource)
+
+	if err := mf.append(resource, b); err != nil {
+		return err
+	}
+
+	if garbage := mf.size - mf.live; garbage > mirrorMinCompact && garbage > mf.live {
+		return m.compact(collection, mf)
+	}
+
+	return nil
+}
+
+// append adds the record to the end of the file: the lengths of the key
+// and value as uvarints, then both.
+func (mf *mirrorFile) append(resource string, b []byte) error {
+	entry := make([]byte, 0, 2*binary.MaxVarintLen64+len(resource)+len(b))
+	entry = binary.AppendUvarint(entry, uint64(len(resource)))
+	entry = append(entry, resource...)
+	entry = binary.AppendUvarint(entry, uint64(len(b)))
+	header := len(entry)
+	entry = append(entry, b...)
+
+	if _, err := mf.f.WriteAt(entry, mf.size); err != nil {
+		return err
+	}
+
+	mf.index[resource] = mirrorEntry{offset: mf.size + int64(header), length: len(b), size: len(entry)}
+	mf.size += int64(len(entry))
+	mf.live += int64(len(entry))
+
+	return nil
+}
+
+func (m *MirrorTier) Remove(collection, resource string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mf, ok := m.files[collection]
+
+	if !ok {
+		return nil
+	}
+
+	if resource != "" {
+		m.drop(mf, resource)
+		return nil
+	}
+
+	delete(m.files, collection)
+	mf.f.Close()
+
+	return os.Remove(m.path(collection))
+}
+
+// drop forgets the entry of resource, leaving its bytes as garbage.
+func (m *MirrorTier) drop(mf *mirrorFile, resource string) {
+	if e, ok := mf.index[resource]; ok {
+		mf.live -= int64(e.size)
+		delete(mf.index, resource)
+	}
+}
+
+// compact rewrites the file of collection with just its live entries. On
+// failure the collection is forgotten instead, being only a cache.
+func (m *MirrorTier) compact(collection string, mf *mirrorFile) error {
+	path := m.path(collection)
+	next, err := m.rewrite(path, mf)
+	mf.f.Close()
+
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	if err != nil {
+		if next != nil {
+			next.f.Close()
+		}
+
+		os.Remove(path + ".tmp")
+		os.Remove(path)
+		delete(m.files, collection)
+
+		return err
+	}
+
+	m.files[collection] = next
+
+	return nil
+}
+
+func (m *MirrorTier) rewrite(path string, mf *mirrorFile) (*mirrorFile, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	next := &mirrorFile{f: f, index: make(map[string]mirrorEntry, len(mf.index))}
+
+	for resource, e := range mf.index {
+		b := make([]byte, e.length)
+
+		if _, err := mf.f.ReadAt(b, e.offset); err != nil {
+			return next, err
+		}
+
+		if err := next.append(resource, b); err != nil {
+			return next, err
+		}
+	}
+
+	return next, nil
+}
+
+// Close closes and removes the mirror files.
+func (m *MirrorTier) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var first error
+
+	for collection, mf := range m.files {
+		mf.f.Close()
+
+		if err := os.Remove(m.path(collection)); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	m.files = make(map[string]*mirrorFile)
+
+	return first
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mongoReader reads the documents written by mongoexport, one per line or
+// as a JSON array, into records of collection keyed by their _id.
+func mongoReader(r io.Reader, collection string) func() (*importRecord, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+
+	started, array := false, false
+
+	return func() (*importRecord, error) {
+		if !started {
+			started = true
+
+			for {
+				b, err := br.Peek(1)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+					array = b[0] == '['
+					break
+				}
+
+				br.ReadByte()
+			}
+
+			if array {
+				if _, err := dec.Token(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if array && !dec.More() {
+			return nil, io.EOF
+		}
+
+		var doc map[string]interface{}
+
+		if err := dec.Decode(&doc); err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+
+			if _, syntax := err.(*json.SyntaxError); syntax {
+				return nil, err
+			}
+
+			return nil, invalidRecordError{err}
+		}
+
+		id, ok := doc["_id"]
+
+		if !ok {
+			return nil, invalidRecordError{fmt.Errorf("Missing _id")}
+		}
+
+		v, err := fromExtendedJSON(doc)
+
+		if err != nil {
+			return nil, invalidRecordError{err}
+		}
+
+		resource, err := mongoID(id)
+
+		if err != nil {
+			return nil, invalidRecordError{err}
+		}
+
+		b, err := json.Marshal(v)
+
+		if err != nil {
+			return nil, invalidRecordError{err}
+		}
+
+		return &importRecord{Collection: collection, Resource: resource, Data: b}, nil
+	}
+}
+
+// mongoID names the record of a document after its _id: ObjectIds by
+// their hex, strings as they are, and other values by their JSON.
+func mongoID(id interface{}) (string, error) {
+	v, err := fromExtendedJSON(id)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// fromExtendedJSON turns MongoDB extended JSON, canonical or relaxed, into
+// plain JSON values: ObjectIds and UUIDs become strings, dates RFC 3339
+// strings as time.Time encodes them, $numberLong, $numberInt,
+// $numberDouble and $numberDecimal numbers with their digits kept, and
+// binary data base64 strings as []byte encodes them.
+func fromExtendedJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(v))
+
+		for i, item := range v {
+			converted, err := fromExtendedJSON(item)
+
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = converted
+		}
+
+		return out, nil
+
+	case map[string]interface{}:
+		if converted, ok, err := fromWrapper(v); ok || err != nil {
+			return converted, err
+		}
+
+		out := make(map[string]interface{}, len(v))
+
+		for k, item := range v {
+			converted, err := fromExtendedJSON(item)
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+
+			out[k] = converted
+		}
+
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// fromWrapper converts the single-key objects extended JSON wraps typed
+// values in, reporting whether v was one.
+func fromWrapper(v map[string]interface{}) (interface{}, bool, error) {
+	if len(v) == 0 || len(v) > 2 {
+		return nil, false, nil
+	}
+
+	var key string
+
+	for k := range v {
+		if strings.HasPrefix(k, "$") && (key == "" || k < key) {
+			key = k
+		}
+	}
+
+	if key == "" || (len(v) == 2 && !(key == "$binary" && v["$type"] != nil)) {
+		return nil, false, nil
+	}
+
+	value := v[key]
+	str, _ := value.(string)
+
+	switch key {
+	case "$oid":
+		if _, err := hex.DecodeString(str); err != nil || len(str) != 24 {
+			return nil, true, fmt.Errorf("Invalid ObjectId %q", str)
+		}
+
+		return str, true, nil
+
+	case "$uuid", "$symbol", "$code":
+		return str, true, nil
+
+	case "$numberLong", "$numberInt", "$numberDecimal":
+		return mongoNumber(str), true, nil
+
+	case "$numberDouble":
+		return mongoNumber(str), true, nil
+
+	case "$date":
+		t, err := mongoDate(value)
+		return t, true, err
+
+	case "$binary":
+		data := str
+
+		if m, ok := value.(map[string]interface{}); ok {
+			data, _ = m["base64"].(string)
+		}
+
+		b, err := base64.StdEncoding.DecodeString(data)
+
+		if err != nil {
+			return nil, true, fmt.Errorf("Invalid binary data: %w", err)
+		}
+
+		return base64.StdEncoding.EncodeToString(b), true, nil
+
+	case "$regularExpression":
+		m, _ := value.(map[string]interface{})
+		pattern, _ := m["pattern"].(string)
+		options, _ := m["options"].(string)
+
+		return "/" + pattern + "/" + options, true, nil
+
+	case "$timestamp":
+		m, _ := value.(map[string]interface{})
+		seconds, _ := m["t"].(json.Number)
+		n, _ := seconds.Int64()
+
+		return time.Unix(n, 0).UTC(), true, nil
+
+	case "$undefined":
+		return nil, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// mongoNumber keeps the digits of a number as they were written.
+// Infinities and NaN, which JSON has no numbers for, stay strings.
+func mongoNumber(s string) interface{} {
+	if _, err := strconv.ParseFloat(s, 64); err != nil || strings.ContainsAny(s, "IiNn") {
+		return s
+	}
+
+	return json.Number(s)
+}
+
+// mongoDate reads the value of a $date: an ISO-8601 string, milliseconds
+// since the epoch, or those wrapped in $numberLong.
+func mongoDate(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999Z0700"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC(), nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("Invalid date %q", v)
+
+	case json.Number:
+		ms, err := v.Int64()
+
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid date %v", v)
+		}
+
+		return time.UnixMilli(ms).UTC(), nil
+
+	case map[string]interface{}:
+		if n, ok := v["$numberLong"].(string); ok {
+			return mongoDate(json.Number(n))
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid date %v", v)
+}
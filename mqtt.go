@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTOptions configures a publisher of changes to an MQTT broker.
+type MQTTOptions struct {
+	// Broker is the host:port of the broker, reached over TLS when
+	// TLSConfig is set.
+	Broker    string
+	TLSConfig *tls.Config
+
+	ClientID           string
+	Username, Password string
+
+	// Topic is the topic changes are published on, with {collection}
+	// and {resource} replaced. It defaults to db/{collection}/{resource}.
+	Topic string
+
+	// QoS is 0 (at most once) or 1 (at least once).
+	QoS    byte
+	Retain bool
+
+	KeepAlive time.Duration
+
+	// Collections limits the changes published to those of the listed
+	// collections.
+	Collections []string
+
+	// Buffer is the number of changes held while the broker is slow or
+	// unreachable, 1024 by default. Changes past it are dropped.
+	Buffer int
+}
+
+// MQTTPublisher publishes the changes made through a driver to an MQTT
+// broker. Writes are published with the record as payload, deletes with an
+// empty one, which also clears a retained message.
+type MQTTPublisher struct {
+	d       *Driver
+	opts    MQTTOptions
+	changes chan Change
+	stop    func()
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttPingreq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+// PublishMQTT starts publishing changes to the broker of opts. Changes are
+// queued and published in order, reconnecting as needed, until the
+// publisher is closed.
+func (d *Driver) PublishMQTT(opts *MQTTOptions) (*MQTTPublisher, error) {
+	if opts == nil || opts.Broker == "" {
+		return nil, fmt.Errorf("Missing broker")
+	}
+
+	if opts.QoS > 1 {
+		return nil, fmt.Errorf("Unsupported QoS %d", opts.QoS)
+	}
+
+	p := &MQTTPublisher{d: d, opts: *opts, done: make(chan struct{})}
+
+	if p.opts.Topic == "" {
+		p.opts.Topic = "db/{collection}/{resource}"
+	}
+
+	if p.opts.ClientID == "" {
+		p.opts.ClientID = fmt.Sprintf("go-json-database-%d", os.Getpid())
+	}
+
+	if p.opts.KeepAlive <= 0 {
+		p.opts.KeepAlive = time.Minute
+	}
+
+	if p.opts.Buffer <= 0 {
+		p.opts.Buffer = 1024
+	}
+
+	p.changes = make(chan Change, p.opts.Buffer)
+
+	collections := make(map[string]bool, len(opts.Collections))
+
+	for _, c := range opts.Collections {
+		collections[c] = true
+	}
+
+	p.stop = d.OnChange(func(c Change) {
+		if len(collections) > 0 && !collections[c.Collection] {
+			return
+		}
+
+		select {
+		case p.changes <- c:
+		default:
+			d.log.Warn("MQTT publisher is behind, dropping change of '%s/%s'\n", c.Collection, c.Resource)
+		}
+	})
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p, nil
+}
+
+// Close stops publishing. Changes still queued are dropped.
+func (p *MQTTPublisher) Close() error {
+	p.once.Do(func() {
+		p.stop()
+		close(p.done)
+	})
+
+	p.wg.Wait()
+
+	return nil
+}
+
+func (p *MQTTPublisher) topic(c Change) string {
+	return strings.NewReplacer("{collection}", c.Collection, "{resource}", c.Resource).Replace(p.opts.Topic)
+}
+
+func (p *MQTTPublisher) run() {
+	defer p.wg.Done()
+
+	var pending *Change
+	backoff := time.Second
+
+	for {
+		conn, err := p.connect()
+
+		if err == nil {
+			backoff = time.Second
+			pending, err = p.serve(conn, pending)
+			conn.Close()
+		}
+
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		p.d.log.Warn("MQTT broker '%s' failed: %v\n", p.opts.Broker, err)
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (p *MQTTPublisher) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if p.opts.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.opts.Broker, p.opts.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", p.opts.Broker)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte = 0x02
+
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(p.opts.KeepAlive/time.Second))
+	body = mqttString(body, p.opts.ClientID)
+
+	if p.opts.Username != "" {
+		flags |= 0x80
+		body = mqttString(body, p.opts.Username)
+	}
+
+	if p.opts.Password != "" {
+		flags |= 0x40
+		body = mqttString(body, p.opts.Password)
+	}
+
+	body[7] = flags
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := writePacket(conn, mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	kind, ack, err := readPacket(bufio.NewReader(conn))
+
+	if err == nil && (kind&0xF0 != mqttConnack || len(ack) < 2) {
+		err = fmt.Errorf("Unexpected packet 0x%x", kind)
+	} else if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("Connection refused with code %d", ack[1])
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// serve publishes changes on conn until it fails, returning the change
+// that was being published so it can be retried on the next connection.
+func (p *MQTTPublisher) serve(conn net.Conn, pending *Change) (*Change, error) {
+	acks := make(chan uint16, 1)
+	failed := make(chan error, 1)
+
+	go func() {
+		r := bufio.NewReader(conn)
+
+		for {
+			kind, body, err := readPacket(r)
+
+			if err != nil {
+				failed <- err
+				return
+			}
+
+			if kind&0xF0 == mqttPuback && len(body) >= 2 {
+				select {
+				case acks <- binary.BigEndian.Uint16(body):
+				default:
+				}
+			}
+		}
+	}()
+
+	ping := time.NewTicker(p.opts.KeepAlive / 2)
+	defer ping.Stop()
+
+	var id uint16
+
+	for {
+		if pending != nil {
+			id++
+
+			if id == 0 {
+				id = 1
+			}
+
+			if err := p.publish(conn, *pending, id, acks, failed); err != nil {
+				return pending, err
+			}
+
+			pending = nil
+		}
+
+		select {
+		case <-p.done:
+			writePacket(conn, mqttDisconnect, nil)
+			return nil, nil
+		case err := <-failed:
+			return nil, err
+		case <-ping.C:
+			if err := writePacket(conn, mqttPingreq, nil); err != nil {
+				return nil, err
+			}
+		case c := <-p.changes:
+			pending = &c
+		}
+	}
+}
+
+func (p *MQTTPublisher) publish(conn net.Conn, c Change, id uint16, acks <-chan uint16, failed <-chan error) error {
+	kind := byte(mqttPublish) | p.opts.QoS<<1
+
+	if p.opts.Retain {
+		kind |= 0x01
+	}
+
+	body := mqttString(nil, p.topic(c))
+
+	if p.opts.QoS > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+
+	body = append(body, c.Value...)
+
+	if err := writePacket(conn, kind, body); err != nil {
+		return err
+	}
+
+	if p.opts.QoS == 0 {
+		return nil
+	}
+
+	timeout := time.After(p.opts.KeepAlive)
+
+	for {
+		select {
+		case acked := <-acks:
+			if acked == id {
+				return nil
+			}
+		case err := <-failed:
+			return err
+		case <-timeout:
+			return fmt.Errorf("No acknowledgement of '%s'", p.topic(c))
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func writePacket(w io.Writer, kind byte, body []byte) error {
+	packet := []byte{kind}
+	n := len(body)
+
+	for {
+		digit := byte(n % 128)
+		n /= 128
+
+		if n > 0 {
+			digit |= 0x80
+		}
+
+		packet = append(packet, digit)
+
+		if n == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, shift := 0, 0
+
+	for {
+		digit, err := r.ReadByte()
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n |= int(digit&0x7F) << shift
+		shift += 7
+
+		if digit&0x80 == 0 {
+			break
+		}
+
+		if shift > 21 {
+			return 0, nil, fmt.Errorf("Malformed packet length")
+		}
+	}
+
+	body := make([]byte, n)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return kind, body, nil
+}
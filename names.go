@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidName is returned for collection names the driver cannot store
+// safely.
+var ErrInvalidName = errors.New("Invalid name")
+
+const maxNameLen = 255
+
+// reservedNames are the directories the driver keeps its own state in.
+var reservedNames = map[string]bool{
+	indexesDir:    true,
+	historyDir:    true,
+	metaDir:       true,
+	chunksDir:     true,
+	arraysDir:     true,
+	quarantineDir: true,
+	snapshotsDir:  true,
+	trashDir:      true,
+	keysDir:       true,
+	changesDir:    true,
+	configDir:     true,
+}
+
+// checkCollection validates a collection name. Names are made of letters,
+// digits, '_', '-' and '.', and may not start with '.', which keeps them
+// clear of the driver's internal directories and of path separators.
+func checkCollection(collection string) error {
+	if collection == "" {
+		return fmt.Errorf("Missing collection")
+	}
+
+	if reservedNames[collection] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, collection)
+	}
+
+	if collection[0] == '.' {
+		return fmt.Errorf("%w: collection %q may not start with '.'", ErrInvalidName, collection)
+	}
+
+	if len(collection) > maxNameLen {
+		return fmt.Errorf("%w: collection name longer than %d bytes", ErrInvalidName, maxNameLen)
+	}
+
+	for _, r := range collection {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '_', r == '-':
+		case r == '.':
+		default:
+			return fmt.Errorf("%w: collection %q may not contain %q", ErrInvalidName, collection, r)
+		}
+	}
+
+	return nil
+}
+
+// ErrKeyCollision is returned when writing a record whose name normalizes to
+// the same key as a record already stored under a different form.
+var ErrKeyCollision = errors.New("Key collision")
+
+type KeyNormalization int
+
+const (
+	NormalizeNFC KeyNormalization = iota
+	NormalizeNFKC
+	NormalizeNone
+)
+
+// key returns the name a resource is stored under, so that "José" written as
+// NFD on macOS is found when read as NFC on Linux.
+func (d *Driver) key(resource string) string {
+	switch d.opts.KeyNormalization {
+	case NormalizeNFC:
+		return norm.NFC.String(resource)
+	case NormalizeNFKC:
+		return norm.NFKC.String(resource)
+	}
+
+	return resource
+}
+
+// checkKeyCollision fails when a record is stored under another Unicode form
+// of resource, as written before normalization or by another tool, unless
+// the filesystem treats both names as the same file.
+func (d *Driver) checkKeyCollision(collection, resource string) error {
+	if d.opts.KeyNormalization == NormalizeNone {
+		return nil
+	}
+
+	dir := filepath.Join(d.dir, collection)
+	fi, _ := os.Lstat(filepath.Join(dir, fileName(resource)+".json"))
+
+	for _, alt := range []string{norm.NFC.String(resource), norm.NFD.String(resource)} {
+		if alt == resource {
+			continue
+		}
+
+		other, err := os.Lstat(filepath.Join(dir, fileName(alt)+".json"))
+
+		if err != nil || (fi != nil && os.SameFile(fi, other)) {
+			continue
+		}
+
+		return fmt.Errorf("%w: %+q is already stored as %+q", ErrKeyCollision, resource, alt)
+	}
+
+	return nil
+}
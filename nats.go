@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+type NATSOptions struct {
+	URL string
+
+	// Subject is the subject changes are published on, with {collection}
+	// replaced. It defaults to db.{collection}, and must belong to a
+	// JetStream stream.
+	Subject string
+
+	// MsgIDPrefix is put before the sequence number in the Nats-Msg-Id of
+	// each message, for the stream to drop redeliveries. It should tell
+	// apart databases publishing to the same stream.
+	MsgIDPrefix string
+
+	Options []nats.Option
+}
+
+// NATSSink publishes changes as JSON messages to a NATS JetStream stream,
+// waiting for the stream to acknowledge each of them.
+type NATSSink struct {
+	nc   *nats.Conn
+	js   nats.JetStreamContext
+	opts NATSOptions
+}
+
+func NewNATSSink(opts *NATSOptions) (*NATSSink, error) {
+	if opts == nil || opts.URL == "" {
+		return nil, fmt.Errorf("Missing URL")
+	}
+
+	s := &NATSSink{opts: *opts}
+
+	if s.opts.Subject == "" {
+		s.opts.Subject = "db.{collection}"
+	}
+
+	nc, err := nats.Connect(opts.URL, opts.Options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	s.nc, s.js = nc, js
+
+	return s, nil
+}
+
+func (s *NATSSink) Publish(ctx context.Context, changes []Change) error {
+	for _, c := range changes {
+		data, err := json.Marshal(c)
+
+		if err != nil {
+			return err
+		}
+
+		subject := strings.ReplaceAll(s.opts.Subject, "{collection}", c.Collection)
+		id := s.opts.MsgIDPrefix + strconv.FormatInt(c.Seq, 10)
+
+		if _, err := s.js.Publish(subject, data, nats.Context(ctx), nats.MsgId(id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NATSSink) Close() error {
+	s.nc.Close()
+	return nil
+}
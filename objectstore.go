@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectStore is the cold storage records are tiered to, such as an
+// S3Store. Get of a missing key fails with an error that satisfies
+// errors.Is(err, os.ErrNotExist), and Delete of one succeeds.
+type ObjectStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, b []byte) error
+	Delete(ctx context.Context, key string) error
+
+	// List returns the objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// DirStore is an ObjectStore keeping objects as files under a directory,
+// such as a network share or a bucket mounted with gcsfuse.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore keeps objects in dir, which is created if need be.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DirStore{dir: filepath.Clean(dir)}, nil
+}
+
+func (s *DirStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *DirStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *DirStore) Put(ctx context.Context, key string, b []byte) error {
+	path := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *DirStore) Delete(ctx context.Context, key string) error {
+	path := s.path(key)
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	removeEmptyParents(s.dir, path)
+
+	return nil
+}
+
+func (s *DirStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), Modified: fi.ModTime()})
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
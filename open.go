@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned by Open for a database another driver has open.
+var ErrLocked = errors.New("Database is locked")
+
+// formatVersion is the version of the on-disk layout, recorded in
+// .gojsondb/format by Open.
+const formatVersion = 1
+
+// defaultMinFreeSpace is the free space Open requires when
+// Options.MinFreeSpace is zero.
+const defaultMinFreeSpace = 16 << 20
+
+// errLockHeld is returned by lockFile when another process holds the lock.
+var errLockHeld = errors.New("Lock held")
+
+// Open is New for programs that want problems with the database directory
+// reported up front rather than by the first write that runs into them.
+// Before opening the database it checks that the directory can be created,
+// written and has Options.MinFreeSpace left, that no other process has it
+// open through Open, and that it was not written by a newer, incompatible
+// version of the driver. The directory stays locked until Close.
+func Open(dir string, options ...Option) (*Driver, error) {
+	dir = filepath.Clean(dir)
+
+	opts := Options{}
+
+	for _, option := range options {
+		if option != nil {
+			option.apply(&opts)
+		}
+	}
+
+	if err := checkDir(dir, opts.MinFreeSpace); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFormat(dir); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	driver, err := New(dir, &opts)
+
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	driver.lock = lock
+
+	return driver, nil
+}
+
+func checkDir(dir string, minFree int64) error {
+	fi, err := os.Stat(dir)
+
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Unable to create the database directory %v: %w; check that its parent exists and is writable", dir, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to reach the database directory %v: %w", dir, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("The database path %v is not a directory", dir)
+	}
+
+	probe, err := os.CreateTemp(dir, ".probe-")
+
+	if err == nil {
+		_, err = probe.Write([]byte{0})
+
+		if cerr := probe.Close(); err == nil {
+			err = cerr
+		}
+
+		if rerr := os.Remove(probe.Name()); err == nil {
+			err = rerr
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("The database directory %v is not writable: %w; check its owner and permissions", dir, err)
+	}
+
+	if minFree == 0 {
+		minFree = defaultMinFreeSpace
+	}
+
+	free, err := freeSpace(dir)
+
+	if err != nil {
+		return fmt.Errorf("Unable to check the free space of %v: %w", dir, err)
+	}
+
+	if minFree > 0 && free >= 0 && free < minFree {
+		return fmt.Errorf("Only %d bytes are free for the database in %v, less than the %d required; free up space or lower Options.MinFreeSpace", free, dir, minFree)
+	}
+
+	return nil
+}
+
+// lockDir takes the lock on dir that keeps other processes from opening it
+// with Open, recording the process id for the error they get.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, configDir, "lock")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the lock file %v: %w", path, err)
+	}
+
+	if err := lockFile(f); err != nil {
+		owner := make([]byte, 32)
+		n, _ := f.ReadAt(owner, 0)
+		f.Close()
+
+		if err == errLockHeld {
+			pid := strings.TrimSpace(string(owner[:n]))
+
+			if pid == "" {
+				pid = "unknown"
+			}
+
+			return nil, fmt.Errorf("%w: %v is in use by process %v; close the other driver or open a different directory", ErrLocked, dir, pid)
+		}
+
+		return nil, fmt.Errorf("Unable to lock %v: %w", path, err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return f, nil
+}
+
+// checkFormat records the layout version in a new database, and refuses a
+// database written in a newer one.
+func checkFormat(dir string) error {
+	path := filepath.Join(dir, configDir, "format")
+	b, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return os.WriteFile(path, []byte(strconv.Itoa(formatVersion)+"\n"), 0644)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+
+	if err != nil || version < 1 {
+		return fmt.Errorf("Unrecognized format marker %q in %v; the directory may not hold a database", strings.TrimSpace(string(b)), path)
+	}
+
+	if version > formatVersion {
+		return fmt.Errorf("The database in %v uses format %d, newer than the format %d this driver supports; upgrade the driver", dir, version, formatVersion)
+	}
+
+	return nil
+}
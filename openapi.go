@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// OpenAPI builds an OpenAPI 3 document describing the REST API of the
+// server. Collections given in ServerOptions.Schemas get paths of their own
+// with the schema of their Go type; any other collection is covered by the
+// generic paths.
+func (s *Server) OpenAPI() map[string]interface{} {
+	record := map[string]interface{}{"type": "object", "additionalProperties": true}
+	schemas := map[string]interface{}{"Record": record}
+	paths := map[string]interface{}{
+		"/{collection}":            listPath(ref("Record"), collectionParam),
+		"/{collection}/{resource}": recordPath(ref("Record"), collectionParam, resourceParam),
+	}
+
+	names := make([]string, 0, len(s.opts.Schemas))
+
+	for name := range s.opts.Schemas {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		schemas[name] = jsonSchema(reflect.TypeOf(s.opts.Schemas[name]), make(map[reflect.Type]bool))
+		paths["/"+name] = listPath(ref(name))
+		paths["/"+name+"/{resource}"] = recordPath(ref(name), resourceParam)
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "go-json-database",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+
+	if s.opts.Authorize != nil {
+		doc["components"].(map[string]interface{})["securitySchemes"] = map[string]interface{}{
+			"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+		}
+		doc["security"] = []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		}
+	}
+
+	return doc
+}
+
+var (
+	collectionParam = map[string]interface{}{
+		"name": "collection", "in": "path", "required": true,
+		"schema": map[string]interface{}{"type": "string"},
+	}
+	resourceParam = map[string]interface{}{
+		"name": "resource", "in": "path", "required": true,
+		"schema": map[string]interface{}{"type": "string"},
+	}
+	etagHeader = map[string]interface{}{
+		"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+	}
+)
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func listPath(schema map[string]interface{}, params ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"parameters": params,
+		"get": map[string]interface{}{
+			"summary": "List all records of the collection",
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The records",
+					"content":     jsonContent(map[string]interface{}{"type": "array", "items": schema}),
+				},
+			},
+		},
+	}
+}
+
+func recordPath(schema map[string]interface{}, params ...interface{}) map[string]interface{} {
+	conditional := []interface{}{
+		map[string]interface{}{"name": "If-Match", "in": "header", "schema": map[string]interface{}{"type": "string"}},
+		map[string]interface{}{"name": "If-None-Match", "in": "header", "schema": map[string]interface{}{"type": "string"}},
+	}
+
+	return map[string]interface{}{
+		"parameters": params,
+		"get": map[string]interface{}{
+			"summary":    "Read a record",
+			"parameters": conditional[1:],
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "The record", "headers": etagHeader, "content": jsonContent(schema)},
+				"304": map[string]interface{}{"description": "Not modified"},
+				"404": map[string]interface{}{"description": "Not found"},
+			},
+		},
+		"put": map[string]interface{}{
+			"summary":     "Write a record",
+			"parameters":  conditional,
+			"requestBody": map[string]interface{}{"required": true, "content": jsonContent(schema)},
+			"responses": map[string]interface{}{
+				"204": map[string]interface{}{"description": "Written", "headers": etagHeader},
+				"400": map[string]interface{}{"description": "Invalid document"},
+				"412": map[string]interface{}{"description": "Precondition failed"},
+			},
+		},
+		"delete": map[string]interface{}{
+			"summary":    "Delete a record",
+			"parameters": conditional,
+			"responses": map[string]interface{}{
+				"204": map[string]interface{}{"description": "Deleted"},
+				"412": map[string]interface{}{"description": "Precondition failed"},
+			},
+		},
+	}
+}
+
+// jsonSchema describes how values of t are encoded, following the json,
+// validate and default tags of structs. Types already being described are
+// left open, so recursive types end.
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "integer"}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+
+		seen[t] = true
+		defer delete(seen, t)
+
+		schema := map[string]interface{}{"type": "object"}
+		properties := make(map[string]interface{})
+		var required []string
+
+		structSchema(t, properties, &required, seen)
+		schema["properties"] = properties
+
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+
+		return schema
+	}
+
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, properties map[string]interface{}, required *[]string, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+
+		if tag == "-" {
+			continue
+		}
+
+		ft := f.Type
+
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			structSchema(ft, properties, required, seen)
+			continue
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		name := jsonName(f)
+		schema := jsonSchema(f.Type, seen)
+
+		if tag, ok := f.Tag.Lookup("default"); ok {
+			v := reflect.New(f.Type).Elem()
+
+			if err := parseDefault(v, tag); err == nil {
+				if b, err := json.Marshal(v.Interface()); err == nil {
+					schema["default"] = json.RawMessage(b)
+				}
+			}
+		}
+
+		properties[name] = schema
+
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if strings.TrimSpace(rule) == "required" {
+				*required = append(*required, name)
+			}
+		}
+	}
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-json-database</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// serveOpenAPI answers requests for the OpenAPI document and Swagger UI,
+// returning false for any other request.
+func (s *Server) serveOpenAPI(w http.ResponseWriter, r *http.Request) bool {
+	if !s.opts.OpenAPI || r.Method != http.MethodGet {
+		return false
+	}
+
+	switch strings.Trim(r.URL.Path, "/") {
+	case "openapi.json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.OpenAPI())
+	case "docs":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(swaggerUI))
+	default:
+		return false
+	}
+
+	return true
+}
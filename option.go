@@ -0,0 +1,130 @@
+package main
+
+import "time"
+
+// Option configures the driver created by New. Besides the With functions,
+// an *Options is itself an Option setting every field at once, so it
+// comes before any With options meant to adjust it.
+type Option interface {
+	apply(o *Options)
+}
+
+type optionFunc func(o *Options)
+
+func (f optionFunc) apply(o *Options) {
+	f(o)
+}
+
+func (opts *Options) apply(o *Options) {
+	if opts != nil {
+		*o = *opts
+	}
+}
+
+func WithLogger(l Logger) Option {
+	return optionFunc(func(o *Options) { o.Logger = l })
+}
+
+// WithCache keeps up to size decoded records in memory for reads.
+func WithCache(size int) Option {
+	return optionFunc(func(o *Options) { o.CacheSize = size })
+}
+
+// WithCacheTiers adds caches of decoded records behind the memory cache.
+func WithCacheTiers(tiers ...CacheTier) Option {
+	return optionFunc(func(o *Options) { o.CacheTiers = append(o.CacheTiers, tiers...) })
+}
+
+// WithFsync flushes every write to disk before it returns.
+func WithFsync() Option {
+	return optionFunc(func(o *Options) { o.Durability = DurabilitySync })
+}
+
+// WithGroupCommit flushes writes to disk, batching the flushes of
+// concurrent writers over window.
+func WithGroupCommit(window time.Duration) Option {
+	return optionFunc(func(o *Options) {
+		o.Durability = DurabilitySync
+		o.GroupCommit = window
+	})
+}
+
+func WithJournal(size int) Option {
+	return optionFunc(func(o *Options) { o.JournalSize = size })
+}
+
+// WithHistory keeps every version of each record for retention, or
+// forever when it is zero.
+func WithHistory(retention time.Duration) Option {
+	return optionFunc(func(o *Options) {
+		o.History = true
+		o.HistoryRetention = retention
+	})
+}
+
+func WithTombstones(retention time.Duration) Option {
+	return optionFunc(func(o *Options) {
+		o.Tombstones = true
+		o.TombstoneRetention = retention
+	})
+}
+
+// WithIndexes declares indexes on fields of collection, adding to those
+// already declared.
+func WithIndexes(collection string, fields ...string) Option {
+	return optionFunc(func(o *Options) {
+		indexes := make(map[string][]string, len(o.Indexes)+1)
+
+		for c, f := range o.Indexes {
+			indexes[c] = f
+		}
+
+		indexes[collection] = append(append([]string(nil), indexes[collection]...), fields...)
+		o.Indexes = indexes
+	})
+}
+
+func WithKeyIndex() Option {
+	return optionFunc(func(o *Options) { o.KeyIndex = true })
+}
+
+func WithWatch() Option {
+	return optionFunc(func(o *Options) { o.Watch = true })
+}
+
+func WithSweepInterval(interval time.Duration) Option {
+	return optionFunc(func(o *Options) { o.SweepInterval = interval })
+}
+
+func WithMaxOpenFiles(n int) Option {
+	return optionFunc(func(o *Options) { o.MaxOpenFiles = n })
+}
+
+func WithQuota(maxBytes int64, maxRecords int) Option {
+	return optionFunc(func(o *Options) {
+		o.MaxBytes = maxBytes
+		o.MaxRecords = maxRecords
+	})
+}
+
+func WithMaxDocumentSize(size int) Option {
+	return optionFunc(func(o *Options) { o.MaxDocumentSize = size })
+}
+
+func WithEncryption(e Encryption) Option {
+	return optionFunc(func(o *Options) { o.Encryption = e })
+}
+
+func WithChangeLog(opts ChangeLogOptions) Option {
+	return optionFunc(func(o *Options) { o.ChangeLog = &opts })
+}
+
+// WithTiering demotes records to store as their collections' tier
+// policies decide, applying the policies every interval.
+func WithTiering(store ObjectStore, interval time.Duration) Option {
+	return optionFunc(func(o *Options) { o.Tiering = &TieringOptions{Store: store, Interval: interval} })
+}
+
+func WithVerifyOnOpen() Option {
+	return optionFunc(func(o *Options) { o.VerifyOnOpen = true })
+}
@@ -0,0 +1,131 @@
+package main
+
+import "fmt"
+
+type FindOptions struct {
+	Limit  int
+	Offset int
+	Sort   []SortField
+	Fields []string
+}
+
+func (d *Driver) ReadAllWithOptions(collection string, opts *FindOptions) ([]string, error) {
+	return d.FindWithOptions(collection, nil, opts)
+}
+
+func (d *Driver) FindWithOptions(collection string, filter Filter, opts *FindOptions) ([]string, error) {
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.FindWithOptions(collection, nil, opts)
+}
+
+func (q *Query) FindWithOptions(collection string, params Params, opts *FindOptions) ([]string, error) {
+	o := FindOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Limit < 0 || o.Offset < 0 {
+		return nil, fmt.Errorf("Limit and Offset must not be negative")
+	}
+
+	if len(o.Sort) > 0 {
+		return q.findSorted(collection, params, o)
+	}
+
+	// Skips are counted among the records each yields, so that expired,
+	// deleted and forgotten records do not count toward the offset.
+	skip := o.Offset
+
+	var records []string
+
+	err := q.each(collection, params, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+
+		if len(o.Fields) > 0 {
+			p, err := project(b, o.Fields)
+
+			if err != nil {
+				return fmt.Errorf("Unable to project %v/%v: %w", collection, resource, err)
+			}
+
+			b = p
+		}
+
+		records = append(records, string(b))
+
+		if o.Limit > 0 && len(records) == o.Limit {
+			return errStop
+		}
+
+		return nil
+	})
+
+	return records, err
+}
+
+// findSorted has to gather every match before the offset and limit can be
+// applied, so only the sort keys are kept alongside each record.
+func (q *Query) findSorted(collection string, params Params, o FindOptions) ([]string, error) {
+	cmps, err := q.d.comparatorsFor(o.Sort)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []sortedRecord
+
+	err = q.each(collection, params, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		keys, err := sortKeys(b, doc, o.Sort)
+
+		if err != nil {
+			return fmt.Errorf("Unable to decode %v/%v: %w", collection, resource, err)
+		}
+
+		matches = append(matches, sortedRecord{record: string(b), keys: keys})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortRecords(matches, o.Sort, cmps)
+
+	if o.Offset >= len(matches) {
+		return nil, nil
+	}
+
+	matches = matches[o.Offset:]
+
+	if o.Limit > 0 && o.Limit < len(matches) {
+		matches = matches[:o.Limit]
+	}
+
+	records := make([]string, len(matches))
+
+	for i, m := range matches {
+		records[i] = m.record
+
+		if len(o.Fields) > 0 {
+			p, err := project([]byte(m.record), o.Fields)
+
+			if err != nil {
+				return nil, err
+			}
+
+			records[i] = string(p)
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFindWithOptionsOffset(t *testing.T) {
+	db, err := New(t.TempDir(), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resource := range []string{"a", "c", "d"} {
+		if err := db.Write("Users", resource, map[string]string{"name": resource}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.WriteWithTTL("Users", "b", map[string]string{"name": "b"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		offset int
+		limit  int
+		want   []string
+	}{
+		{offset: 0, want: []string{"a", "c", "d"}},
+		{offset: 1, want: []string{"c", "d"}},
+		{offset: 1, limit: 1, want: []string{"c"}},
+		{offset: 2, want: []string{"d"}},
+		{offset: 3, want: nil},
+	}
+
+	for _, tt := range tests {
+		got, err := db.ReadAllWithOptions("Users", &FindOptions{Offset: tt.offset, Limit: tt.limit})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("Offset %d, Limit %d returned %q, want %q", tt.offset, tt.limit, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			var doc map[string]string
+
+			if err := json.Unmarshal([]byte(got[i]), &doc); err != nil || doc["name"] != tt.want[i] {
+				t.Errorf("Offset %d, Limit %d returned %q, want %q", tt.offset, tt.limit, got, tt.want)
+				break
+			}
+		}
+	}
+}
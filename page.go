@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+type cursorToken struct {
+	After string `json:"a"`
+}
+
+func (d *Driver) ReadAllPage(collection, cursor string, size int) ([]string, string, error) {
+	return d.FindPage(collection, nil, cursor, size)
+}
+
+func (d *Driver) FindPage(collection string, filter Filter, cursor string, size int) ([]string, string, error) {
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return q.FindPage(collection, nil, cursor, size)
+}
+
+// FindPage returns up to size matching records following the position
+// encoded in cursor, plus the cursor for the next page. The next cursor is
+// empty once the last page has been returned. Pages are keyed on resource
+// names, so records added while paging never shift the pages already read.
+func (q *Query) FindPage(collection string, params Params, cursor string, size int) ([]string, string, error) {
+	if size <= 0 {
+		return nil, "", fmt.Errorf("Page size must be positive, got %d", size)
+	}
+
+	after, err := decodeCursor(cursor)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		records []string
+		last    string
+		more    bool
+	)
+
+	err = q.each(collection, params, after, func(resource string, b []byte, doc map[string]interface{}) error {
+		if len(records) == size {
+			more = true
+			return errStop
+		}
+
+		records = append(records, string(b))
+		last = resource
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !more {
+		return records, "", nil
+	}
+
+	return records, encodeCursor(last), nil
+}
+
+func encodeCursor(after string) string {
+	b, _ := json.Marshal(cursorToken{After: after})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid cursor")
+	}
+
+	var token cursorToken
+
+	if err := json.Unmarshal(b, &token); err != nil || token.After == "" {
+		return "", fmt.Errorf("Invalid cursor")
+	}
+
+	return token.After, nil
+}
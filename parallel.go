@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BatchError reports the records of a batch that could not be written, by
+// resource.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	resources := e.resources()
+	msg := fmt.Sprintf("%d records failed", len(resources))
+
+	if len(resources) > 0 {
+		msg += ", first " + e.Errors[resources[0]].Error()
+	}
+
+	return msg
+}
+
+// Unwrap returns the errors of the records, in resource order.
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+
+	for _, resource := range e.resources() {
+		errs = append(errs, e.Errors[resource])
+	}
+
+	return errs
+}
+
+func (e *BatchError) resources() []string {
+	resources := make([]string, 0, len(e.Errors))
+
+	for resource := range e.Errors {
+		resources = append(resources, resource)
+	}
+
+	sort.Strings(resources)
+
+	return resources
+}
+
+// WriteBatchParallel writes docs, keyed by resource, with workers writers at
+// a time, which defaults to GOMAXPROCS. Marshaling, encoding and the file
+// writes run in parallel; only the final rename of each record is made
+// under the collection lock. Records that fail do not stop the others, and
+// are reported together in a *BatchError.
+func (d *Driver) WriteBatchParallel(collection string, docs map[string]interface{}, workers int) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	resources := make(chan string)
+	errs := make(map[string]error)
+
+	var (
+		errMutex sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for resource := range resources {
+				if err := d.writeParallel(collection, resource, docs[resource]); err != nil {
+					errMutex.Lock()
+					errs[resource] = err
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for resource := range docs {
+		resources <- resource
+	}
+
+	close(resources)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+
+	d.log.Debug("Wrote %d records to '%s' with %d workers\n", len(docs), collection, workers)
+
+	return nil
+}
+
+func (d *Driver) writeParallel(collection, resource string, v interface{}) (err error) {
+	defer d.observe(time.Now(), &err, "write", collection, resource)
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+	path := d.recordPath(collection, resource)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return d.writeStaged(collection, resource, v, d.opts.Durability)
+}
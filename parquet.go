@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type ParquetType int
+
+const (
+	ParquetString ParquetType = iota
+	ParquetInt64
+	ParquetDouble
+	ParquetBool
+	// ParquetTimestamp columns hold RFC 3339 strings, as time.Time encodes
+	// them, stored as microseconds since the epoch in UTC.
+	ParquetTimestamp
+	// ParquetJSON columns hold any value, objects and arrays included,
+	// stored as its JSON text.
+	ParquetJSON
+)
+
+type ParquetColumn struct {
+	Name string
+
+	// Field is the dotted path of the value in each document; Name when
+	// empty.
+	Field string
+
+	Type ParquetType
+
+	// Required columns reject records whose value is missing or null;
+	// other columns store them as nulls.
+	Required bool
+}
+
+type ParquetSchema struct {
+	Columns []ParquetColumn
+
+	// ResourceColumn, if set, names an extra first column holding the name
+	// of each record.
+	ResourceColumn string
+
+	// RowGroupSize is the number of rows per row group; 10000 when zero.
+	RowGroupSize int
+
+	// Compression is "" for none or "zstd".
+	Compression string
+}
+
+// Parquet physical and converted types, encodings and codecs, as numbered
+// by the format's Thrift definitions.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetJSONType        = 19
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetZstd         = 6
+)
+
+// ExportParquet writes the records of collection to w as a Parquet file
+// with one row per record and the columns of schema, for tools such as
+// DuckDB and Spark to read directly. Only the current row group is held
+// in memory.
+func (d *Driver) ExportParquet(collection string, w io.Writer, schema ParquetSchema) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	var columns []ParquetColumn
+
+	if schema.ResourceColumn != "" {
+		columns = append(columns, ParquetColumn{Name: schema.ResourceColumn, Type: ParquetString, Required: true})
+	}
+
+	columns = append(columns, schema.Columns...)
+
+	if len(columns) == 0 {
+		return fmt.Errorf("Missing Parquet columns")
+	}
+
+	names := make(map[string]bool, len(columns))
+
+	for i, c := range columns {
+		if c.Name == "" || names[c.Name] {
+			return fmt.Errorf("Invalid or duplicate Parquet column %q", c.Name)
+		}
+
+		if c.Type < ParquetString || c.Type > ParquetJSON {
+			return fmt.Errorf("Unknown type of Parquet column %v", c.Name)
+		}
+
+		if c.Field == "" {
+			columns[i].Field = c.Name
+		}
+
+		names[c.Name] = true
+	}
+
+	if schema.RowGroupSize <= 0 {
+		schema.RowGroupSize = 10000
+	}
+
+	var compress func([]byte) ([]byte, error)
+	codec := parquetUncompressed
+
+	switch schema.Compression {
+	case "":
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+
+		if err != nil {
+			return err
+		}
+
+		defer enc.Close()
+
+		compress = func(b []byte) ([]byte, error) { return enc.EncodeAll(b, nil), nil }
+		codec = parquetZstd
+	default:
+		return fmt.Errorf("Unknown Parquet compression %v", schema.Compression)
+	}
+
+	pw := &parquetWriter{w: bufio.NewWriter(w), columns: columns, codec: codec, compress: compress}
+	pw.reset()
+
+	if err := pw.write([]byte("PAR1")); err != nil {
+		return err
+	}
+
+	q, err := d.Prepare(nil)
+
+	if err != nil {
+		return err
+	}
+
+	paths := make([][]string, len(columns))
+
+	for i, c := range columns {
+		paths[i] = strings.Split(c.Field, ".")
+	}
+
+	err = q.each(collection, nil, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		doc = nil
+
+		if err := decodeNumbers(b, &doc); err != nil {
+			return fmt.Errorf("Unable to decode %v/%v: %w", collection, resource, err)
+		}
+
+		for i, c := range columns {
+			var v interface{} = resource
+
+			if i > 0 || schema.ResourceColumn == "" {
+				v, _ = lookupPath(doc, paths[i])
+			}
+
+			if err := pw.chunks[i].add(c, v); err != nil {
+				return fmt.Errorf("%v/%v: %w", collection, resource, err)
+			}
+		}
+
+		pw.rows++
+
+		if pw.rows >= schema.RowGroupSize {
+			return pw.flushRowGroup()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	return pw.close()
+}
+
+type parquetWriter struct {
+	w        *bufio.Writer
+	offset   int64
+	columns  []ParquetColumn
+	codec    int
+	compress func([]byte) ([]byte, error)
+
+	chunks    []*parquetChunk
+	rows      int
+	totalRows int64
+	groups    [][]byte
+}
+
+func (pw *parquetWriter) reset() {
+	pw.chunks = make([]*parquetChunk, len(pw.columns))
+
+	for i := range pw.chunks {
+		pw.chunks[i] = &parquetChunk{}
+	}
+
+	pw.rows = 0
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// flushRowGroup writes the buffered rows as a row group of one data page
+// per column, remembering its metadata for the footer.
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+
+	var (
+		group thriftWriter
+		total int64
+	)
+
+	group.listBegin(1, thriftStruct, len(pw.columns))
+
+	for i, c := range pw.columns {
+		page := pw.chunks[i].page(c)
+		compressed := page
+
+		if pw.compress != nil {
+			var err error
+
+			if compressed, err = pw.compress(page); err != nil {
+				return err
+			}
+		}
+
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.structBegin(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+
+		start := pw.offset
+
+		if err := pw.write(header.b); err != nil {
+			return err
+		}
+
+		if err := pw.write(compressed); err != nil {
+			return err
+		}
+
+		uncompressed := int64(len(header.b) + len(page))
+		total += uncompressed
+
+		group.elemBegin()
+		group.i64(2, start)
+		group.structBegin(3)
+		group.i32(1, parquetPhysical(c.Type))
+		group.listBegin(2, thriftI32, 2)
+		group.elemI32(parquetPlain)
+		group.elemI32(parquetRLE)
+		group.listBegin(3, thriftBinary, 1)
+		group.elemString(c.Name)
+		group.i32(4, int32(pw.codec))
+		group.i64(5, int64(pw.rows))
+		group.i64(6, uncompressed)
+		group.i64(7, pw.offset-start)
+		group.i64(9, start)
+		group.structEnd()
+		group.stop()
+	}
+
+	group.i64(2, total)
+	group.i64(3, int64(pw.rows))
+	group.stop()
+
+	pw.groups = append(pw.groups, group.b)
+	pw.totalRows += int64(pw.rows)
+	pw.reset()
+
+	return nil
+}
+
+// close writes the footer: the file metadata, its length and the magic.
+func (pw *parquetWriter) close() error {
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(pw.columns)+1)
+	meta.elemBegin()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.stop()
+
+	for _, c := range pw.columns {
+		meta.elemBegin()
+		meta.i32(1, parquetPhysical(c.Type))
+
+		if c.Required {
+			meta.i32(3, 0)
+		} else {
+			meta.i32(3, 1)
+		}
+
+		meta.str(4, c.Name)
+
+		switch c.Type {
+		case ParquetString:
+			meta.i32(6, parquetUTF8)
+		case ParquetTimestamp:
+			meta.i32(6, parquetTimestampMicros)
+		case ParquetJSON:
+			meta.i32(6, parquetJSONType)
+		}
+
+		meta.stop()
+	}
+
+	meta.i64(3, pw.totalRows)
+	meta.listBegin(4, thriftStruct, len(pw.groups))
+
+	for _, g := range pw.groups {
+		meta.elemRaw(g)
+	}
+
+	meta.str(6, "go-json-database")
+	meta.stop()
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(meta.b)))
+
+	for _, b := range [][]byte{meta.b, size[:], []byte("PAR1")} {
+		if err := pw.write(b); err != nil {
+			return err
+		}
+	}
+
+	return pw.w.Flush()
+}
+
+func parquetPhysical(typ ParquetType) int32 {
+	switch typ {
+	case ParquetInt64, ParquetTimestamp:
+		return parquetInt64
+	case ParquetDouble:
+		return parquetDouble
+	case ParquetBool:
+		return parquetBoolean
+	}
+
+	return parquetByteArray
+}
+
+// parquetChunk buffers the values of one column of a row group, PLAIN
+// encoded, with a definition level per row telling nulls apart.
+type parquetChunk struct {
+	defined []bool
+	values  bytes.Buffer
+	bools   []bool
+}
+
+func (p *parquetChunk) add(c ParquetColumn, v interface{}) error {
+	if v == nil {
+		if c.Required {
+			return fmt.Errorf("Missing value of required column %v", c.Name)
+		}
+
+		p.defined = append(p.defined, false)
+		return nil
+	}
+
+	var scratch [8]byte
+
+	switch c.Type {
+	case ParquetString:
+		s, ok := v.(string)
+
+		if !ok {
+			return fmt.Errorf("Column %v: %v is not a string", c.Name, v)
+		}
+
+		p.byteArray([]byte(s))
+
+	case ParquetJSON:
+		b, err := json.Marshal(v)
+
+		if err != nil {
+			return err
+		}
+
+		p.byteArray(b)
+
+	case ParquetInt64:
+		n, ok := v.(json.Number)
+		i, err := n.Int64()
+
+		if !ok || err != nil {
+			return fmt.Errorf("Column %v: %v is not an integer", c.Name, v)
+		}
+
+		binary.LittleEndian.PutUint64(scratch[:], uint64(i))
+		p.values.Write(scratch[:])
+
+	case ParquetDouble:
+		n, ok := v.(json.Number)
+		f, err := n.Float64()
+
+		if !ok || err != nil {
+			return fmt.Errorf("Column %v: %v is not a number", c.Name, v)
+		}
+
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(f))
+		p.values.Write(scratch[:])
+
+	case ParquetBool:
+		b, ok := v.(bool)
+
+		if !ok {
+			return fmt.Errorf("Column %v: %v is not a boolean", c.Name, v)
+		}
+
+		p.bools = append(p.bools, b)
+
+	case ParquetTimestamp:
+		s, _ := v.(string)
+		ts, err := time.Parse(time.RFC3339Nano, s)
+
+		if err != nil {
+			return fmt.Errorf("Column %v: %v is not a timestamp", c.Name, v)
+		}
+
+		binary.LittleEndian.PutUint64(scratch[:], uint64(ts.UnixMicro()))
+		p.values.Write(scratch[:])
+	}
+
+	p.defined = append(p.defined, true)
+
+	return nil
+}
+
+func (p *parquetChunk) byteArray(b []byte) {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(b)))
+	p.values.Write(size[:])
+	p.values.Write(b)
+}
+
+// page returns the uncompressed data page: the definition levels of
+// optional columns, as a single bit-packed run prefixed by its length,
+// followed by the values.
+func (p *parquetChunk) page(c ParquetColumn) []byte {
+	var page []byte
+
+	if !c.Required {
+		groups := (len(p.defined) + 7) / 8
+		levels := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+		levels = append(levels, packBits(p.defined)...)
+
+		page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+		page = append(page, levels...)
+	}
+
+	if c.Type == ParquetBool {
+		return append(page, packBits(p.bools)...)
+	}
+
+	return append(page, p.values.Bytes()...)
+}
+
+// packBits packs bits least significant first, padding the last byte.
+func packBits(bits []bool) []byte {
+	b := make([]byte, (len(bits)+7)/8)
+
+	for i, bit := range bits {
+		if bit {
+			b[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	return b
+}
+
+// Thrift compact protocol type codes.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs with the compact protocol, which is how Parquet
+// writes its page headers and file metadata. Fields must be written in
+// increasing order of id within each struct.
+type thriftWriter struct {
+	b    []byte
+	last []int16
+	id   int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.id; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+
+	t.id = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemString(s)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+}
+
+// stop ends the current struct, going back to the one around it.
+func (t *thriftWriter) stop() {
+	t.b = append(t.b, 0)
+
+	if n := len(t.last); n > 0 {
+		t.id = t.last[n-1]
+		t.last = t.last[:n-1]
+	}
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+
+	if size < 15 {
+		t.b = append(t.b, byte(size)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xf0|elem)
+		t.b = binary.AppendUvarint(t.b, uint64(size))
+	}
+}
+
+// elemBegin starts a struct element of a list, or a nested struct.
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, t.id)
+	t.id = 0
+}
+
+// elemRaw appends a struct element encoded on its own.
+func (t *thriftWriter) elemRaw(b []byte) {
+	t.b = append(t.b, b...)
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thriftWriter) elemString(s string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(s)))
+	t.b = append(t.b, s...)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const opPatch = "patch"
+
+// Pipeline gathers operations on any number of collections and runs them
+// together with Exec, which takes the lock of each collection once for the
+// whole pipeline. Unlike a Tx, the operations are independent: one failing
+// does not undo or stop the others.
+type Pipeline struct {
+	d   *Driver
+	ops []pipelineOp
+}
+
+type pipelineOp struct {
+	kind       string
+	collection string
+	resource   string
+	value      json.RawMessage
+	err        error
+}
+
+type PipelineResult struct {
+	// Errors holds the outcome of each operation, in the order they were
+	// added, with nil for those that succeeded.
+	Errors []error
+	Failed int
+}
+
+// Err returns the first error of the pipeline, or nil when every operation
+// succeeded.
+func (r *PipelineResult) Err() error {
+	for _, err := range r.Errors {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) Pipeline() *Pipeline {
+	return &Pipeline{d: d}
+}
+
+func (p *Pipeline) Write(collection, resource string, v interface{}) *Pipeline {
+	return p.add(OpWrite, collection, resource, v)
+}
+
+// Update replaces an existing record, keeping its expiry.
+func (p *Pipeline) Update(collection, resource string, v interface{}) *Pipeline {
+	return p.add(OpUpdate, collection, resource, v)
+}
+
+// Patch applies patch to an existing record as a JSON merge patch (RFC
+// 7386): its members replace those of the record, recursively for objects,
+// and null members remove them.
+func (p *Pipeline) Patch(collection, resource string, patch interface{}) *Pipeline {
+	return p.add(opPatch, collection, resource, patch)
+}
+
+func (p *Pipeline) Delete(collection, resource string) *Pipeline {
+	return p.add(OpDelete, collection, resource, nil)
+}
+
+func (p *Pipeline) add(kind, collection, resource string, v interface{}) *Pipeline {
+	op := pipelineOp{kind: kind, collection: collection, resource: resource}
+
+	switch err := checkCollection(collection); {
+	case err != nil:
+		op.err = err
+	case resource == "":
+		op.err = fmt.Errorf("Missing resource")
+	default:
+		op.resource = p.d.key(resource)
+
+		if kind != OpDelete {
+			op.value, op.err = p.d.marshalDocument(collection, v)
+		}
+	}
+
+	if op.err != nil {
+		op.err = &OpError{Op: kind, Collection: collection, Resource: resource, Err: op.err}
+	}
+
+	p.ops = append(p.ops, op)
+
+	return p
+}
+
+// Exec runs the operations in the order they were added, with the locks
+// of all their collections held, taken in name order. The error is only
+// set when the locks could not be taken, in which case nothing ran.
+func (p *Pipeline) Exec() (*PipelineResult, error) {
+	d := p.d
+	seen := make(map[string]bool)
+	var collections []string
+
+	for _, op := range p.ops {
+		if op.err == nil && !seen[op.collection] {
+			seen[op.collection] = true
+			collections = append(collections, op.collection)
+		}
+	}
+
+	sort.Strings(collections)
+
+	// The locks are taken through a transaction so that deadlocks with
+	// transactions holding them are detected.
+	tx := d.Begin()
+
+	for _, collection := range collections {
+		if err := tx.lock(collection); err != nil {
+			tx.unlock()
+			return nil, err
+		}
+	}
+
+	defer tx.unlock()
+
+	d.fence.RLock()
+	defer d.fence.RUnlock()
+
+	for _, collection := range collections {
+		d.applyBuffered(collection)
+	}
+
+	result := &PipelineResult{Errors: make([]error, len(p.ops))}
+
+	for i, op := range p.ops {
+		err := op.err
+
+		if err == nil {
+			if err = d.execOp(op); err != nil {
+				err = &OpError{Op: op.kind, Collection: op.collection, Resource: op.resource, Err: err}
+			}
+		}
+
+		if err != nil {
+			result.Errors[i] = err
+			result.Failed++
+		}
+	}
+
+	d.log.Debug("Ran pipeline of %d operations on %d collections, %d failed\n", len(p.ops), len(collections), result.Failed)
+
+	return result, nil
+}
+
+// execOp runs one operation of a pipeline. Callers must hold the collection
+// lock.
+func (d *Driver) execOp(op pipelineOp) error {
+	switch op.kind {
+	case OpWrite:
+		return d.write(op.collection, op.resource, op.value)
+
+	case OpUpdate:
+		return d.journaled(OpUpdate, op.collection, op.resource, func() error {
+			return d.update(op.collection, op.resource, op.value)
+		})
+
+	case opPatch:
+		return d.journaled(OpUpdate, op.collection, op.resource, func() error {
+			return d.patch(op.collection, op.resource, op.value)
+		})
+
+	default:
+		return d.delete(op.collection, op.resource)
+	}
+}
+
+// patch merges a JSON merge patch into an existing record. Callers must
+// hold the collection lock.
+func (d *Driver) patch(collection, resource string, patch json.RawMessage) error {
+	if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		if os.IsNotExist(err) {
+			return d.notFound(collection)
+		}
+		return err
+	}
+
+	if d.expired(collection, resource) {
+		return ErrRecordNotFound
+	}
+
+	b, err := d.readRecord(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	var doc, p interface{}
+
+	if err := decodeNumbers(b, &doc); err != nil {
+		return err
+	}
+
+	if err := decodeNumbers(patch, &p); err != nil {
+		return err
+	}
+
+	return d.update(collection, resource, mergePatch(doc, p))
+}
+
+func decodeNumbers(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// configDir holds the configuration stored with the database, in
+// config.json.
+const configDir = ".gojsondb"
+
+// CollectionPolicy holds the settings of a collection kept in the
+// database's configuration file, so they live with the data. TTL gives
+// every record written an expiry, Schema is a JSON Schema documents must
+// satisfy, and Compression, Indexes and Cap are as for SetCompression,
+// EnsureIndex and SetCapped. Tier moves the records to cold storage when
+// the driver is set up with Options.Tiering.
+type CollectionPolicy struct {
+	TTL         time.Duration   `json:"-"`
+	Compression string          `json:"compression,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Indexes     []string        `json:"indexes,omitempty"`
+	Cap         *CapOptions     `json:"cap,omitempty"`
+	Tier        *TierPolicy     `json:"tier,omitempty"`
+}
+
+type policyJSON struct {
+	TTL string `json:"ttl,omitempty"`
+	*policyFields
+}
+
+type policyFields CollectionPolicy
+
+// MarshalJSON writes TTL as a duration string such as "24h".
+func (p CollectionPolicy) MarshalJSON() ([]byte, error) {
+	out := policyJSON{policyFields: (*policyFields)(&p)}
+
+	if p.TTL > 0 {
+		out.TTL = p.TTL.String()
+	}
+
+	return json.Marshal(out)
+}
+
+func (p *CollectionPolicy) UnmarshalJSON(b []byte) error {
+	in := policyJSON{policyFields: (*policyFields)(p)}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&in); err != nil {
+		return err
+	}
+
+	if in.TTL == "" {
+		p.TTL = 0
+		return nil
+	}
+
+	ttl, err := time.ParseDuration(in.TTL)
+
+	if err != nil {
+		return fmt.Errorf("Invalid ttl: %w", err)
+	}
+
+	p.TTL = ttl
+
+	return nil
+}
+
+type configFile struct {
+	Collections map[string]CollectionPolicy `json:"collections"`
+}
+
+func (d *Driver) configPath() string {
+	return filepath.Join(d.dir, configDir, "config.json")
+}
+
+// loadPolicies applies the policies of the configuration file, if the
+// database has one.
+func (d *Driver) loadPolicies() error {
+	b, err := d.readFile(d.configPath())
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var cfg configFile
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("Invalid %v: %w", d.configPath(), err)
+	}
+
+	names := make([]string, 0, len(cfg.Collections))
+
+	for collection := range cfg.Collections {
+		names = append(names, collection)
+	}
+
+	sort.Strings(names)
+
+	for _, collection := range names {
+		policy := cfg.Collections[collection]
+
+		if err := d.applyPolicy(collection, nil, &policy); err != nil {
+			return fmt.Errorf("Invalid policy of %v in %v: %w", collection, d.configPath(), err)
+		}
+	}
+
+	d.policyMutex.Lock()
+	d.policies = cfg.Collections
+	d.policyMutex.Unlock()
+
+	return nil
+}
+
+// Policy returns the policy of collection, if it has one.
+func (d *Driver) Policy(collection string) (CollectionPolicy, bool) {
+	d.policyMutex.Lock()
+	defer d.policyMutex.Unlock()
+
+	p, ok := d.policies[collection]
+
+	return p, ok
+}
+
+// Policies returns the policies of all collections that have one.
+func (d *Driver) Policies() map[string]CollectionPolicy {
+	d.policyMutex.Lock()
+	defer d.policyMutex.Unlock()
+
+	policies := make(map[string]CollectionPolicy, len(d.policies))
+
+	for collection, p := range d.policies {
+		policies[collection] = p
+	}
+
+	return policies
+}
+
+// SetPolicy applies policy to collection and saves it in the configuration
+// file, replacing any earlier policy: settings it no longer has are turned
+// off. A nil policy removes the collection's.
+func (d *Driver) SetPolicy(collection string, policy *CollectionPolicy) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if policy != nil {
+		if err := checkPolicy(policy); err != nil {
+			return err
+		}
+	}
+
+	d.policyMutex.Lock()
+	defer d.policyMutex.Unlock()
+
+	var old *CollectionPolicy
+
+	if p, ok := d.policies[collection]; ok {
+		old = &p
+	}
+
+	policies := make(map[string]CollectionPolicy, len(d.policies)+1)
+
+	for c, p := range d.policies {
+		policies[c] = p
+	}
+
+	if policy == nil {
+		delete(policies, collection)
+	} else {
+		policies[collection] = *policy
+	}
+
+	if err := d.savePolicies(policies); err != nil {
+		return err
+	}
+
+	d.policies = policies
+
+	return d.applyPolicy(collection, old, policy)
+}
+
+func checkPolicy(p *CollectionPolicy) error {
+	if p.TTL < 0 {
+		return fmt.Errorf("TTL must not be negative")
+	}
+
+	if p.Compression != "" {
+		if _, err := compressor(p.Compression); err != nil {
+			return err
+		}
+	}
+
+	if len(p.Schema) > 0 {
+		if _, err := compileSchema(p.Schema); err != nil {
+			return err
+		}
+	}
+
+	if p.Cap != nil && (p.Cap.MaxRecords < 0 || p.Cap.MaxBytes < 0) {
+		return fmt.Errorf("Cap limits must not be negative")
+	}
+
+	for _, field := range p.Indexes {
+		if field == "" {
+			return fmt.Errorf("Missing index field")
+		}
+	}
+
+	if p.Tier != nil {
+		if p.Tier.DemoteAfter < 0 || p.Tier.PromoteReads < 0 {
+			return fmt.Errorf("Tier settings must not be negative")
+		}
+
+		if p.Tier.PromoteReads > 0 && p.Tier.DemoteAfter == 0 {
+			return fmt.Errorf("Promoting records needs a demoteAfter")
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) savePolicies(policies map[string]CollectionPolicy) error {
+	b, err := json.MarshalIndent(configFile{Collections: policies}, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	path := d.configPath()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := d.writeFile(path+".tmp", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return d.replaceFile(path+".tmp", path)
+}
+
+// applyPolicy changes the settings of collection from those of the old
+// policy to those of p, either of which may be nil.
+func (d *Driver) applyPolicy(collection string, old, p *CollectionPolicy) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if old == nil {
+		old = &CollectionPolicy{}
+	}
+
+	if p == nil {
+		p = &CollectionPolicy{}
+	}
+
+	if err := checkPolicy(p); err != nil {
+		return err
+	}
+
+	var schema *docSchema
+
+	if len(p.Schema) > 0 {
+		var err error
+
+		if schema, err = compileSchema(p.Schema); err != nil {
+			return err
+		}
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.ttl = p.TTL
+		cfg.schema = schema
+		cfg.indexes = append([]string(nil), p.Indexes...)
+	})
+
+	if p.Compression != old.Compression {
+		if err := d.SetCompression(collection, p.Compression); err != nil {
+			return err
+		}
+	}
+
+	if !reflect.DeepEqual(p.Cap, old.Cap) {
+		var limits CapOptions
+
+		if p.Cap != nil {
+			limits = *p.Cap
+		}
+
+		if err := d.SetCapped(collection, limits); err != nil {
+			return err
+		}
+	}
+
+	keep := make(map[string]bool)
+
+	for _, field := range d.declared(collection) {
+		keep[field] = true
+	}
+
+	for _, field := range old.Indexes {
+		if !keep[field] {
+			d.DropIndex(collection, field)
+		}
+	}
+
+	return nil
+}
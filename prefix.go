@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReadPrefix reads the records whose keys start with prefix, in key order.
+// Since '/' separates the namespaces of a key, only the directory of the
+// deepest namespace named in full by prefix is read: "orders/2024/05/"
+// reads nothing outside orders/2024/05. Keys with an empty namespace, such
+// as "a//b", are stored flat and only found by prefixes without a '/'.
+func (d *Driver) ReadPrefix(collection, prefix string) (_ []string, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, prefix)
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	prefix = d.key(prefix)
+
+	d.flushCollection(collection)
+
+	if _, err := os.Stat(filepath.Join(d.dir, collection)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCollectionNotFound
+		}
+		return nil, err
+	}
+
+	var ns string
+
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		ns = prefix[:i+1]
+	}
+
+	dir, ok := namespaceDir(ns)
+
+	if !ok {
+		return nil, nil
+	}
+
+	files, err := d.readTree(filepath.Join(d.dir, collection, dir))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []string
+
+	for _, file := range files {
+		if !isRecordFile(file) {
+			continue
+		}
+
+		name := file.Name()
+
+		if dir != "" {
+			name = dir + "/" + name
+		}
+
+		resource := d.recordKey(collection, name)
+
+		if strings.HasPrefix(resource, prefix) && !d.expired(collection, resource) {
+			resources = append(resources, resource)
+		}
+	}
+
+	sort.Strings(resources)
+
+	var records []string
+
+	for _, resource := range resources {
+		b, err := d.readRecord(collection, resource)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, string(b))
+	}
+
+	return records, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Param string
+
+type Params map[string]interface{}
+
+type Query struct {
+	d          *Driver
+	conditions []condition
+	params     []string
+}
+
+type condition struct {
+	field     string
+	path      []string
+	op        string
+	arg       interface{}
+	term      string
+	threshold float64
+}
+
+func (d *Driver) Prepare(filter Filter) (*Query, error) {
+	q := &Query{d: d}
+	seen := make(map[string]bool)
+
+	for _, field := range sortedFields(filter) {
+		if field == "" {
+			return nil, fmt.Errorf("Empty field name in filter")
+		}
+
+		cond := filter[field]
+		ops, ok := cond.(map[string]interface{})
+
+		if !ok || !isOperatorMap(ops) {
+			ops = map[string]interface{}{"$eq": cond}
+		}
+
+		names := make([]string, 0, len(ops))
+
+		for op := range ops {
+			names = append(names, op)
+		}
+
+		sort.Strings(names)
+
+		for _, op := range names {
+			c := condition{
+				field: field,
+				path:  strings.Split(field, "."),
+				op:    op,
+				arg:   ops[op],
+			}
+
+			if err := c.check(); err != nil {
+				return nil, err
+			}
+
+			for _, name := range paramNames(c.arg) {
+				if !seen[name] {
+					seen[name] = true
+					q.params = append(q.params, name)
+				}
+			}
+
+			q.conditions = append(q.conditions, c)
+		}
+	}
+
+	return q, nil
+}
+
+func (q *Query) Params() []string {
+	return q.params
+}
+
+func (q *Query) Find(collection string, params Params) ([]string, error) {
+	return q.FindWithOptions(collection, params, nil)
+}
+
+// each calls fn, in resource order, for every record after the given
+// resource that matches the query. The decoded document is only passed
+// when the query had to decode it to evaluate its conditions.
+func (q *Query) each(collection string, params Params, after string, fn func(resource string, b []byte, doc map[string]interface{}) error) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	conds, err := q.bind(params)
+
+	if err != nil {
+		return err
+	}
+
+	return q.d.candidates(collection, conds, after, func(resource string, b []byte) error {
+		b, doc, err := q.d.withComputed(collection, b)
+
+		if err != nil {
+			return fmt.Errorf("Unable to decode %v/%v: %w", collection, resource, err)
+		}
+
+		if len(conds) == 0 {
+			return fn(resource, b, doc)
+		}
+
+		if doc == nil {
+			if err := json.Unmarshal(b, &doc); err != nil {
+				return fmt.Errorf("Unable to decode %v/%v: %w", collection, resource, err)
+			}
+		}
+
+		if !matchConditions(doc, conds) {
+			return nil
+		}
+
+		return fn(resource, b, doc)
+	})
+}
+
+func (q *Query) Explain(collection string, params Params) (*Explain, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	conds, err := q.bind(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q.d.declaredIndexes(collection)
+
+	explain := &Explain{Plan: PlanCollectionScan}
+
+	for _, c := range conds {
+		explain.Operators = append(explain.Operators, OperatorPlan{
+			Field:          c.field,
+			Operator:       c.op,
+			IndexSupported: indexOperators[c.op] && q.d.index(collection, c.field) != nil,
+		})
+	}
+
+	if idx, keys := q.d.chooseIndex(collection, conds); idx != nil {
+		explain.Plan = PlanIndexScan
+		explain.Index = idx.field
+		explain.RecordsExamined = len(keys)
+		return explain, nil
+	}
+
+	dir := filepath.Join(q.d.dir, collection)
+
+	if _, err := stat(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := q.d.readTree(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if isRecordFile(file) {
+			explain.RecordsExamined++
+		}
+	}
+
+	return explain, nil
+}
+
+// bind substitutes params into the placeholders of the prepared conditions.
+// Queries without placeholders are returned as is.
+func (q *Query) bind(params Params) ([]condition, error) {
+	if len(q.params) == 0 {
+		return q.conditions, nil
+	}
+
+	conds := make([]condition, len(q.conditions))
+
+	for i, c := range q.conditions {
+		arg, err := substitute(c.arg, params)
+
+		if err != nil {
+			return nil, fmt.Errorf("Condition %v %v: %w", c.field, c.op, err)
+		}
+
+		c.arg = arg
+
+		if err := c.check(); err != nil {
+			return nil, err
+		}
+
+		conds[i] = c
+	}
+
+	return conds, nil
+}
+
+// check validates the argument of c and pre-parses it where the operator
+// needs more than the raw value. Placeholders are checked once bound.
+func (c *condition) check() error {
+	if len(paramNames(c.arg)) > 0 {
+		return nil
+	}
+
+	switch c.op {
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$exists":
+	case "$in", "$nin":
+		if _, ok := c.arg.([]interface{}); !ok {
+			return fmt.Errorf("Operator %v on %v expects an array", c.op, c.field)
+		}
+	case "$fuzzy":
+		term, threshold, err := fuzzyArgs(c.arg)
+
+		if err != nil {
+			return fmt.Errorf("Operator %v on %v: %w", c.op, c.field, err)
+		}
+
+		c.term, c.threshold = term, threshold
+	default:
+		return fmt.Errorf("Unknown operator %v on %v", c.op, c.field)
+	}
+
+	return nil
+}
+
+func (c condition) match(doc map[string]interface{}) bool {
+	value, exists := lookupPath(doc, c.path)
+
+	if c.op == "$fuzzy" {
+		s, ok := value.(string)
+		return exists && ok && similarity(s, c.term) >= c.threshold
+	}
+
+	return matchOperator(c.op, value, exists, c.arg)
+}
+
+func matchConditions(doc map[string]interface{}, conds []condition) bool {
+	for _, c := range conds {
+		if !c.match(doc) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func paramNames(arg interface{}) []string {
+	switch a := arg.(type) {
+	case Param:
+		return []string{string(a)}
+
+	case []interface{}:
+		var names []string
+
+		for _, v := range a {
+			names = append(names, paramNames(v)...)
+		}
+
+		return names
+
+	case map[string]interface{}:
+		var names []string
+
+		for _, v := range a {
+			names = append(names, paramNames(v)...)
+		}
+
+		return names
+	}
+
+	return nil
+}
+
+func substitute(arg interface{}, params Params) (interface{}, error) {
+	switch a := arg.(type) {
+	case Param:
+		v, ok := params[string(a)]
+
+		if !ok {
+			return nil, fmt.Errorf("missing parameter %v", a)
+		}
+
+		return v, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(a))
+
+		for i, v := range a {
+			s, err := substitute(v, params)
+
+			if err != nil {
+				return nil, err
+			}
+
+			out[i] = s
+		}
+
+		return out, nil
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(a))
+
+		for k, v := range a {
+			s, err := substitute(v, params)
+
+			if err != nil {
+				return nil, err
+			}
+
+			out[k] = s
+		}
+
+		return out, nil
+	}
+
+	return arg, nil
+}
+
+func isOperatorMap(m map[string]interface{}) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+
+	return len(m) > 0
+}
+
+func sortedFields(filter Filter) []string {
+	var fields []string
+
+	for field := range filter {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// project builds a record holding only the given fields, copying their raw
+// JSON values so the rest of the document is never decoded. Nested fields
+// such as "Address.City" keep their nesting in the result.
+func project(b []byte, fields []string) ([]byte, error) {
+	out := make(map[string]interface{})
+
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		raw := rawField(b, path)
+
+		if raw == nil {
+			continue
+		}
+
+		parent := out
+
+		for _, part := range path[:len(path)-1] {
+			if _, whole := parent[part].(json.RawMessage); whole {
+				parent = nil
+				break
+			}
+
+			child, ok := parent[part].(map[string]interface{})
+
+			if !ok {
+				child = make(map[string]interface{})
+				parent[part] = child
+			}
+
+			parent = child
+		}
+
+		if parent != nil {
+			parent[path[len(path)-1]] = raw
+		}
+	}
+
+	return marshalRecord(out)
+}
+
+// rawField walks path through the objects of b and returns the raw value
+// found there, or nil when the path does not exist.
+func rawField(b []byte, path []string) json.RawMessage {
+	raw := json.RawMessage(b)
+
+	for _, part := range path {
+		var obj map[string]json.RawMessage
+
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil
+		}
+
+		if raw = obj[part]; raw == nil {
+			return nil
+		}
+	}
+
+	return raw
+}
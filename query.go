@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Filter map[string]interface{}
+
+type Explain struct {
+	Plan            string
+	Index           string
+	RecordsExamined int
+	Operators       []OperatorPlan
+}
+
+type OperatorPlan struct {
+	Field          string
+	Operator       string
+	IndexSupported bool
+}
+
+const (
+	PlanCollectionScan = "COLLSCAN"
+	PlanIndexScan      = "IXSCAN"
+)
+
+const defaultFuzzyThreshold = 0.8
+
+var indexOperators = map[string]bool{
+	"$eq": true,
+	"$in": true,
+}
+
+func (d *Driver) Find(collection string, filter Filter) ([]string, error) {
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Find(collection, nil)
+}
+
+func (d *Driver) ExplainFind(collection string, filter Filter) (*Explain, error) {
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Explain(collection, nil)
+}
+
+// errStop may be returned by a record callback to end the iteration early
+// without reporting an error to the caller.
+var errStop = errors.New("stop iteration")
+
+// candidates calls fn, in resource order, for every record after the given
+// resource that may satisfy conds. It uses an index when one covers the
+// conditions and scans the collection otherwise.
+func (d *Driver) candidates(collection string, conds []condition, after string, fn func(resource string, b []byte) error) error {
+	d.flushCollection(collection)
+
+	if _, err := stat(filepath.Join(d.dir, collection)); err != nil {
+		return err
+	}
+
+	d.declaredIndexes(collection)
+
+	idx, keys := d.chooseIndex(collection, conds)
+
+	if idx == nil {
+		return d.eachRecord(collection, after, fn)
+	}
+
+	for _, resource := range keys {
+		if (after != "" && resource <= after) || d.expired(collection, resource) {
+			continue
+		}
+
+		b, err := d.readRecord(collection, resource)
+
+		if os.IsNotExist(err) || errors.Is(err, ErrForgotten) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(resource, b); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) eachRecord(collection, after string, fn func(resource string, b []byte) error) error {
+	resources, err := d.resources(collection)
+
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		if (after != "" && resource <= after) || d.expired(collection, resource) {
+			continue
+		}
+
+		b, err := d.readRecord(collection, resource)
+
+		if errors.Is(err, ErrForgotten) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(resource, b); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) resources(collection string) ([]string, error) {
+	files, err := d.readTree(filepath.Join(d.dir, collection))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []string
+
+	for _, file := range files {
+		if isRecordFile(file) {
+			resources = append(resources, d.recordKey(collection, file.Name()))
+		}
+	}
+
+	sort.Strings(resources)
+
+	return resources, nil
+}
+
+func isRecordFile(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".json")
+}
+
+func matchOperator(op string, value interface{}, exists bool, arg interface{}) bool {
+	switch op {
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want
+
+	case "$ne":
+		return !exists || !equalValues(value, arg)
+
+	case "$nin":
+		for _, v := range arg.([]interface{}) {
+			if exists && equalValues(value, v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !exists {
+		return false
+	}
+
+	switch op {
+	case "$eq":
+		return equalValues(value, arg)
+
+	case "$in":
+		for _, v := range arg.([]interface{}) {
+			if equalValues(value, v) {
+				return true
+			}
+		}
+		return false
+
+	case "$gt", "$gte", "$lt", "$lte":
+		c, ok := compareValues(value, arg)
+
+		if !ok {
+			return false
+		}
+
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	}
+
+	return false
+}
+
+func fuzzyArgs(arg interface{}) (string, float64, error) {
+	switch a := arg.(type) {
+	case string:
+		return a, defaultFuzzyThreshold, nil
+
+	case map[string]interface{}:
+		term, ok := a["term"].(string)
+
+		if !ok {
+			return "", 0, fmt.Errorf("missing term")
+		}
+
+		threshold := defaultFuzzyThreshold
+
+		if t, ok := a["threshold"]; ok {
+			f, ok := toFloat(t)
+
+			if !ok || f <= 0 || f > 1 {
+				return "", 0, fmt.Errorf("threshold must be in (0, 1]")
+			}
+
+			threshold = f
+		}
+
+		return term, threshold, nil
+	}
+
+	return "", 0, fmt.Errorf("expects a term or {term, threshold}")
+}
+
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+
+	return valueKey(a) == valueKey(b)
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+
+		return 0, true
+	}
+
+	sa, ok := a.(string)
+
+	if !ok {
+		return 0, false
+	}
+
+	sb, ok := b.(string)
+
+	if !ok {
+		return 0, false
+	}
+
+	return strings.Compare(sa, sb), true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// valueKey renders a value in a canonical form so that equal JSON values
+// produce equal keys regardless of the Go type they were supplied as.
+func valueKey(v interface{}) string {
+	if f, ok := toFloat(v); ok {
+		v = f
+	}
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned by writes that would take the database past
+// Options.MaxBytes or a collection past Options.MaxRecords.
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+
+// DocumentTooLargeError is returned for a document larger than
+// Options.MaxDocumentSize.
+type DocumentTooLargeError struct {
+	Collection string
+	Resource   string
+	Size       int
+	Limit      int
+}
+
+func (e *DocumentTooLargeError) Error() string {
+	return fmt.Sprintf("Document %v/%v is %d bytes, larger than the limit of %d", e.Collection, e.Resource, e.Size, e.Limit)
+}
+
+type Usage struct {
+	Bytes       int64
+	Records     int
+	Collections map[string]CollectionUsage
+}
+
+type CollectionUsage struct {
+	Bytes   int64
+	Records int
+}
+
+// quota mirrors the usage of the database while limits are configured, so
+// that writes can be checked without scanning the disk.
+type quota struct {
+	mutex       sync.Mutex
+	maxBytes    int64
+	maxRecords  int
+	bytes       int64
+	collections map[string]*CollectionUsage
+}
+
+// Usage reports the records stored in the database and the bytes they take
+// on disk. Metadata, tombstones and temporary files are not counted.
+func (d *Driver) Usage() (Usage, error) {
+	u := Usage{Collections: make(map[string]CollectionUsage)}
+
+	collections, err := d.listCollections()
+
+	if err != nil {
+		return u, err
+	}
+
+	for _, collection := range collections {
+		c, err := d.collectionUsage(collection)
+
+		if err != nil {
+			return u, err
+		}
+
+		if c.Records == 0 {
+			continue
+		}
+
+		u.Collections[collection] = c
+		u.Bytes += c.Bytes
+		u.Records += c.Records
+	}
+
+	return u, nil
+}
+
+func (d *Driver) collectionUsage(collection string) (CollectionUsage, error) {
+	var c CollectionUsage
+
+	files, err := d.readTree(filepath.Join(d.dir, collection))
+
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+
+	if err != nil {
+		return c, err
+	}
+
+	dir := filepath.Join(d.dir, collection)
+
+	for _, file := range files {
+		if isRecordFile(file) {
+			c.Records++
+			c.Bytes += d.fileSize(filepath.Join(dir, file.Name()), file)
+		}
+	}
+
+	return c, nil
+}
+
+func (d *Driver) loadQuota() error {
+	u, err := d.Usage()
+
+	if err != nil {
+		return err
+	}
+
+	q := &quota{
+		maxBytes:    d.opts.MaxBytes,
+		maxRecords:  d.opts.MaxRecords,
+		bytes:       u.Bytes,
+		collections: make(map[string]*CollectionUsage),
+	}
+
+	for collection, c := range u.Collections {
+		c := c
+		q.collections[collection] = &c
+	}
+
+	d.quota = q
+
+	return nil
+}
+
+// reserve accounts for a record of collection growing from oldSize to
+// newSize bytes, where an oldSize of -1 means the record is new. It fails
+// with ErrQuotaExceeded, and accounts for nothing, when that would break a
+// limit. Callers must hold the collection lock.
+func (d *Driver) reserve(collection string, oldSize, newSize int64) error {
+	q := d.quota
+
+	if q == nil {
+		return nil
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	c := q.collections[collection]
+
+	if c == nil {
+		c = &CollectionUsage{}
+		q.collections[collection] = c
+	}
+
+	records := c.Records
+	delta := newSize
+
+	if oldSize >= 0 {
+		delta -= oldSize
+	} else {
+		records++
+	}
+
+	if q.maxRecords > 0 && oldSize < 0 && records > q.maxRecords {
+		return ErrQuotaExceeded
+	}
+
+	if q.maxBytes > 0 && delta > 0 && q.bytes+delta > q.maxBytes {
+		return ErrQuotaExceeded
+	}
+
+	c.Records = records
+	c.Bytes += delta
+	q.bytes += delta
+
+	return nil
+}
+
+// unreserve undoes a reservation whose write did not go through.
+func (d *Driver) unreserve(collection string, oldSize, newSize int64) {
+	q := d.quota
+
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if c := q.collections[collection]; c != nil {
+		delta := newSize
+
+		if oldSize >= 0 {
+			delta -= oldSize
+		} else {
+			c.Records--
+		}
+
+		c.Bytes -= delta
+		q.bytes -= delta
+	}
+}
+
+// release accounts for a record of size bytes leaving collection.
+func (d *Driver) release(collection string, size int64) {
+	q := d.quota
+
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if c := q.collections[collection]; c != nil {
+		c.Records--
+		c.Bytes -= size
+		q.bytes -= size
+	}
+}
+
+// releaseCollection accounts for all records of collection being removed.
+func (d *Driver) releaseCollection(collection string) {
+	q := d.quota
+
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if c := q.collections[collection]; c != nil {
+		q.bytes -= c.Bytes
+		delete(q.collections, collection)
+	}
+}
+
+// checkDocumentSize fails for a document of size bytes when it is larger
+// than Options.MaxDocumentSize.
+func (d *Driver) checkDocumentSize(collection, resource string, size int) error {
+	if d.opts.MaxDocumentSize > 0 && size > d.opts.MaxDocumentSize {
+		return &DocumentTooLargeError{Collection: collection, Resource: resource, Size: size, Limit: d.opts.MaxDocumentSize}
+	}
+
+	return nil
+}
+
+// refreshUsage recounts the usage of collection from disk after it was
+// changed behind the driver's back.
+func (d *Driver) refreshUsage(collection string) {
+	q := d.quota
+
+	if q == nil {
+		return
+	}
+
+	c, err := d.collectionUsage(collection)
+
+	if err != nil {
+		d.log.Warn("Unable to recount usage of '%s': %v\n", collection, err)
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if old := q.collections[collection]; old != nil {
+		q.bytes -= old.Bytes
+	}
+
+	q.bytes += c.Bytes
+	q.collections[collection] = &c
+}
+
+// recordSize returns the size of a stored record, or -1 if there is none.
+// A chunked record counts for the stored bytes its chunks hold rather than
+// for its manifest, in Usage as against quotas and caps.
+func (d *Driver) recordSize(path string) int64 {
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		return -1
+	}
+
+	return d.fileSize(path, fi)
+}
+
+// maxManifestSize bounds the size of a chunked record's manifest, an
+// envelope without payload.
+var maxManifestSize = int64(len(envelopeMagic) + 2 + math.MaxUint16)
+
+// fileSize is recordSize for the record file at path, already listed as fi.
+// Headers are only looked at while Options.ChunkSize is set.
+func (d *Driver) fileSize(path string, fi os.FileInfo) int64 {
+	if d.opts.ChunkSize <= 0 || fi.Size() > maxManifestSize {
+		return fi.Size()
+	}
+
+	if h, _ := readEnvelopeHeader(path); h != nil && len(h.Chunks) > 0 {
+		return h.Size
+	}
+
+	return fi.Size()
+}
+
+// storedSize is recordSize for the stored bytes of a record about to be
+// written.
+func storedSize(stored []byte) int64 {
+	if h, _, err := openEnvelope(stored); err == nil && h != nil && len(h.Chunks) > 0 {
+		return h.Size
+	}
+
+	return int64(len(stored))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ReadRaw returns the stored JSON of a record without decoding it, for
+// forwarding as is. The message may be shared with the record cache and
+// must not be modified.
+func (d *Driver) ReadRaw(collection, resource string) (_ json.RawMessage, err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	resource, err = d.checkRead(collection, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.readRecord(collection, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(b), nil
+}
+
+// checkRead validates the names of a record about to be read and checks
+// that it exists. It returns the normalized resource.
+func (d *Driver) checkRead(collection, resource string) (string, error) {
+	if err := checkCollection(collection); err != nil {
+		return "", err
+	}
+
+	if resource == "" {
+		return "", fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	d.flushCollection(collection)
+
+	return resource, d.checkExists(collection, resource)
+}
+
+// checkExists checks that a record about to be read exists and has not
+// expired, without writing out buffered writes first.
+func (d *Driver) checkExists(collection, resource string) error {
+	if !d.mayExist(collection, resource) {
+		return ErrRecordNotFound
+	}
+
+	if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		if os.IsNotExist(err) {
+			return d.notFound(collection)
+		}
+		return err
+	}
+
+	if d.expired(collection, resource) {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// FindRaw is Find returning the stored JSON of the matching records. The
+// messages may be shared with the record cache and must not be modified.
+func (d *Driver) FindRaw(collection string, filter Filter) ([]json.RawMessage, error) {
+	q, err := d.Prepare(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.FindRaw(collection, nil)
+}
+
+func (q *Query) FindRaw(collection string, params Params) ([]json.RawMessage, error) {
+	var records []json.RawMessage
+
+	err := q.each(collection, params, "", func(resource string, b []byte, doc map[string]interface{}) error {
+		records = append(records, json.RawMessage(b))
+		return nil
+	})
+
+	return records, err
+}
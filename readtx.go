@@ -0,0 +1,24 @@
+package main
+
+// ReadTx is a read-only transaction: every read made through it sees the
+// database as it was when the transaction began, across all collections.
+type ReadTx struct {
+	*Snapshot
+}
+
+// BeginRead starts a read-only transaction backed by a snapshot. It must be
+// ended with Rollback to release the snapshot.
+func (d *Driver) BeginRead() (*ReadTx, error) {
+	s, err := d.Snapshot()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadTx{Snapshot: s}, nil
+}
+
+// Rollback ends the transaction.
+func (tx *ReadTx) Rollback() error {
+	return tx.Close()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SchemaRegistry is a client of a Confluent-compatible schema registry.
+// Schemas are cached once registered or fetched, so each is only looked
+// up once.
+type SchemaRegistry struct {
+	URL string
+
+	Username string
+	Password string
+
+	// Client is http.DefaultClient when nil.
+	Client *http.Client
+
+	mutex   sync.Mutex
+	ids     map[string]int
+	schemas map[int]*AvroSchema
+}
+
+// Register registers schema under subject, if it is not already, and
+// returns its id.
+func (r *SchemaRegistry) Register(ctx context.Context, subject string, schema *AvroSchema) (int, error) {
+	key := subject + "\x00" + schema.String()
+
+	r.mutex.Lock()
+	id, ok := r.ids[key]
+	r.mutex.Unlock()
+
+	if ok {
+		return id, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"schema": schema.String()})
+
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		ID int `json:"id"`
+	}
+
+	if err := r.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &resp); err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+
+	if r.ids == nil {
+		r.ids = make(map[string]int)
+	}
+
+	r.ids[key] = resp.ID
+	r.mutex.Unlock()
+
+	return resp.ID, nil
+}
+
+// Schema returns the schema registered with id.
+func (r *SchemaRegistry) Schema(ctx context.Context, id int) (*AvroSchema, error) {
+	r.mutex.Lock()
+	schema, ok := r.schemas[id]
+	r.mutex.Unlock()
+
+	if ok {
+		return schema, nil
+	}
+
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+
+	if err := r.do(ctx, http.MethodGet, "/schemas/ids/"+strconv.Itoa(id), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	schema, err := ParseAvroSchema(resp.Schema)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+
+	if r.schemas == nil {
+		r.schemas = make(map[int]*AvroSchema)
+	}
+
+	r.schemas[id] = schema
+	r.mutex.Unlock()
+
+	return schema, nil
+}
+
+// Decode decodes a message in the Confluent wire format, a zero byte and
+// the big-endian schema id ahead of the Avro data, into v.
+func (r *SchemaRegistry) Decode(ctx context.Context, msg []byte, v interface{}) error {
+	if len(msg) < 5 || msg[0] != 0 {
+		return fmt.Errorf("Not a schema registry message")
+	}
+
+	schema, err := r.Schema(ctx, int(binary.BigEndian.Uint32(msg[1:5])))
+
+	if err != nil {
+		return err
+	}
+
+	return schema.Unmarshal(msg[5:], v)
+}
+
+// frameSchema puts the Confluent wire format header for id ahead of data.
+func frameSchema(id int, data []byte) []byte {
+	b := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return append(b, data...)
+}
+
+func (r *SchemaRegistry) do(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	var reader io.Reader
+
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(r.URL, "/")+path, reader)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+
+	client := r.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+
+		return fmt.Errorf("Schema registry: %v", e.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
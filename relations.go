@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type relation struct {
+	hasMany    bool
+	field      []int
+	collection string
+
+	// key is the field of the related records holding the key of this
+	// record for hasMany, or the field of this record holding the key of
+	// the related one for belongsTo.
+	key string
+}
+
+// HasMany declares that the records of collection whose foreignKey field
+// holds the key of a value belong to it, to be loaded into its field, a
+// slice. Such fields are usually tagged `json:"-"` so they are not stored.
+func (r *Repository[T]) HasMany(field, collection, foreignKey string) error {
+	f, err := r.relationField(field, collection, reflect.Slice)
+
+	if err != nil {
+		return err
+	}
+
+	if foreignKey == "" {
+		return fmt.Errorf("Missing foreign key of relation %v", field)
+	}
+
+	r.relations[field] = relation{hasMany: true, field: f, collection: collection, key: foreignKey}
+
+	return nil
+}
+
+// BelongsTo declares that a value refers to the record of collection whose
+// key it holds in its key field, to be loaded into its field, a struct or a
+// pointer to one.
+func (r *Repository[T]) BelongsTo(field, collection, key string) error {
+	f, err := r.relationField(field, collection, reflect.Struct)
+
+	if err != nil {
+		return err
+	}
+
+	var zero T
+
+	if _, ok := reflect.TypeOf(zero).FieldByName(key); !ok {
+		return fmt.Errorf("%T has no field %v", zero, key)
+	}
+
+	r.relations[field] = relation{field: f, collection: collection, key: key}
+
+	return nil
+}
+
+func (r *Repository[T]) relationField(field, collection string, kind reflect.Kind) ([]int, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	var zero T
+	f, ok := reflect.TypeOf(zero).FieldByName(field)
+
+	if !ok {
+		return nil, fmt.Errorf("%T has no field %v", zero, field)
+	}
+
+	t := f.Type
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != kind {
+		return nil, fmt.Errorf("Relation field %v must be a %v, not %v", field, kind, f.Type)
+	}
+
+	return f.Index, nil
+}
+
+// GetWith is Get, loading the named relations into the value.
+func (r *Repository[T]) GetWith(id string, relations ...string) (*T, error) {
+	v, err := r.Get(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := []T{*v}
+
+	if err := r.LoadRelated(values, relations...); err != nil {
+		return nil, err
+	}
+
+	return &values[0], nil
+}
+
+// QueryWith is Query, loading the named relations into the values.
+func (r *Repository[T]) QueryWith(filter Filter, opts *FindOptions, relations ...string) ([]T, error) {
+	values, err := r.Query(filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return values, r.LoadRelated(values, relations...)
+}
+
+// LoadRelated loads the named relations into values. Each relation is read
+// once for all the values: a single query for hasMany, and one read per
+// distinct key for belongsTo.
+func (r *Repository[T]) LoadRelated(values []T, relations ...string) error {
+	for _, name := range relations {
+		rel, ok := r.relations[name]
+
+		if !ok {
+			return fmt.Errorf("Unknown relation %v of %v", name, r.collection)
+		}
+
+		var err error
+
+		if rel.hasMany {
+			err = r.loadHasMany(values, rel)
+		} else {
+			err = r.loadBelongsTo(values, rel)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Unable to load %v of %v: %w", name, r.collection, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository[T]) loadHasMany(values []T, rel relation) error {
+	keys := make([]interface{}, 0, len(values))
+
+	for i := range values {
+		keys = append(keys, reflect.ValueOf(&values[i]).Elem().FieldByIndex(r.key).Interface())
+	}
+
+	records, err := r.d.Find(rel.collection, Filter{rel.key: map[string]interface{}{"$in": keys}})
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	groups := make(map[string][]string)
+
+	for _, record := range records {
+		var doc map[string]interface{}
+
+		if err := json.Unmarshal([]byte(record), &doc); err != nil {
+			return err
+		}
+
+		if v, ok := lookupField(doc, rel.key); ok {
+			k := valueKey(v)
+			groups[k] = append(groups[k], record)
+		}
+	}
+
+	for i, key := range keys {
+		f := reflect.ValueOf(&values[i]).Elem().FieldByIndex(rel.field)
+		related := reflect.New(f.Type())
+
+		if err := r.d.decode(rel.collection, []byte("["+strings.Join(groups[normalizedKey(key)], ",")+"]"), related.Interface()); err != nil {
+			return err
+		}
+
+		f.Set(related.Elem())
+	}
+
+	return nil
+}
+
+func (r *Repository[T]) loadBelongsTo(values []T, rel relation) error {
+	loaded := make(map[string]json.RawMessage)
+
+	for i := range values {
+		v := reflect.ValueOf(&values[i]).Elem()
+		key := v.FieldByName(rel.key)
+
+		if key.IsZero() {
+			continue
+		}
+
+		id := fmt.Sprint(key.Interface())
+		b, ok := loaded[id]
+
+		if !ok {
+			var err error
+
+			if b, err = r.d.ReadRaw(rel.collection, id); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+
+			loaded[id] = b
+		}
+
+		if b == nil {
+			continue
+		}
+
+		f := v.FieldByIndex(rel.field)
+		related := reflect.New(f.Type())
+
+		if err := r.d.decode(rel.collection, b, related.Interface()); err != nil {
+			return err
+		}
+
+		f.Set(related.Elem())
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// replaceFile atomically moves oldpath over newpath.
+func replaceFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// replaceFile atomically moves oldpath over newpath. MoveFileEx replaces an
+// existing target in one step, unlike a rename on some Windows filesystems.
+// A target briefly held open by a reader or a virus scanner fails with a
+// sharing violation, which the driver's retry policy retries.
+func replaceFile(oldpath, newpath string) error {
+	from, err := windows.UTF16PtrFromString(oldpath)
+
+	if err != nil {
+		return err
+	}
+
+	to, err := windows.UTF16PtrFromString(newpath)
+
+	if err != nil {
+		return err
+	}
+
+	if err := windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH); err != nil {
+		return &os.LinkError{Op: "replace", Old: oldpath, New: newpath, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Repository stores values of the struct type T in one collection, keyed by
+// one of its fields. The collection is named after the type, or by a
+// CollectionName method on it. The key is the field tagged
+// `gojsondb:"id"`, or else the field named ID.
+type Repository[T any] struct {
+	d          *Driver
+	collection string
+	key        []int
+	relations  map[string]relation
+}
+
+type collectionNamer interface {
+	CollectionName() string
+}
+
+func NewRepository[T any](d *Driver) (*Repository[T], error) {
+	var zero T
+	t := reflect.TypeOf(zero)
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Repository type %v is not a struct", t)
+	}
+
+	collection := t.Name()
+
+	if n, ok := interface{}(zero).(collectionNamer); ok {
+		collection = n.CollectionName()
+	} else if n, ok := interface{}(&zero).(collectionNamer); ok {
+		collection = n.CollectionName()
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	key, err := keyField(t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Repository[T]{d: d, collection: collection, key: key, relations: make(map[string]relation)}, nil
+}
+
+func keyField(t reflect.Type) ([]int, error) {
+	var byName []int
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name, _, _ := strings.Cut(f.Tag.Get("gojsondb"), ","); name == "id" {
+			return f.Index, nil
+		}
+
+		if f.Name == "ID" {
+			byName = f.Index
+		}
+	}
+
+	if byName == nil {
+		return nil, fmt.Errorf("%v has no field tagged `gojsondb:\"id\"` or named ID", t)
+	}
+
+	return byName, nil
+}
+
+func (r *Repository[T]) Collection() string {
+	return r.collection
+}
+
+// ID returns the key of v.
+func (r *Repository[T]) ID(v *T) string {
+	f := reflect.ValueOf(v).Elem().FieldByIndex(r.key)
+
+	if f.Kind() == reflect.String {
+		return f.String()
+	}
+
+	if f.IsZero() {
+		return ""
+	}
+
+	return fmt.Sprint(f.Interface())
+}
+
+func (r *Repository[T]) Save(v *T) error {
+	id := r.ID(v)
+
+	if id == "" {
+		return fmt.Errorf("Missing key of %v", r.collection)
+	}
+
+	return r.d.Write(r.collection, id, v)
+}
+
+func (r *Repository[T]) Get(id string) (*T, error) {
+	v := new(T)
+
+	if err := r.d.Read(r.collection, id, v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (r *Repository[T]) Delete(id string) error {
+	return r.d.Delete(r.collection, id)
+}
+
+// Query returns the values matching filter, with opts applied as in
+// FindWithOptions. A nil filter matches every value.
+func (r *Repository[T]) Query(filter Filter, opts *FindOptions) ([]T, error) {
+	records, err := r.d.FindWithOptions(r.collection, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]T, len(records))
+
+	for i, record := range records {
+		if err := r.d.decode(r.collection, []byte(record), &values[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+func (r *Repository[T]) All() ([]T, error) {
+	return r.Query(nil, nil)
+}
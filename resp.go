@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESPOptions configures a RESPServer.
+type RESPOptions struct {
+	// Separator splits keys into collection and resource at its first
+	// occurrence, so "users:42" names record 42 of users. It defaults to
+	// ":".
+	Separator string
+
+	// DefaultCollection holds the keys without a separator. It defaults to
+	// "kv".
+	DefaultCollection string
+
+	// Password, when set, must be given with AUTH before any other command.
+	Password string
+}
+
+// RESPServer serves a subset of the Redis protocol, so that Redis clients
+// can use a Driver as a key-value store: PING, ECHO, AUTH, SELECT 0, GET,
+// SET (with EX, PX, NX and XX), DEL, EXISTS, EXPIRE, PEXPIRE, PERSIST, TTL,
+// PTTL, KEYS, SCAN and QUIT.
+//
+// Values that are JSON objects or arrays are stored as they are, and read
+// back compacted; any other value is stored as a JSON string. Records that
+// hold neither are read back as their JSON.
+type RESPServer struct {
+	db   *Driver
+	opts RESPOptions
+
+	tcp tcpServer
+}
+
+func NewRESPServer(db *Driver, opts *RESPOptions) *RESPServer {
+	s := &RESPServer{db: db}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if s.opts.Separator == "" {
+		s.opts.Separator = ":"
+	}
+
+	if s.opts.DefaultCollection == "" {
+		s.opts.DefaultCollection = "kv"
+	}
+
+	return s
+}
+
+func (s *RESPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *RESPServer) Serve(l net.Listener) error {
+	defer s.db.track(s)()
+
+	return s.tcp.serve(l, s.db.log, s.serveConn)
+}
+
+// Close stops the listeners and drops the open connections.
+func (s *RESPServer) Close() error {
+	return s.tcp.close()
+}
+
+// Shutdown stops the listeners and waits for the commands being served to
+// finish, dropping the connections that are left when ctx is done.
+func (s *RESPServer) Shutdown(ctx context.Context) error {
+	return s.tcp.shutdown(ctx)
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := s.opts.Password == ""
+
+	for {
+		args, err := readCommand(r)
+
+		if err != nil {
+			if err != io.EOF {
+				writeRESPError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+
+		switch {
+		case name == "QUIT":
+			w.WriteString("+OK\r\n")
+			w.Flush()
+			return
+
+		case name == "AUTH":
+			password := args[len(args)-1]
+
+			if len(args) < 2 || len(args) > 3 {
+				writeRESPError(w, "ERR wrong number of arguments for 'auth' command")
+			} else if s.opts.Password == "" {
+				writeRESPError(w, "ERR AUTH called without any password configured")
+			} else if subtle.ConstantTimeCompare([]byte(password), []byte(s.opts.Password)) != 1 {
+				writeRESPError(w, "WRONGPASS invalid password")
+			} else {
+				authed = true
+				w.WriteString("+OK\r\n")
+			}
+
+		case !authed:
+			writeRESPError(w, "NOAUTH Authentication required.")
+
+		default:
+			s.command(w, name, args[1:])
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// The largest command readCommand accepts: its number of arguments and the
+// size of each.
+const (
+	respMaxArgs = 1024 * 1024
+	respMaxBulk = 512 * 1024 * 1024
+)
+
+// readCommand reads a command, either as an array of bulk strings or
+// inline, separated by spaces.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+
+	if err != nil || n < -1 || n > respMaxArgs {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+
+	// A null array, *-1, is an empty command.
+	if n <= 0 {
+		return nil, nil
+	}
+
+	// The count is only what the client claims to send, so the arguments
+	// are allocated as they arrive.
+	args := make([]string, 0, 16)
+
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got '%s'", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+
+		var buf bytes.Buffer
+
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+			return nil, fmt.Errorf("expected CRLF after bulk string")
+		}
+
+		args = append(args, string(buf.Bytes()[:size]))
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESPError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+
+	for _, item := range items {
+		writeBulk(w, []byte(item))
+	}
+}
+
+// splitKey maps a Redis key to a collection and resource.
+func (s *RESPServer) splitKey(key string) (string, string) {
+	if collection, resource, ok := strings.Cut(key, s.opts.Separator); ok && collection != "" {
+		return collection, resource
+	}
+
+	return s.opts.DefaultCollection, key
+}
+
+func (s *RESPServer) joinKey(collection, resource string) string {
+	if collection == s.opts.DefaultCollection && !strings.Contains(resource, s.opts.Separator) {
+		return resource
+	}
+
+	return collection + s.opts.Separator + resource
+}
+
+// existsCondition holds when the record exists, or does not when want is
+// false, for SET NX and XX.
+type existsCondition struct {
+	want bool
+}
+
+func (c existsCondition) holds(current []byte, revision int64) (bool, error) {
+	return (current != nil) == c.want, nil
+}
+
+func (s *RESPServer) command(w *bufio.Writer, name string, args []string) {
+	arity := map[string]int{
+		"PING": 0, "ECHO": 1, "SELECT": 1, "GET": 1, "SET": 2, "DEL": 1, "EXISTS": 1,
+		"EXPIRE": 2, "PEXPIRE": 2, "PERSIST": 1, "TTL": 1, "PTTL": 1, "KEYS": 1, "SCAN": 1,
+		"COMMAND": 0, "CLIENT": 0,
+	}
+
+	need, ok := arity[name]
+
+	if !ok {
+		writeRESPError(w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+		return
+	}
+
+	if len(args) < need {
+		writeRESPError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, []byte(args[0]))
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+
+	case "ECHO":
+		writeBulk(w, []byte(args[0]))
+
+	case "SELECT":
+		if args[0] != "0" {
+			writeRESPError(w, "ERR DB index is out of range")
+			return
+		}
+		w.WriteString("+OK\r\n")
+
+	case "COMMAND":
+		writeArray(w, nil)
+
+	case "CLIENT":
+		w.WriteString("+OK\r\n")
+
+	case "GET":
+		s.get(w, args[0])
+
+	case "SET":
+		s.set(w, args)
+
+	case "DEL", "EXISTS":
+		var n int64
+
+		for _, key := range args {
+			collection, resource := s.splitKey(key)
+			var err error
+
+			if name == "DEL" {
+				err = s.db.Delete(collection, resource)
+			} else {
+				_, err = s.db.ReadRaw(collection, resource)
+			}
+
+			if err == nil {
+				n++
+			} else if !errors.Is(err, ErrNotFound) {
+				writeRESPError(w, "ERR "+err.Error())
+				return
+			}
+		}
+
+		writeInt(w, n)
+
+	case "EXPIRE", "PEXPIRE":
+		n, err := strconv.ParseInt(args[1], 10, 64)
+
+		if err != nil {
+			writeRESPError(w, "ERR value is not an integer or out of range")
+			return
+		}
+
+		unit := time.Second
+
+		if name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+
+		collection, resource := s.splitKey(args[0])
+
+		if n <= 0 {
+			err = s.db.Delete(collection, resource)
+		} else {
+			err = s.db.Expire(collection, resource, time.Duration(n)*unit)
+		}
+
+		s.writeFound(w, err)
+
+	case "PERSIST":
+		collection, resource := s.splitKey(args[0])
+
+		if _, ok := s.db.TTL(collection, resource); !ok {
+			writeInt(w, 0)
+			return
+		}
+
+		s.writeFound(w, s.db.Persist(collection, resource))
+
+	case "TTL", "PTTL":
+		collection, resource := s.splitKey(args[0])
+
+		if _, err := s.db.ReadRaw(collection, resource); errors.Is(err, ErrNotFound) {
+			writeInt(w, -2)
+			return
+		}
+
+		ttl, ok := s.db.TTL(collection, resource)
+
+		switch {
+		case !ok:
+			writeInt(w, -1)
+		case name == "TTL":
+			writeInt(w, int64((ttl+time.Second/2)/time.Second))
+		default:
+			writeInt(w, ttl.Milliseconds())
+		}
+
+	case "KEYS":
+		keys, err := s.keys(args[0])
+
+		if err != nil {
+			writeRESPError(w, "ERR "+err.Error())
+			return
+		}
+
+		writeArray(w, keys)
+
+	case "SCAN":
+		s.scan(w, args)
+	}
+}
+
+// writeFound answers 1 for a change made and 0 for a missing key.
+func (s *RESPServer) writeFound(w *bufio.Writer, err error) {
+	switch {
+	case err == nil:
+		writeInt(w, 1)
+	case errors.Is(err, ErrNotFound):
+		writeInt(w, 0)
+	default:
+		writeRESPError(w, "ERR "+err.Error())
+	}
+}
+
+func (s *RESPServer) get(w *bufio.Writer, key string) {
+	collection, resource := s.splitKey(key)
+	b, err := s.db.ReadRaw(collection, resource)
+
+	if errors.Is(err, ErrNotFound) {
+		writeBulk(w, nil)
+		return
+	}
+
+	if err != nil {
+		writeRESPError(w, "ERR "+err.Error())
+		return
+	}
+
+	var str string
+
+	if json.Unmarshal(b, &str) == nil {
+		writeBulk(w, []byte(str))
+		return
+	}
+
+	var compact bytes.Buffer
+
+	if err := json.Compact(&compact, b); err != nil {
+		writeRESPError(w, "ERR "+err.Error())
+		return
+	}
+
+	writeBulk(w, compact.Bytes())
+}
+
+func (s *RESPServer) set(w *bufio.Writer, args []string) {
+	var (
+		ttl  time.Duration
+		cond Condition
+	)
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX", "XX":
+			cond = existsCondition{want: opt == "XX"}
+
+		case "EX", "PX":
+			if i+1 == len(args) {
+				writeRESPError(w, "ERR syntax error")
+				return
+			}
+
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+
+			if err != nil || n <= 0 {
+				writeRESPError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+
+			ttl = time.Duration(n) * time.Second
+
+			if opt == "PX" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+
+			i++
+
+		default:
+			writeRESPError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	collection, resource := s.splitKey(args[0])
+
+	var v interface{} = args[1]
+
+	if value := strings.TrimSpace(args[1]); (strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[")) && json.Valid([]byte(value)) {
+		v = json.RawMessage(value)
+	}
+
+	var err error
+
+	if cond == nil {
+		err = s.db.Write(collection, resource, v)
+	} else {
+		err = s.db.WriteIf(collection, resource, v, cond)
+	}
+
+	if errors.Is(err, ErrConditionFailed) {
+		writeBulk(w, nil)
+		return
+	}
+
+	if err == nil && ttl > 0 {
+		err = s.db.Expire(collection, resource, ttl)
+	}
+
+	if err != nil {
+		writeRESPError(w, "ERR "+err.Error())
+		return
+	}
+
+	w.WriteString("+OK\r\n")
+}
+
+// keys lists the keys matching pattern, in order. A pattern starting with a
+// collection and the separator only lists that collection.
+func (s *RESPServer) keys(pattern string) ([]string, error) {
+	var collections []string
+
+	if prefix, _, ok := strings.Cut(pattern, s.opts.Separator); ok && prefix != "" && !strings.ContainsAny(prefix, `*?[\`) {
+		collections = []string{prefix}
+	} else {
+		var err error
+
+		if collections, err = s.db.listCollections(); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+
+	for _, collection := range collections {
+		if checkCollection(collection) != nil {
+			continue
+		}
+
+		resources, err := s.db.Keys(collection)
+
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range resources {
+			if key := s.joinKey(collection, resource); globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// scan pages through the keys by their position in key order, which is
+// what the cursor holds.
+func (s *RESPServer) scan(w *bufio.Writer, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+
+	if err != nil || cursor < 0 {
+		writeRESPError(w, "ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", 10
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			writeRESPError(w, "ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				writeRESPError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		case "TYPE":
+		default:
+			writeRESPError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	keys, err := s.keys(pattern)
+
+	if err != nil {
+		writeRESPError(w, "ERR "+err.Error())
+		return
+	}
+
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+
+	end, next := cursor+count, cursor+count
+
+	if end >= len(keys) {
+		end, next = len(keys), 0
+	}
+
+	w.WriteString("*2\r\n")
+	writeBulk(w, []byte(strconv.Itoa(next)))
+	writeArray(w, keys[cursor:end])
+}
+
+// globMatch matches s against a Redis glob pattern, supporting *, ?, [...]
+// and escaping with \.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if pattern == "" {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+
+			return false
+
+		case '?':
+			if s == "" {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+
+		case '[':
+			if s == "" {
+				return false
+			}
+
+			end := strings.IndexByte(pattern[1:], ']')
+
+			if end < 0 {
+				return false
+			}
+
+			set := pattern[1 : end+1]
+			negate := strings.HasPrefix(set, "^")
+
+			if negate {
+				set = set[1:]
+			}
+
+			matched := false
+
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					if set[i] <= s[0] && s[0] <= set[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if set[i] == s[0] {
+					matched = true
+				}
+			}
+
+			if matched == negate {
+				return false
+			}
+
+			pattern, s = pattern[end+2:], s[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return s == ""
+}
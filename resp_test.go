@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "PING\r\n", want: []string{"PING"}},
+		{in: "SET a b\r\n", want: []string{"SET", "a", "b"}},
+		{in: "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", want: []string{"GET", "a"}},
+		{in: "*1\r\n$0\r\n\r\n", want: []string{""}},
+		{in: "*0\r\n", want: nil},
+		{in: "*-1\r\n", want: nil},
+		{in: "*-2\r\n", err: true},
+		{in: "*x\r\n", err: true},
+		{in: "*2000000\r\n", err: true},
+		{in: "*1\r\n$-1\r\n", err: true},
+		{in: "*1\r\nGET\r\n", err: true},
+		{in: "*1\r\n$536870913\r\n", err: true},
+		{in: "*1\r\n$536870912\r\nshort\r\n", err: true},
+		{in: "*1\r\n$3\r\nGETxx", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := readCommand(bufio.NewReader(strings.NewReader(tt.in)))
+
+		if (err != nil) != tt.err {
+			t.Errorf("readCommand(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readCommand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+	f.Add("*-2\r\n")
+	f.Add("*1\r\n$100000000\r\n")
+	f.Add("SET a b\r\n")
+
+	f.Fuzz(func(t *testing.T, in string) {
+		r := bufio.NewReader(strings.NewReader(in))
+
+		for {
+			if _, err := readCommand(r); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	defaultRetryAttempts   = 10
+	defaultRetryBackoff    = 10 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+)
+
+// RetryPolicy controls how the driver retries a rename, write or removal
+// that fails with a transient error, such as a file that is briefly busy or
+// a stale NFS handle. The backoff doubles after each attempt up to
+// MaxBackoff. Zero values take the defaults: 10 attempts, starting at 10ms,
+// up to 1s. Set Attempts to 1 to disable retries.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// RetryError is returned when an operation still failed with a transient
+// error after every attempt.
+type RetryError struct {
+	Op       string
+	Path     string
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s %s: %v (after %d attempts)", e.Op, e.Path, e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (d *Driver) retryPolicy() RetryPolicy {
+	p := RetryPolicy{}
+
+	if d.opts.Retry != nil {
+		p = *d.opts.Retry
+	}
+
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryAttempts
+	}
+
+	if p.Backoff <= 0 {
+		p.Backoff = defaultRetryBackoff
+	}
+
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	return p
+}
+
+// retry runs fn until it succeeds, fails with an error that is not
+// transient, or runs out of attempts.
+func (d *Driver) retry(op, path string, fn func() error) error {
+	p := d.retryPolicy()
+	backoff := p.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+
+		if err == nil || !transient(err) {
+			return err
+		}
+
+		if attempt == p.Attempts {
+			if attempt == 1 {
+				return err
+			}
+
+			return &RetryError{Op: op, Path: path, Attempts: attempt, Err: err}
+		}
+
+		d.log.Debug("Retrying %s of '%s' after %v: %v\n", op, path, backoff, err)
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (d *Driver) replaceFile(oldpath, newpath string) error {
+	return d.retry("replace", newpath, func() error {
+		if _, err := d.fault(FaultRename, newpath); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+
+		return replaceFile(oldpath, newpath)
+	})
+}
+
+func (d *Driver) removeAll(path string) error {
+	return d.retry("remove", path, func() error {
+		if _, err := d.fault(FaultRemove, path); err != nil {
+			return &os.PathError{Op: "remove", Path: path, Err: err}
+		}
+
+		return os.RemoveAll(path)
+	})
+}
@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package main
+
+func transient(err error) bool {
+	return false
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transient reports whether err is worth retrying: a busy file or a stale
+// NFS handle.
+func transient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETXTBSY) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EAGAIN)
+}
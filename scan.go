@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Scan reads the records with keys from startKey up to, but not including,
+// endKey, in key order, and at most limit of them when limit is positive.
+// An empty endKey scans to the last key. Keys compare as byte strings, so
+// time-ordered keys such as ULIDs are read in the order they were made.
+func (d *Driver) Scan(collection, startKey, endKey string, limit int) ([]string, error) {
+	return d.scan(collection, startKey, endKey, limit, false)
+}
+
+// ScanReverse reads the same range as Scan, from the last key down, so that
+// ScanReverse(collection, "", "", n) reads the n newest records by ULID.
+func (d *Driver) ScanReverse(collection, startKey, endKey string, limit int) ([]string, error) {
+	return d.scan(collection, startKey, endKey, limit, true)
+}
+
+func (d *Driver) scan(collection, startKey, endKey string, limit int, reverse bool) (_ []string, err error) {
+	defer d.observe(time.Now(), &err, "scan", collection, "")
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	d.flushCollection(collection)
+
+	if _, err := os.Stat(filepath.Join(d.dir, collection)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCollectionNotFound
+		}
+		return nil, err
+	}
+
+	idx, err := d.keyIndex(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := idx.between(d.key(startKey), d.key(endKey))
+
+	if reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	var records []string
+
+	for _, resource := range keys {
+		if limit > 0 && len(records) == limit {
+			break
+		}
+
+		if d.expired(collection, resource) {
+			continue
+		}
+
+		b, err := d.readRecord(collection, resource)
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, string(b))
+	}
+
+	return records, nil
+}
+
+// Keys lists the keys of the records of collection in order.
+func (d *Driver) Keys(collection string) (_ []string, err error) {
+	defer d.observe(time.Now(), &err, "keys", collection, "")
+
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	d.flushCollection(collection)
+
+	if _, err := os.Stat(filepath.Join(d.dir, collection)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCollectionNotFound
+		}
+		return nil, err
+	}
+
+	idx, err := d.keyIndex(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, resource := range idx.between("", "") {
+		if !d.expired(collection, resource) {
+			keys = append(keys, resource)
+		}
+	}
+
+	return keys, nil
+}
+
+// Count returns the number of records in collection.
+func (d *Driver) Count(collection string) (int, error) {
+	keys, err := d.Keys(collection)
+
+	return len(keys), err
+}
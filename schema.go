@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// docSchema is a compiled JSON Schema, limited to the keywords that
+// describe the shape of a document: type, properties, required,
+// additionalProperties, items, enum, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, minLength, maxLength, pattern, minItems and maxItems.
+// Other keywords are ignored.
+type docSchema struct {
+	Types      []string
+	Properties map[string]*docSchema
+	Required   []string
+	Additional *docSchema
+	NoExtra    bool
+	Items      *docSchema
+	Enum       []interface{}
+
+	Minimum, Maximum                   *float64
+	ExclusiveMinimum, ExclusiveMaximum *float64
+	MinLength, MaxLength               *int
+	MinItems, MaxItems                 *int
+	Pattern                            *regexp.Regexp
+}
+
+func compileSchema(b []byte) (*docSchema, error) {
+	var v interface{}
+
+	if err := decodeNumbers(b, &v); err != nil {
+		return nil, fmt.Errorf("Invalid schema: %w", err)
+	}
+
+	s, err := compileSchemaValue(v)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema: %w", err)
+	}
+
+	return s, nil
+}
+
+func compileSchemaValue(v interface{}) (*docSchema, error) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return &docSchema{}, nil
+		}
+
+		// The false schema matches nothing.
+		return &docSchema{Types: []string{}}, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("%v is not a schema", v)
+	}
+
+	s := &docSchema{}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.Types = []string{t}
+	case []interface{}:
+		s.Types = []string{}
+
+		for _, name := range t {
+			name, _ := name.(string)
+			s.Types = append(s.Types, name)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid type %v", t)
+	}
+
+	for _, name := range s.Types {
+		switch name {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("Unknown type %q", name)
+		}
+	}
+
+	if props, ok := m["properties"].(map[string]interface{}); ok {
+		s.Properties = make(map[string]*docSchema, len(props))
+
+		for name, p := range props {
+			ps, err := compileSchemaValue(p)
+
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", name, err)
+			}
+
+			s.Properties[name] = ps
+		}
+	}
+
+	if required, ok := m["required"].([]interface{}); ok {
+		for _, name := range required {
+			name, _ := name.(string)
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	switch a := m["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		s.NoExtra = !a
+	default:
+		as, err := compileSchemaValue(a)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.Additional = as
+	}
+
+	if items, ok := m["items"]; ok {
+		is, err := compileSchemaValue(items)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.Items = is
+	}
+
+	if enum, ok := m["enum"].([]interface{}); ok {
+		s.Enum = enum
+	}
+
+	for key, dst := range map[string]**float64{
+		"minimum": &s.Minimum, "maximum": &s.Maximum,
+		"exclusiveMinimum": &s.ExclusiveMinimum, "exclusiveMaximum": &s.ExclusiveMaximum,
+	} {
+		if n, ok := m[key].(json.Number); ok {
+			f, err := n.Float64()
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %v", key)
+			}
+
+			*dst = &f
+		}
+	}
+
+	for key, dst := range map[string]**int{
+		"minLength": &s.MinLength, "maxLength": &s.MaxLength,
+		"minItems": &s.MinItems, "maxItems": &s.MaxItems,
+	} {
+		if n, ok := m[key].(json.Number); ok {
+			i, err := n.Int64()
+
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("Invalid %v", key)
+			}
+
+			limit := int(i)
+			*dst = &limit
+		}
+	}
+
+	if pattern, ok := m["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.Pattern = re
+	}
+
+	return s, nil
+}
+
+// validate checks doc, decoded with json.Number numbers, against the
+// schema, returning a ValidationError listing every field that breaks it.
+func (s *docSchema) validate(doc interface{}) error {
+	var e ValidationError
+	s.check(doc, "", &e)
+
+	if len(e.Fields) > 0 {
+		return &e
+	}
+
+	return nil
+}
+
+func (s *docSchema) check(v interface{}, path string, e *ValidationError) {
+	field := path
+
+	if field == "" {
+		field = "document"
+	}
+
+	fail := func(rule string) {
+		e.Fields = append(e.Fields, FieldError{Field: field, Rule: rule})
+	}
+
+	if s.Types != nil && !schemaTypeOf(v, s.Types) {
+		if len(s.Types) == 1 {
+			fail("not of type " + s.Types[0])
+		} else {
+			fail(fmt.Sprintf("not of type %v", s.Types))
+		}
+
+		return
+	}
+
+	if s.Enum != nil {
+		found := false
+
+		for _, allowed := range s.Enum {
+			if schemaEqual(v, allowed) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			fail("not one of the allowed values")
+		}
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("less than " + formatLimit(*s.Minimum))
+		}
+
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("greater than " + formatLimit(*s.Maximum))
+		}
+
+		if s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum {
+			fail("not greater than " + formatLimit(*s.ExclusiveMinimum))
+		}
+
+		if s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum {
+			fail("not less than " + formatLimit(*s.ExclusiveMaximum))
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+
+		if s.MinLength != nil && n < *s.MinLength {
+			fail(fmt.Sprintf("shorter than %d characters", *s.MinLength))
+		}
+
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail(fmt.Sprintf("longer than %d characters", *s.MaxLength))
+		}
+
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			fail("not matching " + s.Pattern.String())
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail(fmt.Sprintf("shorter than %d items", *s.MinItems))
+		}
+
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail(fmt.Sprintf("longer than %d items", *s.MaxItems))
+		}
+
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.check(item, path+"["+strconv.Itoa(i)+"]", e)
+			}
+		}
+
+	case map[string]interface{}:
+		prefix := path
+
+		if prefix != "" {
+			prefix += "."
+		}
+
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				e.Fields = append(e.Fields, FieldError{Field: prefix + name, Rule: "required"})
+			}
+		}
+
+		names := make([]string, 0, len(v))
+
+		for name := range v {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ps, ok := s.Properties[name]; ok {
+				ps.check(v[name], prefix+name, e)
+			} else if s.Additional != nil {
+				s.Additional.check(v[name], prefix+name, e)
+			} else if s.NoExtra {
+				e.Fields = append(e.Fields, FieldError{Field: prefix + name, Rule: "not allowed"})
+			}
+		}
+	}
+}
+
+func schemaTypeOf(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+
+			if f, err := v.Float64(); t == "integer" && err == nil && f == float64(int64(f)) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// schemaEqual compares JSON values, numbers by value.
+func schemaEqual(a, b interface{}) bool {
+	if x, ok := a.(json.Number); ok {
+		y, ok := b.(json.Number)
+
+		if !ok {
+			return false
+		}
+
+		fx, _ := x.Float64()
+		fy, _ := y.Float64()
+
+		return fx == fy
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func formatLimit(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Server exposes a Driver over a small REST API:
+//
+//	GET    /{collection}             all records of a collection
+//	GET    /{collection}/{resource}  a single record
+//	PUT    /{collection}/{resource}  write a record
+//	DELETE /{collection}/{resource}  delete a record
+//	GET    /openapi.json             the OpenAPI document, when enabled
+//	GET    /healthz                  the report of Ping, when enabled
+//	GET    /watch/{collection}       a stream of its changes, when enabled
+//
+// Single records carry a strong ETag, and If-Match / If-None-Match are
+// honoured for optimistic concurrency.
+type Server struct {
+	db      *Driver
+	opts    ServerOptions
+	limits  clientLimits
+	handler http.Handler
+}
+
+type ServerOptions struct {
+	// Authorize is called before every request is served, with the role
+	// it needs on its collection: RoleRead for reads and RoleWrite for
+	// changes. When nil, every request is allowed. See TokenAuth.
+	Authorize AuthorizeFunc
+
+	// RateLimit is the number of requests per second a client may make,
+	// with bursts of up to Burst (by default RateLimit rounded up).
+	// Clients over it get 429 Too Many Requests. Zero means no limit.
+	RateLimit float64
+	Burst     int
+
+	// MaxConcurrent caps the requests of a client served at the same time.
+	MaxConcurrent int
+
+	// MaxBodySize caps the size of request bodies, in bytes. Larger ones
+	// get 413 Request Entity Too Large.
+	MaxBodySize int64
+
+	// ClientID tells clients apart for RateLimit and MaxConcurrent. It
+	// defaults to ClientAddr.
+	ClientID func(r *http.Request) string
+
+	// CORS, when set, lets browsers on other origins use the server.
+	CORS *CORSOptions
+
+	// Middleware wraps the server, the first one outermost, so requests
+	// pass through it before CORS, limits and Authorize.
+	Middleware []func(http.Handler) http.Handler
+
+	// TLSConfig, CertFile and KeyFile are used by ListenAndServe to serve
+	// HTTPS instead of plain HTTP, with the certificate and key loaded
+	// from the files when given.
+	TLSConfig         *tls.Config
+	CertFile, KeyFile string
+
+	// Health serves the report of Ping at /healthz, unauthenticated, for
+	// liveness and readiness probes, in place of a collection of that name.
+	Health bool
+
+	// Watch streams the changes of each collection at /watch/{collection},
+	// as server-sent events resuming from a change log sequence number, in
+	// place of a collection named watch. It needs Options.ChangeLog.
+	Watch bool
+
+	// Metrics serves the metrics of WriteMetrics at /metrics,
+	// unauthenticated, for Prometheus to scrape, in place of a collection
+	// of that name.
+	Metrics bool
+
+	// Debug serves the profiles of net/http/pprof under /debug/pprof/ and
+	// the report of Driver.Debug at /debug/db, in place of those records
+	// of a collection named debug. When Authorize is set, they need
+	// RoleAdmin on "*".
+	Debug bool
+
+	// OpenAPI serves an OpenAPI document of the API at /openapi.json and
+	// Swagger UI at /docs, in place of collections of those names.
+	// Schemas maps collections to a value of the Go type stored in them,
+	// to describe their records in the document.
+	OpenAPI bool
+	Schemas map[string]interface{}
+}
+
+func NewServer(db *Driver, opts *ServerOptions) *Server {
+	s := &Server{db: db}
+
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	s.handler = http.HandlerFunc(s.serve)
+
+	if c := s.opts.CORS; c != nil {
+		if c.ignoresWildcard() {
+			db.log.Warn("CORS origin \"*\" is ignored with AllowCredentials\n")
+		}
+
+		s.handler = c.wrap(s.handler)
+	}
+
+	for i := len(s.opts.Middleware) - 1; i >= 0; i-- {
+		s.handler = s.opts.Middleware[i](s.handler)
+	}
+
+	return s
+}
+
+// ListenAndServe serves on addr, over TLS when the options ask for it.
+func (s *Server) ListenAndServe(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s, TLSConfig: s.opts.TLSConfig}
+	defer s.db.track(srv)()
+
+	if s.opts.TLSConfig == nil && s.opts.CertFile == "" {
+		return srv.ListenAndServe()
+	}
+
+	return srv.ListenAndServeTLS(s.opts.CertFile, s.opts.KeyFile)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	done, ok := s.limit(w, r)
+
+	if !ok {
+		return
+	}
+
+	defer done()
+
+	if s.serveOpenAPI(w, r) || s.serveHealth(w, r) || s.serveMetrics(w, r) || s.serveDebug(w, r) || s.serveWatch(w, r) {
+		return
+	}
+
+	collection, resource, err := splitPath(r.URL.Path)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := checkCollection(collection); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if s.opts.Authorize != nil {
+		if err := s.opts.Authorize(r, collection, access(r)); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	switch {
+	case resource == "" && r.Method == http.MethodGet:
+		s.list(w, collection)
+	case resource != "" && r.Method == http.MethodGet:
+		s.get(w, r, collection, resource)
+	case resource != "" && r.Method == http.MethodPut:
+		s.put(w, r, collection, resource)
+	case resource != "" && r.Method == http.MethodDelete:
+		s.delete(w, r, collection, resource)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func splitPath(path string) (string, string, error) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("Missing collection")
+	}
+
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (s *Server) list(w http.ResponseWriter, collection string) {
+	records, err := s.db.ReadAll(collection)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "[%s]", strings.Join(records, ","))
+}
+
+// current returns the stored JSON and revision of a record, read as
+// ReadRaw reads it.
+func (s *Server) current(collection, resource string) ([]byte, int64, error) {
+	b, err := s.db.ReadRaw(collection, resource)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	revision, err := s.db.Revision(collection, resource)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b, revision, nil
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, collection, resource string) {
+	current, revision, err := s.current(collection, resource)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tag := etag(current, revision)
+	w.Header().Set("ETag", tag)
+
+	if matchesETag(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(current)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, collection, resource string) {
+	body, err := ioutil.ReadAll(r.Body)
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(body, &doc); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cond := requestCondition(r)
+
+	if cond == nil {
+		err = s.db.Write(collection, resource, doc)
+	} else {
+		err = s.db.WriteIf(collection, resource, doc, cond)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if current, revision, err := s.current(collection, resource); err == nil {
+		w.Header().Set("ETag", etag(current, revision))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, collection, resource string) {
+	var err error
+
+	if cond := requestCondition(r); cond == nil {
+		err = s.db.Delete(collection, resource)
+	} else {
+		err = s.db.DeleteIf(collection, resource, cond)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrConditionFailed):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, ErrValidation), errors.Is(err, ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnauthorized):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrCollectionNotFound):
+		http.Error(w, "Collection not found", http.StatusNotFound)
+	case errors.Is(err, ErrRecordNotFound):
+		http.Error(w, "Record not found", http.StatusNotFound)
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// etag derives a strong entity tag from the revision and the stored bytes,
+// so it changes with every write even when a value is written back as is.
+func etag(b []byte, revision int64) string {
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf(`"%d-%s"`, revision, hex.EncodeToString(sum[:8]))
+}
+
+func matchesETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+type etagCondition struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+func requestCondition(r *http.Request) Condition {
+	c := etagCondition{
+		ifMatch:     r.Header.Get("If-Match"),
+		ifNoneMatch: r.Header.Get("If-None-Match"),
+	}
+
+	if c.ifMatch == "" && c.ifNoneMatch == "" {
+		return nil
+	}
+
+	return c
+}
+
+func (c etagCondition) holds(current []byte, revision int64) (bool, error) {
+	if current == nil {
+		return c.ifMatch == "", nil
+	}
+
+	tag := etag(current, revision)
+
+	if c.ifMatch != "" && !matchesETag(c.ifMatch, tag) {
+		return false, nil
+	}
+
+	return c.ifNoneMatch == "" || !matchesETag(c.ifNoneMatch, tag), nil
+}
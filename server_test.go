@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerGet(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db")
+
+	if err := os.WriteFile(filepath.Join(root, "secret.json"), []byte(`{"pw":"hunter2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New(dir, &Options{KeyNormalization: NormalizeNFC, WriteBuffer: &WriteBufferOptions{MaxOps: 100}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err := db.Write("Users", "José", map[string]string{"name": "José"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(db, nil)
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{name: "buffered write", path: "/Users/Jos%C3%A9", want: http.StatusOK},
+		{name: "other normal form", path: "/Users/Jose%CC%81", want: http.StatusOK},
+		{name: "missing record", path: "/Users/Nobody", want: http.StatusNotFound},
+		{name: "missing collection", path: "/Nobody/Nobody", want: http.StatusNotFound},
+		{name: "parent directory", path: "/../secret", want: http.StatusBadRequest},
+		{name: "internal directory", path: "/.meta/Users", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("GET %v = %d %q, want %d", tt.path, w.Code, w.Body.String(), tt.want)
+			}
+
+			if w.Code == http.StatusOK && w.Header().Get("ETag") == "" {
+				t.Errorf("GET %v has no ETag", tt.path)
+			}
+		})
+	}
+}
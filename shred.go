@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const keysDir = ".keys"
+
+// ErrForgotten is returned for records of a subject erased with Forget.
+// Queries and listings leave such records out.
+var ErrForgotten = errors.New("Subject forgotten")
+
+type ShreddingOptions struct {
+	// MasterKey wraps the data keys of the subjects.
+	MasterKey Encryption
+
+	// KeyDir is where the wrapped data keys are kept. It defaults to
+	// .keys in the database directory; keeping it out of backups is what
+	// makes Forget reach the records in them.
+	KeyDir string
+}
+
+// subjectKeys caches the unwrapped data keys of subjects, by the hash of
+// the subject.
+type subjectKeys struct {
+	mutex sync.Mutex
+	keys  map[string]Encryption
+}
+
+// SetSubjectField encrypts each record of collection under the data key of
+// the subject named by its field, so that Forget can erase every record of
+// a subject at once. Records without the field are encrypted as usual. An
+// empty field stops new records from being encrypted per subject.
+func (d *Driver) SetSubjectField(collection, field string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if d.opts.Shredding == nil {
+		return fmt.Errorf("Crypto-shredding is not configured")
+	}
+
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.subjectField = field
+	})
+
+	return nil
+}
+
+// Forget destroys the data key of subject. Its records, and every copy of
+// them made since, can no longer be decrypted by anyone; reading them fails
+// with ErrForgotten. The decrypted copies the driver holds, in the caches,
+// the field indexes and the undo journal, are dropped too; journaled
+// operations that held them can no longer be undone.
+func (d *Driver) Forget(subject string) error {
+	if d.opts.Shredding == nil {
+		return fmt.Errorf("Crypto-shredding is not configured")
+	}
+
+	id := subjectID(subject)
+
+	d.subjects.mutex.Lock()
+	delete(d.subjects.keys, id)
+	err := d.removeAll(d.subjectKeyPath(id))
+	d.subjects.mutex.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	collections, err := d.listCollections()
+
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(collections))
+
+	for _, collection := range collections {
+		listed[collection] = true
+	}
+
+	// Collections deleted as a whole may only be left in the journal.
+	for _, collection := range d.journal.collections() {
+		if !listed[collection] {
+			collections = append(collections, collection)
+		}
+	}
+
+	for _, collection := range collections {
+		if err := d.forgetRecords(collection, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forgetRecords drops the records of subject id in collection from the
+// caches and field indexes. The whole collection is evicted from the
+// caches, since chunked and cold records only tell their subject once
+// read.
+func (d *Driver) forgetRecords(collection, id string) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.forgetJournaled(collection, id)
+	d.changedRecord(collection, "", nil)
+
+	resources, err := d.resources(collection)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	indexes := d.collectionIndexes(collection)
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	for _, resource := range resources {
+		h, err := readEnvelopeHeader(d.recordPath(collection, resource))
+
+		if err != nil {
+			return err
+		}
+
+		if h == nil || (h.Subject != id && len(h.Chunks) == 0 && h.Cold == "") {
+			continue
+		}
+
+		if h.Subject != id {
+			if _, err := d.readRecord(collection, resource); !errors.Is(err, ErrForgotten) {
+				continue
+			}
+		}
+
+		for _, idx := range indexes {
+			idx.remove(resource)
+		}
+	}
+
+	return nil
+}
+
+// subjectID names the data key of a subject without revealing the subject
+// in file names and record headers.
+func subjectID(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Driver) subjectKeyPath(id string) string {
+	dir := d.opts.Shredding.KeyDir
+
+	if dir == "" {
+		dir = filepath.Join(d.dir, keysDir)
+	}
+
+	return filepath.Join(dir, id[:2], id)
+}
+
+// subject returns the ID of the subject whose key encrypts the record b of
+// collection, or an empty ID.
+func (d *Driver) subject(collection string, b []byte) string {
+	field := d.config(collection).subjectField
+
+	if field == "" || d.opts.Shredding == nil {
+		return ""
+	}
+
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return ""
+	}
+
+	v, ok := lookupField(doc, field)
+
+	if !ok || v == nil {
+		return ""
+	}
+
+	s, ok := v.(string)
+
+	if !ok {
+		s = valueKey(v)
+	}
+
+	if s == "" {
+		return ""
+	}
+
+	return subjectID(s)
+}
+
+// subjectKey returns the data key of subject id, creating it when create is
+// set. A missing key is reported as ErrForgotten.
+func (d *Driver) subjectKey(id string, create bool) (Encryption, error) {
+	d.subjects.mutex.Lock()
+	defer d.subjects.mutex.Unlock()
+
+	if enc, ok := d.subjects.keys[id]; ok {
+		return enc, nil
+	}
+
+	master := d.opts.Shredding.MasterKey
+	path := d.subjectKeyPath(id)
+
+	var key []byte
+
+	wrapped, err := d.readFile(path)
+
+	switch {
+	case err == nil:
+		if key, err = master.Decrypt(wrapped); err != nil {
+			return nil, fmt.Errorf("Unable to unwrap data key: %w", err)
+		}
+
+	case os.IsNotExist(err) && create:
+		key = make([]byte, 32)
+
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+
+		if wrapped, err = master.Encrypt(key); err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+
+		if err := d.writeFile(path+".tmp", wrapped, 0600); err != nil {
+			return nil, err
+		}
+
+		if err := d.replaceFile(path+".tmp", path); err != nil {
+			return nil, err
+		}
+
+	case os.IsNotExist(err):
+		return nil, ErrForgotten
+
+	default:
+		return nil, err
+	}
+
+	enc, err := NewSymmetricEncryption(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.subjects.keys == nil {
+		d.subjects.keys = make(map[string]Encryption)
+	}
+
+	d.subjects.keys[id] = enc
+
+	return enc, nil
+}
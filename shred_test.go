@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUndoAfterForget(t *testing.T) {
+	key, err := NewSymmetricEncryption(bytes.Repeat([]byte{1}, 32))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(d *Driver) error
+	}{
+		{name: "overwrite", change: func(d *Driver) error {
+			return d.Write("Users", "a", map[string]string{"owner": "bob", "pw": "other"})
+		}},
+		{name: "delete", change: func(d *Driver) error {
+			return d.Delete("Users", "a")
+		}},
+		{name: "delete collection", change: func(d *Driver) error {
+			return d.Delete("Users", "")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := New(t.TempDir(), &Options{JournalSize: 10, Shredding: &ShreddingOptions{MasterKey: key}})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.SetSubjectField("Users", "owner"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Write("Users", "a", map[string]string{"owner": "alice", "pw": "hunter2"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.change(db); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Forget("alice"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Undo(1); err == nil {
+				t.Error("Undo after Forget succeeded")
+			}
+
+			for _, op := range db.Journal() {
+				if bytes.Contains(op.Before["a"], []byte("hunter2")) {
+					t.Errorf("Operation %d still holds the forgotten value", op.ID)
+				}
+			}
+
+			var doc map[string]string
+
+			if err := db.Read("Users", "a", &doc); err == nil && doc["pw"] == "hunter2" {
+				t.Error("The forgotten value was stored again")
+			} else if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned for writes to a driver that has been shut down.
+var ErrClosed = errors.New("Database is closed")
+
+// shutdowner is a server or sink that Shutdown stops gracefully.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// track registers s to be shut down with the driver, until the returned
+// function is called.
+func (d *Driver) track(s shutdowner) (untrack func()) {
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+
+	if d.services == nil {
+		d.services = make(map[shutdowner]bool)
+	}
+
+	d.services[s] = true
+
+	return func() {
+		d.serviceMutex.Lock()
+		delete(d.services, s)
+		d.serviceMutex.Unlock()
+	}
+}
+
+// tracked returns the registered servers and sinks, servers first, as
+// sinks must see the changes made by the requests being finished.
+func (d *Driver) tracked() (servers, sinks []shutdowner) {
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+
+	for s := range d.services {
+		if _, ok := s.(*SinkRunner); ok {
+			sinks = append(sinks, s)
+		} else {
+			servers = append(servers, s)
+		}
+	}
+
+	return servers, sinks
+}
+
+// Shutdown closes the driver gracefully: it stops the servers serving it,
+// letting the requests in progress finish, writes out the buffered writes,
+// lets the sinks publish the changes made so far, and stops the background
+// goroutines. It then turns away new writes with ErrClosed, and syncs and
+// closes the change log; reads keep working. Servers are those running
+// ListenAndServe or Serve, and sinks those started with StartSink.
+//
+// When ctx is done first, the servers and sinks still busy are closed
+// outright and the rest of the shutdown goes ahead; the error then
+// includes ctx.Err().
+func (d *Driver) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	servers, sinks := d.tracked()
+
+	errs = append(errs, shutdownAll(ctx, servers)...)
+
+	if err := d.Flush(); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, shutdownAll(ctx, sinks)...)
+
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+
+	d.tasks.close()
+
+	// Holding the fence, no operation holds a collection lock, so the
+	// writes buffered since can be flushed before writes are turned away.
+	d.fence.Lock()
+
+	if d.buffer != nil {
+		for _, collection := range d.buffer.collections() {
+			d.applyBuffered(collection)
+		}
+	}
+
+	atomic.StoreInt32(&d.closed, 1)
+	d.fence.Unlock()
+
+	if err := d.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// shutdownAll shuts down services at once, returning their errors other
+// than running out of time.
+func shutdownAll(ctx context.Context, services []shutdowner) []error {
+	results := make(chan error, len(services))
+
+	for _, s := range services {
+		go func(s shutdowner) { results <- s.Shutdown(ctx) }(s)
+	}
+
+	var errs []error
+
+	for range services {
+		if err := <-results; err != nil && !errors.Is(err, ctx.Err()) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// writable returns ErrClosed once the driver has been shut down.
+func (d *Driver) writable() error {
+	if atomic.LoadInt32(&d.closed) == 1 {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// drainInterval is how often Shutdown checks whether connections and sinks
+// are done.
+const drainInterval = 10 * time.Millisecond
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// ErrTampered is returned for records whose signature does not match their
+// contents, or that are not signed although Options.SigningKey is set.
+var ErrTampered = errors.New("Record signature mismatch")
+
+// sign computes the signature of a record envelope: an HMAC-SHA256, under
+// Options.SigningKey, of the collection, the resource, the header without
+// its signature and the payload. Binding the collection and resource keeps
+// records from being copied over one another unnoticed.
+func (d *Driver) sign(collection, resource string, h envelopeHeader, payload []byte) (string, error) {
+	h.Signature = ""
+
+	hb, err := json.Marshal(h)
+
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, d.opts.SigningKey)
+	mac.Write([]byte(collection))
+	mac.Write([]byte{0})
+	mac.Write([]byte(resource))
+	mac.Write([]byte{0})
+	mac.Write(hb)
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySignature checks the signature of an opened envelope, or that a
+// record without one is acceptable.
+func (d *Driver) verifySignature(collection, resource string, h *envelopeHeader, payload []byte) error {
+	if len(d.opts.SigningKey) == 0 {
+		return nil
+	}
+
+	if h == nil || h.Signature == "" {
+		return ErrTampered
+	}
+
+	sig, err := d.sign(collection, resource, *h, payload)
+
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(h.Signature)) {
+		return ErrTampered
+	}
+
+	return nil
+}
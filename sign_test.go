@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+)
+
+func TestSignatureBindsResource(t *testing.T) {
+	db, err := New(t.TempDir(), &Options{Logger: lumber.NewConsoleLogger(lumber.WARN), SigningKey: []byte("secret")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err := db.Write("users", "alice", map[string]string{"role": "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Write("users", "bob", map[string]string{"role": "user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(db.recordPath("users", "alice"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(db.recordPath("users", "bob"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var v map[string]string
+
+	if err := db.Read("users", "bob", &v); !errors.Is(err, ErrTampered) {
+		t.Fatalf("Read of a swapped record = %v, %v, want ErrTampered", v, err)
+	}
+
+	if err := db.Read("users", "alice", &v); err != nil || v["role"] != "admin" {
+		t.Fatalf("Read(alice) = %v, %v", v, err)
+	}
+}
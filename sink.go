@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventSink publishes changes to another system. Publish must only return
+// nil once every change given has been accepted; on error the same changes
+// are offered again, so delivery is at least once.
+type EventSink interface {
+	Publish(ctx context.Context, changes []Change) error
+	Close() error
+}
+
+type SinkOptions struct {
+	// Collections limits the changes published to those of the listed
+	// collections.
+	Collections []string
+
+	// BatchSize is the most changes given to Publish at once, 100 by
+	// default.
+	BatchSize int
+
+	// CheckpointCollection is the collection the position of each sink is
+	// written to, keyed by its name. It defaults to _sinks, and its own
+	// changes are never published.
+	CheckpointCollection string
+
+	// RetryInterval is the wait after the first failed Publish, doubled
+	// on each further failure up to a minute. It defaults to a second.
+	RetryInterval time.Duration
+}
+
+type sinkCheckpoint struct {
+	Seq int64 `json:"seq"`
+}
+
+// SinkRunner feeds the change log to an EventSink.
+type SinkRunner struct {
+	d        *Driver
+	name     string
+	sink     EventSink
+	opts     SinkOptions
+	filter   map[string]bool
+	position int64
+
+	mutex   sync.Mutex
+	task    *task
+	untrack func()
+}
+
+// StartSink publishes the changes in the change log to sink, starting after
+// the last checkpoint of the sink called name, and goes on publishing new
+// changes as they are made until the runner is closed.
+func (d *Driver) StartSink(name string, sink EventSink, opts *SinkOptions) (*SinkRunner, error) {
+	if d.changes == nil {
+		return nil, errChangeLogDisabled
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("Missing sink name")
+	}
+
+	r := &SinkRunner{d: d, name: name, sink: sink}
+
+	if opts != nil {
+		r.opts = *opts
+	}
+
+	if r.opts.BatchSize <= 0 {
+		r.opts.BatchSize = 100
+	}
+
+	if r.opts.CheckpointCollection == "" {
+		r.opts.CheckpointCollection = "_sinks"
+	}
+
+	if r.opts.RetryInterval <= 0 {
+		r.opts.RetryInterval = time.Second
+	}
+
+	if err := checkCollection(r.opts.CheckpointCollection); err != nil {
+		return nil, err
+	}
+
+	if len(r.opts.Collections) > 0 {
+		r.filter = make(map[string]bool, len(r.opts.Collections))
+
+		for _, c := range r.opts.Collections {
+			r.filter[c] = true
+		}
+	}
+
+	var cp sinkCheckpoint
+
+	if err := d.Read(r.opts.CheckpointCollection, name, &cp); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	r.position = cp.Seq
+
+	r.untrack = d.track(r)
+	r.task = d.tasks.start("sink "+name, 0, restartAlways, r.run)
+
+	return r, nil
+}
+
+// Position returns the sequence number of the last change the sink has
+// accepted, or skipped.
+func (r *SinkRunner) Position() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.position
+}
+
+// Close stops the runner and closes the sink. Changes being published are
+// offered again when the sink is next started.
+func (r *SinkRunner) Close() error {
+	r.untrack()
+	r.d.tasks.stop(r.task)
+
+	return r.sink.Close()
+}
+
+// Shutdown waits for the sink to publish the changes logged so far, and
+// then closes the runner, whether or not it caught up before ctx was done.
+func (r *SinkRunner) Shutdown(ctx context.Context) error {
+	last, err := r.d.LastChange()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for err == nil && r.Position() < last {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-r.task.done:
+			err = fmt.Errorf("Sink '%s' stopped before publishing change %d", r.name, last)
+		case <-ticker.C:
+		}
+	}
+
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (r *SinkRunner) run(ctx context.Context, t *task) error {
+	retry := r.opts.RetryInterval
+
+	for ctx.Err() == nil {
+		position := r.Position()
+		changes, last, err := r.d.readChanges(position, r.opts.BatchSize)
+
+		if err == nil && last == position {
+			if r.d.WaitChanges(ctx, position) != nil {
+				return nil
+			}
+
+			continue
+		}
+
+		batch := changes[:0]
+
+		for _, c := range changes {
+			if c.Collection != r.opts.CheckpointCollection && (r.filter == nil || r.filter[c.Collection]) {
+				batch = append(batch, c)
+			}
+		}
+
+		if err == nil && len(batch) > 0 {
+			err = r.sink.Publish(ctx, batch)
+		}
+
+		if err == nil && len(batch) > 0 {
+			// Only publishing moves the checkpoint, as writing it is a
+			// change of its own.
+			err = r.d.Write(r.opts.CheckpointCollection, r.name, sinkCheckpoint{Seq: last})
+		}
+
+		t.beat(err)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			r.d.log.Warn("Sink '%s' failed: %v\n", r.name, err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retry):
+			}
+
+			if retry < time.Minute {
+				retry *= 2
+			}
+
+			continue
+		}
+
+		retry = r.opts.RetryInterval
+
+		r.mutex.Lock()
+		r.position = last
+		r.mutex.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const snapshotsDir = ".snapshots"
+
+// Snapshot is a read-only view of the database as it was when the snapshot
+// was taken, unaffected by later writes.
+type Snapshot struct {
+	d    *Driver
+	dir  string
+	Time time.Time
+}
+
+// Snapshot pins the current state of the database. Writes are held off
+// while every live record is hard linked, or copied where links are not
+// supported, into a private directory; since records are only ever
+// replaced by rename, the links keep their contents from then on. The
+// snapshot must be closed to release its files.
+func (d *Driver) Snapshot() (*Snapshot, error) {
+	d.flushAll()
+
+	d.fence.Lock()
+	defer d.fence.Unlock()
+
+	now := time.Now()
+	s := &Snapshot{d: d, dir: filepath.Join(d.dir, snapshotsDir, fmt.Sprintf("%d", now.UnixNano())), Time: now}
+
+	collections, err := d.listCollections()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, collection := range collections {
+		if err := s.pin(collection); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Snapshot) pin(collection string) error {
+	resources, err := s.d.resources(collection)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.dir, collection)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		if s.d.expired(collection, resource) {
+			continue
+		}
+
+		src := s.d.recordPath(collection, resource)
+		dst := filepath.Join(dir, fileName(resource)+".json")
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Link(src, dst); err != nil {
+			if err := copyFile(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Snapshot) Read(collection, resource string, v interface{}) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = s.d.key(resource)
+
+	b, err := s.d.readRecordFile(collection, resource, filepath.Join(s.dir, collection, fileName(resource)+".json"))
+
+	if err != nil {
+		return err
+	}
+
+	return s.d.decode(collection, b, v)
+}
+
+func (s *Snapshot) ReadAll(collection string) ([]string, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(s.dir, collection)
+	files, err := s.d.readTree(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var records []string
+
+	for _, file := range files {
+		if !isRecordFile(file) {
+			continue
+		}
+
+		b, err := s.d.readRecordFile(collection, s.d.recordKey(collection, file.Name()), filepath.Join(dir, file.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, string(b))
+	}
+
+	return records, nil
+}
+
+// Collections lists the collections in the snapshot.
+func (s *Snapshot) Collections() ([]string, error) {
+	files, err := s.d.readDir(s.dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var collections []string
+
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			collections = append(collections, file.Name())
+		}
+	}
+
+	return collections, nil
+}
+
+// Close releases the files held by the snapshot.
+func (s *Snapshot) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
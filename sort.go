@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SortField struct {
+	Field      string
+	Desc       bool
+	Comparator string
+}
+
+type Comparator func(a, b interface{}) int
+
+// SortBy builds sort fields from names, where a leading "-" sorts that
+// field in descending order: SortBy("Company", "-Age").
+func SortBy(fields ...string) []SortField {
+	sorts := make([]SortField, 0, len(fields))
+
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			sorts = append(sorts, SortField{Field: f[1:], Desc: true})
+		} else {
+			sorts = append(sorts, SortField{Field: strings.TrimPrefix(f, "+")})
+		}
+	}
+
+	return sorts
+}
+
+func (d *Driver) RegisterComparator(name string, fn Comparator) error {
+	if name == "" {
+		return fmt.Errorf("Missing comparator name")
+	}
+
+	if fn == nil {
+		return fmt.Errorf("Missing comparator function")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.comparators[name] = fn
+
+	return nil
+}
+
+func (d *Driver) comparatorsFor(sorts []SortField) ([]Comparator, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	cmps := make([]Comparator, len(sorts))
+
+	for i, s := range sorts {
+		if s.Field == "" {
+			return nil, fmt.Errorf("Empty field name in sort")
+		}
+
+		switch fn, ok := d.comparators[s.Comparator]; {
+		case s.Comparator == "":
+			cmps[i] = defaultCompare
+		case !ok:
+			return nil, fmt.Errorf("Unknown comparator %v", s.Comparator)
+		default:
+			cmps[i] = fn
+		}
+	}
+
+	return cmps, nil
+}
+
+type sortedRecord struct {
+	record string
+	keys   []interface{}
+}
+
+func sortRecords(records []sortedRecord, sorts []SortField, cmps []Comparator) {
+	sort.SliceStable(records, func(i, j int) bool {
+		for k, s := range sorts {
+			c := cmps[k](records[i].keys[k], records[j].keys[k])
+
+			if s.Desc {
+				c = -c
+			}
+
+			if c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+}
+
+// sortKeys extracts the values of the sort fields. When the document has
+// not been decoded already only the objects along each field path are,
+// leaving the rest of the record as raw bytes.
+func sortKeys(b []byte, doc map[string]interface{}, sorts []SortField) ([]interface{}, error) {
+	keys := make([]interface{}, len(sorts))
+
+	for i, s := range sorts {
+		path := strings.Split(s.Field, ".")
+
+		if doc != nil {
+			keys[i], _ = lookupPath(doc, path)
+			continue
+		}
+
+		raw := rawField(b, path)
+
+		if raw == nil {
+			continue
+		}
+
+		if err := json.Unmarshal(raw, &keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// defaultCompare orders missing values first, then null, booleans, numbers,
+// strings and finally any other JSON value by its encoding.
+func defaultCompare(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+
+	if ra != rb {
+		return ra - rb
+	}
+
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+
+	if ba, ok := a.(bool); ok {
+		bb := b.(bool)
+
+		switch {
+		case ba == bb:
+			return 0
+		case !ba:
+			return -1
+		}
+
+		return 1
+	}
+
+	return strings.Compare(valueKey(a), valueKey(b))
+}
+
+func typeRank(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 3
+	}
+
+	switch v.(type) {
+	case nil:
+		return 1
+	case bool:
+		return 2
+	case string:
+		return 4
+	}
+
+	return 5
+}
+
+// compareSemver orders strings such as "v1.10.2" numerically by their dot
+// separated components, with pre-releases before the release they precede.
+func compareSemver(a, b interface{}) int {
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+
+	if !okA || !okB {
+		return defaultCompare(a, b)
+	}
+
+	va, pa := splitSemver(sa)
+	vb, pb := splitSemver(sb)
+
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+
+		if i < len(va) {
+			x = va[i]
+		}
+
+		if i < len(vb) {
+			y = vb[i]
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+
+	return strings.Compare(pa, pb)
+}
+
+func splitSemver(s string) ([]int, string) {
+	s = strings.TrimPrefix(s, "v")
+
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	pre := ""
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, pre = s[:i], s[i+1:]
+	}
+
+	var parts []int
+
+	for _, p := range strings.Split(s, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+
+	return parts, pre
+}
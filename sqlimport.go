@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ImportSQL copies the rows of table into collection, one record per row
+// named after its keyColumn, with a field per column. Rows are read in key
+// order, so an import given a Checkpoint can resume; the Format and
+// Collection options do not apply. Text columns become strings, numbers,
+// booleans and timestamps keep their types, NULLs become null, and binary
+// values that are not UTF-8 are stored base64 encoded.
+func (d *Driver) ImportSQL(db *sql.DB, table, keyColumn, collection string, opts *ImportOptions) (ImportStats, error) {
+	o := ImportOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return ImportStats{}, err
+	}
+
+	if table == "" || keyColumn == "" {
+		return ImportStats{}, fmt.Errorf("Missing table or key column")
+	}
+
+	rows, err := db.Query("SELECT * FROM " + quoteIdentifier(table) + " ORDER BY " + quoteIdentifier(keyColumn))
+
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	key := -1
+
+	for i, column := range columns {
+		if column == keyColumn {
+			key = i
+		}
+	}
+
+	if key < 0 {
+		return ImportStats{}, fmt.Errorf("Table %v has no column %v", table, keyColumn)
+	}
+
+	return d.importRecords(sqlReader(rows, columns, key, collection), o)
+}
+
+func sqlReader(rows *sql.Rows, columns []string, key int, collection string) func() (*importRecord, error) {
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	return func() (*importRecord, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+
+			return nil, io.EOF
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		doc := make(map[string]interface{}, len(columns))
+
+		for i, column := range columns {
+			doc[column] = sqlValue(values[i])
+		}
+
+		resource, err := sqlKey(doc[columns[key]])
+
+		if err != nil {
+			return nil, invalidRecordError{err}
+		}
+
+		b, err := marshalRecord(doc)
+
+		if err != nil {
+			return nil, invalidRecordError{err}
+		}
+
+		return &importRecord{Collection: collection, Resource: resource, Data: b}, nil
+	}
+}
+
+// sqlValue converts a scanned column to the value stored in the document.
+// Drivers return text as []byte, which is copied since the driver may
+// reuse it.
+func sqlValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+
+		return append([]byte(nil), b...)
+	}
+
+	return v
+}
+
+func sqlKey(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("Missing key")
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	}
+
+	return fmt.Sprint(v), nil
+}
+
+// quoteIdentifier quotes a table or column name the standard SQL way,
+// which SQLite, PostgreSQL and most others accept.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
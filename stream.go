@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type StreamOptions struct {
+	// Validate checks, while streaming, that the document is a single JSON
+	// value, and fails the write otherwise.
+	Validate bool
+}
+
+// WriteFrom stores the document read from r as the value of a record,
+// streaming it to disk so that it never has to be held in memory. The bytes
+// are stored as read, without reformatting. Collections whose writes do
+// more than store the JSON, such as compressed, validated or indexed ones,
+// read the document into memory as Write does.
+func (d *Driver) WriteFrom(collection, resource string, r io.Reader, opts *StreamOptions) (err error) {
+	defer d.observe(time.Now(), &err, "write", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	o := StreamOptions{}
+
+	if opts != nil {
+		o = *opts
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.opts.MaxDocumentSize > 0 {
+		r = io.LimitReader(r, int64(d.opts.MaxDocumentSize)+1)
+	}
+
+	if d.rewritesDocuments(collection) {
+		b, err := ioutil.ReadAll(r)
+
+		if err != nil {
+			return err
+		}
+
+		if !json.Valid(b) {
+			return fmt.Errorf("Invalid JSON document")
+		}
+
+		return d.write(collection, resource, json.RawMessage(b))
+	}
+
+	return d.journaled(OpWrite, collection, resource, func() error {
+		return d.storeFrom(collection, resource, r, o)
+	})
+}
+
+// storeFrom streams a document into a record. Callers must hold the
+// collection lock.
+func (d *Driver) storeFrom(collection, resource string, r io.Reader, o StreamOptions) error {
+	fnlPath := d.recordPath(collection, resource)
+	tmpPath := fnlPath + ".tmp"
+	dir := filepath.Dir(fnlPath)
+
+	if err := d.checkKeyCollision(collection, resource); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	n, err := d.streamFile(tmpPath, r, o.Validate)
+
+	if err == nil {
+		err = d.checkDocumentSize(collection, resource, int(n))
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	oldSize := d.recordSize(fnlPath)
+
+	d.bloomAdd(collection, resource)
+
+	if err := d.reserve(collection, oldSize, n); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := d.syncWrite(d.opts.Durability, tmpPath); err != nil {
+		d.unreserve(collection, oldSize, n)
+		return err
+	}
+
+	written, err := d.recordWritten(collection, resource, false)
+
+	if err != nil {
+		d.unreserve(collection, oldSize, n)
+		return err
+	}
+
+	if err := d.replaceFile(tmpPath, fnlPath); err != nil {
+		written(false)
+		d.unreserve(collection, oldSize, n)
+		return err
+	}
+
+	written(true)
+
+	synced := d.syncPublished(d.opts.Durability, collection, dir)
+
+	d.changedRecord(collection, resource, nil)
+	d.updateIndexes(collection, resource, nil)
+
+	if err := d.evict(collection, resource); err != nil {
+		return err
+	}
+
+	return synced
+}
+
+// streamFile copies r into a new file at path, checking on the way that it
+// holds one JSON value when validate is set, and returns its size.
+func (d *Driver) streamFile(path string, r io.Reader, validate bool) (int64, error) {
+	d.files.acquire()
+	defer d.files.release()
+
+	f, err := d.openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := d.fault(FaultWrite, path); err != nil {
+		f.Close()
+		return 0, &os.PathError{Op: "write", Path: path, Err: err}
+	}
+
+	bw := bufio.NewWriter(f)
+	w := &countingWriter{w: bw}
+
+	if validate {
+		err = validateJSON(io.TeeReader(r, w))
+	} else {
+		_, err = io.Copy(w, r)
+	}
+
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return w.n, err
+}
+
+// validateJSON reads a single JSON value token by token, so that documents
+// of any size are checked in bounded memory.
+func validateJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	depth := 0
+
+	for {
+		t, err := dec.Token()
+
+		if err == io.EOF && depth == 0 {
+			return fmt.Errorf("Invalid JSON document: empty")
+		}
+
+		if err == io.EOF {
+			return fmt.Errorf("Invalid JSON document: %w", io.ErrUnexpectedEOF)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Invalid JSON document: %w", err)
+		}
+
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			break
+		}
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("Invalid JSON document: unexpected data after the value")
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadTo writes the stored JSON of a record to w. Plain records are
+// streamed from disk; compressed, encrypted, signed or migrated ones are
+// decoded in memory first.
+func (d *Driver) ReadTo(collection, resource string, w io.Writer) (err error) {
+	defer d.observe(time.Now(), &err, "read", collection, resource)
+
+	resource, err = d.checkRead(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	if b, ok := d.cache.get(collection, resource); ok {
+		_, err := w.Write(b)
+		return err
+	}
+
+	d.files.acquire()
+	f, err := d.openFile(d.recordPath(collection, resource), os.O_RDONLY, 0)
+
+	if err != nil {
+		d.files.release()
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(envelopeMagic))
+
+	if !bytes.Equal(magic, envelopeMagic) && len(d.opts.SigningKey) == 0 && len(d.config(collection).migrations) == 0 {
+		_, err = io.Copy(w, br)
+		f.Close()
+		d.files.release()
+		return err
+	}
+
+	f.Close()
+	d.files.release()
+
+	b, err := d.readRecord(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The states of a background task.
+const (
+	TaskRunning    = "running"
+	TaskRestarting = "restarting"
+	TaskFailed     = "failed"
+	TaskStopped    = "stopped"
+)
+
+// TaskStatus describes a background task of the driver, such as the
+// sweeper, the compactor, the watcher or a sink.
+type TaskStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+
+	// Interval is how often the task does its work, or zero for tasks that
+	// work on events.
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Restarts counts the times the task was restarted after failing or
+	// panicking.
+	Restarts int       `json:"restarts"`
+	Started  time.Time `json:"started"`
+	LastRun  time.Time `json:"lastRun"`
+
+	// Error is the error of the task's last run, or what it failed with.
+	Error string `json:"error,omitempty"`
+}
+
+// restartPolicy tells the supervisor what to do when a task fails or
+// panics: it is restarted after a wait, doubled after each failure up to
+// a minute, unless it failed more than limit times in a row. A zero limit
+// restarts it for ever. Failures more than a minute apart are not in a row.
+type restartPolicy struct {
+	limit int
+}
+
+var restartAlways = restartPolicy{}
+
+const taskRetry = time.Second
+
+// taskFunc is the body of a background task, which runs until ctx is done.
+// Returning early is a failure.
+type taskFunc func(ctx context.Context, t *task) error
+
+type task struct {
+	name     string
+	interval time.Duration
+	policy   restartPolicy
+	fn       taskFunc
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	last   int64
+
+	mutex    sync.Mutex
+	state    string
+	err      error
+	restarts int
+	started  time.Time
+}
+
+// supervisor owns the background goroutines of a driver: it recovers their
+// panics, restarts them by their policy, and waits for them on close.
+type supervisor struct {
+	log    Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  errgroup.Group
+
+	mutex sync.Mutex
+	tasks map[string]*task
+}
+
+func newSupervisor(log Logger) *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{log: log, ctx: ctx, cancel: cancel, tasks: make(map[string]*task)}
+}
+
+// start runs fn as the task name, which works every interval, or on events
+// when interval is zero.
+func (s *supervisor) start(name string, interval time.Duration, policy restartPolicy, fn taskFunc) *task {
+	ctx, cancel := context.WithCancel(s.ctx)
+	now := time.Now()
+
+	t := &task{
+		name:     name,
+		interval: interval,
+		policy:   policy,
+		fn:       fn,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		last:     now.UnixNano(),
+		state:    TaskRunning,
+		started:  now,
+	}
+
+	s.mutex.Lock()
+	s.tasks[name] = t
+	s.mutex.Unlock()
+
+	s.group.Go(func() error {
+		defer close(t.done)
+		return s.run(ctx, t)
+	})
+
+	return t
+}
+
+func (s *supervisor) run(ctx context.Context, t *task) error {
+	wait := taskRetry
+	failures := 0
+
+	for {
+		began := time.Now()
+		err := s.call(ctx, t)
+
+		if ctx.Err() != nil {
+			t.set(TaskStopped, nil)
+			return nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("Exited unexpectedly")
+		}
+
+		if time.Since(began) > time.Minute {
+			wait, failures = taskRetry, 0
+		}
+
+		failures++
+
+		if t.policy.limit > 0 && failures > t.policy.limit {
+			s.log.Error("Background task '%s' failed %d times in a row, giving up: %v\n", t.name, failures, err)
+			t.set(TaskFailed, err)
+			return fmt.Errorf("Background task '%s' failed: %w", t.name, err)
+		}
+
+		s.log.Error("Background task '%s' failed, restarting in %v: %v\n", t.name, wait, err)
+		t.set(TaskRestarting, err)
+
+		select {
+		case <-ctx.Done():
+			t.set(TaskStopped, err)
+			return nil
+		case <-time.After(wait):
+		}
+
+		if wait < time.Minute {
+			wait *= 2
+		}
+
+		t.mutex.Lock()
+		t.restarts++
+		t.state = TaskRunning
+		t.mutex.Unlock()
+	}
+}
+
+// call runs the task's body once, turning a panic into an error and
+// logging where it happened.
+func (s *supervisor) call(ctx context.Context, t *task) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.log.Error("Background task '%s' panicked: %v\n%s\n", t.name, v, debug.Stack())
+			err = fmt.Errorf("Panic: %v", v)
+		}
+	}()
+
+	return t.fn(ctx, t)
+}
+
+func (t *task) set(state string, err error) {
+	t.mutex.Lock()
+	t.state = state
+	t.err = err
+	t.mutex.Unlock()
+}
+
+// beat records that the task did its work, with the error it ran into.
+func (t *task) beat(err error) {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+
+	t.mutex.Lock()
+	t.err = err
+	t.mutex.Unlock()
+}
+
+// stop stops the task and waits for it, removing it from the supervisor.
+func (s *supervisor) stop(t *task) {
+	t.cancel()
+	<-t.done
+
+	s.mutex.Lock()
+
+	if s.tasks[t.name] == t {
+		delete(s.tasks, t.name)
+	}
+
+	s.mutex.Unlock()
+}
+
+// close stops every task and waits for them, returning the error of the
+// first that failed for good.
+func (s *supervisor) close() error {
+	s.cancel()
+	return s.group.Wait()
+}
+
+func (t *task) status() TaskStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	st := TaskStatus{
+		Name:     t.name,
+		State:    t.state,
+		Interval: t.interval,
+		Restarts: t.restarts,
+		Started:  t.started,
+		LastRun:  time.Unix(0, atomic.LoadInt64(&t.last)),
+	}
+
+	if t.err != nil {
+		st.Error = t.err.Error()
+	}
+
+	return st
+}
+
+// Tasks returns the status of the driver's background tasks, by name.
+func (d *Driver) Tasks() []TaskStatus {
+	d.tasks.mutex.Lock()
+	tasks := make([]*task, 0, len(d.tasks.tasks))
+
+	for _, t := range d.tasks.tasks {
+		tasks = append(tasks, t)
+	}
+
+	d.tasks.mutex.Unlock()
+
+	statuses := make([]TaskStatus, len(tasks))
+
+	for i, t := range tasks {
+		statuses[i] = t.status()
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSymlink is returned when a path inside the database, or the database
+// directory itself with Options.RejectSymlinkDir, is a symbolic link.
+var ErrSymlink = errors.New("Refusing to follow symbolic link")
+
+// checkNoSymlinks fails when a directory between the database directory and
+// path is a symbolic link, and when path itself is one if last is set. Paths
+// outside the database are not checked.
+func (d *Driver) checkNoSymlinks(path string, last bool) error {
+	rel, err := filepath.Rel(d.dir, path)
+
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+
+	if !last {
+		parts = parts[:len(parts)-1]
+	}
+
+	current := d.dir
+
+	for _, part := range parts {
+		current = filepath.Join(current, part)
+
+		fi, err := os.Lstat(current)
+
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return &os.PathError{Op: "open", Path: current, Err: ErrSymlink}
+		}
+	}
+
+	return nil
+}
+
+// openFile opens a file inside the database without following symbolic
+// links on the way to it or at it.
+func (d *Driver) openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := d.checkNoSymlinks(path, !noFollowSupported); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, flag|oNoFollow, perm)
+
+	if err != nil {
+		if fi, lerr := os.Lstat(path); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: ErrSymlink}
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func checkDatabaseDir(dir string) error {
+	fi, err := os.Lstat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "open", Path: dir, Err: ErrSymlink}
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+// Without O_NOFOLLOW the final path element is checked with lstat before
+// opening it.
+const (
+	oNoFollow         = 0
+	noFollowSupported = false
+)
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// oNoFollow makes opening a symbolic link fail rather than open its target.
+const (
+	oNoFollow         = syscall.O_NOFOLLOW
+	noFollowSupported = true
+)
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var errServerClosed = errors.New("Server closed")
+
+// tcpServer keeps track of the listeners and connections of the servers
+// speaking a protocol of their own over TCP, so they can all be closed.
+type tcpServer struct {
+	mutex     sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// serve accepts connections on l, handing each to handle on a goroutine of
+// its own, until the server is closed. A handler that panics only drops its
+// connection, so a bad client cannot bring the process down.
+func (s *tcpServer) serve(l net.Listener, log Logger, handle func(conn net.Conn)) error {
+	s.mutex.Lock()
+
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return errServerClosed
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+		s.conns = make(map[net.Conn]bool)
+	}
+
+	s.listeners[l] = true
+	s.mutex.Unlock()
+
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+
+			if closed {
+				return errServerClosed
+			}
+
+			return err
+		}
+
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					log.Error("Connection from %v panicked: %v\n%s\n", conn.RemoteAddr(), v, debug.Stack())
+				}
+
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+
+				conn.Close()
+			}()
+
+			handle(conn)
+		}()
+	}
+}
+
+// close stops the listeners and drops the open connections.
+func (s *tcpServer) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// shutdown stops the listeners and lets each connection finish the command
+// it is serving: the read of the next one fails at once. The connections
+// left when ctx is done are dropped.
+func (s *tcpServer) shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mutex.Lock()
+		left := len(s.conns)
+		s.mutex.Unlock()
+
+		if left == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// CacheTier is a cache of decoded records behind the memory cache, such as
+// a MirrorTier. The driver keeps it coherent: every change to a record on
+// disk, including those the watcher sees made by other processes, is put
+// in or removed from the tier before it is published to readers. Remove
+// drops every record of collection when resource is empty.
+type CacheTier interface {
+	Get(collection, resource string) ([]byte, bool)
+	Put(collection, resource string, b []byte) error
+	Remove(collection, resource string) error
+	Close() error
+}
+
+// tieredCache serves reads from the memory cache and then from the tiers
+// in their order, and writes through to all of them.
+type tieredCache struct {
+	memory     *recordCache
+	tiers      []CacheTier
+	generation func(collection string) uint64
+	lock       func(collection string) *collectionMutex
+	log        Logger
+
+	tierHits int64
+}
+
+func (d *Driver) newTieredCache(memory *recordCache, tiers []CacheTier) *tieredCache {
+	if memory == nil && len(tiers) == 0 {
+		return nil
+	}
+
+	return &tieredCache{memory: memory, tiers: tiers, generation: d.Generation, lock: d.getOrCreateMutex, log: d.log}
+}
+
+func (c *tieredCache) get(collection, resource string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	if b, ok := c.memory.get(collection, resource); ok {
+		return b, true
+	}
+
+	if len(c.tiers) == 0 {
+		return nil, false
+	}
+
+	gen := c.generation(collection)
+
+	for i, tier := range c.tiers {
+		b, ok := tier.Get(collection, resource)
+
+		if !ok {
+			continue
+		}
+
+		atomic.AddInt64(&c.tierHits, 1)
+
+		current := func() bool { return c.generation(collection) == gen }
+
+		c.memory.fill(collection, resource, b, current)
+		c.fillTiers(c.tiers[:i], collection, resource, b, current)
+
+		return b, true
+	}
+
+	return nil, false
+}
+
+// fill caches a record read from disk after a miss, unless current reports
+// that it changed in the meantime.
+func (c *tieredCache) fill(collection, resource string, b []byte, current func() bool) {
+	if c == nil {
+		return
+	}
+
+	c.memory.fill(collection, resource, b, current)
+	c.fillTiers(c.tiers, collection, resource, b, current)
+}
+
+// fillTiers puts b in tiers, unless the record changed since current was
+// taken. It holds the collection lock to keep out changes while doing so,
+// and gives up if a change is being made.
+func (c *tieredCache) fillTiers(tiers []CacheTier, collection, resource string, b []byte, current func() bool) {
+	if len(tiers) == 0 {
+		return
+	}
+
+	m := c.lock(collection)
+
+	if !m.Mutex.TryLock() {
+		return
+	}
+
+	defer m.Mutex.Unlock()
+
+	if !current() {
+		return
+	}
+
+	for _, tier := range tiers {
+		if err := tier.Put(collection, resource, b); err != nil {
+			c.log.Warn("Unable to cache '%s/%s': %v\n", collection, resource, err)
+			tier.Remove(collection, resource)
+		}
+	}
+}
+
+// publish applies a change to the caches: the new value b is put in them,
+// or the record, or whole collection when resource is empty, removed if b
+// is nil. Callers must hold the collection lock. The tiers are changed
+// before bump moves the generation, so a reader that sees the new
+// generation cannot find the old value there.
+func (c *tieredCache) publish(collection, resource string, b []byte, bump func()) {
+	if c == nil {
+		bump()
+		return
+	}
+
+	for _, tier := range c.tiers {
+		var err error
+
+		if b != nil {
+			err = tier.Put(collection, resource, b)
+		}
+
+		if b == nil || err != nil {
+			if err != nil {
+				c.log.Warn("Unable to cache '%s/%s': %v\n", collection, resource, err)
+			}
+
+			if err := tier.Remove(collection, resource); err != nil {
+				c.log.Error("Unable to drop '%s/%s' from the cache: %v\n", collection, resource, err)
+			}
+		}
+	}
+
+	bump()
+
+	if b == nil {
+		c.memory.remove(collection, resource)
+	} else {
+		c.memory.put(collection, resource, b)
+	}
+}
+
+func (c *tieredCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	s := c.memory.stats()
+	s.TierHits = atomic.LoadInt64(&c.tierHits)
+
+	return s
+}
+
+func (c *tieredCache) close() {
+	if c == nil {
+		return
+	}
+
+	for _, tier := range c.tiers {
+		if err := tier.Close(); err != nil {
+			c.log.Warn("Unable to close cache tier: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const trashDir = ".trash"
+
+type Tombstone struct {
+	Resource string
+	Deleted  time.Time
+}
+
+func (d *Driver) trashPath(collection, resource string) string {
+	return filepath.Join(d.dir, trashDir, collection, fileName(resource)+".json")
+}
+
+// tombstone moves a record into the trash and marks it deleted in its
+// metadata. Callers must hold the collection lock.
+func (d *Driver) tombstone(collection, resource string) error {
+	path := d.recordPath(collection, resource)
+	trash := d.trashPath(collection, resource)
+	size := d.recordSize(path)
+
+	if err := os.MkdirAll(filepath.Dir(trash), 0755); err != nil {
+		return err
+	}
+
+	if err := d.replaceFile(path, trash); err != nil {
+		return err
+	}
+
+	d.release(collection, size)
+
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	clock := d.clock.now(m.Clock)
+	m.Expires, m.Deleted, m.Clock = nil, &now, &clock
+	m.Revs = pushRev(collection, resource, couchRevs(collection, resource, m), "deleted")
+
+	return d.writeMeta(collection, resource, m)
+}
+
+func (d *Driver) tombstoneAll(collection string) error {
+	resources, err := d.resources(collection)
+
+	if err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		if err := d.tombstone(collection, resource); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tombstones lists the records of collection that were deleted while
+// tombstones were enabled and have not been vacuumed yet.
+func (d *Driver) Tombstones(collection string) ([]Tombstone, error) {
+	files, err := d.readTree(d.metaPath(collection, ""))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tombstones []Tombstone
+
+	for _, file := range files {
+		if !isRecordFile(file) {
+			continue
+		}
+
+		resource := d.recordKey(collection, file.Name())
+		m, err := d.readMeta(collection, resource)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Deleted != nil {
+			tombstones = append(tombstones, Tombstone{Resource: resource, Deleted: *m.Deleted})
+		}
+	}
+
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].Resource < tombstones[j].Resource })
+
+	return tombstones, nil
+}
+
+// Vacuum physically removes the records of tombstones older than
+// Options.TombstoneRetention, together with the tombstones themselves.
+func (d *Driver) Vacuum() (int, error) {
+	collections, err := d.listCollections()
+
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-d.opts.TombstoneRetention)
+	removed := 0
+
+	for _, collection := range collections {
+		n, err := d.vacuumCollection(collection, cutoff)
+		removed += n
+
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	if removed > 0 {
+		d.log.Info("Vacuumed %d tombstones\n", removed)
+	}
+
+	return removed, nil
+}
+
+func (d *Driver) vacuumCollection(collection string, cutoff time.Time) (int, error) {
+	tombstones, err := d.Tombstones(collection)
+
+	if err != nil || len(tombstones) == 0 {
+		return 0, err
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	removed := 0
+
+	for _, t := range tombstones {
+		if t.Deleted.After(cutoff) {
+			continue
+		}
+
+		m, err := d.readMeta(collection, t.Resource)
+
+		if err != nil {
+			return removed, err
+		}
+
+		// The record may have been written again since it was listed.
+		if m.Deleted == nil {
+			continue
+		}
+
+		trash := d.trashPath(collection, t.Resource)
+
+		if err := os.Remove(trash); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+
+		removeEmptyParents(filepath.Join(d.dir, trashDir, collection), trash)
+
+		if err := d.retireMeta(collection, t.Resource); err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
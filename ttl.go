@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SweepStats struct {
+	Runs         int64
+	Purged       int64
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastPurged   int
+	LastError    error
+}
+
+// expiries mirrors the expiry times held in record metadata. A collection
+// is loaded from disk the first time it is consulted.
+type expiries struct {
+	mutex  sync.Mutex
+	loaded map[string]bool
+	at     map[string]map[string]time.Time
+}
+
+func newExpiries() *expiries {
+	return &expiries{
+		loaded: make(map[string]bool),
+		at:     make(map[string]map[string]time.Time),
+	}
+}
+
+func (d *Driver) WriteWithTTL(collection, resource string, v interface{}, ttl time.Duration) (err error) {
+	defer wrapOp(&err, "write", collection, resource)
+
+	if err := d.Write(collection, resource, v); err != nil {
+		return err
+	}
+
+	return d.Expire(collection, resource, ttl)
+}
+
+// Expire marks a record to expire after ttl. Expired records are no longer
+// returned by reads and are removed by the background sweeper.
+func (d *Driver) Expire(collection, resource string, ttl time.Duration) (err error) {
+	defer d.observe(time.Now(), &err, "expire", collection, resource)
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	resource = d.key(resource)
+
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive, got %v", ttl)
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		if os.IsNotExist(err) {
+			return d.notFound(collection)
+		}
+		return err
+	}
+
+	return d.setExpiry(collection, resource, time.Now().Add(ttl))
+}
+
+// Persist removes the expiry of a record.
+func (d *Driver) Persist(collection, resource string) (err error) {
+	defer d.observe(time.Now(), &err, "persist", collection, resource)
+
+	resource = d.key(resource)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.clearExpiry(collection, resource)
+}
+
+func (d *Driver) TTL(collection, resource string) (time.Duration, bool) {
+	resource = d.key(resource)
+
+	at, ok := d.expiry(collection, resource)
+
+	if !ok {
+		return 0, false
+	}
+
+	return time.Until(at), true
+}
+
+func (d *Driver) setExpiry(collection, resource string, at time.Time) error {
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	m.Expires = &at
+
+	if err := d.writeMeta(collection, resource, m); err != nil {
+		return err
+	}
+
+	d.rememberExpiry(collection, resource, at)
+
+	return nil
+}
+
+func (d *Driver) rememberExpiry(collection, resource string, at time.Time) {
+	e := d.loadExpiries(collection)
+	defer e.mutex.Unlock()
+
+	if e.at[collection] == nil {
+		e.at[collection] = make(map[string]time.Time)
+	}
+
+	e.at[collection][resource] = at
+}
+
+func (d *Driver) clearExpiry(collection, resource string) error {
+	e := d.loadExpiries(collection)
+	_, ok := e.at[collection][resource]
+	delete(e.at[collection], resource)
+	e.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	m.Expires = nil
+
+	return d.writeMeta(collection, resource, m)
+}
+
+func (d *Driver) forgetExpiries(collection, resource string) {
+	e := d.loadExpiries(collection)
+	defer e.mutex.Unlock()
+
+	if resource == "" {
+		delete(e.at, collection)
+	} else {
+		delete(e.at[collection], resource)
+	}
+}
+
+func (d *Driver) expiry(collection, resource string) (time.Time, bool) {
+	e := d.loadExpiries(collection)
+	defer e.mutex.Unlock()
+
+	at, ok := e.at[collection][resource]
+
+	return at, ok
+}
+
+func (d *Driver) expired(collection, resource string) bool {
+	at, ok := d.expiry(collection, resource)
+	return ok && !time.Now().Before(at)
+}
+
+// loadExpiries returns the expiry mirror locked, reading the expiry times of
+// collection from disk if this is the first time they are needed.
+func (d *Driver) loadExpiries(collection string) *expiries {
+	e := d.expiries
+	e.mutex.Lock()
+
+	if e.loaded[collection] {
+		return e
+	}
+
+	e.loaded[collection] = true
+
+	files, err := d.readTree(d.metaPath(collection, ""))
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.log.Warn("Unable to load expiries of '%s': %v\n", collection, err)
+		}
+		return e
+	}
+
+	for _, file := range files {
+		if !isRecordFile(file) {
+			continue
+		}
+
+		resource := d.recordKey(collection, file.Name())
+		m, err := d.readMeta(collection, resource)
+
+		if err != nil {
+			d.log.Warn("Unable to read metadata of '%s/%s': %v\n", collection, resource, err)
+			continue
+		}
+
+		if m.Expires != nil {
+			if e.at[collection] == nil {
+				e.at[collection] = make(map[string]time.Time)
+			}
+
+			e.at[collection][resource] = *m.Expires
+		}
+	}
+
+	return e
+}
+
+func (d *Driver) SweepStats() SweepStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.sweepStats
+}
+
+// Sweep removes every expired record and returns how many were purged.
+func (d *Driver) Sweep() (int, error) {
+	start := time.Now()
+
+	collections, err := ioutil.ReadDir(filepath.Join(d.dir, metaDir))
+
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	purged := 0
+
+	for _, c := range collections {
+		if !c.IsDir() || strings.HasPrefix(c.Name(), ".") {
+			continue
+		}
+
+		collection := c.Name()
+		d.loadExpiries(collection).mutex.Unlock()
+
+		for _, resource := range d.expiredResources(collection, start) {
+			if derr := d.deleteExpired(collection, resource); derr != nil {
+				err = derr
+				continue
+			}
+
+			purged++
+		}
+	}
+
+	d.mutex.Lock()
+	d.sweepStats.Runs++
+	d.sweepStats.Purged += int64(purged)
+	d.sweepStats.LastRun = start
+	d.sweepStats.LastDuration = time.Since(start)
+	d.sweepStats.LastPurged = purged
+	d.sweepStats.LastError = err
+	d.mutex.Unlock()
+
+	if purged > 0 {
+		d.log.Info("Purged %d expired records in %v\n", purged, time.Since(start))
+	}
+
+	return purged, err
+}
+
+func (d *Driver) expiredResources(collection string, now time.Time) []string {
+	e := d.loadExpiries(collection)
+	defer e.mutex.Unlock()
+
+	var resources []string
+
+	for resource, at := range e.at[collection] {
+		if !now.Before(at) {
+			resources = append(resources, resource)
+		}
+	}
+
+	return resources
+}
+
+// deleteExpired re-checks the expiry under the collection lock, since the
+// record may have been rewritten since the sweep collected it.
+func (d *Driver) deleteExpired(collection, resource string) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !d.expired(collection, resource) {
+		return nil
+	}
+
+	defer d.changedRecord(collection, resource, nil)
+	d.removeFromIndexes(collection, resource)
+	d.forgetExpiries(collection, resource)
+	d.forgetCapped(collection, resource)
+
+	d.recordHistory(collection, resource, nil)
+	d.notify(collection, resource, nil)
+
+	path := d.recordPath(collection, resource)
+	defer removeEmptyParents(filepath.Join(d.dir, collection), path)
+
+	if d.opts.Tombstones {
+		return d.tombstone(collection, resource)
+	}
+
+	size := d.recordSize(path)
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if size >= 0 {
+		d.release(collection, size)
+	}
+
+	return d.retireMeta(collection, resource)
+}
+
+func (d *Driver) sweeper(ctx context.Context, t *task) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			_, err := d.Sweep()
+
+			if err != nil {
+				d.log.Error("Sweeping expired records failed: %v\n", err)
+			}
+
+			t.beat(err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Tx is a write transaction. Its writes and deletes are buffered, visible to
+// its own reads, and applied together by Commit.
+type Tx struct {
+	d          *Driver
+	ops        []txOp
+	savepoints []savepoint
+	held       map[string]*collectionMutex
+	done       bool
+}
+
+type txOp struct {
+	collection string
+	resource   string
+	value      json.RawMessage
+	delete     bool
+}
+
+type savepoint struct {
+	name string
+	ops  int
+}
+
+func (d *Driver) Begin() *Tx {
+	return &Tx{d: d}
+}
+
+func (tx *Tx) Write(collection, resource string, v interface{}) error {
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+
+	resource = tx.d.key(resource)
+
+	b, err := tx.d.marshalDocument(collection, v)
+
+	if err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, txOp{collection: collection, resource: resource, value: b})
+
+	return nil
+}
+
+func (tx *Tx) Delete(collection, resource string) error {
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+
+	resource = tx.d.key(resource)
+
+	tx.ops = append(tx.ops, txOp{collection: collection, resource: resource, delete: true})
+
+	return nil
+}
+
+// Read returns the value of a record as the transaction would leave it.
+func (tx *Tx) Read(collection, resource string, v interface{}) error {
+	if err := tx.check(collection, resource); err != nil {
+		return err
+	}
+
+	resource = tx.d.key(resource)
+
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		op := tx.ops[i]
+
+		if op.collection != collection || op.resource != resource {
+			continue
+		}
+
+		if op.delete {
+			return ErrRecordNotFound
+		}
+
+		return tx.d.decode(collection, op.value, v)
+	}
+
+	if tx.held[collection] == nil {
+		return tx.d.Read(collection, resource, v)
+	}
+
+	// Read would write out the buffered writes by taking the lock the
+	// transaction holds, so they are written out under it instead.
+	d := tx.d
+
+	d.fence.RLock()
+	d.applyBuffered(collection)
+	d.fence.RUnlock()
+
+	if err := d.checkExists(collection, resource); err != nil {
+		return err
+	}
+
+	b, err := d.readRecord(collection, resource)
+
+	if err != nil {
+		return err
+	}
+
+	return d.decode(collection, b, v)
+}
+
+// Savepoint marks the current point of the transaction under name, so that
+// RollbackTo can later discard what was done after it. Reusing a name moves
+// the savepoint.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+
+	if name == "" {
+		return fmt.Errorf("Missing savepoint name")
+	}
+
+	tx.release(name)
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, ops: len(tx.ops)})
+
+	return nil
+}
+
+// RollbackTo discards the writes and deletes made since the named savepoint,
+// along with any savepoints set after it. The savepoint itself remains.
+func (tx *Tx) RollbackTo(name string) error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			tx.ops = tx.ops[:tx.savepoints[i].ops]
+			tx.savepoints = tx.savepoints[:i+1]
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No savepoint named %v", name)
+}
+
+// ReleaseSavepoint forgets the named savepoint, keeping the work done since.
+func (tx *Tx) ReleaseSavepoint(name string) error {
+	if !tx.release(name) {
+		return fmt.Errorf("No savepoint named %v", name)
+	}
+
+	return nil
+}
+
+func (tx *Tx) release(name string) bool {
+	for i, sp := range tx.savepoints {
+		if sp.name == name {
+			tx.savepoints = append(tx.savepoints[:i], tx.savepoints[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rollback discards the transaction.
+func (tx *Tx) Rollback() error {
+	tx.done = true
+	tx.ops = nil
+	tx.unlock()
+
+	return nil
+}
+
+// Commit applies the transaction with the locks of every collection it
+// touches held, taking those not yet locked in name order. If any change
+// fails, those already applied are reverted.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+
+	d := tx.d
+
+	collections := tx.collections()
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		if err := tx.lock(collection); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	tx.done = true
+	defer tx.unlock()
+
+	d.fence.RLock()
+	defer d.fence.RUnlock()
+
+	// The locks were taken without collectionMutex.Lock, which would have
+	// written out the buffered writes.
+	for _, collection := range collections {
+		d.applyBuffered(collection)
+	}
+
+	var applied []Operation
+
+	for _, op := range tx.ops {
+		before, err := d.prior(op.collection, op.resource)
+
+		if err == nil {
+			if op.delete {
+				err = d.removeIfExists(op.collection, op.resource)
+			} else {
+				err = d.store(op.collection, op.resource, op.value)
+			}
+		}
+
+		if err != nil {
+			for i := len(applied) - 1; i >= 0; i-- {
+				if rerr := d.revert(applied[i]); rerr != nil {
+					d.log.Error("Unable to revert %v/%v after a failed commit: %v\n", applied[i].Collection, applied[i].Resource, rerr)
+				}
+			}
+
+			return &OpError{Op: "commit", Collection: op.collection, Resource: op.resource, Err: err}
+		}
+
+		kind := OpWrite
+
+		if op.delete {
+			kind = OpDelete
+		}
+
+		applied = append(applied, Operation{Kind: kind, Collection: op.collection, Resource: op.resource, Before: before})
+	}
+
+	for _, op := range applied {
+		d.journal.add(op)
+	}
+
+	return nil
+}
+
+func (tx *Tx) check(collection, resource string) error {
+	if tx.done {
+		return fmt.Errorf("Transaction already finished")
+	}
+
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+
+	if resource == "" {
+		return fmt.Errorf("Missing resource")
+	}
+
+	return nil
+}
+
+func (tx *Tx) collections() []string {
+	seen := make(map[string]bool)
+	var collections []string
+
+	for _, op := range tx.ops {
+		if !seen[op.collection] {
+			seen[op.collection] = true
+			collections = append(collections, op.collection)
+		}
+	}
+
+	return collections
+}
+
+// removeIfExists deletes a record, treating one that does not exist as
+// already deleted. Callers must hold the collection lock.
+func (d *Driver) removeIfExists(collection, resource string) error {
+	if _, err := os.Stat(d.recordPath(collection, resource)); os.IsNotExist(err) {
+		return nil
+	}
+
+	return d.remove(collection, resource)
+}
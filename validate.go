@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrValidation is matched by the ValidationError of a document rejected by
+// its validate tags.
+var ErrValidation = errors.New("Validation failed")
+
+// FieldError names a field of a document, as a path of JSON names, and the
+// rule of its validate tag it breaks.
+type FieldError struct {
+	Field string
+	Rule  string
+}
+
+// ValidationError lists every field that made Write or Update reject a
+// document.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+
+	for i, f := range e.Fields {
+		problems[i] = f.Field + " is " + f.Rule
+	}
+
+	return ErrValidation.Error() + ": " + strings.Join(problems, ", ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// SetValidator has fn check every document written to collection, decoded
+// from JSON as by json.Unmarshal into an interface{}, so the rules apply
+// however the document reaches the driver. Writes of documents fn returns
+// an error for fail with an error matching both it and ErrValidation. A nil
+// fn removes the validator.
+func (d *Driver) SetValidator(collection string, fn func(doc interface{}) error) {
+	d.configure(collection, func(cfg *collectionConfig) {
+		cfg.validator = fn
+	})
+}
+
+type validatorError struct {
+	err error
+}
+
+func (e *validatorError) Error() string {
+	return ErrValidation.Error() + ": " + e.err.Error()
+}
+
+func (e *validatorError) Unwrap() error {
+	return e.err
+}
+
+func (e *validatorError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// runValidator checks the encoded document b against the schema of
+// collection and passes it to its validator, if it has them.
+func (d *Driver) runValidator(collection string, b []byte) error {
+	cfg := d.config(collection)
+
+	if cfg.schema != nil {
+		var doc interface{}
+
+		if err := decodeNumbers(b, &doc); err != nil {
+			return err
+		}
+
+		if err := cfg.schema.validate(doc); err != nil {
+			return err
+		}
+	}
+
+	fn := cfg.validator
+
+	if fn == nil {
+		return nil
+	}
+
+	var doc interface{}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	if err := fn(doc); err != nil {
+		if errors.Is(err, ErrValidation) {
+			return err
+		}
+		return &validatorError{err}
+	}
+
+	return nil
+}
+
+// validate checks the validate tags of a struct value about to be written.
+// The only rule is "required", which rejects zero values; other rules are
+// left to whatever validation the caller does.
+func validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var e ValidationError
+	validateStruct(rv, "", &e)
+
+	if len(e.Fields) > 0 {
+		return &e
+	}
+
+	return nil
+}
+
+func validateStruct(v reflect.Value, prefix string, e *ValidationError) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+
+		if tag == "-" {
+			continue
+		}
+
+		fv := v.Field(i)
+		name := prefix + jsonName(f)
+		nested := name
+
+		if f.Anonymous && tag == "" {
+			// Fields of embedded structs are encoded as fields of their
+			// parent.
+			nested = strings.TrimSuffix(prefix, ".")
+		}
+
+		required := false
+
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if strings.TrimSpace(rule) == "required" {
+				required = true
+			}
+		}
+
+		if required && fv.IsZero() {
+			e.Fields = append(e.Fields, FieldError{Field: name, Rule: "required"})
+			continue
+		}
+
+		validateValue(fv, nested, e)
+	}
+}
+
+func validateValue(v reflect.Value, name string, e *ValidationError) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return
+		}
+
+		prefix := name
+
+		if prefix != "" {
+			prefix += "."
+		}
+
+		validateStruct(v, prefix, e)
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), name+"["+strconv.Itoa(i)+"]", e)
+		}
+
+	case reflect.Map:
+		iter := v.MapRange()
+
+		for iter.Next() {
+			if iter.Key().Kind() == reflect.String {
+				validateValue(iter.Value(), name+"."+iter.Key().String(), e)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const quarantineDir = ".quarantine"
+
+type VerifyProblem string
+
+const (
+	// ProblemTempFile is a temporary file left by an interrupted write. The
+	// file it was replacing is intact, so it is removed.
+	ProblemTempFile VerifyProblem = "temp file"
+
+	// ProblemEmpty and ProblemInvalidJSON are documents or metadata files
+	// that cannot be read back. They are moved into .quarantine.
+	ProblemEmpty       VerifyProblem = "empty"
+	ProblemInvalidJSON VerifyProblem = "invalid JSON"
+
+	// ProblemUnreadable is a record that could not be decrypted or
+	// decompressed. It is left in place, since the cause is more often the
+	// configuration than the file.
+	ProblemUnreadable VerifyProblem = "unreadable"
+)
+
+type VerifyIssue struct {
+	// Path is the file, relative to the database directory.
+	Path       string
+	Collection string
+	Resource   string
+	Problem    VerifyProblem
+	Detail     string
+
+	// Quarantined is where the file was moved, relative to the database
+	// directory, when it was quarantined.
+	Quarantined string
+}
+
+type VerifyReport struct {
+	Files    int
+	Issues   []VerifyIssue
+	Duration time.Duration
+}
+
+// Verification returns the report of the integrity scan run by New with
+// Options.VerifyOnOpen, or nil without it.
+func (d *Driver) Verification() *VerifyReport {
+	return d.verified
+}
+
+// verify scans the database for the debris of crashes: temporary files,
+// which are removed, and records or metadata that are empty or not valid
+// JSON, which are quarantined. It runs before anything else touches the
+// database, and must not run while another process is writing to it.
+func (d *Driver) verify() (*VerifyReport, error) {
+	start := time.Now()
+	report := &VerifyReport{}
+
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		parts := strings.SplitN(rel, "/", 2)
+
+		if fi.IsDir() {
+			if parts[0] == quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		report.Files++
+
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			if err := d.removeAll(path); err != nil {
+				return err
+			}
+
+			report.Issues = append(report.Issues, VerifyIssue{Path: rel, Problem: ProblemTempFile})
+			return nil
+		}
+
+		if len(parts) < 2 || !strings.HasSuffix(fi.Name(), ".json") {
+			return nil
+		}
+
+		issue := VerifyIssue{Path: rel}
+		root := filepath.Join(d.dir, parts[0])
+
+		switch {
+		case parts[0] == metaDir:
+			sub := strings.SplitN(parts[1], "/", 2)
+
+			if len(sub) < 2 {
+				return nil
+			}
+
+			root = d.metaPath(sub[0], "")
+			issue.Collection, issue.Resource = sub[0], keyName(strings.TrimSuffix(sub[1], ".json"))
+			issue.Problem, issue.Detail, err = checkJSONFile(path, fi, func(b []byte) ([]byte, error) { return b, nil })
+
+		case !strings.HasPrefix(parts[0], "."):
+			issue.Collection, issue.Resource = parts[0], d.recordKey(parts[0], parts[1])
+			issue.Problem, issue.Detail, err = checkJSONFile(path, fi, func(b []byte) ([]byte, error) {
+				// Cold records are not fetched; their stub is all there is
+				// to check here.
+				if h, _, err := openEnvelope(b); err == nil && h != nil && h.Cold != "" {
+					return json.Marshal(h)
+				}
+
+				return d.decodeRecord(parts[0], issue.Resource, b)
+			})
+
+		default:
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if issue.Problem == "" {
+			return nil
+		}
+
+		if issue.Problem != ProblemUnreadable {
+			if issue.Quarantined, err = d.quarantine(rel); err != nil {
+				return err
+			}
+
+			removeEmptyParents(root, path)
+		}
+
+		report.Issues = append(report.Issues, issue)
+		return nil
+	})
+
+	report.Duration = time.Since(start)
+
+	return report, err
+}
+
+// checkJSONFile reads a file and reports what is wrong with it, if anything.
+func checkJSONFile(path string, fi os.FileInfo, decode func([]byte) ([]byte, error)) (VerifyProblem, string, error) {
+	if fi.Size() == 0 {
+		return ProblemEmpty, "", nil
+	}
+
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if b, err = decode(b); err != nil {
+		return ProblemUnreadable, err.Error(), nil
+	}
+
+	if len(b) == 0 {
+		return ProblemEmpty, "", nil
+	}
+
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return ProblemInvalidJSON, err.Error(), nil
+	}
+
+	return "", "", nil
+}
+
+// quarantine moves the file at rel, relative to the database directory, to
+// the same place under .quarantine. It returns where the file went.
+func (d *Driver) quarantine(rel string) (string, error) {
+	dst := quarantineDir + "/" + rel
+
+	if _, err := os.Lstat(filepath.Join(d.dir, filepath.FromSlash(dst))); err == nil {
+		dst = fmt.Sprintf("%s.%d", dst, time.Now().UnixNano())
+	}
+
+	path := filepath.Join(d.dir, filepath.FromSlash(dst))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	if err := d.replaceFile(filepath.Join(d.dir, filepath.FromSlash(rel)), path); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+func (r *VerifyReport) log(l Logger) {
+	for _, issue := range r.Issues {
+		detail := ""
+
+		if issue.Detail != "" {
+			detail = ": " + issue.Detail
+		}
+
+		switch {
+		case issue.Quarantined != "":
+			l.Warn("Quarantined %s '%s' to '%s'%s\n", issue.Problem, issue.Path, issue.Quarantined, detail)
+		case issue.Problem == ProblemTempFile:
+			l.Info("Removed temp file '%s'\n", issue.Path)
+		default:
+			l.Warn("Found %s '%s'%s\n", issue.Problem, issue.Path, detail)
+		}
+	}
+
+	l.Info("Verified %d files with %d issues in %v\n", r.Files, len(r.Issues), r.Duration)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch starts following changes made to the database directory by other
+// processes, or by hand, so that indexes, expiries and usage stay in line
+// with what is on disk. Changes made by the driver itself are seen too and
+// reconciled to the same state.
+func (d *Driver) watch() error {
+	w, err := d.newWatcher()
+
+	if err != nil {
+		return err
+	}
+
+	// A watcher that failed is replaced by a new one when restarted; the
+	// changes made in between are missed.
+	d.tasks.start("watcher", 0, restartPolicy{limit: 5}, func(ctx context.Context, t *task) error {
+		if w == nil {
+			var err error
+
+			if w, err = d.newWatcher(); err != nil {
+				return err
+			}
+		}
+
+		defer func() {
+			w.Close()
+			w = nil
+		}()
+
+		return d.watcher(ctx, t, w)
+	})
+
+	return nil
+}
+
+var errWatcherClosed = errors.New("Watcher closed")
+
+func (d *Driver) newWatcher() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{d.dir, filepath.Join(d.dir, metaDir)} {
+		if err := d.watchTree(w, dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// watchTree watches dir and the directories below it, leaving out the
+// driver's internal ones.
+func (d *Driver) watchTree(w *fsnotify.Watcher, dir string) error {
+	if err := w.Add(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	files, err := d.readDir(dir)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			if err := d.watchTree(w, filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) watcher(ctx context.Context, t *task, w *fsnotify.Watcher) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errWatcherClosed
+			}
+
+			d.log.Warn("Watching '%s' failed: %v\n", d.dir, err)
+			t.beat(err)
+
+		case event, ok := <-w.Events:
+			if !ok {
+				return errWatcherClosed
+			}
+
+			d.changed(w, event)
+		}
+	}
+}
+
+func (d *Driver) changed(w *fsnotify.Watcher, event fsnotify.Event) {
+	rel, err := filepath.Rel(d.dir, event.Name)
+
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	isMeta := parts[0] == metaDir
+
+	if isMeta {
+		parts = parts[1:]
+	}
+
+	if len(parts) == 0 || strings.HasPrefix(parts[0], ".") {
+		return
+	}
+
+	if event.Op&fsnotify.Create != 0 {
+		if fi, err := os.Lstat(event.Name); err == nil && fi.IsDir() {
+			if err := d.watchTree(w, event.Name); err != nil {
+				d.log.Warn("Unable to watch '%s': %v\n", event.Name, err)
+			}
+			return
+		}
+	}
+
+	if len(parts) < 2 || !strings.HasSuffix(rel, ".json") {
+		return
+	}
+
+	collection, resource := parts[0], d.recordKey(parts[0], strings.Join(parts[1:], "/"))
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if isMeta {
+		d.reloadExpiry(collection, resource)
+	} else {
+		d.reloadRecord(collection, resource)
+	}
+}
+
+// reloadRecord brings the in-memory state of a record in line with its
+// file. Callers must hold the collection lock.
+func (d *Driver) reloadRecord(collection, resource string) {
+	d.bloomAdd(collection, resource)
+	d.refreshUsage(collection)
+	d.forgetCapped(collection, "")
+	d.changedRecord(collection, resource, nil)
+
+	b, err := d.readRecord(collection, resource)
+
+	if os.IsNotExist(err) {
+		d.removeFromIndexes(collection, resource)
+		return
+	}
+
+	if err != nil {
+		d.log.Warn("Unable to reload '%s/%s': %v\n", collection, resource, err)
+		return
+	}
+
+	d.updateIndexes(collection, resource, b)
+}
+
+func (d *Driver) reloadExpiry(collection, resource string) {
+	m, err := d.readMeta(collection, resource)
+
+	if err != nil {
+		d.log.Warn("Unable to reload metadata of '%s/%s': %v\n", collection, resource, err)
+		return
+	}
+
+	e := d.loadExpiries(collection)
+	defer e.mutex.Unlock()
+
+	if m.Expires == nil {
+		delete(e.at[collection], resource)
+		return
+	}
+
+	if e.at[collection] == nil {
+		e.at[collection] = make(map[string]time.Time)
+	}
+
+	e.at[collection][resource] = *m.Expires
+}
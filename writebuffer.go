@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type WriteBufferOptions struct {
+	// MaxOps and MaxBytes flush the buffer once that many writes, or bytes
+	// of documents, are pending. MaxDelay flushes it at least that often.
+	// Zero leaves the limit out.
+	MaxOps   int
+	MaxBytes int
+	MaxDelay time.Duration
+}
+
+// writeBuffer holds the documents of buffered writes until they are
+// flushed. Later writes of a record replace the pending earlier ones.
+type writeBuffer struct {
+	mutex   sync.Mutex
+	opts    WriteBufferOptions
+	pending map[string]map[string][]byte
+	ops     int
+	bytes   int
+	err     error
+}
+
+func newWriteBuffer(opts WriteBufferOptions) *writeBuffer {
+	return &writeBuffer{opts: opts, pending: make(map[string]map[string][]byte)}
+}
+
+// add queues a document and reports whether the buffer is due to be
+// flushed.
+func (b *writeBuffer) add(collection, resource string, doc []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.pending[collection] == nil {
+		b.pending[collection] = make(map[string][]byte)
+	}
+
+	b.bytes += len(doc) - len(b.pending[collection][resource])
+	b.pending[collection][resource] = doc
+	b.ops++
+
+	return (b.opts.MaxOps > 0 && b.ops >= b.opts.MaxOps) || (b.opts.MaxBytes > 0 && b.bytes >= b.opts.MaxBytes)
+}
+
+func (b *writeBuffer) has(collection string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.pending[collection]) > 0
+}
+
+func (b *writeBuffer) collections() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var collections []string
+
+	for collection := range b.pending {
+		collections = append(collections, collection)
+	}
+
+	sort.Strings(collections)
+
+	return collections
+}
+
+// take removes the pending documents of collection from the buffer.
+func (b *writeBuffer) take(collection string) map[string][]byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	docs := b.pending[collection]
+	delete(b.pending, collection)
+
+	for _, doc := range docs {
+		b.bytes -= len(doc)
+	}
+
+	if len(b.pending) == 0 {
+		b.ops, b.bytes = 0, 0
+	}
+
+	return docs
+}
+
+func (b *writeBuffer) fail(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *writeBuffer) takeErr() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.err
+	b.err = nil
+
+	return err
+}
+
+// bufferWrite queues a write until the buffer is flushed. Writes to a
+// collection a transaction has locked are not queued, where the
+// transaction would see them, but wait for it to finish.
+func (d *Driver) bufferWrite(collection, resource string, v interface{}) error {
+	doc, err := d.marshalDocument(collection, v)
+
+	if err != nil {
+		return err
+	}
+
+	if err := d.checkDocumentSize(collection, resource, len(doc)); err != nil {
+		return err
+	}
+
+	// Shutdown takes the fence to flush the buffer for the last time.
+	d.fence.RLock()
+
+	if err := d.writable(); err != nil {
+		d.fence.RUnlock()
+		return err
+	}
+
+	// The lock table is held while queueing so that a transaction cannot
+	// take the collection in between.
+	d.locks.mutex.Lock()
+	held := d.locks.owners[collection] != nil
+	full := !held && d.buffer.add(collection, resource, doc)
+	d.locks.mutex.Unlock()
+	d.fence.RUnlock()
+
+	if held {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return d.write(collection, resource, json.RawMessage(doc))
+	}
+
+	if full {
+		return d.Flush()
+	}
+
+	return nil
+}
+
+// Flush writes out the buffered writes, with a single sync per collection.
+// It returns the first error met by the writes flushed since the last
+// call, including those flushed in the background.
+func (d *Driver) Flush() error {
+	if d.buffer == nil {
+		return nil
+	}
+
+	d.flushAll()
+
+	return d.buffer.takeErr()
+}
+
+func (d *Driver) flushAll() {
+	if d.buffer == nil {
+		return
+	}
+
+	for _, collection := range d.buffer.collections() {
+		d.flushCollection(collection)
+	}
+}
+
+// flushCollection writes out the buffered writes of collection, which the
+// collection lock does as it is taken. Readers that do not lock call it so
+// they see the writes.
+func (d *Driver) flushCollection(collection string) {
+	if d.buffer == nil || !d.buffer.has(collection) {
+		return
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	mutex.Unlock()
+}
+
+// applyBuffered writes out the buffered writes of collection. Callers must
+// hold the collection lock.
+func (d *Driver) applyBuffered(collection string) {
+	if d.buffer == nil {
+		return
+	}
+
+	docs := d.buffer.take(collection)
+
+	if len(docs) == 0 {
+		return
+	}
+
+	resources := make([]string, 0, len(docs))
+
+	for resource := range docs {
+		resources = append(resources, resource)
+	}
+
+	sort.Strings(resources)
+
+	var paths []string
+
+	for _, resource := range resources {
+		err := d.journaled(OpWrite, collection, resource, func() error {
+			return d.storeWith(collection, resource, json.RawMessage(docs[resource]), DurabilityNone)
+		})
+
+		if err != nil {
+			err = &OpError{Op: "write", Collection: collection, Resource: resource, Err: err}
+			d.log.Error("Unable to flush %v\n", err)
+			d.buffer.fail(err)
+			continue
+		}
+
+		path := d.recordPath(collection, resource)
+		paths = append(paths, path, filepath.Dir(path))
+	}
+
+	if err := d.syncWrite(d.opts.Durability, paths...); err != nil {
+		d.log.Error("Unable to sync flushed writes of '%s': %v\n", collection, err)
+		d.buffer.fail(err)
+	}
+
+	d.log.Debug("Flushed %d buffered writes of '%s'\n", len(resources), collection)
+}
+
+func (d *Driver) flusher(ctx context.Context, t *task) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := d.Flush()
+
+			if err != nil {
+				d.buffer.fail(err)
+			}
+
+			t.beat(err)
+		}
+	}
+}